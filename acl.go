@@ -0,0 +1,1057 @@
+package redcon
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/match"
+)
+
+// aclCategories are the Redis ACL categories.
+var aclCategories = []string{
+	"keyspace", "read", "write", "set", "sortedset", "list", "hash", "string",
+	"bitmap", "hyperloglog", "geo", "stream", "pubsub", "admin", "fast",
+	"slow", "blocking", "dangerous", "connection", "transaction",
+	"scripting",
+}
+
+// aclSpec is the spec for the ACL command, which is handled by the ACL.
+var aclSpec = CommandSpec{
+	Name:       "acl",
+	Arity:      -2,
+	Categories: []string{"slow"},
+	Subcommands: []CommandSpec{
+		{Name: "acl|cat", Arity: -2, Categories: []string{"slow"}},
+		{Name: "acl|deluser", Arity: -3,
+			Categories: []string{"admin", "slow", "dangerous"}},
+		{Name: "acl|getuser", Arity: 3,
+			Categories: []string{"admin", "slow", "dangerous"}},
+		{Name: "acl|list", Arity: 2,
+			Categories: []string{"admin", "slow", "dangerous"}},
+		{Name: "acl|load", Arity: 2,
+			Categories: []string{"admin", "slow", "dangerous"}},
+		{Name: "acl|log", Arity: -2,
+			Categories: []string{"admin", "slow", "dangerous"}},
+		{Name: "acl|save", Arity: 2,
+			Categories: []string{"admin", "slow", "dangerous"}},
+		{Name: "acl|setuser", Arity: -3,
+			Categories: []string{"admin", "slow", "dangerous"}},
+		{Name: "acl|users", Arity: 2,
+			Categories: []string{"admin", "slow", "dangerous"}},
+		{Name: "acl|whoami", Arity: 2, Categories: []string{"slow"}},
+	},
+}
+
+// aclChannelArgs are the commands that have channel arguments. The value
+// is true when the arguments are patterns.
+var aclChannelArgs = map[string]bool{
+	"publish": false, "spublish": false, "subscribe": false,
+	"ssubscribe": false, "psubscribe": true,
+}
+
+// ACL is an access control list of users, which is compatible with Redis
+// ACL rules. The ACL uses the specs of the commands that are registered
+// with a ServeMux to check permissions for command categories and keys.
+//
+// An ACL is an Authenticator and is usually used along with an AuthHandler:
+//
+//	acl := redcon.NewACL(mux)
+//	acl.SetUser("default", "on", ">secret")
+//	acl.SetUser("alice", "on", ">wonderland", "~cache:*", "+@read")
+//	handler := redcon.NewAuthHandler(acl, acl.Handler(mux))
+//
+// The ACL has a "default" user, which initially has all permissions and
+// does not require a password.
+type ACL struct {
+	mu        sync.RWMutex
+	mux       *ServeMux
+	users     map[string]*aclUser
+	file      string
+	log       []*ACLLogEntry
+	logMaxLen int
+	logNextID int64
+}
+
+// aclUser is a user and its permissions.
+type aclUser struct {
+	name      string
+	enabled   bool
+	nopass    bool
+	passwords []string // sha256 hex
+	commands  []aclCommandRule
+	keys      []aclKeyPattern
+	channels  []string
+}
+
+// aclCommandRule allows or denies a command, subcommand or category.
+type aclCommandRule struct {
+	allow    bool
+	command  string // command or "command|subcommand"
+	category string
+}
+
+// aclKeyPattern is a key pattern with read and/or write permissions.
+type aclKeyPattern struct {
+	pattern string
+	read    bool
+	write   bool
+}
+
+// ACLLogEntry is an entry in the ACL log, which records denied commands.
+// Identical denials that occur within 60 seconds of each other are grouped
+// into a single entry.
+type ACLLogEntry struct {
+	// ID is the unique id of the entry.
+	ID int64
+	// Count is the number of times the entry was recorded.
+	Count int
+	// Reason is "command", "key" or "channel".
+	Reason string
+	// Context is where the command was executed, such as "toplevel".
+	Context string
+	// Object is the command, key or channel that was denied.
+	Object string
+	// Username is the user that executed the command.
+	Username string
+	// ClientInfo describes the client, such as
+	// "id=7 addr=127.0.0.1:52314 name= user=alice".
+	ClientInfo string
+	// Created is when the entry was created.
+	Created time.Time
+	// Updated is when the entry was last recorded.
+	Updated time.Time
+}
+
+// NewACL returns a new ACL. The mux is used for looking up command specs,
+// and may be nil when only the @all category is used.
+func NewACL(mux *ServeMux) *ACL {
+	acl := &ACL{
+		mux:       mux,
+		users:     make(map[string]*aclUser),
+		logMaxLen: 128,
+	}
+	acl.users["default"] = newACLDefaultUser()
+	return acl
+}
+
+// newACLDefaultUser returns a "default" user with all permissions.
+func newACLDefaultUser() *aclUser {
+	return &aclUser{
+		name:     "default",
+		enabled:  true,
+		nopass:   true,
+		commands: []aclCommandRule{{allow: true, category: "all"}},
+		keys:     []aclKeyPattern{{pattern: "*", read: true, write: true}},
+		channels: []string{"*"},
+	}
+}
+
+// aclHashPassword returns the sha256 hex of the password.
+func aclHashPassword(password string) string {
+	sum := sha256.Sum256([]byte(password))
+	return hex.EncodeToString(sum[:])
+}
+
+// SetUser creates or modifies a user using Redis ACL rules, such as
+// "on", ">password", "~key:*", "&channel", "+@read" and "-flushall".
+// The user is not modified when a rule is invalid.
+func (acl *ACL) SetUser(name string, rules ...string) error {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+	var u aclUser
+	if prev, ok := acl.users[name]; ok {
+		u = *prev
+		u.passwords = append([]string(nil), prev.passwords...)
+		u.commands = append([]aclCommandRule(nil), prev.commands...)
+		u.keys = append([]aclKeyPattern(nil), prev.keys...)
+		u.channels = append([]string(nil), prev.channels...)
+	} else {
+		u.name = name
+	}
+	for _, rule := range rules {
+		if err := acl.applyRule(&u, rule); err != nil {
+			return err
+		}
+	}
+	acl.users[name] = &u
+	return nil
+}
+
+// applyRule applies a single rule to a user.
+func (acl *ACL) applyRule(u *aclUser, rule string) error {
+	syntaxErr := func(reason string) error {
+		return errors.New("ERR Error in ACL SETUSER modifier '" + rule +
+			"': " + reason)
+	}
+	lrule := strings.ToLower(rule)
+	switch lrule {
+	case "on":
+		u.enabled = true
+		return nil
+	case "off":
+		u.enabled = false
+		return nil
+	case "nopass":
+		u.nopass = true
+		u.passwords = nil
+		return nil
+	case "resetpass":
+		u.nopass = false
+		u.passwords = nil
+		return nil
+	case "allkeys":
+		u.keys = []aclKeyPattern{{pattern: "*", read: true, write: true}}
+		return nil
+	case "resetkeys":
+		u.keys = nil
+		return nil
+	case "allchannels":
+		u.channels = []string{"*"}
+		return nil
+	case "resetchannels":
+		u.channels = nil
+		return nil
+	case "allcommands":
+		u.commands = []aclCommandRule{{allow: true, category: "all"}}
+		return nil
+	case "nocommands":
+		u.commands = nil
+		return nil
+	case "reset":
+		*u = aclUser{name: u.name}
+		return nil
+	}
+	if len(rule) == 0 {
+		return syntaxErr("Syntax error")
+	}
+	switch rule[0] {
+	case '>':
+		u.nopass = false
+		u.addPassword(aclHashPassword(rule[1:]))
+	case '<':
+		u.removePassword(aclHashPassword(rule[1:]))
+	case '#', '!':
+		hash := strings.ToLower(rule[1:])
+		if len(hash) != 64 {
+			return syntaxErr("The password hash must be exactly 64 " +
+				"characters and contain only lowercase hexadecimal " +
+				"characters")
+		}
+		if _, err := hex.DecodeString(hash); err != nil {
+			return syntaxErr("The password hash must be exactly 64 " +
+				"characters and contain only lowercase hexadecimal " +
+				"characters")
+		}
+		if rule[0] == '#' {
+			u.nopass = false
+			u.addPassword(hash)
+		} else {
+			u.removePassword(hash)
+		}
+	case '~', '%':
+		kp := aclKeyPattern{read: true, write: true}
+		kp.pattern = rule[1:]
+		if rule[0] == '%' {
+			i := strings.IndexByte(rule, '~')
+			if i < 2 {
+				return syntaxErr("Syntax error")
+			}
+			kp.read, kp.write = false, false
+			for _, c := range strings.ToUpper(rule[1:i]) {
+				switch c {
+				case 'R':
+					kp.read = true
+				case 'W':
+					kp.write = true
+				default:
+					return syntaxErr("Syntax error")
+				}
+			}
+			kp.pattern = rule[i+1:]
+		}
+		u.keys = append(u.keys, kp)
+	case '&':
+		u.channels = append(u.channels, rule[1:])
+	case '+', '-':
+		r := aclCommandRule{allow: rule[0] == '+'}
+		name := strings.ToLower(rule[1:])
+		if strings.HasPrefix(name, "@") {
+			r.category = name[1:]
+			if !acl.isCategory(r.category) {
+				return syntaxErr("Unknown command or category name in ACL")
+			}
+			if r.category == "all" {
+				// @all overrides all previous command rules
+				u.commands = nil
+			}
+		} else {
+			r.command = name
+			if !acl.isCommand(name) {
+				return syntaxErr("Unknown command or category name in ACL")
+			}
+		}
+		u.commands = append(u.commands, r)
+	default:
+		return syntaxErr("Syntax error")
+	}
+	return nil
+}
+
+func (u *aclUser) addPassword(hash string) {
+	for _, p := range u.passwords {
+		if p == hash {
+			return
+		}
+	}
+	u.passwords = append(u.passwords, hash)
+}
+
+func (u *aclUser) removePassword(hash string) {
+	for i, p := range u.passwords {
+		if p == hash {
+			u.passwords = append(u.passwords[:i], u.passwords[i+1:]...)
+			return
+		}
+	}
+}
+
+// isCategory returns true when the name is a known category, or is used by
+// a registered command spec.
+func (acl *ACL) isCategory(name string) bool {
+	if name == "all" {
+		return true
+	}
+	for _, cat := range aclCategories {
+		if cat == name {
+			return true
+		}
+	}
+	if acl.mux != nil {
+		for _, spec := range acl.mux.specs {
+			if spec.InCategory(name) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isCommand returns true when the command, or "command|subcommand", is
+// known. All commands are known when the ACL does not have a mux.
+func (acl *ACL) isCommand(name string) bool {
+	if acl.mux == nil {
+		return true
+	}
+	parts := strings.SplitN(name, "|", 2)
+	spec, ok := acl.spec(parts[0])
+	if !ok {
+		_, ok = acl.mux.handlers[parts[0]]
+		return ok && len(parts) == 1
+	}
+	if len(parts) == 2 {
+		_, ok = spec.Subcommand(parts[1])
+	}
+	return ok
+}
+
+// spec returns the command spec, which includes the ACL command itself.
+func (acl *ACL) spec(command string) (CommandSpec, bool) {
+	if acl.mux != nil {
+		if spec, ok := acl.mux.specs[command]; ok {
+			return spec, true
+		}
+	}
+	if command == "acl" {
+		return aclSpec, true
+	}
+	return CommandSpec{}, false
+}
+
+// DelUser deletes users and returns the number of users that were deleted.
+// The "default" user cannot be deleted.
+func (acl *ACL) DelUser(names ...string) (int, error) {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+	for _, name := range names {
+		if name == "default" {
+			return 0, errors.New("ERR The 'default' user cannot be removed")
+		}
+	}
+	var n int
+	for _, name := range names {
+		if _, ok := acl.users[name]; ok {
+			delete(acl.users, name)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Users returns the names of all users, in sorted order.
+func (acl *ACL) Users() []string {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+	names := make([]string, 0, len(acl.users))
+	for name := range acl.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Describe returns the rules of a user in the ACL LIST format, such as
+// "user default on nopass ~* &* +@all".
+func (acl *ACL) Describe(name string) (string, bool) {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+	u, ok := acl.users[name]
+	if !ok {
+		return "", false
+	}
+	parts := []string{"user", u.name}
+	parts = append(parts, u.flags()...)
+	for _, hash := range u.passwords {
+		parts = append(parts, "#"+hash)
+	}
+	if keys := u.describeKeys(); keys != "" {
+		parts = append(parts, keys)
+	}
+	parts = append(parts, u.describeChannels(), u.describeCommands())
+	return strings.Join(parts, " "), true
+}
+
+func (u *aclUser) flags() []string {
+	var flags []string
+	if u.enabled {
+		flags = append(flags, "on")
+	} else {
+		flags = append(flags, "off")
+	}
+	if u.nopass {
+		flags = append(flags, "nopass")
+	}
+	return flags
+}
+
+func (u *aclUser) describeKeys() string {
+	var parts []string
+	for _, kp := range u.keys {
+		switch {
+		case kp.read && kp.write:
+			parts = append(parts, "~"+kp.pattern)
+		case kp.read:
+			parts = append(parts, "%R~"+kp.pattern)
+		case kp.write:
+			parts = append(parts, "%W~"+kp.pattern)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func (u *aclUser) describeChannels() string {
+	if len(u.channels) == 0 {
+		return "resetchannels"
+	}
+	var parts []string
+	for _, ch := range u.channels {
+		parts = append(parts, "&"+ch)
+	}
+	return strings.Join(parts, " ")
+}
+
+func (u *aclUser) describeCommands() string {
+	var parts []string
+	if len(u.commands) == 0 || u.commands[0].category != "all" {
+		parts = append(parts, "-@all")
+	}
+	for _, r := range u.commands {
+		part := "-"
+		if r.allow {
+			part = "+"
+		}
+		if r.category != "" {
+			part += "@" + r.category
+		} else {
+			part += r.command
+		}
+		parts = append(parts, part)
+	}
+	return strings.Join(parts, " ")
+}
+
+// Authenticate returns true when the user exists, is enabled, and the
+// password is valid. This allows the ACL to be used as an Authenticator.
+func (acl *ACL) Authenticate(user, password string) bool {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+	u, ok := acl.users[user]
+	if !ok || !u.enabled {
+		return false
+	}
+	if u.nopass {
+		return true
+	}
+	hash := aclHashPassword(password)
+	for _, p := range u.passwords {
+		if p == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// canRun returns true when the user is permitted to run the command.
+func (u *aclUser) canRun(spec CommandSpec, sub *CommandSpec) bool {
+	cats := spec
+	if sub != nil {
+		cats = *sub
+	}
+	var allowed bool
+	for _, r := range u.commands {
+		switch {
+		case r.category != "":
+			if r.category == "all" || cats.InCategory(r.category) {
+				allowed = r.allow
+			}
+		case r.command == spec.Name:
+			allowed = r.allow
+		case sub != nil && r.command == sub.Name:
+			allowed = r.allow
+		}
+	}
+	return allowed
+}
+
+// canAccessKey returns true when the user is permitted to access the key.
+func (u *aclUser) canAccessKey(key string, read, write bool) bool {
+	for _, kp := range u.keys {
+		if (!read || kp.read) && (!write || kp.write) &&
+			match.Match(key, kp.pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// canAccessChannel returns true when the user is permitted to access the
+// channel. Patterns must be literally matched by a channel rule.
+func (u *aclUser) canAccessChannel(channel string, pattern bool) bool {
+	for _, ch := range u.channels {
+		if ch == "*" || ch == channel ||
+			(!pattern && match.Match(channel, ch)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check returns a NOPERM error when the user is not permitted to execute
+// the command, access its keys or access its channels. Denied commands are
+// recorded in the ACL log.
+func (acl *ACL) Check(user string, cmd Command) error {
+	return acl.check(nil, user, cmd)
+}
+
+// check is Check, which includes the client info of conn in the ACL log.
+// The conn may be nil.
+func (acl *ACL) check(conn Conn, user string, cmd Command) error {
+	if len(cmd.Args) == 0 {
+		return nil
+	}
+	name := strings.ToLower(string(cmd.Args[0]))
+	spec, ok := acl.spec(name)
+	if !ok {
+		spec = CommandSpec{Name: name}
+	}
+	var sub *CommandSpec
+	if len(spec.Subcommands) > 0 && len(cmd.Args) > 1 {
+		if s, ok := spec.Subcommand(string(cmd.Args[1])); ok {
+			sub = &s
+		}
+	}
+	acl.mu.RLock()
+	reason, object, err := acl.deny(user, name, spec, sub, cmd)
+	acl.mu.RUnlock()
+	if err != nil {
+		acl.addLog(conn, reason, object, user)
+	}
+	return err
+}
+
+// deny returns the reason, the denied object and a NOPERM error when the
+// user is not permitted to execute the command. The caller must hold the
+// read lock.
+func (acl *ACL) deny(user, name string, spec CommandSpec, sub *CommandSpec,
+	cmd Command) (reason, object string, err error) {
+	u, ok := acl.users[user]
+	if !ok || !u.canRun(spec, sub) {
+		object := name
+		if sub != nil {
+			object = sub.Name
+		}
+		return "command", object, errors.New("NOPERM User " + user +
+			" has no permissions to run the '" + object + "' command")
+	}
+	keySpec := spec
+	if sub != nil {
+		keySpec = *sub
+	}
+	write := keySpec.HasFlag("write")
+	read := keySpec.HasFlag("readonly") || !write
+	for _, key := range keySpec.Keys(cmd.Args) {
+		if !u.canAccessKey(string(key), read, write) {
+			return "key", string(key),
+				errors.New("NOPERM No permissions to access a key")
+		}
+	}
+	if pattern, ok := aclChannelArgs[name]; ok {
+		channels := cmd.Args[1:]
+		if (name == "publish" || name == "spublish") && len(channels) > 0 {
+			channels = channels[:1]
+		}
+		for _, channel := range channels {
+			if !u.canAccessChannel(string(channel), pattern) {
+				return "channel", string(channel), errNoChannelPerm
+			}
+		}
+	}
+	return "", "", nil
+}
+
+var errNoChannelPerm = errors.New("NOPERM No permissions to access a channel")
+
+// checkChannel returns a NOPERM error when the user of conn is not
+// permitted to access the channel. Denied channels are recorded in the ACL
+// log.
+func (acl *ACL) checkChannel(conn Conn, channel string, pattern bool) error {
+	user := aclConnUser(conn)
+	if acl.CheckChannel(user, channel, pattern) {
+		return nil
+	}
+	acl.addLog(conn, "channel", channel, user)
+	return errNoChannelPerm
+}
+
+// CheckChannel returns true when the user is permitted to access the
+// channel. A pattern is only permitted when it literally matches a channel
+// rule of the user.
+func (acl *ACL) CheckChannel(user, channel string, pattern bool) bool {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+	u, ok := acl.users[user]
+	return ok && u.canAccessChannel(channel, pattern)
+}
+
+// aclLogGroupingTime is the maximum time between identical denials that
+// are grouped into a single log entry.
+const aclLogGroupingTime = time.Minute
+
+// SetLogMaxLen sets the maximum number of entries in the ACL log. The
+// default is 128.
+func (acl *ACL) SetLogMaxLen(n int) {
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+	acl.logMaxLen = n
+	if len(acl.log) > n {
+		acl.log = acl.log[:n]
+	}
+}
+
+// aclClientInfo returns the client info of a connection for the ACL log.
+func aclClientInfo(conn Conn) string {
+	if conn == nil {
+		return ""
+	}
+	var id uint64
+	var name string
+	if c := baseConn(conn); c != nil {
+		id, name = c.id, c.name
+	}
+	return fmt.Sprintf("id=%d addr=%s name=%s user=%s", id,
+		conn.RemoteAddr(), name, aclConnUser(conn))
+}
+
+// aclContext returns the context of a command for the ACL log, which is
+// "multi" for commands that are queued or run by EXEC.
+func aclContext(conn Conn) string {
+	if c := baseConn(conn); c != nil && (c.multi || c.execing) {
+		return "multi"
+	}
+	return "toplevel"
+}
+
+// addLog adds an entry to the ACL log, or updates the count of an identical
+// entry.
+func (acl *ACL) addLog(conn Conn, reason, object, user string) {
+	now := time.Now()
+	info := aclClientInfo(conn)
+	context := aclContext(conn)
+	acl.mu.Lock()
+	defer acl.mu.Unlock()
+	for i, entry := range acl.log {
+		if entry.Reason == reason && entry.Object == object &&
+			entry.Username == user && entry.Context == context &&
+			now.Sub(entry.Updated) < aclLogGroupingTime {
+			entry.Count++
+			entry.ClientInfo = info
+			entry.Updated = now
+			// move to the front
+			copy(acl.log[1:i+1], acl.log[:i])
+			acl.log[0] = entry
+			return
+		}
+	}
+	entry := &ACLLogEntry{
+		ID:         acl.logNextID,
+		Count:      1,
+		Reason:     reason,
+		Context:    context,
+		Object:     object,
+		Username:   user,
+		ClientInfo: info,
+		Created:    now,
+		Updated:    now,
+	}
+	acl.logNextID++
+	acl.log = append([]*ACLLogEntry{entry}, acl.log...)
+	if len(acl.log) > acl.logMaxLen {
+		acl.log = acl.log[:acl.logMaxLen]
+	}
+}
+
+// Log returns the most recent entries of the ACL log, newest first.
+// A count of less than zero returns all entries.
+func (acl *ACL) Log(count int) []ACLLogEntry {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+	if count < 0 || count > len(acl.log) {
+		count = len(acl.log)
+	}
+	entries := make([]ACLLogEntry, count)
+	for i := 0; i < count; i++ {
+		entries[i] = *acl.log[i]
+	}
+	return entries
+}
+
+// ResetLog removes all entries from the ACL log.
+func (acl *ACL) ResetLog() {
+	acl.mu.Lock()
+	acl.log = nil
+	acl.mu.Unlock()
+}
+
+// aclConnUser returns the user for a connection. Connections that have not
+// authenticated use the "default" user.
+func aclConnUser(conn Conn) string {
+	if user, ok := AuthUser(conn); ok {
+		return user
+	}
+	return "default"
+}
+
+// Handler returns a Handler that checks the permissions of each command
+// before passing it to handler. The ACL command is handled by the ACL.
+func (acl *ACL) Handler(handler Handler) Handler {
+	return HandlerFunc(func(conn Conn, cmd Command) {
+		if err := acl.check(conn, aclConnUser(conn), cmd); err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+		if strings.ToLower(string(cmd.Args[0])) == "acl" {
+			acl.serveACL(conn, cmd)
+			return
+		}
+		handler.ServeRESP(conn, cmd)
+	})
+}
+
+// serveACL handles the ACL command.
+func (acl *ACL) serveACL(conn Conn, cmd Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'acl' command")
+		return
+	}
+	sub := strings.ToLower(string(cmd.Args[1]))
+	if spec, ok := aclSpec.Subcommand(sub); !ok {
+		conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) +
+			"'. Try ACL HELP.")
+		return
+	} else if !spec.CheckArity(len(cmd.Args)) {
+		conn.WriteError("ERR wrong number of arguments for 'acl|" + sub +
+			"' command")
+		return
+	}
+	args := cmd.Args[2:]
+	switch sub {
+	case "setuser":
+		rules := make([]string, len(args)-1)
+		for i := range rules {
+			rules[i] = string(args[i+1])
+		}
+		if err := acl.SetUser(string(args[0]), rules...); err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+		conn.WriteString("OK")
+	case "getuser":
+		acl.writeUser(conn, string(args[0]))
+	case "deluser":
+		names := make([]string, len(args))
+		for i := range args {
+			names[i] = string(args[i])
+		}
+		n, err := acl.DelUser(names...)
+		if err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+		conn.WriteInt(n)
+	case "list":
+		users := acl.Users()
+		conn.WriteArray(len(users))
+		for _, name := range users {
+			desc, _ := acl.Describe(name)
+			conn.WriteBulkString(desc)
+		}
+	case "users":
+		conn.WriteAny(acl.Users())
+	case "whoami":
+		conn.WriteBulkString(aclConnUser(conn))
+	case "cat":
+		acl.writeCat(conn, args)
+	case "load", "save":
+		var err error
+		if sub == "load" {
+			err = acl.Load()
+		} else {
+			err = acl.Save()
+		}
+		if err != nil {
+			conn.WriteError(prefixERRIfNeeded(err.Error()))
+			return
+		}
+		conn.WriteString("OK")
+	case "log":
+		acl.serveLog(conn, args)
+	}
+}
+
+// writeUser writes the ACL GETUSER reply.
+func (acl *ACL) writeUser(conn Conn, name string) {
+	acl.mu.RLock()
+	defer acl.mu.RUnlock()
+	u, ok := acl.users[name]
+	if !ok {
+		conn.WriteNull()
+		return
+	}
+	conn.WriteArray(12)
+	conn.WriteBulkString("flags")
+	conn.WriteAny(u.flags())
+	conn.WriteBulkString("passwords")
+	conn.WriteAny(append([]string{}, u.passwords...))
+	conn.WriteBulkString("commands")
+	conn.WriteBulkString(u.describeCommands())
+	conn.WriteBulkString("keys")
+	conn.WriteBulkString(u.describeKeys())
+	conn.WriteBulkString("channels")
+	channels := u.describeChannels()
+	if channels == "resetchannels" {
+		channels = ""
+	}
+	conn.WriteBulkString(channels)
+	conn.WriteBulkString("selectors")
+	conn.WriteArray(0)
+}
+
+// writeCat writes the ACL CAT reply, which lists the categories or the
+// commands in a category.
+func (acl *ACL) writeCat(conn Conn, args [][]byte) {
+	if len(args) == 0 {
+		conn.WriteAny(aclCategories)
+		return
+	}
+	if len(args) > 1 {
+		conn.WriteError("ERR wrong number of arguments for 'acl|cat' command")
+		return
+	}
+	cat := strings.ToLower(string(args[0]))
+	if cat == "all" || !acl.isCategory(cat) {
+		conn.WriteError("ERR Unknown category '" + string(args[0]) + "'")
+		return
+	}
+	commands := []string{}
+	specs := []CommandSpec{aclSpec}
+	if acl.mux != nil {
+		specs = append(specs, acl.mux.Commands()...)
+	}
+	for _, spec := range specs {
+		if spec.InCategory(cat) {
+			commands = append(commands, spec.Name)
+		}
+		for _, sub := range spec.Subcommands {
+			if sub.InCategory(cat) {
+				commands = append(commands, sub.Name)
+			}
+		}
+	}
+	sort.Strings(commands)
+	conn.WriteAny(commands)
+}
+
+// serveLog handles "ACL LOG [count | RESET]"
+func (acl *ACL) serveLog(conn Conn, args [][]byte) {
+	count := 10
+	if len(args) > 1 {
+		conn.WriteError(ErrSyntax.Error())
+		return
+	}
+	if len(args) == 1 {
+		if strings.EqualFold(string(args[0]), "reset") {
+			acl.ResetLog()
+			conn.WriteString("OK")
+			return
+		}
+		n, err := strconv.Atoi(string(args[0]))
+		if err != nil || n < 0 {
+			conn.WriteError(ErrNotInteger.Error())
+			return
+		}
+		count = n
+	}
+	entries := acl.Log(count)
+	now := time.Now()
+	conn.WriteArray(len(entries))
+	for _, entry := range entries {
+		conn.WriteArray(20)
+		conn.WriteBulkString("count")
+		conn.WriteInt(entry.Count)
+		conn.WriteBulkString("reason")
+		conn.WriteBulkString(entry.Reason)
+		conn.WriteBulkString("context")
+		conn.WriteBulkString(entry.Context)
+		conn.WriteBulkString("object")
+		conn.WriteBulkString(entry.Object)
+		conn.WriteBulkString("username")
+		conn.WriteBulkString(entry.Username)
+		conn.WriteBulkString("age-seconds")
+		age := now.Sub(entry.Created).Seconds()
+		conn.WriteBulkString(strconv.FormatFloat(age, 'f', 3, 64))
+		conn.WriteBulkString("client-info")
+		conn.WriteBulkString(entry.ClientInfo)
+		conn.WriteBulkString("entry-id")
+		conn.WriteInt64(entry.ID)
+		conn.WriteBulkString("timestamp-created")
+		conn.WriteInt64(entry.Created.UnixNano() / int64(time.Millisecond))
+		conn.WriteBulkString("timestamp-last-updated")
+		conn.WriteInt64(entry.Updated.UnixNano() / int64(time.Millisecond))
+	}
+}
+
+// errNoACLFile is returned by Load and Save when the ACL does not have a
+// file.
+var errNoACLFile = errors.New("ERR This Redis instance is not configured " +
+	"to use an ACL file. You may want to specify users via the ACL SETUSER " +
+	"command and then issue a CONFIG REWRITE (assuming you have a Redis " +
+	"configuration file set) in order to store users in the Redis " +
+	"configuration.")
+
+// SetFile sets the path of the ACL file, which is used by Load, Save and the
+// ACL LOAD and ACL SAVE commands. The file uses the Redis users.acl format,
+// with one "user <name> <rules...>" line per user.
+func (acl *ACL) SetFile(path string) {
+	acl.mu.Lock()
+	acl.file = path
+	acl.mu.Unlock()
+}
+
+// Load replaces all users with the users in the ACL file. The users are not
+// modified when the file is invalid. A "default" user with all permissions
+// is created when the file does not have one.
+func (acl *ACL) Load() error {
+	acl.mu.RLock()
+	path := acl.file
+	acl.mu.RUnlock()
+	if path == "" {
+		return errNoACLFile
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// Parse the users into a temporary ACL, which is swapped in only when
+	// every line is valid.
+	tmp := &ACL{mux: acl.mux, users: make(map[string]*aclUser)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for lineno := 1; scanner.Scan(); lineno++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		lineErr := func(reason string) error {
+			return fmt.Errorf("ERR %s:%d: %s", path, lineno, reason)
+		}
+		if fields[0] != "user" || len(fields) < 2 {
+			return lineErr("line should start with user keyword")
+		}
+		if _, ok := tmp.users[fields[1]]; ok {
+			return lineErr("duplicate user '" + fields[1] + "' found")
+		}
+		if err := tmp.SetUser(fields[1], fields[2:]...); err != nil {
+			return lineErr(strings.TrimPrefix(err.Error(), "ERR "))
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if _, ok := tmp.users["default"]; !ok {
+		tmp.users["default"] = newACLDefaultUser()
+	}
+	acl.mu.Lock()
+	acl.users = tmp.users
+	acl.mu.Unlock()
+	return nil
+}
+
+// Save writes all users to the ACL file. The file is replaced atomically.
+func (acl *ACL) Save() error {
+	acl.mu.RLock()
+	path := acl.file
+	acl.mu.RUnlock()
+	if path == "" {
+		return errNoACLFile
+	}
+	var buf bytes.Buffer
+	for _, name := range acl.Users() {
+		if desc, ok := acl.Describe(name); ok {
+			buf.WriteString(desc)
+			buf.WriteByte('\n')
+		}
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".users.acl-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
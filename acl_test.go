@@ -0,0 +1,275 @@
+package redcon
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testACLMux() *ServeMux {
+	mux := NewServeMux()
+	ok := HandlerFunc(func(conn Conn, cmd Command) { conn.WriteString("OK") })
+	mux.HandleCommand(CommandSpec{Name: "get", Arity: 2,
+		Flags: []string{"readonly", "fast"}, Categories: []string{"read",
+			"string", "fast"}, FirstKey: 1, LastKey: 1, Step: 1}, ok)
+	mux.HandleCommand(CommandSpec{Name: "set", Arity: -3,
+		Flags: []string{"write", "denyoom"}, Categories: []string{"write",
+			"string", "slow"}, FirstKey: 1, LastKey: 1, Step: 1}, ok)
+	mux.HandleCommand(CommandSpec{Name: "flushall", Arity: -1,
+		Flags: []string{"write"}, Categories: []string{"keyspace", "write",
+			"slow", "dangerous"}}, ok)
+	mux.HandleCommand(CommandSpec{Name: "publish", Arity: 3,
+		Categories: []string{"pubsub", "fast"}}, ok)
+	mux.Handle("ping", ok)
+	return mux
+}
+
+func TestACLRules(t *testing.T) {
+	acl := NewACL(testACLMux())
+	if desc, _ := acl.Describe("default"); desc !=
+		"user default on nopass ~* &* +@all" {
+		t.Fatalf("unexpected '%v'", desc)
+	}
+	err := acl.SetUser("alice", "on", ">wonderland", "~cache:*",
+		"%R~shared:*", "&news.*", "+@read", "+ping", "-flushall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc, _ := acl.Describe("alice")
+	exp := "user alice on #" + aclHashPassword("wonderland") +
+		" ~cache:* %R~shared:* &news.* -@all +@read +ping -flushall"
+	if desc != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, desc)
+	}
+	if !acl.Authenticate("alice", "wonderland") ||
+		acl.Authenticate("alice", "wrong") || acl.Authenticate("bob", "") {
+		t.Fatal("invalid authentication")
+	}
+	acl.SetUser("alice", "off")
+	if acl.Authenticate("alice", "wonderland") {
+		t.Fatal("expected disabled user")
+	}
+	for _, rule := range []string{"+nosuchcmd", "+@nosuchcat", "#abc",
+		"%X~key", "bogus"} {
+		if err := acl.SetUser("alice", rule); err == nil {
+			t.Fatalf("%s: expected error", rule)
+		}
+	}
+	if err := acl.SetUser("alice", "reset"); err != nil {
+		t.Fatal(err)
+	}
+	if desc, _ := acl.Describe("alice"); desc !=
+		"user alice off resetchannels -@all" {
+		t.Fatalf("unexpected '%v'", desc)
+	}
+	if _, err := acl.DelUser("default"); err == nil {
+		t.Fatal("expected error")
+	}
+	if n, _ := acl.DelUser("alice", "bob"); n != 1 {
+		t.Fatalf("expected '%v', got '%v'", 1, n)
+	}
+}
+
+func TestACLCheck(t *testing.T) {
+	acl := NewACL(testACLMux())
+	acl.SetUser("alice", "on", "nopass", "~cache:*", "%R~shared:*",
+		"&news.*", "+@read", "+@write", "+publish", "-flushall")
+	tests := []struct {
+		args string
+		err  string
+	}{
+		{"GET cache:1", ""},
+		{"GET shared:1", ""},
+		{"SET shared:1 x", "NOPERM No permissions to access a key"},
+		{"GET other", "NOPERM No permissions to access a key"},
+		{"FLUSHALL", "NOPERM User alice has no permissions to run the " +
+			"'flushall' command"},
+		{"PING", "NOPERM User alice has no permissions to run the " +
+			"'ping' command"},
+		{"PUBLISH news.tech hi", ""},
+		{"PUBLISH sports hi", "NOPERM No permissions to access a channel"},
+		{"PUBLISH", ""},
+		{"ACL WHOAMI", "NOPERM User alice has no permissions to run the " +
+			"'acl|whoami' command"},
+	}
+	for _, test := range tests {
+		var errstr string
+		err := acl.Check("alice", testArgCommand(
+			strings.Split(test.args, " ")...))
+		if err != nil {
+			errstr = err.Error()
+		}
+		if errstr != test.err {
+			t.Fatalf("%s: expected '%v', got '%v'", test.args, test.err,
+				errstr)
+		}
+	}
+	// a command without a channel is left for the arity check
+	if err := acl.Check("default", testArgCommand("SPUBLISH")); err != nil {
+		t.Fatal(err)
+	}
+	if !acl.CheckChannel("alice", "news.tech", false) ||
+		acl.CheckChannel("alice", "news.*x", true) ||
+		!acl.CheckChannel("alice", "news.*", true) {
+		t.Fatal("invalid channel permissions")
+	}
+	entries := acl.Log(-1)
+	if len(entries) != 6 {
+		t.Fatalf("expected '%v', got '%v'", 6, len(entries))
+	}
+	if entries[0].Reason != "command" || entries[0].Object != "acl|whoami" ||
+		entries[0].Username != "alice" {
+		t.Fatalf("unexpected entry '%v'", entries[0])
+	}
+}
+
+func TestACLHandler(t *testing.T) {
+	mux := testACLMux()
+	acl := NewACL(mux)
+	h := NewAuthHandler(acl, acl.Handler(mux))
+	var buf bytes.Buffer
+	c := &conn{wr: NewWriter(&buf)}
+	tests := [][2]string{
+		{"ACL WHOAMI", "$7\r\ndefault\r\n"},
+		{"ACL SETUSER alice on >pw ~* +get", "+OK\r\n"},
+		{"ACL SETUSER alice +bad", "-ERR Error in ACL SETUSER modifier " +
+			"'+bad': Unknown command or category name in ACL\r\n"},
+		{"ACL USERS", "*2\r\n$5\r\nalice\r\n$7\r\ndefault\r\n"},
+		{"ACL GETUSER alice", "*12\r\n$5\r\nflags\r\n*1\r\n$2\r\non\r\n" +
+			"$9\r\npasswords\r\n*1\r\n$64\r\n" + aclHashPassword("pw") +
+			"\r\n$8\r\ncommands\r\n$10\r\n-@all +get\r\n$4\r\nkeys\r\n" +
+			"$2\r\n~*\r\n$8\r\nchannels\r\n$0\r\n\r\n$9\r\nselectors\r\n" +
+			"*0\r\n"},
+		{"ACL GETUSER bob", "$-1\r\n"},
+		{"ACL CAT string", "*2\r\n$3\r\nget\r\n$3\r\nset\r\n"},
+		{"ACL CAT nope", "-ERR Unknown category 'nope'\r\n"},
+		{"ACL NOPE", "-ERR unknown subcommand 'NOPE'. Try ACL HELP.\r\n"},
+		{"AUTH alice pw", "+OK\r\n"},
+		{"GET k", "+OK\r\n"},
+		{"SET k v", "-NOPERM User alice has no permissions to run the " +
+			"'set' command\r\n"},
+		{"AUTH default x", "+OK\r\n"},
+		{"ACL LIST", "*2\r\n$107\r\nuser alice on #" +
+			aclHashPassword("pw") + " ~* resetchannels -@all +get\r\n" +
+			"$34\r\nuser default on nopass ~* &* +@all\r\n"},
+		{"ACL DELUSER alice", ":1\r\n"},
+	}
+	for _, test := range tests {
+		res := testHandlerDo(h, c, &buf, strings.Split(test[0], " ")...)
+		if res != test[1] {
+			t.Fatalf("%s: expected '%q', got '%q'", test[0], test[1], res)
+		}
+	}
+	res := testHandlerDo(h, c, &buf, "ACL", "LOG", "1")
+	if !strings.HasPrefix(res, "*1\r\n*20\r\n$5\r\ncount\r\n:1\r\n"+
+		"$6\r\nreason\r\n$7\r\ncommand\r\n") {
+		t.Fatalf("unexpected response '%q'", res)
+	}
+	if res := testHandlerDo(h, c, &buf, "ACL", "LOG", "RESET"); res !=
+		"+OK\r\n" {
+		t.Fatalf("unexpected response '%q'", res)
+	}
+	if len(acl.Log(-1)) != 0 {
+		t.Fatal("expected empty log")
+	}
+}
+
+func TestACLLog(t *testing.T) {
+	acl := NewACL(testACLMux())
+	acl.SetUser("alice", "on", "nopass", "+get")
+	c := &conn{addr: "127.0.0.1:5000", id: 3, name: "app", authed: true,
+		user: "alice"}
+	for i := 0; i < 3; i++ {
+		acl.check(c, "alice", testArgCommand("SET", "k", "v"))
+	}
+	acl.check(c, "alice", testArgCommand("GET", "k"))
+	entries := acl.Log(-1)
+	if len(entries) != 2 {
+		t.Fatalf("expected '%v', got '%v'", 2, len(entries))
+	}
+	if entries[0].Count != 1 || entries[0].Reason != "key" ||
+		entries[0].ID != 1 {
+		t.Fatalf("unexpected entry '%v'", entries[0])
+	}
+	if entries[1].Count != 3 || entries[1].Object != "set" ||
+		entries[1].ID != 0 || entries[1].Context != "toplevel" {
+		t.Fatalf("unexpected entry '%v'", entries[1])
+	}
+	exp := "id=3 addr=127.0.0.1:5000 name=app user=alice"
+	if entries[1].ClientInfo != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, entries[1].ClientInfo)
+	}
+	acl.check(c, "alice", testArgCommand("SET", "k", "v"))
+	if entries := acl.Log(1); entries[0].Count != 4 {
+		t.Fatalf("expected '%v', got '%v'", 4, entries[0].Count)
+	}
+	// denials inside of a transaction are logged separately
+	c.multi = true
+	acl.check(c, "alice", testArgCommand("SET", "k", "v"))
+	c.multi = false
+	if entries := acl.Log(1); entries[0].Count != 1 ||
+		entries[0].Context != "multi" {
+		t.Fatalf("unexpected entry '%v'", entries[0])
+	}
+	acl.SetLogMaxLen(1)
+	if entries := acl.Log(-1); len(entries) != 1 {
+		t.Fatalf("expected '%v', got '%v'", 1, len(entries))
+	}
+}
+
+func TestACLFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redcon-acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "users.acl")
+	acl := NewACL(testACLMux())
+	if err := acl.Save(); err != errNoACLFile {
+		t.Fatalf("expected '%v', got '%v'", errNoACLFile, err)
+	}
+	acl.SetFile(path)
+	acl.SetUser("default", "resetpass", ">secret")
+	acl.SetUser("alice", "on", ">pw", "~cache:*", "&news.*", "+@read",
+		"-get")
+	if err := acl.Save(); err != nil {
+		t.Fatal(err)
+	}
+	acl2 := NewACL(testACLMux())
+	acl2.SetFile(path)
+	if err := acl2.Load(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "default"} {
+		desc1, _ := acl.Describe(name)
+		desc2, _ := acl2.Describe(name)
+		if desc1 != desc2 {
+			t.Fatalf("expected '%v', got '%v'", desc1, desc2)
+		}
+	}
+	err = ioutil.WriteFile(path, []byte("user bob on nopass +@all\n\n"+
+		"user carol on +nosuchcmd\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = acl2.Load()
+	exp := "ERR " + path + ":3: Error in ACL SETUSER modifier " +
+		"'+nosuchcmd': Unknown command or category name in ACL"
+	if err == nil || err.Error() != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, err)
+	}
+	if _, ok := acl2.Describe("alice"); !ok {
+		t.Fatal("expected users to be unchanged")
+	}
+	ioutil.WriteFile(path, []byte("user bob on nopass +@all\n"), 0600)
+	if err := acl2.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if users := acl2.Users(); len(users) != 2 || users[0] != "bob" ||
+		users[1] != "default" {
+		t.Fatalf("unexpected users '%v'", users)
+	}
+}
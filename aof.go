@@ -0,0 +1,553 @@
+package redcon
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FsyncPolicy is a policy for flushing an append-only file to disk, which
+// matches the appendfsync option of Redis.
+type FsyncPolicy int
+
+// Fsync policies.
+const (
+	FsyncEverySec FsyncPolicy = iota // fsync once per second
+	FsyncAlways                      // fsync after each command
+	FsyncNo                          // let the operating system flush
+)
+
+var fsyncPolicyNames = []string{"everysec", "always", "no"}
+
+// String returns the name of the policy, such as "everysec".
+func (p FsyncPolicy) String() string {
+	if p < 0 || int(p) >= len(fsyncPolicyNames) {
+		return "unknown"
+	}
+	return fsyncPolicyNames[p]
+}
+
+// ParseFsyncPolicy returns the policy of a name, such as "everysec".
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+	for i, s := range fsyncPolicyNames {
+		if strings.EqualFold(name, s) {
+			return FsyncPolicy(i), nil
+		}
+	}
+	return 0, errors.New("redcon: invalid fsync policy")
+}
+
+var errAOFRewriting = errors.New("ERR Background append only file " +
+	"rewriting already in progress")
+
+// AOFSnapshot is called by Rewrite while no write commands are running. It
+// captures the data, such as by copying it, and returns a function that
+// writes the commands that recreate the data to w, which is called in the
+// background. The function may call w.Flush to limit memory usage.
+type AOFSnapshot func() func(w *Writer) error
+
+// AOF is a Handler that persists the data of a server in an append-only
+// file, like Redis does. Each write command that succeeds is appended to
+// the file as RESP, and Load replays the file at startup to restore the
+// data. Write commands are those with the "write" flag on the mux, and a
+// command succeeds when the first reply is not an error.
+//
+// Write commands are run one at a time, which keeps the file in the order
+// that the commands ran. Relative expirations, such as of EXPIRE, SET EX,
+// GETEX PX and RESTORE, are written as absolute times. Handlers of
+// commands that can't be replayed as they are, such as SPOP or XADD with a
+// generated ID, call Propagate with the commands that have the same effect.
+// Blocking commands don't hold up other writes, and are only written with
+// Propagate.
+//
+// A TxHandler must wrap the AOF, so that EXEC runs the queued commands
+// through the AOF and each write command is written when it runs.
+//
+// The file grows with each write, and Rewrite replaces it in the
+// background with the commands of a snapshot of the data.
+//
+//	aof, err := redcon.OpenAOF("appendonly.aof", mux, redcon.FsyncEverySec)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer aof.Close()
+//	if _, err := aof.Load(); err != nil {
+//		log.Fatal(err)
+//	}
+//	tx := redcon.NewTxHandler(aof, nil)
+//	redcon.ListenAndServe(":6379", tx.ServeRESP, nil, nil)
+type AOF struct {
+	mux   *ServeMux
+	path  string
+	fsync FsyncPolicy
+	now   func() time.Time
+
+	wmu sync.Mutex // held while a write command runs
+
+	mu        sync.Mutex
+	f         *os.File
+	dirty     bool  // written since the last fsync
+	err       error // the last write error
+	rewriting bool
+	rewrite   []byte // the commands written during a rewrite
+	done      chan struct{}
+	stopped   chan struct{}
+	wg        sync.WaitGroup
+}
+
+// OpenAOF opens or creates the append-only file at path, and returns an
+// AOF that passes commands to the mux.
+func OpenAOF(path string, mux *ServeMux, fsync FsyncPolicy) (*AOF, error) {
+	if mux == nil {
+		panic("redcon: nil mux")
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	a := &AOF{mux: mux, path: path, fsync: fsync, now: time.Now, f: f}
+	if fsync == FsyncEverySec {
+		a.done = make(chan struct{})
+		a.stopped = make(chan struct{})
+		go a.syncEverySec()
+	}
+	return a, nil
+}
+
+func (a *AOF) syncEverySec() {
+	defer close(a.stopped)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			a.Sync()
+		case <-a.done:
+			return
+		}
+	}
+}
+
+// Load replays the commands of the file through the mux, and returns the
+// number of commands. A command that is incomplete at the end of the file,
+// such as after a crash, is removed from the file. Load must be called
+// before the AOF is used.
+func (a *AOF) Load() (int, error) {
+	f, err := os.Open(a.path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	c := &conn{wr: NewWriter(ioutil.Discard)}
+	rd := NewReader(f)
+	var n int
+	var off int64
+	for {
+		cmd, err := rd.ReadCommand()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return n, errors.New("redcon: bad format of append-only file " +
+				"at offset " + strconv.FormatInt(off, 10))
+		}
+		a.mux.ServeRESP(c, cmd)
+		c.wr.Flush()
+		off += int64(len(cmd.Raw))
+		n++
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return n, err
+	}
+	if info.Size() > off {
+		if err := a.f.Truncate(off); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ServeRESP passes the command to the mux, and appends it, or the commands
+// that the handler passed to Propagate, to the file when it's a write
+// command that succeeds. Write commands are replied to with a MISCONF error
+// after writing to the file failed.
+func (a *AOF) ServeRESP(conn Conn, cmd Command) {
+	spec, ok := a.mux.Command(string(cmd.Args[0]))
+	if !ok || !spec.HasFlag("write") {
+		a.mux.ServeRESP(conn, cmd)
+		return
+	}
+	blocking := spec.HasFlag("blocking")
+	if !blocking {
+		a.wmu.Lock()
+		defer a.wmu.Unlock()
+	}
+	if err := a.Err(); err != nil {
+		conn.WriteError("MISCONF Errors writing to the AOF file: " +
+			err.Error())
+		return
+	}
+	var propagated bool
+	var b []byte
+	propagate := func(args [][]byte) {
+		propagated = true
+		if len(args) > 0 {
+			b = append(b, a.command(Command{Args: args})...)
+		}
+	}
+	var failed bool
+	if c := baseConn(conn); c != nil {
+		start := len(c.wr.b)
+		c.propagate = propagate
+		a.mux.ServeRESP(conn, cmd)
+		c.propagate = nil
+		failed = len(c.wr.b) > start && c.wr.b[start] == '-'
+	} else {
+		rc := &replyConn{Conn: conn, propagate: propagate}
+		a.mux.ServeRESP(rc, cmd)
+		failed = rc.failed
+	}
+	if failed || (!propagated && blocking) {
+		return
+	}
+	if !propagated {
+		b = a.command(cmd)
+	}
+	if len(b) > 0 {
+		a.write(b)
+	}
+}
+
+// Propagate replaces the command that runs on the connection with the
+// command of args in the append-only file of an AOF, like alsoPropagate of
+// Redis. Each call with args adds a command, so that a call without args
+// writes nothing for the command unless there are other calls. It does
+// nothing when the command is not run by an AOF.
+//
+//	// SPOP is written as SREM of the popped member
+//	redcon.Propagate(conn, []byte("SREM"), key, member)
+func Propagate(conn Conn, args ...[]byte) {
+	var propagate func(args [][]byte)
+	if c := baseConn(conn); c != nil {
+		propagate = c.propagate
+	} else if c, ok := conn.(*replyConn); ok {
+		propagate = c.propagate
+	}
+	if propagate != nil {
+		propagate(args)
+	}
+}
+
+// replyConn records whether the first reply to a command is an error, for
+// connections that are not server connections.
+type replyConn struct {
+	Conn
+	replied   bool
+	failed    bool
+	propagate func(args [][]byte)
+}
+
+func (c *replyConn) reply(failed bool) {
+	if !c.replied {
+		c.replied = true
+		c.failed = failed
+	}
+}
+
+func (c *replyConn) WriteError(msg string) {
+	c.reply(true)
+	c.Conn.WriteError(msg)
+}
+
+func (c *replyConn) WriteString(str string) {
+	c.reply(false)
+	c.Conn.WriteString(str)
+}
+
+func (c *replyConn) WriteBulk(bulk []byte) {
+	c.reply(false)
+	c.Conn.WriteBulk(bulk)
+}
+
+func (c *replyConn) WriteBulkString(bulk string) {
+	c.reply(false)
+	c.Conn.WriteBulkString(bulk)
+}
+
+func (c *replyConn) WriteInt(num int) {
+	c.reply(false)
+	c.Conn.WriteInt(num)
+}
+
+func (c *replyConn) WriteInt64(num int64) {
+	c.reply(false)
+	c.Conn.WriteInt64(num)
+}
+
+func (c *replyConn) WriteUint64(num uint64) {
+	c.reply(false)
+	c.Conn.WriteUint64(num)
+}
+
+func (c *replyConn) WriteArray(count int) {
+	c.reply(false)
+	c.Conn.WriteArray(count)
+}
+
+func (c *replyConn) WriteNull() {
+	c.reply(false)
+	c.Conn.WriteNull()
+}
+
+func (c *replyConn) WriteRaw(data []byte) {
+	c.reply(len(data) > 0 && data[0] == '-')
+	c.Conn.WriteRaw(data)
+}
+
+func (c *replyConn) WriteAny(v interface{}) {
+	_, failed := v.(error)
+	c.reply(failed)
+	c.Conn.WriteAny(v)
+}
+
+func (c *replyConn) WriteBulkFrom(n int64, rb io.Reader) {
+	c.reply(false)
+	c.Conn.WriteBulkFrom(n, rb)
+}
+
+// command returns a command as it's written to the file, where relative
+// expirations are converted to absolute times.
+func (a *AOF) command(cmd Command) []byte {
+	name := strings.ToLower(string(cmd.Args[0]))
+	var args [][]byte
+	switch name {
+	case "expire", "pexpire", "expireat":
+		if ms, ok := a.unixMilli(name, cmd.Args, 2); ok {
+			args = append([][]byte{[]byte("PEXPIREAT"), cmd.Args[1],
+				ms}, cmd.Args[3:]...)
+		}
+	case "setex", "psetex":
+		if ms, ok := a.unixMilli(name, cmd.Args, 2); ok && len(cmd.Args) == 4 {
+			args = [][]byte{[]byte("SET"), cmd.Args[1], cmd.Args[3],
+				[]byte("PXAT"), ms}
+		}
+	case "set", "getex":
+		first := 3
+		if name == "getex" {
+			first = 2
+		}
+		for i := first; i < len(cmd.Args)-1; i++ {
+			opt := strings.ToLower(string(cmd.Args[i]))
+			if opt != "ex" && opt != "px" {
+				continue
+			}
+			if ms, ok := a.unixMilli(opt, cmd.Args, i+1); ok {
+				args = append([][]byte(nil), cmd.Args...)
+				args[i], args[i+1] = []byte("PXAT"), ms
+			}
+			break
+		}
+	case "restore":
+		// a zero ttl is no expiration
+		keep := len(cmd.Args) < 4 || string(cmd.Args[2]) == "0"
+		for i := 4; i < len(cmd.Args) && !keep; i++ {
+			keep = strings.EqualFold(string(cmd.Args[i]), "absttl")
+		}
+		if ms, ok := a.unixMilli("pexpire", cmd.Args, 2); ok && !keep {
+			args = append(append([][]byte(nil), cmd.Args...), []byte("ABSTTL"))
+			args[2] = ms
+		}
+	}
+	if args == nil {
+		if len(cmd.Raw) > 0 {
+			return cmd.Raw
+		}
+		args = cmd.Args
+	}
+	b := AppendArray(nil, len(args))
+	for _, arg := range args {
+		b = AppendBulk(b, arg)
+	}
+	return b
+}
+
+// unixMilli returns the absolute time in unix milliseconds of an argument
+// of a command or option, such as the seconds of EXPIRE or EX.
+func (a *AOF) unixMilli(name string, args [][]byte, i int) ([]byte, bool) {
+	if i >= len(args) {
+		return nil, false
+	}
+	n, err := strconv.ParseInt(string(args[i]), 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	switch name {
+	case "expireat":
+		n *= 1000
+	case "expire", "setex", "ex":
+		n = a.now().UnixNano()/int64(time.Millisecond) + n*1000
+	case "pexpire", "psetex", "px":
+		n = a.now().UnixNano()/int64(time.Millisecond) + n
+	}
+	return []byte(strconv.FormatInt(n, 10)), true
+}
+
+// write appends a command to the file.
+func (a *AOF) write(b []byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.rewriting {
+		a.rewrite = append(a.rewrite, b...)
+	}
+	if _, err := a.f.Write(b); err != nil {
+		a.err = err
+		return
+	}
+	a.dirty = true
+	if a.fsync == FsyncAlways {
+		a.syncLocked()
+	}
+}
+
+// Sync flushes the file to disk.
+func (a *AOF) Sync() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.syncLocked()
+}
+
+func (a *AOF) syncLocked() error {
+	if !a.dirty {
+		return nil
+	}
+	if err := a.f.Sync(); err != nil {
+		a.err = err
+		return err
+	}
+	a.dirty = false
+	return nil
+}
+
+// Err returns the last error of writing to the file, which is cleared by a
+// rewrite.
+func (a *AOF) Err() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.err
+}
+
+// Rewriting returns true while a rewrite is in progress.
+func (a *AOF) Rewriting() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rewriting
+}
+
+// Rewrite starts replacing the file with the commands of a snapshot, and
+// returns a channel that receives the result. The commands that are
+// written while the snapshot is written in the background are appended to
+// the new file before it replaces the file.
+func (a *AOF) Rewrite(snapshot AOFSnapshot) (<-chan error, error) {
+	a.wmu.Lock()
+	a.mu.Lock()
+	if a.rewriting {
+		a.mu.Unlock()
+		a.wmu.Unlock()
+		return nil, errAOFRewriting
+	}
+	a.rewriting = true
+	a.mu.Unlock()
+	write := snapshot()
+	a.wmu.Unlock()
+	done := make(chan error, 1)
+	a.wg.Add(1)
+	go func() {
+		defer a.wg.Done()
+		err := a.rewriteFile(write)
+		a.mu.Lock()
+		a.rewriting = false
+		a.rewrite = nil
+		a.mu.Unlock()
+		done <- err
+	}()
+	return done, nil
+}
+
+// rewriteFile writes a snapshot to a temporary file, which replaces the
+// file.
+func (a *AOF) rewriteFile(write func(w *Writer) error) error {
+	tmp := a.path + ".rewrite"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+	w := NewWriter(f)
+	if err := write(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := f.Write(a.rewrite); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, a.path); err != nil {
+		return err
+	}
+	a.f.Close()
+	// the file is opened again for appending
+	if err := f.Close(); err != nil {
+		return err
+	}
+	a.f, err = os.OpenFile(a.path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		a.err = err
+		return err
+	}
+	a.dirty = false
+	a.err = nil
+	return nil
+}
+
+// RegisterRewrite registers the BGREWRITEAOF command on the mux, which
+// calls Rewrite with the snapshot.
+func (a *AOF) RegisterRewrite(snapshot AOFSnapshot) {
+	a.mux.HandleCommand(CommandSpec{Name: "bgrewriteaof", Arity: 1,
+		Flags:      []string{"admin", "noscript", "no-async-loading"},
+		Categories: []string{"admin", "slow", "dangerous"}},
+		HandlerFunc(func(conn Conn, cmd Command) {
+			if _, err := a.Rewrite(snapshot); err != nil {
+				conn.WriteError(err.Error())
+				return
+			}
+			conn.WriteString("Background append only file rewriting " +
+				"started")
+		}))
+}
+
+// Close waits for a rewrite to finish, and flushes and closes the file.
+func (a *AOF) Close() error {
+	if a.done != nil {
+		close(a.done)
+		<-a.stopped
+		a.done = nil
+	}
+	a.wg.Wait()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.syncLocked()
+	return a.f.Close()
+}
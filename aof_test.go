@@ -0,0 +1,314 @@
+package redcon
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testAOFMux returns a mux with SET, GET, DEL and EXPIRE commands on a map.
+func testAOFMux() (*ServeMux, map[string]string) {
+	var mu sync.Mutex
+	keys := make(map[string]string)
+	mux := NewServeMux()
+	write := []string{"write"}
+	mux.HandleCommand(CommandSpec{Name: "set", Arity: -3, Flags: write},
+		HandlerFunc(func(conn Conn, cmd Command) {
+			mu.Lock()
+			defer mu.Unlock()
+			if string(cmd.Args[2]) == "fail" {
+				conn.WriteError("ERR fail")
+				return
+			}
+			keys[string(cmd.Args[1])] = string(cmd.Args[2])
+			conn.WriteString("OK")
+		}))
+	mux.HandleCommand(CommandSpec{Name: "get", Arity: 2,
+		Flags: []string{"readonly"}}, HandlerFunc(
+		func(conn Conn, cmd Command) {
+			mu.Lock()
+			defer mu.Unlock()
+			conn.WriteBulkString(keys[string(cmd.Args[1])])
+		}))
+	mux.HandleCommand(CommandSpec{Name: "del", Arity: 2, Flags: write},
+		HandlerFunc(func(conn Conn, cmd Command) {
+			mu.Lock()
+			defer mu.Unlock()
+			delete(keys, string(cmd.Args[1]))
+			conn.WriteInt(1)
+		}))
+	mux.HandleCommand(CommandSpec{Name: "expire", Arity: 3, Flags: write},
+		HandlerFunc(func(conn Conn, cmd Command) { conn.WriteInt(1) }))
+	mux.HandleCommand(CommandSpec{Name: "pexpireat", Arity: 3, Flags: write},
+		HandlerFunc(func(conn Conn, cmd Command) { conn.WriteInt(1) }))
+	return mux, keys
+}
+
+func testAOFCommands(t *testing.T, path string) string {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd := NewReader(bytes.NewReader(data))
+	var cmds []string
+	for {
+		cmd, err := rd.ReadCommand()
+		if err != nil {
+			break
+		}
+		var args []string
+		for _, arg := range cmd.Args {
+			args = append(args, string(arg))
+		}
+		cmds = append(cmds, strings.Join(args, " "))
+	}
+	return strings.Join(cmds, ",")
+}
+
+func TestFsyncPolicy(t *testing.T) {
+	for p := FsyncEverySec; p <= FsyncNo; p++ {
+		if res, err := ParseFsyncPolicy(p.String()); err != nil || res != p {
+			t.Fatalf("expected '%v', got '%v' %v", p, res, err)
+		}
+	}
+	if _, err := ParseFsyncPolicy("never"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestAOF(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	mux, _ := testAOFMux()
+	aof, err := OpenAOF(path, mux, FsyncAlways)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aof.now = func() time.Time { return time.Unix(1000, 0) }
+	var buf bytes.Buffer
+	c := &conn{wr: NewWriter(&buf)}
+	for _, test := range [][2]string{
+		{"SET a 1", "+OK"},
+		{"SET b 2 EX 10", "+OK"},
+		{"SET c fail", "-ERR fail"},
+		{"GET a", "$1\r\n1"},
+		{"DEL a", ":1"},
+		{"EXPIRE b 20", ":1"},
+		{"SET a 3", "+OK"},
+	} {
+		args := strings.Split(test[0], " ")
+		res := strings.TrimSuffix(testHandlerDo(aof, c, &buf, args...),
+			"\r\n")
+		if res != test[1] {
+			t.Fatalf("%v: expected '%v', got '%v'", args, test[1], res)
+		}
+	}
+	if err := aof.Close(); err != nil {
+		t.Fatal(err)
+	}
+	exp := "SET a 1,SET b 2 PXAT 1010000,DEL a,PEXPIREAT b 1020000,SET a 3"
+	if res := testAOFCommands(t, path); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+
+	// an incomplete command at the end of the file is removed
+	f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	f.WriteString("*2\r\n$3\r\nDEL\r\n$1")
+	f.Close()
+	mux, keys := testAOFMux()
+	aof, err = OpenAOF(path, mux, FsyncNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aof.Close()
+	if n, err := aof.Load(); err != nil || n != 5 {
+		t.Fatalf("unexpected load %v %v", n, err)
+	}
+	if len(keys) != 2 || keys["a"] != "3" || keys["b"] != "2" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+	if res := testAOFCommands(t, path); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	testHandlerDo(aof, c, &buf, "SET", "c", "4")
+	if res := testAOFCommands(t, path); res != exp+",SET c 4" {
+		t.Fatalf("expected '%v', got '%v'", exp+",SET c 4", res)
+	}
+
+	ioutil.WriteFile(path, []byte("*1\r\n$x\r\n"), 0644)
+	if _, err := aof.Load(); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestAOFRewrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	mux, keys := testAOFMux()
+	aof, err := OpenAOF(path, mux, FsyncEverySec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aof.Close()
+	var buf bytes.Buffer
+	c := &conn{wr: NewWriter(&buf)}
+	for _, key := range []string{"a", "b", "a", "c", "b"} {
+		testHandlerDo(aof, c, &buf, "SET", key, "1")
+	}
+	testHandlerDo(aof, c, &buf, "DEL", "c")
+
+	// the snapshot is written while another write runs
+	written := make(chan bool)
+	aof.RegisterRewrite(func() func(w *Writer) error {
+		snapshot := make([]string, 0, len(keys))
+		for key, value := range keys {
+			snapshot = append(snapshot, key+" "+value)
+		}
+		sort.Strings(snapshot)
+		return func(w *Writer) error {
+			<-written
+			for _, kv := range snapshot {
+				w.WriteArray(3)
+				w.WriteBulkString("SET")
+				w.WriteBulkString(strings.Fields(kv)[0])
+				w.WriteBulkString(strings.Fields(kv)[1])
+			}
+			return nil
+		}
+	})
+	res := testHandlerDo(aof, c, &buf, "BGREWRITEAOF")
+	if res != "+Background append only file rewriting started\r\n" {
+		t.Fatalf("unexpected reply %q", res)
+	}
+	if !aof.Rewriting() {
+		t.Fatal("expected a rewrite")
+	}
+	res = testHandlerDo(aof, c, &buf, "BGREWRITEAOF")
+	if res != "-"+errAOFRewriting.Error()+"\r\n" {
+		t.Fatalf("unexpected reply %q", res)
+	}
+	testHandlerDo(aof, c, &buf, "SET", "d", "2")
+	close(written)
+	start := time.Now()
+	for aof.Rewriting() {
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	exp := "SET a 1,SET b 1,SET d 2"
+	if res := testAOFCommands(t, path); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+	testHandlerDo(aof, c, &buf, "SET", "e", "3")
+	if res := testAOFCommands(t, path); res != exp+",SET e 3" {
+		t.Fatalf("expected '%v', got '%v'", exp+",SET e 3", res)
+	}
+}
+
+func TestAOFCommand(t *testing.T) {
+	aof := &AOF{now: func() time.Time { return time.Unix(1000, 0) }}
+	for _, test := range [][2]string{
+		{"SET a 1 EX 10", "SET a 1 PXAT 1010000"},
+		{"SET a 1 PXAT 5", "SET a 1 PXAT 5"},
+		{"GETEX a PX 500", "GETEX a PXAT 1000500"},
+		{"GETEX a EX 1", "GETEX a PXAT 1001000"},
+		{"GETEX a PERSIST", "GETEX a PERSIST"},
+		{"SETEX a 10 1", "SET a 1 PXAT 1010000"},
+		{"EXPIREAT a 20", "PEXPIREAT a 20000"},
+		{"RESTORE a 500 data", "RESTORE a 1000500 data ABSTTL"},
+		{"RESTORE a 0 data", "RESTORE a 0 data"},
+		{"RESTORE a 500 data absttl", "RESTORE a 500 data absttl"},
+	} {
+		rd := NewReader(bytes.NewReader(aof.command(
+			testArgCommand(strings.Split(test[0], " ")...))))
+		cmd, err := rd.ReadCommand()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var args []string
+		for _, arg := range cmd.Args {
+			args = append(args, string(arg))
+		}
+		if res := strings.Join(args, " "); res != test[1] {
+			t.Fatalf("%s: expected '%v', got '%v'", test[0], test[1], res)
+		}
+	}
+}
+
+func TestAOFHandlers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	mux, _ := testAOFMux()
+	aof, err := OpenAOF(path, mux, FsyncNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aof.Close()
+	var buf bytes.Buffer
+	c := &conn{wr: NewWriter(&buf)}
+	// a connection that is wrapped by another handler
+	wrapped := struct{ Conn }{c}
+	for _, args := range []string{"SET a 1", "SET b fail"} {
+		aof.ServeRESP(wrapped, testArgCommand(strings.Split(args, " ")...))
+	}
+	// the TxHandler wraps the AOF
+	tx := NewTxHandler(aof, nil)
+	for _, args := range []string{"MULTI", "SET c 1", "SET d fail", "EXEC",
+		"MULTI", "SET e 1", "DISCARD"} {
+		testHandlerDo(tx, c, &buf, strings.Split(args, " ")...)
+	}
+	if exp := "SET a 1,SET c 1"; testAOFCommands(t, path) != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, testAOFCommands(t, path))
+	}
+}
+
+func TestAOFPropagate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	mux, _ := testAOFMux()
+	// POP is written as DEL, and is not written when there is nothing to pop
+	pop := func(conn Conn, cmd Command) {
+		if string(cmd.Args[1]) == "none" {
+			Propagate(conn)
+			conn.WriteNull()
+			return
+		}
+		Propagate(conn, []byte("DEL"), cmd.Args[1])
+		Propagate(conn, []byte("EXPIRE"), cmd.Args[1], []byte("10"))
+		conn.WriteBulkString("1")
+	}
+	mux.HandleCommand(CommandSpec{Name: "pop", Arity: 2,
+		Flags: []string{"write"}}, HandlerFunc(pop))
+	mux.HandleCommand(CommandSpec{Name: "bpop", Arity: 2,
+		Flags: []string{"write", "blocking"}}, HandlerFunc(pop))
+	mux.HandleCommand(CommandSpec{Name: "bnoop", Arity: 1,
+		Flags: []string{"write", "blocking"}}, HandlerFunc(
+		func(conn Conn, cmd Command) { conn.WriteNull() }))
+	aof, err := OpenAOF(path, mux, FsyncNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aof.Close()
+	aof.now = func() time.Time { return time.Unix(1000, 0) }
+	var buf bytes.Buffer
+	c := &conn{wr: NewWriter(&buf)}
+	for _, args := range []string{"POP a", "POP none", "BPOP b", "BPOP none",
+		"BNOOP"} {
+		testHandlerDo(aof, c, &buf, strings.Split(args, " ")...)
+	}
+	aof.ServeRESP(struct{ Conn }{c}, testArgCommand("POP", "c"))
+	if c.propagate != nil {
+		t.Fatal("expected no propagate function")
+	}
+	// Propagate does nothing without an AOF
+	testHandlerDo(mux, c, &buf, "POP", "d")
+	exp := "DEL a,PEXPIREAT a 1010000,DEL b,PEXPIREAT b 1010000,DEL c," +
+		"PEXPIREAT c 1010000"
+	if res := testAOFCommands(t, path); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+}
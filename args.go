@@ -0,0 +1,259 @@
+package redcon
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrSyntax is returned when a command has unexpected arguments.
+	ErrSyntax = errors.New("ERR syntax error")
+	// ErrNotInteger is returned when an argument is not a valid integer.
+	ErrNotInteger = errors.New("ERR value is not an integer or out of range")
+	// ErrNotFloat is returned when an argument is not a valid float.
+	ErrNotFloat = errors.New("ERR value is not a valid float")
+)
+
+// ArgReader reads typed arguments from a command, from left to right.
+//
+// The first error encountered is retained and all following reads return
+// zero values. This allows for reading all of the arguments of a command
+// and checking for an error once at the end.
+//
+//	// SET key value [NX|XX] [EX seconds|PX milliseconds]
+//	args := redcon.NewArgReader(cmd)
+//	key := args.Bytes()
+//	value := args.Bytes()
+//	var nx, xx bool
+//	var ttl time.Duration
+//	for args.More() {
+//	    switch {
+//	    case args.Flag("NX"):
+//	        nx = true
+//	    case args.Flag("XX"):
+//	        xx = true
+//	    case args.Flag("EX"):
+//	        ttl = args.Duration(time.Second)
+//	    case args.Flag("PX"):
+//	        ttl = args.Duration(time.Millisecond)
+//	    default:
+//	        args.Fail(redcon.ErrSyntax)
+//	    }
+//	}
+//	if err := args.Err(); err != nil {
+//	    conn.WriteError(err.Error())
+//	    return
+//	}
+type ArgReader struct {
+	name string
+	args [][]byte
+	pos  int
+	err  error
+}
+
+// NewArgReader returns an ArgReader for the command. The command name,
+// which is the first argument, is skipped.
+func NewArgReader(cmd Command) *ArgReader {
+	r := &ArgReader{}
+	if len(cmd.Args) > 0 {
+		r.name = strings.ToLower(string(cmd.Args[0]))
+		r.args = cmd.Args[1:]
+	}
+	return r
+}
+
+// Err returns the first error encountered while reading arguments.
+func (r *ArgReader) Err() error {
+	return r.err
+}
+
+// Fail sets the error for the reader, unless an error was already set.
+func (r *ArgReader) Fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// Len returns the number of unread arguments.
+func (r *ArgReader) Len() int {
+	return len(r.args) - r.pos
+}
+
+// More returns true when there are unread arguments and no error has been
+// encountered.
+func (r *ArgReader) More() bool {
+	return r.err == nil && r.pos < len(r.args)
+}
+
+// Done sets a syntax error when there are unread arguments.
+// It returns the reader error, if any.
+func (r *ArgReader) Done() error {
+	if r.err == nil && r.pos < len(r.args) {
+		r.err = ErrSyntax
+	}
+	return r.err
+}
+
+// Peek returns the next argument without consuming it. Returns nil when
+// there are no more arguments.
+func (r *ArgReader) Peek() []byte {
+	if !r.More() {
+		return nil
+	}
+	return r.args[r.pos]
+}
+
+// PeekFlag returns true when the next argument matches one of the names,
+// using a case-insensitive comparison. Nothing is consumed.
+func (r *ArgReader) PeekFlag(names ...string) bool {
+	arg := r.Peek()
+	if arg == nil {
+		return false
+	}
+	for _, name := range names {
+		if strings.EqualFold(string(arg), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// next returns the next argument. A missing argument is a wrong number of
+// arguments error.
+func (r *ArgReader) next() ([]byte, bool) {
+	if r.err != nil {
+		return nil, false
+	}
+	if r.pos == len(r.args) {
+		r.err = errors.New("ERR wrong number of arguments for '" + r.name +
+			"' command")
+		return nil, false
+	}
+	arg := r.args[r.pos]
+	r.pos++
+	return arg, true
+}
+
+// Bytes reads the next argument.
+func (r *ArgReader) Bytes() []byte {
+	arg, _ := r.next()
+	return arg
+}
+
+// String reads the next argument as a string.
+func (r *ArgReader) String() string {
+	arg, _ := r.next()
+	return string(arg)
+}
+
+// Rest reads all remaining arguments.
+func (r *ArgReader) Rest() [][]byte {
+	if r.err != nil {
+		return nil
+	}
+	rest := r.args[r.pos:]
+	r.pos = len(r.args)
+	return rest
+}
+
+// Int reads the next argument as a 64-bit signed integer.
+func (r *ArgReader) Int() int64 {
+	arg, ok := r.next()
+	if !ok {
+		return 0
+	}
+	n, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		r.err = ErrNotInteger
+		return 0
+	}
+	return n
+}
+
+// IntRange reads the next argument as a 64-bit signed integer, and sets an
+// ErrNotInteger error when the value is not within min and max.
+func (r *ArgReader) IntRange(min, max int64) int64 {
+	n := r.Int()
+	if r.err == nil && (n < min || n > max) {
+		r.err = ErrNotInteger
+		return 0
+	}
+	return n
+}
+
+// Uint reads the next argument as a 64-bit unsigned integer.
+func (r *ArgReader) Uint() uint64 {
+	arg, ok := r.next()
+	if !ok {
+		return 0
+	}
+	n, err := strconv.ParseUint(string(arg), 10, 64)
+	if err != nil {
+		r.err = ErrNotInteger
+		return 0
+	}
+	return n
+}
+
+// Float reads the next argument as a 64-bit floating point number.
+// The values "inf", "+inf" and "-inf" are accepted, while NaN is not.
+func (r *ArgReader) Float() float64 {
+	arg, ok := r.next()
+	if !ok {
+		return 0
+	}
+	f, err := strconv.ParseFloat(string(arg), 64)
+	if err != nil || math.IsNaN(f) {
+		r.err = ErrNotFloat
+		return 0
+	}
+	return f
+}
+
+// Duration reads the next argument as a positive integer and multiplies it
+// by unit. For example, the EX option of SET uses time.Second and the PX
+// option uses time.Millisecond.
+func (r *ArgReader) Duration(unit time.Duration) time.Duration {
+	n := r.Int()
+	if r.err != nil {
+		return 0
+	}
+	if n <= 0 || n > int64(math.MaxInt64/unit) {
+		r.err = errors.New("ERR invalid expire time in '" + r.name +
+			"' command")
+		return 0
+	}
+	return time.Duration(n) * unit
+}
+
+// Enum reads the next argument and returns the index of the matching
+// option, using a case-insensitive comparison. A syntax error is set when
+// no options match.
+func (r *ArgReader) Enum(options ...string) int {
+	arg, ok := r.next()
+	if !ok {
+		return -1
+	}
+	for i, opt := range options {
+		if strings.EqualFold(string(arg), opt) {
+			return i
+		}
+	}
+	r.err = ErrSyntax
+	return -1
+}
+
+// Flag consumes the next argument and returns true when it matches name,
+// using a case-insensitive comparison. Nothing is consumed when the next
+// argument does not match.
+func (r *ArgReader) Flag(name string) bool {
+	arg := r.Peek()
+	if arg == nil || !strings.EqualFold(string(arg), name) {
+		return false
+	}
+	r.pos++
+	return true
+}
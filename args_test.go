@@ -0,0 +1,106 @@
+package redcon
+
+import (
+	"testing"
+	"time"
+)
+
+func testArgCommand(args ...string) Command {
+	var cmd Command
+	for _, arg := range args {
+		cmd.Args = append(cmd.Args, []byte(arg))
+	}
+	return cmd
+}
+
+func TestArgReader(t *testing.T) {
+	args := NewArgReader(testArgCommand("SET", "key", "value", "ex", "10",
+		"NX"))
+	key := args.String()
+	value := args.Bytes()
+	var nx, xx bool
+	var ttl time.Duration
+	for args.More() {
+		switch {
+		case args.Flag("NX"):
+			nx = true
+		case args.Flag("XX"):
+			xx = true
+		case args.Flag("EX"):
+			ttl = args.Duration(time.Second)
+		default:
+			args.Fail(ErrSyntax)
+		}
+	}
+	if err := args.Done(); err != nil {
+		t.Fatal(err)
+	}
+	if key != "key" || string(value) != "value" || !nx || xx ||
+		ttl != time.Second*10 {
+		t.Fatalf("unexpected values: %v %v %v %v %v", key, value, nx, xx, ttl)
+	}
+
+	args = NewArgReader(testArgCommand("INCRBY", "key", "ten"))
+	args.Bytes()
+	if n := args.Int(); n != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, n)
+	}
+	if args.Err() != ErrNotInteger {
+		t.Fatalf("expected '%v', got '%v'", ErrNotInteger, args.Err())
+	}
+	// errors are sticky
+	args.Fail(ErrSyntax)
+	if args.Err() != ErrNotInteger {
+		t.Fatalf("expected '%v', got '%v'", ErrNotInteger, args.Err())
+	}
+
+	args = NewArgReader(testArgCommand("GET"))
+	args.Bytes()
+	exp := "ERR wrong number of arguments for 'get' command"
+	if args.Err() == nil || args.Err().Error() != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, args.Err())
+	}
+
+	args = NewArgReader(testArgCommand("GET", "key", "extra"))
+	args.Bytes()
+	if args.Done() != ErrSyntax {
+		t.Fatalf("expected '%v', got '%v'", ErrSyntax, args.Err())
+	}
+
+	args = NewArgReader(testArgCommand("ZADD", "inf", "nan", "1.5"))
+	if f := args.Float(); f <= 0 {
+		t.Fatalf("expected '%v', got '%v'", "+inf", f)
+	}
+	args.Float()
+	if args.Err() != ErrNotFloat {
+		t.Fatalf("expected '%v', got '%v'", ErrNotFloat, args.Err())
+	}
+
+	args = NewArgReader(testArgCommand("SET", "-1"))
+	args.Duration(time.Second)
+	exp = "ERR invalid expire time in 'set' command"
+	if args.Err() == nil || args.Err().Error() != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, args.Err())
+	}
+
+	args = NewArgReader(testArgCommand("BITOP", "or", "xand", "5"))
+	if i := args.Enum("AND", "OR", "XOR", "NOT"); i != 1 {
+		t.Fatalf("expected '%v', got '%v'", 1, i)
+	}
+	if i := args.Enum("AND", "OR", "XOR", "NOT"); i != -1 {
+		t.Fatalf("expected '%v', got '%v'", -1, i)
+	}
+	if args.Err() != ErrSyntax {
+		t.Fatalf("expected '%v', got '%v'", ErrSyntax, args.Err())
+	}
+
+	args = NewArgReader(testArgCommand("LPUSH", "key", "a", "b"))
+	if n := args.IntRange(0, 10); n != 0 || args.Err() != ErrNotInteger {
+		t.Fatalf("expected '%v', got '%v'", ErrNotInteger, args.Err())
+	}
+	args = NewArgReader(testArgCommand("LPUSH", "key", "a", "b"))
+	args.Bytes()
+	if rest := args.Rest(); len(rest) != 2 || args.Len() != 0 {
+		t.Fatalf("expected '%v', got '%v'", 2, len(rest))
+	}
+}
@@ -0,0 +1,225 @@
+package redcon
+
+import (
+	"strings"
+)
+
+// Authenticator authenticates users for AUTH and HELLO commands.
+type Authenticator interface {
+	// Authenticate returns true when the password is valid for the user.
+	Authenticate(user, password string) bool
+}
+
+// The AuthenticatorFunc type is an adapter to allow the use of ordinary
+// functions as an Authenticator.
+type AuthenticatorFunc func(user, password string) bool
+
+// Authenticate calls f(user, password)
+func (f AuthenticatorFunc) Authenticate(user, password string) bool {
+	return f(user, password)
+}
+
+// PasswordAuthenticator returns an Authenticator that has a single
+// "default" user with the provided password, which is similar to the
+// Redis "requirepass" configuration.
+// An empty password does not require clients to authenticate.
+func PasswordAuthenticator(password string) Authenticator {
+	return AuthenticatorFunc(func(user, pass string) bool {
+		return user == "default" && (password == "" || pass == password)
+	})
+}
+
+// AuthHandler is a Handler that requires clients to authenticate before
+// executing commands. It handles the AUTH and HELLO commands, and replies
+// with a NOAUTH error for all other commands until the client has
+// authenticated. HELLO 3 switches a client to RESP3, which allows it to
+// receive push messages, such as client tracking invalidations.
+//
+// Clients are automatically authenticated as the "default" user when the
+// Authenticator accepts the "default" user with an empty password.
+type AuthHandler struct {
+	auth    Authenticator
+	handler Handler
+	allowed map[string]bool
+}
+
+// NewAuthHandler returns a new AuthHandler that passes commands to handler
+// once a client has authenticated.
+func NewAuthHandler(auth Authenticator, handler Handler) *AuthHandler {
+	if auth == nil {
+		panic("redcon: nil authenticator")
+	}
+	if handler == nil {
+		panic("redcon: nil handler")
+	}
+	return &AuthHandler{
+		auth:    auth,
+		handler: handler,
+		allowed: map[string]bool{"quit": true},
+	}
+}
+
+// Allow permits commands to be executed before a client has authenticated.
+// QUIT is always allowed.
+func (h *AuthHandler) Allow(commands ...string) {
+	for _, command := range commands {
+		h.allowed[strings.ToLower(command)] = true
+	}
+}
+
+// ServeRESP handles AUTH and HELLO and passes all other commands to the
+// handler when the client has authenticated.
+func (h *AuthHandler) ServeRESP(conn Conn, cmd Command) {
+	c := baseConn(conn)
+	if c == nil {
+		conn.WriteError("ERR authentication is not supported on this " +
+			"connection")
+		return
+	}
+	if !c.authed && !c.authChecked {
+		// Check if the default user requires a password.
+		c.authChecked = true
+		if h.auth.Authenticate("default", "") {
+			c.user = "default"
+			c.authed = true
+		}
+	}
+	switch strings.ToLower(string(cmd.Args[0])) {
+	case "auth":
+		h.serveAuth(c, cmd)
+	case "hello":
+		h.serveHello(c, cmd)
+	default:
+		if !c.authed && !h.allowed[strings.ToLower(string(cmd.Args[0]))] {
+			conn.WriteError("NOAUTH Authentication required.")
+			return
+		}
+		h.handler.ServeRESP(conn, cmd)
+	}
+}
+
+// authenticate sets the connection user, or writes a WRONGPASS error.
+func (h *AuthHandler) authenticate(c *conn, user, password string) bool {
+	if !h.auth.Authenticate(user, password) {
+		c.WriteError("WRONGPASS invalid username-password pair or user is " +
+			"disabled.")
+		return false
+	}
+	c.user = user
+	c.authed = true
+	return true
+}
+
+// serveAuth handles "AUTH [username] password"
+func (h *AuthHandler) serveAuth(c *conn, cmd Command) {
+	switch len(cmd.Args) {
+	case 2:
+		if h.auth.Authenticate("default", "") {
+			c.WriteError("ERR AUTH <password> called without any password " +
+				"configured for the default user. Are you sure your " +
+				"configuration is correct?")
+			return
+		}
+		if h.authenticate(c, "default", string(cmd.Args[1])) {
+			c.WriteString("OK")
+		}
+	case 3:
+		if h.authenticate(c, string(cmd.Args[1]), string(cmd.Args[2])) {
+			c.WriteString("OK")
+		}
+	case 1:
+		c.WriteError("ERR wrong number of arguments for 'auth' command")
+	default:
+		c.WriteError(ErrSyntax.Error())
+	}
+}
+
+// serveHello handles
+// "HELLO [protover [AUTH username password] [SETNAME clientname]]"
+func (h *AuthHandler) serveHello(c *conn, cmd Command) {
+	args := NewArgReader(cmd)
+	proto := c.proto
+	if args.More() {
+		ver := args.Int()
+		if args.Err() != nil {
+			c.WriteError("ERR Protocol version is not an integer or out of " +
+				"range")
+			return
+		}
+		if ver != 2 && ver != 3 {
+			c.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+		proto = int(ver)
+	}
+	var user, password, name string
+	var auth, setname bool
+	for args.More() {
+		switch {
+		case args.Len() >= 3 && args.Flag("AUTH"):
+			user = args.String()
+			password = args.String()
+			auth = true
+		case args.Len() >= 2 && args.Flag("SETNAME"):
+			name = args.String()
+			setname = true
+		default:
+			c.WriteError("ERR Syntax error in HELLO option '" +
+				string(args.Peek()) + "'")
+			return
+		}
+	}
+	// the options are valid before the user is switched
+	for i := 0; i < len(name); i++ {
+		if name[i] <= ' ' || name[i] > '~' {
+			c.WriteError("ERR Client names cannot contain spaces, " +
+				"newlines or special characters.")
+			return
+		}
+	}
+	if auth {
+		if !h.authenticate(c, user, password) {
+			return
+		}
+	} else if !c.authed {
+		c.WriteError("NOAUTH HELLO must be called with the client already " +
+			"authenticated, otherwise the HELLO <proto> AUTH <user> <pass> " +
+			"option can be used to authenticate the client and select the " +
+			"RESP protocol version at the same time")
+		return
+	}
+	if setname {
+		c.name = name
+	}
+	c.proto = proto
+	// The server and version fields are for compatibility with clients
+	// that inspect them.
+	c.writeMap(7)
+	c.WriteBulkString("server")
+	c.WriteBulkString("redis")
+	c.WriteBulkString("version")
+	c.WriteBulkString("7.0.0")
+	c.WriteBulkString("proto")
+	if c.proto == 3 {
+		c.WriteInt(3)
+	} else {
+		c.WriteInt(2)
+	}
+	c.WriteBulkString("id")
+	c.WriteUint64(c.id)
+	c.WriteBulkString("mode")
+	c.WriteBulkString("standalone")
+	c.WriteBulkString("role")
+	c.WriteBulkString("master")
+	c.WriteBulkString("modules")
+	c.WriteArray(0)
+}
+
+// AuthUser returns the authenticated user for a connection. Returns false
+// when the client has not authenticated.
+func AuthUser(conn Conn) (user string, ok bool) {
+	if c := baseConn(conn); c != nil && c.authed {
+		return c.user, true
+	}
+	return "", false
+}
@@ -0,0 +1,92 @@
+package redcon
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func testHandlerDo(h Handler, c *conn, buf *bytes.Buffer,
+	args ...string,
+) string {
+	buf.Reset()
+	h.ServeRESP(c, testArgCommand(args...))
+	c.wr.Flush()
+	return buf.String()
+}
+
+func TestAuthHandler(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("ping", func(conn Conn, cmd Command) {
+		user, _ := AuthUser(conn)
+		conn.WriteString("PONG " + user)
+	})
+	auth := NewAuthHandler(AuthenticatorFunc(func(user, pass string) bool {
+		return (user == "default" && pass == "secret") ||
+			(user == "alice" && pass == "wonderland")
+	}), mux)
+	var buf bytes.Buffer
+	c := &conn{wr: NewWriter(&buf), id: 7}
+	tests := [][2]string{
+		{"PING", "-NOAUTH Authentication required.\r\n"},
+		{"AUTH", "-ERR wrong number of arguments for 'auth' command\r\n"},
+		{"AUTH a b c", "-ERR syntax error\r\n"},
+		{"AUTH wrong", "-WRONGPASS invalid username-password pair or " +
+			"user is disabled.\r\n"},
+		{"HELLO 2", "-NOAUTH HELLO must be called with the client " +
+			"already authenticated, otherwise the HELLO <proto> AUTH " +
+			"<user> <pass> option can be used to authenticate the client " +
+			"and select the RESP protocol version at the same time\r\n"},
+		{"HELLO 4", "-NOPROTO unsupported protocol version\r\n"},
+		{"HELLO two", "-ERR Protocol version is not an integer or out of " +
+			"range\r\n"},
+		{"HELLO 2 AUTH alice", "-ERR Syntax error in HELLO option " +
+			"'AUTH'\r\n"},
+		{"AUTH secret", "+OK\r\n"},
+		{"PING", "+PONG default\r\n"},
+		{"AUTH alice wonderland", "+OK\r\n"},
+		{"PING", "+PONG alice\r\n"},
+		{"HELLO 2 AUTH default secret SETNAME café", "-ERR Client names " +
+			"cannot contain spaces, newlines or special characters.\r\n"},
+		{"PING", "+PONG alice\r\n"},
+		{"HELLO 2 AUTH default secret SETNAME my-client",
+			"*14\r\n$6\r\nserver\r\n$5\r\nredis\r\n$7\r\nversion\r\n" +
+				"$5\r\n7.0.0\r\n$5\r\nproto\r\n:2\r\n$2\r\nid\r\n:7\r\n" +
+				"$4\r\nmode\r\n$10\r\nstandalone\r\n$4\r\nrole\r\n" +
+				"$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n"},
+		{"PING", "+PONG default\r\n"},
+		{"HELLO 3", "%7\r\n$6\r\nserver\r\n$5\r\nredis\r\n" +
+			"$7\r\nversion\r\n$5\r\n7.0.0\r\n$5\r\nproto\r\n:3\r\n" +
+			"$2\r\nid\r\n:7\r\n$4\r\nmode\r\n$10\r\nstandalone\r\n" +
+			"$4\r\nrole\r\n$6\r\nmaster\r\n$7\r\nmodules\r\n*0\r\n"},
+	}
+	for _, test := range tests {
+		res := testHandlerDo(auth, c, &buf, strings.Split(test[0], " ")...)
+		if res != test[1] {
+			t.Fatalf("%s: expected '%q', got '%q'", test[0], test[1], res)
+		}
+	}
+	if c.name != "my-client" {
+		t.Fatalf("expected '%v', got '%v'", "my-client", c.name)
+	}
+}
+
+func TestAuthHandlerNoPassword(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleFunc("ping", func(conn Conn, cmd Command) {
+		conn.WriteString("PONG")
+	})
+	auth := NewAuthHandler(PasswordAuthenticator(""), mux)
+	var buf bytes.Buffer
+	c := &conn{wr: NewWriter(&buf)}
+	if res := testHandlerDo(auth, c, &buf, "PING"); res != "+PONG\r\n" {
+		t.Fatalf("expected '%q', got '%q'", "+PONG\r\n", res)
+	}
+	if user, ok := AuthUser(c); !ok || user != "default" {
+		t.Fatalf("expected '%v', got '%v'", "default", user)
+	}
+	res := testHandlerDo(auth, c, &buf, "AUTH", "secret")
+	if !strings.HasPrefix(res, "-ERR AUTH <password> called without") {
+		t.Fatalf("unexpected response '%q'", res)
+	}
+}
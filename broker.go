@@ -0,0 +1,401 @@
+package redcon
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BrokerMessage is a message that is relayed between PubSub instances by a
+// Broker.
+type BrokerMessage struct {
+	Shard   bool // published with Spublish
+	Channel string
+	Message []byte
+}
+
+// Broker relays the messages that are published on a PubSub to other PubSub
+// instances, such as the PubSubs of the other processes of a horizontally
+// scaled service. Messages received from a Broker are only delivered to
+// local subscribers, and are not relayed again.
+type Broker interface {
+	// Publish sends a message that was published locally to the other
+	// instances. The message must not be modified, and Publish should not
+	// block.
+	Publish(msg BrokerMessage)
+	// Listen sets the function that is called for each message that is
+	// received from the other instances. The message is only valid for the
+	// duration of the call.
+	Listen(fn func(msg BrokerMessage))
+}
+
+// SetBroker sets the Broker that relays published messages to and from
+// other PubSub instances. The number of subscribers that is returned by
+// Publish only includes local subscribers.
+func (ps *PubSub) SetBroker(broker Broker) {
+	ps.mu.Lock()
+	ps.broker = broker
+	ps.mu.Unlock()
+	if broker != nil {
+		broker.Listen(ps.receive)
+	}
+}
+
+// receive delivers a message from the broker to the local subscribers.
+func (ps *PubSub) receive(msg BrokerMessage) {
+	bulk := AppendBulk(nil, msg.Message)
+	if msg.Shard {
+		ps.spublish(msg.Channel, bulk, true)
+	} else {
+		ps.publish(msg.Channel, bulk, true)
+	}
+}
+
+// bulkData returns the data of an encoded bulk string.
+func bulkData(bulk []byte) []byte {
+	for i := 0; i < len(bulk); i++ {
+		if bulk[i] == '\n' {
+			return bulk[i+1 : len(bulk)-2]
+		}
+	}
+	return nil
+}
+
+// LocalBroker links the PubSub instances of a single process, which is
+// useful for tests.
+//
+//	lb := redcon.NewLocalBroker()
+//	ps1.SetBroker(lb.Broker())
+//	ps2.SetBroker(lb.Broker())
+type LocalBroker struct {
+	mu    sync.RWMutex
+	nodes []*localBrokerNode
+}
+
+type localBrokerNode struct {
+	lb *LocalBroker
+	fn func(msg BrokerMessage)
+}
+
+// NewLocalBroker returns a new LocalBroker.
+func NewLocalBroker() *LocalBroker {
+	return &LocalBroker{}
+}
+
+// Broker returns a new Broker that is linked to all of the other Brokers
+// of the LocalBroker.
+func (lb *LocalBroker) Broker() Broker {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	node := &localBrokerNode{lb: lb}
+	lb.nodes = append(lb.nodes, node)
+	return node
+}
+
+func (node *localBrokerNode) Publish(msg BrokerMessage) {
+	node.lb.mu.RLock()
+	defer node.lb.mu.RUnlock()
+	for _, other := range node.lb.nodes {
+		if other != node && other.fn != nil {
+			other.fn(msg)
+		}
+	}
+}
+
+func (node *localBrokerNode) Listen(fn func(msg BrokerMessage)) {
+	node.lb.mu.Lock()
+	defer node.lb.mu.Unlock()
+	node.fn = fn
+}
+
+// meshBrokerCommand is the command that a MeshBroker sends to its peers.
+const meshBrokerCommand = "broker.publish"
+
+// meshQueueSize is the number of messages that may be queued for a peer
+// before messages are dropped.
+const meshQueueSize = 4096
+
+// meshTimeout is the timeout of connecting, authenticating and writing to a
+// peer.
+const meshTimeout = time.Second * 5
+
+// MeshBroker links the PubSub instances of multiple processes over redcon
+// connections. Each message that is published locally is sent to every
+// peer, and peers do not relay the messages that they receive, so each
+// MeshBroker must have all of the other processes as peers. The peers
+// receive messages with the ServeBroker handler, which only accepts
+// messages from clients that have authenticated with an AuthHandler.
+//
+//	mb := redcon.NewMeshBroker("10.0.0.2:6380", "10.0.0.3:6380")
+//	mb.SetAuth("broker", password)
+//	mux.HandleFunc("broker.publish", mb.ServeBroker)
+//	ps.SetBroker(mb)
+//	auth := redcon.NewAuthHandler(authenticator, mux)
+//
+// Messages are sent in the background. Messages are dropped while a peer
+// is unreachable, or when too many messages are waiting to be sent.
+type MeshBroker struct {
+	mu       sync.RWMutex
+	peers    map[string]*meshPeer
+	fn       func(msg BrokerMessage)
+	closed   bool
+	user     string
+	password string
+}
+
+type meshPeer struct {
+	mb    *MeshBroker
+	addr  string
+	queue chan []byte
+	done  chan struct{}
+}
+
+// NewMeshBroker returns a MeshBroker that sends messages to the peers,
+// which are the addresses of the other processes.
+func NewMeshBroker(peers ...string) *MeshBroker {
+	mb := &MeshBroker{peers: make(map[string]*meshPeer)}
+	mb.SetPeers(peers...)
+	return mb
+}
+
+// SetPeers sets the addresses of the peers, which allows for adding and
+// removing processes.
+func (mb *MeshBroker) SetPeers(peers ...string) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.closed {
+		return
+	}
+	keep := make(map[string]bool)
+	for _, addr := range peers {
+		keep[addr] = true
+		if _, ok := mb.peers[addr]; !ok {
+			peer := &meshPeer{
+				mb:    mb,
+				addr:  addr,
+				queue: make(chan []byte, meshQueueSize),
+				done:  make(chan struct{}),
+			}
+			mb.peers[addr] = peer
+			go peer.run()
+		}
+	}
+	for addr, peer := range mb.peers {
+		if !keep[addr] {
+			close(peer.done)
+			delete(mb.peers, addr)
+		}
+	}
+}
+
+// SetAuth sets the user and password that the MeshBroker sends to its
+// peers with AUTH. ServeBroker then only accepts messages from clients
+// that have authenticated as the user. The connections to the peers are
+// reestablished.
+func (mb *MeshBroker) SetAuth(user, password string) {
+	mb.mu.Lock()
+	mb.user = user
+	mb.password = password
+	peers := make([]string, 0, len(mb.peers))
+	for addr, peer := range mb.peers {
+		peers = append(peers, addr)
+		close(peer.done)
+		delete(mb.peers, addr)
+	}
+	mb.mu.Unlock()
+	mb.SetPeers(peers...)
+}
+
+// authCommand returns the AUTH command that is sent to the peers, or nil
+// when there are no credentials.
+func (mb *MeshBroker) authCommand() []byte {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	if mb.user == "" {
+		return nil
+	}
+	cmd := AppendArray(nil, 3)
+	cmd = AppendBulkString(cmd, "AUTH")
+	cmd = AppendBulkString(cmd, mb.user)
+	return AppendBulkString(cmd, mb.password)
+}
+
+// Peers returns the addresses of the peers.
+func (mb *MeshBroker) Peers() []string {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	peers := make([]string, 0, len(mb.peers))
+	for addr := range mb.peers {
+		peers = append(peers, addr)
+	}
+	return peers
+}
+
+// Close disconnects from all of the peers.
+func (mb *MeshBroker) Close() error {
+	mb.SetPeers()
+	mb.mu.Lock()
+	mb.closed = true
+	mb.mu.Unlock()
+	return nil
+}
+
+// Publish sends a message to all of the peers.
+func (mb *MeshBroker) Publish(msg BrokerMessage) {
+	kind := "message"
+	if msg.Shard {
+		kind = "smessage"
+	}
+	var frame []byte
+	frame = AppendArray(frame, 4)
+	frame = AppendBulkString(frame, meshBrokerCommand)
+	frame = AppendBulkString(frame, kind)
+	frame = AppendBulkString(frame, msg.Channel)
+	frame = AppendBulk(frame, msg.Message)
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	for _, peer := range mb.peers {
+		select {
+		case peer.queue <- frame:
+		default:
+		}
+	}
+}
+
+// Listen sets the function that is called for the messages from peers.
+func (mb *MeshBroker) Listen(fn func(msg BrokerMessage)) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	mb.fn = fn
+}
+
+// ServeBroker is a HandlerFunc for the messages that are sent by the
+// MeshBrokers of the peers, which must be registered as "broker.publish".
+// The client must have authenticated with an AuthHandler, as the user of
+// SetAuth when it's set.
+func (mb *MeshBroker) ServeBroker(conn Conn, cmd Command) {
+	mb.mu.RLock()
+	fn := mb.fn
+	want := mb.user
+	mb.mu.RUnlock()
+	user, ok := AuthUser(conn)
+	if !ok {
+		conn.WriteError("NOAUTH Authentication required.")
+		return
+	}
+	if want != "" && user != want {
+		conn.WriteError("NOPERM this user has no permissions to run the '" +
+			strings.ToLower(string(cmd.Args[0])) + "' command")
+		return
+	}
+	if len(cmd.Args) != 4 {
+		conn.WriteError("ERR wrong number of arguments for '" +
+			strings.ToLower(string(cmd.Args[0])) + "' command")
+		return
+	}
+	var msg BrokerMessage
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "message":
+	case "smessage":
+		msg.Shard = true
+	default:
+		conn.WriteError("ERR syntax error")
+		return
+	}
+	msg.Channel = string(cmd.Args[2])
+	msg.Message = cmd.Args[3]
+	if fn != nil {
+		fn(msg)
+	}
+	conn.WriteString("OK")
+}
+
+// run connects to the peer and writes the queued messages until the peer
+// is removed. The connection is reestablished when it fails.
+func (peer *meshPeer) run() {
+	var nc net.Conn
+	defer func() {
+		if nc != nil {
+			nc.Close()
+		}
+	}()
+	var buf []byte
+	delay := time.Millisecond * 100
+	for {
+		if nc == nil {
+			var err error
+			nc, err = peer.dial()
+			if err != nil {
+				// drop the messages for the unreachable peer
+				timer := time.NewTimer(delay)
+			wait:
+				for {
+					select {
+					case <-peer.queue:
+					case <-timer.C:
+						break wait
+					case <-peer.done:
+						timer.Stop()
+						return
+					}
+				}
+				if delay < time.Second*5 {
+					delay *= 2
+				}
+				continue
+			}
+			delay = time.Millisecond * 100
+			// the replies are not used
+			go io.Copy(ioutil.Discard, nc)
+		}
+		select {
+		case frame := <-peer.queue:
+			buf = append(buf[:0], frame...)
+			for n := len(peer.queue); n > 0; n-- {
+				buf = append(buf, <-peer.queue...)
+			}
+			nc.SetWriteDeadline(time.Now().Add(meshTimeout))
+			if _, err := nc.Write(buf); err != nil {
+				nc.Close()
+				nc = nil
+			}
+		case <-peer.done:
+			return
+		}
+	}
+}
+
+// dial connects to the peer, and authenticates when the MeshBroker has
+// credentials.
+func (peer *meshPeer) dial() (net.Conn, error) {
+	nc, err := net.DialTimeout("tcp", peer.addr, meshTimeout)
+	if err != nil {
+		return nil, err
+	}
+	auth := peer.mb.authCommand()
+	if auth == nil {
+		return nc, nil
+	}
+	nc.SetDeadline(time.Now().Add(meshTimeout))
+	if _, err := nc.Write(auth); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	// the peer does not send anything else before the reply
+	line, err := bufio.NewReader(nc).ReadString('\n')
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	if line != "+OK\r\n" {
+		nc.Close()
+		return nil, errors.New(strings.TrimSpace(line))
+	}
+	nc.SetDeadline(time.Time{})
+	return nc, nil
+}
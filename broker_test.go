@@ -0,0 +1,121 @@
+package redcon
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalBroker(t *testing.T) {
+	lb := NewLocalBroker()
+	var ps1, ps2 PubSub
+	ps1.SetBroker(lb.Broker())
+	ps2.SetBroker(lb.Broker())
+	sub, peer := testPipeConn(t, 1)
+	defer peer.nc.Close()
+	ps2.Subscribe(sub, "a")
+	peer.expect("*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n")
+	peer.do("SSUBSCRIBE", "b")
+	peer.expect("*3\r\n$10\r\nssubscribe\r\n$1\r\nb\r\n:1\r\n")
+
+	// only local subscribers are counted
+	if n := ps1.Publish("a", "hello"); n != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, n)
+	}
+	peer.expect("*3\r\n$7\r\nmessage\r\n$1\r\na\r\n$5\r\nhello\r\n")
+	ps1.SpublishBytes([]byte("b"), []byte("world"))
+	peer.expect("*3\r\n$8\r\nsmessage\r\n$1\r\nb\r\n$5\r\nworld\r\n")
+
+	// messages are not sent back to the publisher
+	if n := ps2.Publish("a", "local"); n != 1 {
+		t.Fatalf("expected '%v', got '%v'", 1, n)
+	}
+	peer.expect("*3\r\n$7\r\nmessage\r\n$1\r\na\r\n$5\r\nlocal\r\n")
+	peer.expectNothing()
+}
+
+func TestMeshBroker(t *testing.T) {
+	var lns [2]net.Listener
+	var mbs [2]*MeshBroker
+	var pss [2]PubSub
+	for i := range lns {
+		var err error
+		lns[i], err = net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer lns[i].Close()
+	}
+	auth := AuthenticatorFunc(func(user, pass string) bool {
+		return user == "broker" && pass == "secret"
+	})
+	for i := range mbs {
+		mbs[i] = NewMeshBroker(lns[1-i].Addr().String())
+		defer mbs[i].Close()
+		mbs[i].SetAuth("broker", "secret")
+		mux := NewServeMux()
+		mux.HandleFunc("broker.publish", mbs[i].ServeBroker)
+		go Serve(lns[i], NewAuthHandler(auth, mux).ServeRESP, nil, nil)
+		pss[i].SetBroker(mbs[i])
+	}
+	sub, peer := testPipeConn(t, 1)
+	defer peer.nc.Close()
+	pss[1].Psubscribe(sub, "news.*")
+	peer.expect("*3\r\n$10\r\npsubscribe\r\n$6\r\nnews.*\r\n:1\r\n")
+	pss[0].Publish("news.tech", "x\r\ny")
+	peer.expect("*4\r\n$8\r\npmessage\r\n$6\r\nnews.*\r\n$9\r\nnews.tech\r\n" +
+		"$4\r\nx\r\ny\r\n")
+
+	// a peer with the wrong password can't send messages
+	mbs[0].SetAuth("broker", "wrong")
+	pss[0].Publish("news.tech", "denied")
+	time.Sleep(time.Millisecond * 50)
+	peer.expectNothing()
+
+	// a removed peer no longer receives messages
+	mbs[0].SetPeers()
+	if peers := mbs[0].Peers(); len(peers) != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, len(peers))
+	}
+	pss[0].Publish("news.tech", "gone")
+	time.Sleep(time.Millisecond * 50)
+	peer.expectNothing()
+
+	var buf bytes.Buffer
+	c := &conn{wr: NewWriter(&buf)}
+	mux := NewServeMux()
+	mux.HandleFunc("broker.publish", mbs[0].ServeBroker)
+	h := NewAuthHandler(auth, mux)
+	for _, test := range [][2]string{
+		{"BROKER.PUBLISH message a b", "-NOAUTH Authentication required.\r\n"},
+		{"AUTH broker secret", "+OK\r\n"},
+		{"BROKER.PUBLISH message", "-ERR wrong number of arguments for " +
+			"'broker.publish' command\r\n"},
+		{"BROKER.PUBLISH pmessage a b", "-ERR syntax error\r\n"},
+		{"BROKER.PUBLISH message a b", "+OK\r\n"},
+		{"AUTH other secret", "-WRONGPASS invalid username-password pair " +
+			"or user is disabled.\r\n"},
+	} {
+		buf.Reset()
+		h.ServeRESP(c, testArgCommand(strings.Split(test[0], " ")...))
+		c.wr.Flush()
+		if buf.String() != test[1] {
+			t.Fatalf("%s: expected '%q', got '%q'", test[0], test[1],
+				buf.String())
+		}
+	}
+
+	// only the user of the broker may send messages
+	c.user = "other"
+	buf.Reset()
+	mbs[0].ServeBroker(c, testArgCommand("BROKER.PUBLISH", "message", "a",
+		"b"))
+	c.wr.Flush()
+	exp := "-NOPERM this user has no permissions to run the " +
+		"'broker.publish' command\r\n"
+	if buf.String() != exp {
+		t.Fatalf("expected '%q', got '%q'", exp, buf.String())
+	}
+}
@@ -0,0 +1,785 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// generator writes the Go source for a set of commands.
+type generator struct {
+	buf     bytes.Buffer
+	strings bool // the "strings" package is used
+	labels  int  // unique label and variable counter, per function
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+// generate returns the formatted Go source for the commands.
+func generate(pkg string, cmds []*command) ([]byte, error) {
+	g := &generator{}
+	var body generator
+	containers := make(map[string][]*command)
+	var names []string
+	for _, cmd := range cmds {
+		if cmd.Container != "" {
+			key := strings.ToUpper(cmd.Container)
+			if containers[key] == nil {
+				names = append(names, key)
+			}
+			containers[key] = append(containers[key], cmd)
+		}
+	}
+	sort.Strings(names)
+	for _, cmd := range cmds {
+		cmd.containerOf = cmd.Container == "" &&
+			containers[strings.ToUpper(cmd.Name)] != nil
+	}
+	for _, cmd := range cmds {
+		body.genCommand(cmd)
+	}
+	body.genRegister(cmds, containers, names)
+	g.printf("// Code generated by redcon-gen. DO NOT EDIT.\n\n")
+	g.printf("package %s\n\n", pkg)
+	g.printf("import (\n")
+	if body.strings {
+		g.printf("\t\"strings\"\n\n")
+	}
+	g.printf("\t\"github.com/tidwall/redcon\"\n")
+	g.printf(")\n\n")
+	g.buf.Write(body.buf.Bytes())
+	src, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("%v\n%s", err, g.buf.Bytes())
+	}
+	return src, nil
+}
+
+// structDef is a generated argument struct.
+type structDef struct {
+	name   string
+	doc    string
+	fields []*argument
+	names  map[string]bool
+}
+
+func (g *generator) genCommand(cmd *command) {
+	name := cmd.goName()
+	st := &structDef{
+		name:  name + "Args",
+		doc:   fmt.Sprintf("are the arguments for the %s command.", cmd.fullName()),
+		names: make(map[string]bool),
+	}
+	if cmd.Container == "" && cmd.containerOf {
+		// A container command is only a spec. The subcommands have the
+		// arguments and handlers.
+		g.genSpec(cmd)
+		return
+	}
+	var structs []*structDef
+	structs = append(structs, st)
+	annotate(cmd.Arguments, st, "", false, &structs)
+	for _, st := range structs {
+		g.printf("// %s %s\n", st.name, st.doc)
+		g.printf("type %s struct {\n", st.name)
+		for _, a := range st.fields {
+			g.printf("\t%s %s", a.field, a.typ)
+			if a.Token != "" {
+				g.printf(" // %s", a.Token)
+			}
+			g.printf("\n")
+		}
+		g.printf("}\n\n")
+	}
+
+	// parse function
+	g.labels = 0
+	g.printf("// Parse%sArgs parses the arguments for the %s command.\n",
+		name, cmd.fullName())
+	g.printf("func Parse%sArgs(cmd redcon.Command) (%sArgs, error) {\n",
+		name, name)
+	g.printf("\tvar v %sArgs\n", name)
+	g.printf("\targs := redcon.NewArgReader(cmd)\n")
+	if cmd.Container != "" {
+		g.printf("\targs.Bytes() // subcommand\n")
+	}
+	g.genSeq(cmd.Arguments, "v", true, nil)
+	g.printf("\treturn v, args.Done()\n")
+	g.printf("}\n\n")
+
+	g.genSpec(cmd)
+
+	// handler interface
+	g.printf("// %sHandler handles the %s command.\n", name, cmd.fullName())
+	if cmd.Summary != "" {
+		g.printf("//\n// %s\n", cmd.Summary)
+	}
+	g.printf("type %sHandler interface {\n", name)
+	g.printf("\t%s(conn redcon.Conn, args %sArgs)\n", name, name)
+	g.printf("}\n\n")
+
+	g.genReply(cmd)
+}
+
+// genSpec writes the redcon.CommandSpec for a command.
+func (g *generator) genSpec(cmd *command) {
+	name := cmd.goName()
+	g.printf("// %sSpec is the spec for the %s command.\n", name,
+		cmd.fullName())
+	g.printf("var %sSpec = redcon.CommandSpec{\n", name)
+	g.printf("\tName: %q,\n", cmd.specName())
+	g.printf("\tArity: %d,\n", cmd.Arity)
+	if flags := cmd.flags(); len(flags) > 0 {
+		g.printf("\tFlags: %#v,\n", flags)
+	}
+	if cats := cmd.categories(); len(cats) > 0 {
+		g.printf("\tCategories: %#v,\n", cats)
+	}
+	g.genKeys(cmd)
+	g.printf("}\n\n")
+}
+
+// annotate assigns Go field names and types to the arguments, adding the
+// fields to st. Nested blocks are added to structs.
+func annotate(args []*argument, st *structDef, prefix string,
+	optional bool, structs *[]*structDef,
+) {
+	for _, a := range args {
+		name := goIdent(a.Name)
+		opt := optional || a.Optional
+		if a.Type == "oneof" && a.Token == "" && leadTokens(a) != nil {
+			// Flatten the alternatives into the parent struct.
+			a.flatten = true
+			for _, child := range a.Arguments {
+				if a.Multiple {
+					child.Multiple = true
+				}
+			}
+			annotate(a.Arguments, st, name, true, structs)
+			continue
+		}
+		a.field = name
+		if st.names[a.field] {
+			a.field = prefix + name
+		}
+		for i := 2; st.names[a.field]; i++ {
+			a.field = prefix + name + strconv.Itoa(i)
+		}
+		st.names[a.field] = true
+		switch a.Type {
+		case "block":
+			sub := &structDef{
+				name: st.name + name,
+				doc: fmt.Sprintf("are the %s arguments of %s.", a.Name,
+					st.name),
+				names: make(map[string]bool),
+			}
+			*structs = append(*structs, sub)
+			annotate(a.Arguments, sub, "", false, structs)
+			a.elem = sub.name
+		case "pure-token":
+			a.elem = "bool"
+		case "integer", "unix-time":
+			a.elem = "int64"
+		case "double":
+			a.elem = "float64"
+		case "pattern":
+			a.elem = "string"
+		default:
+			// key, string, and oneof with untokened alternatives.
+			a.elem = "[]byte"
+		}
+		switch {
+		case a.Type == "pure-token":
+			a.typ = a.elem
+		case a.Multiple:
+			a.typ = "[]" + a.elem
+		case opt && a.elem != "[]byte":
+			a.typ = "*" + a.elem
+			a.pointer = true
+		default:
+			a.typ = a.elem
+		}
+		st.fields = append(st.fields, a)
+	}
+}
+
+// leadTokens returns the tokens that an argument may start with, or nil
+// when the argument does not start with a token.
+func leadTokens(a *argument) []string {
+	if a.Token != "" {
+		return []string{a.Token}
+	}
+	switch a.Type {
+	case "oneof":
+		var tokens []string
+		for _, child := range a.Arguments {
+			more := leadTokens(child)
+			if more == nil {
+				return nil
+			}
+			tokens = append(tokens, more...)
+		}
+		return tokens
+	case "block":
+		if len(a.Arguments) > 0 && !a.Arguments[0].Optional {
+			return leadTokens(a.Arguments[0])
+		}
+	}
+	return nil
+}
+
+// isOption returns true when the argument starts with a token.
+func isOption(a *argument) bool {
+	return leadTokens(a) != nil
+}
+
+// readExpr returns the expression that reads an argument value.
+func readExpr(a *argument) string {
+	switch a.elem {
+	case "int64":
+		return "args.Int()"
+	case "float64":
+		return "args.Float()"
+	case "string":
+		return "args.String()"
+	}
+	return "args.Bytes()"
+}
+
+// stopExpr returns a condition that is true when there are more arguments
+// that are not one of the stop tokens.
+func stopExpr(stop []string) string {
+	if len(stop) == 0 {
+		return "args.More()"
+	}
+	var quoted []string
+	for _, token := range stop {
+		quoted = append(quoted, strconv.Quote(token))
+	}
+	return "args.More() && !args.PeekFlag(" + strings.Join(quoted, ", ") + ")"
+}
+
+// enumTokens returns the tokens of a oneof that is one of its pure tokens,
+// such as "AGGREGATE SUM|MIN|MAX", or nil.
+func enumTokens(a *argument) []string {
+	if a.Type != "oneof" || a.flatten || len(a.Arguments) == 0 {
+		return nil
+	}
+	var tokens []string
+	for _, child := range a.Arguments {
+		if child.Type != "pure-token" {
+			return nil
+		}
+		tokens = append(tokens, strconv.Quote(child.Token))
+	}
+	return tokens
+}
+
+// genAssign reads a scalar value into the field of target.
+func (g *generator) genAssign(a *argument, target string) {
+	field := target + "." + a.field
+	if tokens := enumTokens(a); tokens != nil {
+		// keep the value and check that it is one of the tokens
+		if a.Multiple {
+			g.printf("%s = append(%s, args.Peek())\n", field, field)
+		} else {
+			g.printf("%s = args.Peek()\n", field)
+		}
+		g.printf("args.Enum(%s)\n", strings.Join(tokens, ", "))
+		return
+	}
+	switch {
+	case a.Type == "pure-token":
+		g.printf("%s = true\n", field)
+	case a.Multiple:
+		g.printf("%s = append(%s, %s)\n", field, field, readExpr(a))
+	case a.pointer:
+		g.printf("%s = new(%s)\n", field, a.elem)
+		g.printf("*%s = %s\n", field, readExpr(a))
+	default:
+		g.printf("%s = %s\n", field, readExpr(a))
+	}
+}
+
+// genSeq reads a sequence of arguments into target. The final options of
+// the top-level sequence fail with a syntax error on unknown arguments.
+func (g *generator) genSeq(args []*argument, target string, top bool,
+	stop []string,
+) {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if isOption(a) {
+			j := i
+			for j < len(args) && isOption(args[j]) {
+				j++
+			}
+			g.genOptions(args[i:j], target, top && j == len(args),
+				append(tokensOf(args[j:]), stop...))
+			i = j - 1
+			continue
+		}
+		next := append(tokensOf(args[i+1:]), stop...)
+		if a.Multiple && i == len(args)-2 && args[i+1].Multiple &&
+			!isOption(args[i+1]) && a.elem == "[]byte" &&
+			args[i+1].elem == "[]byte" {
+			// Two lists of equal length, such as "key [key ...] id [id ...]"
+			b := args[i+1]
+			g.printf("if rest := args.Rest(); len(rest) == 0 || len(rest)%%2 != 0 {\n")
+			g.printf("args.Fail(redcon.ErrSyntax)\n")
+			g.printf("} else {\n")
+			g.printf("%s.%s = rest[:len(rest)/2]\n", target, a.field)
+			g.printf("%s.%s = rest[len(rest)/2:]\n", target, b.field)
+			g.printf("}\n")
+			return
+		}
+		if i+1 < len(args) && isCount(a, args[i+1]) {
+			// A count followed by that many values, such as
+			// "numkeys key [key ...]"
+			g.genCounted(a, args[i+1], target)
+			i++
+			continue
+		}
+		g.genPositional(a, target, next)
+	}
+}
+
+// isCount returns true when the argument is the number of values of the
+// next argument.
+func isCount(a, next *argument) bool {
+	return a.Name == "numkeys" && a.elem == "int64" && !a.Multiple &&
+		!a.Optional && next.Multiple && next.Type != "block" &&
+		!isOption(next)
+}
+
+// genCounted reads a count and the values that it counts. The count must
+// not be more than the remaining arguments, and is at least one when the
+// values are required.
+func (g *generator) genCounted(n, a *argument, target string) {
+	count := target + "." + n.field
+	min := 1
+	if a.Optional {
+		min = 0
+	}
+	g.genAssign(n, target)
+	g.printf("if %s < %d || %s > int64(args.Len()) {\n", count, min, count)
+	g.printf("args.Fail(redcon.ErrSyntax)\n")
+	g.printf("}\n")
+	g.printf("for i := int64(0); i < %s && args.More(); i++ {\n", count)
+	g.genAssign(a, target)
+	g.printf("}\n")
+}
+
+// tokensOf returns the lead tokens of all arguments.
+func tokensOf(args []*argument) []string {
+	var tokens []string
+	for _, a := range args {
+		tokens = append(tokens, leadTokens(a)...)
+	}
+	return tokens
+}
+
+// genPositional reads an argument that does not start with a token.
+func (g *generator) genPositional(a *argument, target string, stop []string) {
+	field := target + "." + a.field
+	if a.Type == "block" {
+		if a.Optional && !a.Multiple {
+			g.printf("if %s {\n", stopExpr(stop))
+			g.printf("%s = &%s{}\n", field, a.elem)
+			g.genSeq(a.Arguments, field, false, stop)
+			g.printf("}\n")
+			return
+		}
+		g.genBlock(a, target, stop)
+		return
+	}
+	switch {
+	case a.Multiple && a.Optional:
+		g.printf("for %s {\n", stopExpr(stop))
+		g.genAssign(a, target)
+		g.printf("}\n")
+	case a.Multiple:
+		g.genAssign(a, target)
+		g.printf("for %s {\n", stopExpr(stop))
+		g.genAssign(a, target)
+		g.printf("}\n")
+	case a.Optional:
+		g.printf("if %s {\n", stopExpr(stop))
+		g.genAssign(a, target)
+		g.printf("}\n")
+	default:
+		g.genAssign(a, target)
+	}
+}
+
+// genBlock reads a required block, or a list of blocks.
+func (g *generator) genBlock(a *argument, target string, stop []string) {
+	field := target + "." + a.field
+	switch {
+	case a.Multiple:
+		g.printf("for {\n")
+		g.printf("var item %s\n", a.elem)
+		g.genSeq(a.Arguments, "item", false, stop)
+		g.printf("%s = append(%s, item)\n", field, field)
+		if len(stop) == 0 {
+			g.printf("if !args.More() {\n")
+		} else {
+			g.printf("if !(%s) {\n", stopExpr(stop))
+		}
+		g.printf("break\n")
+		g.printf("}\n")
+		g.printf("}\n")
+	case a.pointer:
+		g.printf("%s = &%s{}\n", field, a.elem)
+		g.genSeq(a.Arguments, field, false, stop)
+	default:
+		g.genSeq(a.Arguments, field, false, stop)
+	}
+}
+
+// genOptions reads a group of options, which start with a token and may
+// appear in any order.
+func (g *generator) genOptions(opts []*argument, target string, final bool,
+	stop []string,
+) {
+	g.labels++
+	label := fmt.Sprintf("opts%d", g.labels)
+	counters := make(map[*argument]string)
+	var required []string
+	for _, a := range opts {
+		if a.flatten {
+			g.labels++
+			counters[a] = fmt.Sprintf("n%d", g.labels)
+			g.printf("var %s int\n", counters[a])
+		} else if !a.Optional {
+			g.labels++
+			counters[a] = fmt.Sprintf("seen%d", g.labels)
+			g.printf("var %s int\n", counters[a])
+			required = append(required, counters[a])
+		}
+	}
+	stop = append(tokensOf(opts), stop...)
+	if !final {
+		g.printf("%s:\n", label)
+	}
+	g.printf("for args.More() {\n")
+	g.printf("switch {\n")
+	for _, a := range opts {
+		g.genCase(a, target, counters[a], stop)
+	}
+	g.printf("default:\n")
+	if final {
+		g.printf("args.Fail(redcon.ErrSyntax)\n")
+	} else {
+		g.printf("break %s\n", label)
+	}
+	g.printf("}\n")
+	g.printf("}\n")
+	for _, a := range opts {
+		if a.flatten {
+			g.printf("if %s > 1 {\n", counters[a])
+			g.printf("args.Fail(redcon.ErrSyntax)\n")
+			g.printf("}\n")
+		}
+	}
+	for _, counter := range required {
+		g.printf("if %s == 0 {\n", counter)
+		g.printf("args.Fail(redcon.ErrSyntax)\n")
+		g.printf("}\n")
+	}
+}
+
+// genCase writes the switch cases for an option.
+func (g *generator) genCase(a *argument, target, counter string,
+	stop []string,
+) {
+	if a.flatten {
+		for _, child := range a.Arguments {
+			g.genCase(child, target, counter, stop)
+		}
+		return
+	}
+	if a.Token != "" {
+		g.printf("case args.Flag(%q):\n", a.Token)
+	} else {
+		var quoted []string
+		for _, token := range leadTokens(a) {
+			quoted = append(quoted, strconv.Quote(token))
+		}
+		g.printf("case args.PeekFlag(%s):\n", strings.Join(quoted, ", "))
+	}
+	if counter != "" {
+		g.printf("%s++\n", counter)
+	}
+	field := target + "." + a.field
+	switch {
+	case a.Type == "block":
+		if a.Multiple && a.MultipleToken {
+			g.printf("var item %s\n", a.elem)
+			g.genSeq(a.Arguments, "item", false, stop)
+			g.printf("%s = append(%s, item)\n", field, field)
+		} else {
+			g.genBlock(a, target, stop)
+		}
+	case a.Multiple && !a.MultipleToken && a.Token != "":
+		// a token followed by one or more values
+		g.genAssign(a, target)
+		g.printf("for %s {\n", stopExpr(stop))
+		g.genAssign(a, target)
+		g.printf("}\n")
+	case a.Type == "pure-token" || a.Token != "":
+		g.genAssign(a, target)
+	default:
+		// An untokened oneof that is not flattened, read the raw value.
+		g.genAssign(a, target)
+	}
+}
+
+// genKeys writes the key positions of a command spec.
+func (g *generator) genKeys(cmd *command) {
+	if len(cmd.KeySpecs) == 0 {
+		return
+	}
+	simple := true
+	first, last, step := 0, 0, 0
+	for _, ks := range cmd.KeySpecs {
+		idx := ks.BeginSearch.Index
+		rng := ks.FindKeys.Range
+		if idx == nil || rng == nil || rng.Limit > 1 {
+			simple = false
+			break
+		}
+		klast := rng.LastKey
+		if klast >= 0 {
+			klast += idx.Pos
+		}
+		kstep := rng.Step
+		if kstep == 0 {
+			kstep = 1
+		}
+		switch {
+		case first == 0:
+			first, last, step = idx.Pos, klast, kstep
+		case step == kstep && last >= 0 && idx.Pos == last+step:
+			// contiguous
+			last = klast
+		default:
+			simple = false
+		}
+		if !simple {
+			break
+		}
+	}
+	if simple {
+		g.printf("\tFirstKey: %d,\n\tLastKey: %d,\n\tStep: %d,\n",
+			first, last, step)
+		return
+	}
+	g.printf("\tKeysFunc: func(args [][]byte) [][]byte {\n")
+	g.printf("var keys [][]byte\n")
+	for _, ks := range cmd.KeySpecs {
+		// offset returns the begin position plus n.
+		offset := func(n int) string { return "begin+" + strconv.Itoa(n) }
+		begin := "begin"
+		switch {
+		case ks.BeginSearch.Index != nil:
+			pos := ks.BeginSearch.Index.Pos
+			begin = strconv.Itoa(pos)
+			offset = func(n int) string { return strconv.Itoa(pos + n) }
+		case ks.BeginSearch.Keyword != nil:
+			g.strings = true
+			kw := ks.BeginSearch.Keyword
+			g.printf("if begin := func() int {\n")
+			if kw.StartFrom >= 0 {
+				g.printf("for i := %d; i < len(args); i++ {\n", kw.StartFrom)
+			} else {
+				g.printf("for i := len(args) %d; i > 0; i-- {\n", kw.StartFrom)
+			}
+			g.printf("if strings.EqualFold(string(args[i]), %q) {\n", kw.Keyword)
+			g.printf("return i + 1\n")
+			g.printf("}\n")
+			g.printf("}\n")
+			g.printf("return 0\n")
+			g.printf("}(); begin > 0 {\n")
+		default:
+			continue
+		}
+		switch {
+		case ks.FindKeys.Range != nil:
+			rng := ks.FindKeys.Range
+			step := "i++"
+			if rng.Step > 1 {
+				step = "i += " + strconv.Itoa(rng.Step)
+			}
+			if rng.LastKey >= 0 {
+				g.printf("for i := %s; i <= %s && i < len(args); %s {\n",
+					begin, offset(rng.LastKey), step)
+			} else if rng.Limit > 1 {
+				g.printf("for i := %s; i < %s+(len(args)-%s)/%d; %s {\n",
+					begin, begin, begin, rng.Limit, step)
+			} else if rng.LastKey == -1 {
+				g.printf("for i := %s; i < len(args); %s {\n", begin, step)
+			} else {
+				g.printf("for i := %s; i < len(args)-%d; %s {\n",
+					begin, -rng.LastKey-1, step)
+			}
+			g.printf("keys = append(keys, args[i])\n")
+			g.printf("}\n")
+		case ks.FindKeys.KeyNum != nil:
+			kn := ks.FindKeys.KeyNum
+			g.printf("keys = append(keys, redcon.KeyNumKeys(args, %s, %d, %d)...)\n",
+				offset(kn.KeyNumIdx), kn.FirstKey-kn.KeyNumIdx, kn.Step)
+		}
+		if ks.BeginSearch.Keyword != nil {
+			g.printf("}\n")
+		}
+	}
+	g.printf("return keys\n")
+	g.printf("},\n")
+}
+
+// genReply writes a typed reply helper when the reply schema is simple.
+func (g *generator) genReply(cmd *command) {
+	s := cmd.ReplySchema
+	if s == nil {
+		return
+	}
+	name := cmd.goName()
+	typ, write := replyType(s)
+	if typ == "" && write == "" {
+		return
+	}
+	g.printf("// Write%sReply writes the reply for the %s command.\n", name,
+		cmd.fullName())
+	if s.Description != "" {
+		g.printf("//\n// %s\n", s.Description)
+	}
+	if typ == "" {
+		g.printf("func Write%sReply(conn redcon.Conn) {\n", name)
+	} else {
+		g.printf("func Write%sReply(conn redcon.Conn, v %s) {\n", name, typ)
+	}
+	g.printf("%s\n", write)
+	g.printf("}\n\n")
+}
+
+// replyType returns the Go type and write statement for a reply schema.
+func replyType(s *schema) (typ, write string) {
+	if s.Const == "OK" {
+		return "", "conn.WriteString(\"OK\")"
+	}
+	switch s.Type {
+	case "integer":
+		return "int64", "conn.WriteInt64(v)"
+	case "string":
+		return "[]byte", "conn.WriteBulk(v)"
+	case "number":
+		return "float64", "conn.WriteRaw(redcon.AppendBulkFloat(nil, v))"
+	case "null":
+		return "", "conn.WriteNull()"
+	}
+	alts := s.OneOf
+	if alts == nil {
+		alts = s.AnyOf
+	}
+	if len(alts) == 2 {
+		for i := 0; i < 2; i++ {
+			if alts[i].Type != "null" {
+				continue
+			}
+			other := alts[1-i]
+			switch other.Type {
+			case "string":
+				return "[]byte", "if v == nil {\nconn.WriteNull()\n} else {\n" +
+					"conn.WriteBulk(v)\n}"
+			case "integer":
+				return "*int64", "if v == nil {\nconn.WriteNull()\n} else {\n" +
+					"conn.WriteInt64(*v)\n}"
+			}
+		}
+	}
+	return "interface{}", "conn.WriteAny(v)"
+}
+
+// genRegister writes the RegisterCommands function.
+func (g *generator) genRegister(cmds []*command,
+	containers map[string][]*command, names []string,
+) {
+	g.printf("// RegisterCommands registers the commands that are implemented by h,\n")
+	g.printf("// using the command Handler interfaces.\n")
+	g.printf("func RegisterCommands(mux *redcon.ServeMux, h interface{}) {\n")
+	specs := make(map[string]*command)
+	for _, cmd := range cmds {
+		if cmd.Container == "" {
+			specs[strings.ToUpper(cmd.Name)] = cmd
+		}
+	}
+	for _, cmd := range cmds {
+		if cmd.Container != "" || cmd.containerOf {
+			continue
+		}
+		name := cmd.goName()
+		g.printf("if h, ok := h.(%sHandler); ok {\n", name)
+		g.printf("mux.HandleCommand(%sSpec, redcon.HandlerFunc(func(conn redcon.Conn, cmd redcon.Command) {\n", name)
+		g.genCall(name)
+		g.printf("}))\n")
+		g.printf("}\n")
+	}
+	for _, cname := range names {
+		g.strings = true
+		subs := containers[cname]
+		g.printf("{\n")
+		g.printf("var subs []redcon.CommandSpec\n")
+		g.printf("handlers := make(map[string]redcon.Handler)\n")
+		for _, cmd := range subs {
+			name := cmd.goName()
+			g.printf("if h, ok := h.(%sHandler); ok {\n", name)
+			g.printf("subs = append(subs, %sSpec)\n", name)
+			g.printf("handlers[%q] = redcon.HandlerFunc(func(conn redcon.Conn, cmd redcon.Command) {\n",
+				strings.ToLower(cmd.Name))
+			g.printf("if !%sSpec.CheckArity(len(cmd.Args)) {\n", name)
+			g.printf("conn.WriteError(\"ERR wrong number of arguments for '%s' command\")\n",
+				cmd.specName())
+			g.printf("return\n")
+			g.printf("}\n")
+			g.genCall(name)
+			g.printf("})\n")
+			g.printf("}\n")
+		}
+		g.printf("if len(subs) > 0 {\n")
+		if spec := specs[cname]; spec != nil {
+			g.printf("spec := %sSpec\n", spec.goName())
+		} else {
+			g.printf("spec := redcon.CommandSpec{Name: %q, Arity: -2}\n",
+				strings.ToLower(cname))
+		}
+		g.printf("spec.Subcommands = subs\n")
+		g.printf("mux.HandleCommand(spec, redcon.HandlerFunc(func(conn redcon.Conn, cmd redcon.Command) {\n")
+		g.printf("if h, ok := handlers[strings.ToLower(string(cmd.Args[1]))]; ok {\n")
+		g.printf("h.ServeRESP(conn, cmd)\n")
+		g.printf("} else {\n")
+		g.printf("conn.WriteError(\"ERR unknown subcommand '\" + string(cmd.Args[1]) + \"'. Try %s HELP.\")\n",
+			cname)
+		g.printf("}\n")
+		g.printf("}))\n")
+		g.printf("}\n")
+		g.printf("}\n")
+	}
+	g.printf("}\n")
+}
+
+// genCall writes the statements that parse the arguments and call the
+// handler method.
+func (g *generator) genCall(name string) {
+	g.printf("args, err := Parse%sArgs(cmd)\n", name)
+	g.printf("if err != nil {\n")
+	g.printf("conn.WriteError(err.Error())\n")
+	g.printf("return\n")
+	g.printf("}\n")
+	g.printf("h.%s(conn, args)\n", name)
+}
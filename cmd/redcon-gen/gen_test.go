@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func TestGenerate(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cmds []*command
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		more, err := parseCommands(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmds = append(cmds, more...)
+	}
+	src, err := generate("testcmds", cmds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The generated package is checked in, compiled and tested.
+	exp, err := ioutil.ReadFile("internal/testcmds/commands.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, exp) {
+		t.Fatal("internal/testcmds is out of date, run go generate")
+	}
+}
+
+func TestGoIdent(t *testing.T) {
+	tests := [][2]string{
+		{"unix-time-seconds", "UnixTimeSeconds"},
+		{"NO-EVICT", "NoEvict"},
+		{"key", "Key"},
+		{"2d", "N2D"},
+	}
+	for _, test := range tests {
+		if ident := goIdent(test[0]); ident != test[1] {
+			t.Fatalf("expected '%v', got '%v'", test[1], ident)
+		}
+	}
+}
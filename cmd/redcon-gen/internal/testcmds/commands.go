@@ -0,0 +1,554 @@
+// Code generated by redcon-gen. DO NOT EDIT.
+
+package testcmds
+
+import (
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// ConfigGetArgs are the arguments for the CONFIG GET command.
+type ConfigGetArgs struct {
+	Parameter [][]byte
+}
+
+// ParseConfigGetArgs parses the arguments for the CONFIG GET command.
+func ParseConfigGetArgs(cmd redcon.Command) (ConfigGetArgs, error) {
+	var v ConfigGetArgs
+	args := redcon.NewArgReader(cmd)
+	args.Bytes() // subcommand
+	v.Parameter = append(v.Parameter, args.Bytes())
+	for args.More() {
+		v.Parameter = append(v.Parameter, args.Bytes())
+	}
+	return v, args.Done()
+}
+
+// ConfigGetSpec is the spec for the CONFIG GET command.
+var ConfigGetSpec = redcon.CommandSpec{
+	Name:       "config|get",
+	Arity:      -3,
+	Flags:      []string{"admin", "noscript", "loading", "stale"},
+	Categories: []string{"admin", "dangerous", "slow"},
+}
+
+// ConfigGetHandler handles the CONFIG GET command.
+//
+// Returns the effective values of configuration parameters.
+type ConfigGetHandler interface {
+	ConfigGet(conn redcon.Conn, args ConfigGetArgs)
+}
+
+// WriteConfigGetReply writes the reply for the CONFIG GET command.
+func WriteConfigGetReply(conn redcon.Conn, v interface{}) {
+	conn.WriteAny(v)
+}
+
+// ConfigSpec is the spec for the CONFIG command.
+var ConfigSpec = redcon.CommandSpec{
+	Name:       "config",
+	Arity:      -2,
+	Categories: []string{"slow"},
+}
+
+// DelArgs are the arguments for the DEL command.
+type DelArgs struct {
+	Key [][]byte
+}
+
+// ParseDelArgs parses the arguments for the DEL command.
+func ParseDelArgs(cmd redcon.Command) (DelArgs, error) {
+	var v DelArgs
+	args := redcon.NewArgReader(cmd)
+	v.Key = append(v.Key, args.Bytes())
+	for args.More() {
+		v.Key = append(v.Key, args.Bytes())
+	}
+	return v, args.Done()
+}
+
+// DelSpec is the spec for the DEL command.
+var DelSpec = redcon.CommandSpec{
+	Name:       "del",
+	Arity:      -2,
+	Flags:      []string{"write"},
+	Categories: []string{"keyspace", "write", "slow"},
+	FirstKey:   1,
+	LastKey:    -1,
+	Step:       1,
+}
+
+// DelHandler handles the DEL command.
+//
+// Deletes one or more keys.
+type DelHandler interface {
+	Del(conn redcon.Conn, args DelArgs)
+}
+
+// WriteDelReply writes the reply for the DEL command.
+//
+// the number of keys that were removed
+func WriteDelReply(conn redcon.Conn, v int64) {
+	conn.WriteInt64(v)
+}
+
+// GetArgs are the arguments for the GET command.
+type GetArgs struct {
+	Key []byte
+}
+
+// ParseGetArgs parses the arguments for the GET command.
+func ParseGetArgs(cmd redcon.Command) (GetArgs, error) {
+	var v GetArgs
+	args := redcon.NewArgReader(cmd)
+	v.Key = args.Bytes()
+	return v, args.Done()
+}
+
+// GetSpec is the spec for the GET command.
+var GetSpec = redcon.CommandSpec{
+	Name:       "get",
+	Arity:      2,
+	Flags:      []string{"readonly", "fast"},
+	Categories: []string{"string", "read", "fast"},
+	FirstKey:   1,
+	LastKey:    1,
+	Step:       1,
+}
+
+// GetHandler handles the GET command.
+//
+// Returns the string value of a key.
+type GetHandler interface {
+	Get(conn redcon.Conn, args GetArgs)
+}
+
+// WriteGetReply writes the reply for the GET command.
+func WriteGetReply(conn redcon.Conn, v []byte) {
+	if v == nil {
+		conn.WriteNull()
+	} else {
+		conn.WriteBulk(v)
+	}
+}
+
+// MsetArgs are the arguments for the MSET command.
+type MsetArgs struct {
+	Data []MsetArgsData
+}
+
+// MsetArgsData are the data arguments of MsetArgs.
+type MsetArgsData struct {
+	Key   []byte
+	Value []byte
+}
+
+// ParseMsetArgs parses the arguments for the MSET command.
+func ParseMsetArgs(cmd redcon.Command) (MsetArgs, error) {
+	var v MsetArgs
+	args := redcon.NewArgReader(cmd)
+	for {
+		var item MsetArgsData
+		item.Key = args.Bytes()
+		item.Value = args.Bytes()
+		v.Data = append(v.Data, item)
+		if !args.More() {
+			break
+		}
+	}
+	return v, args.Done()
+}
+
+// MsetSpec is the spec for the MSET command.
+var MsetSpec = redcon.CommandSpec{
+	Name:       "mset",
+	Arity:      -3,
+	Flags:      []string{"write", "denyoom"},
+	Categories: []string{"string", "write", "slow"},
+	FirstKey:   1,
+	LastKey:    -1,
+	Step:       2,
+}
+
+// MsetHandler handles the MSET command.
+//
+// Atomically creates or modifies the string values of one or more keys.
+type MsetHandler interface {
+	Mset(conn redcon.Conn, args MsetArgs)
+}
+
+// WriteMsetReply writes the reply for the MSET command.
+func WriteMsetReply(conn redcon.Conn) {
+	conn.WriteString("OK")
+}
+
+// PingArgs are the arguments for the PING command.
+type PingArgs struct {
+	Message []byte
+}
+
+// ParsePingArgs parses the arguments for the PING command.
+func ParsePingArgs(cmd redcon.Command) (PingArgs, error) {
+	var v PingArgs
+	args := redcon.NewArgReader(cmd)
+	if args.More() {
+		v.Message = args.Bytes()
+	}
+	return v, args.Done()
+}
+
+// PingSpec is the spec for the PING command.
+var PingSpec = redcon.CommandSpec{
+	Name:       "ping",
+	Arity:      -1,
+	Flags:      []string{"fast", "sentinel"},
+	Categories: []string{"connection", "fast"},
+}
+
+// PingHandler handles the PING command.
+//
+// Returns the server's liveliness response.
+type PingHandler interface {
+	Ping(conn redcon.Conn, args PingArgs)
+}
+
+// WritePingReply writes the reply for the PING command.
+func WritePingReply(conn redcon.Conn, v interface{}) {
+	conn.WriteAny(v)
+}
+
+// SetArgs are the arguments for the SET command.
+type SetArgs struct {
+	Key                  []byte
+	Value                []byte
+	Nx                   bool   // NX
+	Xx                   bool   // XX
+	Get                  bool   // GET
+	Seconds              *int64 // EX
+	Milliseconds         *int64 // PX
+	UnixTimeSeconds      *int64 // EXAT
+	UnixTimeMilliseconds *int64 // PXAT
+	Keepttl              bool   // KEEPTTL
+}
+
+// ParseSetArgs parses the arguments for the SET command.
+func ParseSetArgs(cmd redcon.Command) (SetArgs, error) {
+	var v SetArgs
+	args := redcon.NewArgReader(cmd)
+	v.Key = args.Bytes()
+	v.Value = args.Bytes()
+	var n2 int
+	var n3 int
+	for args.More() {
+		switch {
+		case args.Flag("NX"):
+			n2++
+			v.Nx = true
+		case args.Flag("XX"):
+			n2++
+			v.Xx = true
+		case args.Flag("GET"):
+			v.Get = true
+		case args.Flag("EX"):
+			n3++
+			v.Seconds = new(int64)
+			*v.Seconds = args.Int()
+		case args.Flag("PX"):
+			n3++
+			v.Milliseconds = new(int64)
+			*v.Milliseconds = args.Int()
+		case args.Flag("EXAT"):
+			n3++
+			v.UnixTimeSeconds = new(int64)
+			*v.UnixTimeSeconds = args.Int()
+		case args.Flag("PXAT"):
+			n3++
+			v.UnixTimeMilliseconds = new(int64)
+			*v.UnixTimeMilliseconds = args.Int()
+		case args.Flag("KEEPTTL"):
+			n3++
+			v.Keepttl = true
+		default:
+			args.Fail(redcon.ErrSyntax)
+		}
+	}
+	if n2 > 1 {
+		args.Fail(redcon.ErrSyntax)
+	}
+	if n3 > 1 {
+		args.Fail(redcon.ErrSyntax)
+	}
+	return v, args.Done()
+}
+
+// SetSpec is the spec for the SET command.
+var SetSpec = redcon.CommandSpec{
+	Name:       "set",
+	Arity:      -3,
+	Flags:      []string{"write", "denyoom"},
+	Categories: []string{"string", "write", "slow"},
+	FirstKey:   1,
+	LastKey:    1,
+	Step:       1,
+}
+
+// SetHandler handles the SET command.
+//
+// Sets the string value of a key, ignoring its type. The key is created if it doesn't exist.
+type SetHandler interface {
+	Set(conn redcon.Conn, args SetArgs)
+}
+
+// WriteSetReply writes the reply for the SET command.
+func WriteSetReply(conn redcon.Conn, v interface{}) {
+	conn.WriteAny(v)
+}
+
+// XreadArgs are the arguments for the XREAD command.
+type XreadArgs struct {
+	Count        *int64           // COUNT
+	Milliseconds *int64           // BLOCK
+	Streams      XreadArgsStreams // STREAMS
+}
+
+// XreadArgsStreams are the streams arguments of XreadArgs.
+type XreadArgsStreams struct {
+	Key [][]byte
+	Id  [][]byte
+}
+
+// ParseXreadArgs parses the arguments for the XREAD command.
+func ParseXreadArgs(cmd redcon.Command) (XreadArgs, error) {
+	var v XreadArgs
+	args := redcon.NewArgReader(cmd)
+	var seen2 int
+	for args.More() {
+		switch {
+		case args.Flag("COUNT"):
+			v.Count = new(int64)
+			*v.Count = args.Int()
+		case args.Flag("BLOCK"):
+			v.Milliseconds = new(int64)
+			*v.Milliseconds = args.Int()
+		case args.Flag("STREAMS"):
+			seen2++
+			if rest := args.Rest(); len(rest) == 0 || len(rest)%2 != 0 {
+				args.Fail(redcon.ErrSyntax)
+			} else {
+				v.Streams.Key = rest[:len(rest)/2]
+				v.Streams.Id = rest[len(rest)/2:]
+			}
+		default:
+			args.Fail(redcon.ErrSyntax)
+		}
+	}
+	if seen2 == 0 {
+		args.Fail(redcon.ErrSyntax)
+	}
+	return v, args.Done()
+}
+
+// XreadSpec is the spec for the XREAD command.
+var XreadSpec = redcon.CommandSpec{
+	Name:       "xread",
+	Arity:      -4,
+	Flags:      []string{"blocking", "readonly"},
+	Categories: []string{"stream", "read", "blocking", "slow"},
+	KeysFunc: func(args [][]byte) [][]byte {
+		var keys [][]byte
+		if begin := func() int {
+			for i := 1; i < len(args); i++ {
+				if strings.EqualFold(string(args[i]), "STREAMS") {
+					return i + 1
+				}
+			}
+			return 0
+		}(); begin > 0 {
+			for i := begin; i < begin+(len(args)-begin)/2; i++ {
+				keys = append(keys, args[i])
+			}
+		}
+		return keys
+	},
+}
+
+// XreadHandler handles the XREAD command.
+//
+// Returns messages from multiple streams with IDs greater than the ones requested. Blocks until a message is available otherwise.
+type XreadHandler interface {
+	Xread(conn redcon.Conn, args XreadArgs)
+}
+
+// ZunionstoreArgs are the arguments for the ZUNIONSTORE command.
+type ZunionstoreArgs struct {
+	Destination []byte
+	Numkeys     int64
+	Key         [][]byte
+	Weight      []int64 // WEIGHTS
+	Aggregate   []byte  // AGGREGATE
+}
+
+// ParseZunionstoreArgs parses the arguments for the ZUNIONSTORE command.
+func ParseZunionstoreArgs(cmd redcon.Command) (ZunionstoreArgs, error) {
+	var v ZunionstoreArgs
+	args := redcon.NewArgReader(cmd)
+	v.Destination = args.Bytes()
+	v.Numkeys = args.Int()
+	if v.Numkeys < 1 || v.Numkeys > int64(args.Len()) {
+		args.Fail(redcon.ErrSyntax)
+	}
+	for i := int64(0); i < v.Numkeys && args.More(); i++ {
+		v.Key = append(v.Key, args.Bytes())
+	}
+	for args.More() {
+		switch {
+		case args.Flag("WEIGHTS"):
+			v.Weight = append(v.Weight, args.Int())
+			for args.More() && !args.PeekFlag("WEIGHTS", "AGGREGATE") {
+				v.Weight = append(v.Weight, args.Int())
+			}
+		case args.Flag("AGGREGATE"):
+			v.Aggregate = args.Peek()
+			args.Enum("SUM", "MIN", "MAX")
+		default:
+			args.Fail(redcon.ErrSyntax)
+		}
+	}
+	return v, args.Done()
+}
+
+// ZunionstoreSpec is the spec for the ZUNIONSTORE command.
+var ZunionstoreSpec = redcon.CommandSpec{
+	Name:       "zunionstore",
+	Arity:      -4,
+	Flags:      []string{"write", "denyoom"},
+	Categories: []string{"sortedset", "write", "slow"},
+	KeysFunc: func(args [][]byte) [][]byte {
+		var keys [][]byte
+		for i := 1; i <= 1 && i < len(args); i++ {
+			keys = append(keys, args[i])
+		}
+		keys = append(keys, redcon.KeyNumKeys(args, 2, 1, 1)...)
+		return keys
+	},
+}
+
+// ZunionstoreHandler handles the ZUNIONSTORE command.
+//
+// Stores the union of multiple sorted sets in a key.
+type ZunionstoreHandler interface {
+	Zunionstore(conn redcon.Conn, args ZunionstoreArgs)
+}
+
+// WriteZunionstoreReply writes the reply for the ZUNIONSTORE command.
+//
+// The number of elements in the resulting sorted set.
+func WriteZunionstoreReply(conn redcon.Conn, v int64) {
+	conn.WriteInt64(v)
+}
+
+// RegisterCommands registers the commands that are implemented by h,
+// using the command Handler interfaces.
+func RegisterCommands(mux *redcon.ServeMux, h interface{}) {
+	if h, ok := h.(DelHandler); ok {
+		mux.HandleCommand(DelSpec, redcon.HandlerFunc(func(conn redcon.Conn, cmd redcon.Command) {
+			args, err := ParseDelArgs(cmd)
+			if err != nil {
+				conn.WriteError(err.Error())
+				return
+			}
+			h.Del(conn, args)
+		}))
+	}
+	if h, ok := h.(GetHandler); ok {
+		mux.HandleCommand(GetSpec, redcon.HandlerFunc(func(conn redcon.Conn, cmd redcon.Command) {
+			args, err := ParseGetArgs(cmd)
+			if err != nil {
+				conn.WriteError(err.Error())
+				return
+			}
+			h.Get(conn, args)
+		}))
+	}
+	if h, ok := h.(MsetHandler); ok {
+		mux.HandleCommand(MsetSpec, redcon.HandlerFunc(func(conn redcon.Conn, cmd redcon.Command) {
+			args, err := ParseMsetArgs(cmd)
+			if err != nil {
+				conn.WriteError(err.Error())
+				return
+			}
+			h.Mset(conn, args)
+		}))
+	}
+	if h, ok := h.(PingHandler); ok {
+		mux.HandleCommand(PingSpec, redcon.HandlerFunc(func(conn redcon.Conn, cmd redcon.Command) {
+			args, err := ParsePingArgs(cmd)
+			if err != nil {
+				conn.WriteError(err.Error())
+				return
+			}
+			h.Ping(conn, args)
+		}))
+	}
+	if h, ok := h.(SetHandler); ok {
+		mux.HandleCommand(SetSpec, redcon.HandlerFunc(func(conn redcon.Conn, cmd redcon.Command) {
+			args, err := ParseSetArgs(cmd)
+			if err != nil {
+				conn.WriteError(err.Error())
+				return
+			}
+			h.Set(conn, args)
+		}))
+	}
+	if h, ok := h.(XreadHandler); ok {
+		mux.HandleCommand(XreadSpec, redcon.HandlerFunc(func(conn redcon.Conn, cmd redcon.Command) {
+			args, err := ParseXreadArgs(cmd)
+			if err != nil {
+				conn.WriteError(err.Error())
+				return
+			}
+			h.Xread(conn, args)
+		}))
+	}
+	if h, ok := h.(ZunionstoreHandler); ok {
+		mux.HandleCommand(ZunionstoreSpec, redcon.HandlerFunc(func(conn redcon.Conn, cmd redcon.Command) {
+			args, err := ParseZunionstoreArgs(cmd)
+			if err != nil {
+				conn.WriteError(err.Error())
+				return
+			}
+			h.Zunionstore(conn, args)
+		}))
+	}
+	{
+		var subs []redcon.CommandSpec
+		handlers := make(map[string]redcon.Handler)
+		if h, ok := h.(ConfigGetHandler); ok {
+			subs = append(subs, ConfigGetSpec)
+			handlers["get"] = redcon.HandlerFunc(func(conn redcon.Conn, cmd redcon.Command) {
+				if !ConfigGetSpec.CheckArity(len(cmd.Args)) {
+					conn.WriteError("ERR wrong number of arguments for 'config|get' command")
+					return
+				}
+				args, err := ParseConfigGetArgs(cmd)
+				if err != nil {
+					conn.WriteError(err.Error())
+					return
+				}
+				h.ConfigGet(conn, args)
+			})
+		}
+		if len(subs) > 0 {
+			spec := ConfigSpec
+			spec.Subcommands = subs
+			mux.HandleCommand(spec, redcon.HandlerFunc(func(conn redcon.Conn, cmd redcon.Command) {
+				if h, ok := handlers[strings.ToLower(string(cmd.Args[1]))]; ok {
+					h.ServeRESP(conn, cmd)
+				} else {
+					conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) + "'. Try CONFIG HELP.")
+				}
+			}))
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package testcmds
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/redcon"
+)
+
+type testHandler struct {
+	set         SetArgs
+	xread       XreadArgs
+	zunionstore ZunionstoreArgs
+}
+
+func (h *testHandler) Set(conn redcon.Conn, args SetArgs) {
+	h.set = args
+	WriteMsetReply(conn)
+}
+
+func (h *testHandler) Get(conn redcon.Conn, args GetArgs) {
+	WriteGetReply(conn, nil)
+}
+
+func (h *testHandler) Xread(conn redcon.Conn, args XreadArgs) {
+	h.xread = args
+	conn.WriteNull()
+}
+
+func (h *testHandler) Zunionstore(conn redcon.Conn, args ZunionstoreArgs) {
+	h.zunionstore = args
+	WriteZunionstoreReply(conn, int64(len(args.Key)))
+}
+
+func (h *testHandler) ConfigGet(conn redcon.Conn, args ConfigGetArgs) {
+	conn.WriteAny(args.Parameter)
+}
+
+// testConn captures the replies of a command.
+type testConn struct {
+	redcon.Conn
+	buf bytes.Buffer
+}
+
+func (c *testConn) WriteString(s string) {
+	c.buf.Write(redcon.AppendString(nil, s))
+}
+
+func (c *testConn) WriteError(s string) {
+	c.buf.Write(redcon.AppendError(nil, s))
+}
+
+func (c *testConn) WriteInt64(n int64) {
+	c.buf.Write(redcon.AppendInt(nil, n))
+}
+
+func (c *testConn) WriteNull() {
+	c.buf.Write(redcon.AppendNull(nil))
+}
+
+func (c *testConn) WriteAny(v interface{}) {
+	c.buf.Write(redcon.AppendAny(nil, v))
+}
+
+func TestCommands(t *testing.T) {
+	h := &testHandler{}
+	mux := redcon.NewServeMux()
+	RegisterCommands(mux, h)
+	if _, ok := mux.Command("del"); ok {
+		t.Fatal("del should not be registered")
+	}
+	spec, ok := mux.Command("config")
+	if !ok || len(spec.Subcommands) != 1 {
+		t.Fatal("expected config with one subcommand")
+	}
+	tests := [][2]string{
+		{"GET key", "$-1\r\n"},
+		{"GET", "-ERR wrong number of arguments for 'get' command\r\n"},
+		{"SET key value", "+OK\r\n"},
+		{"SET key value nx ex 10 get", "+OK\r\n"},
+		{"SET key value NX XX", "-ERR syntax error\r\n"},
+		{"SET key value EX 10 KEEPTTL", "-ERR syntax error\r\n"},
+		{"SET key value EX ten",
+			"-ERR value is not an integer or out of range\r\n"},
+		{"SET key value FOO", "-ERR syntax error\r\n"},
+		{"XREAD COUNT 10 STREAMS a b 0 0", "$-1\r\n"},
+		{"XREAD COUNT 10 STREAMS a b 0", "-ERR syntax error\r\n"},
+		{"XREAD COUNT 10 BLOCK 0", "-ERR syntax error\r\n"},
+		{"ZUNIONSTORE dst 2 a b WEIGHTS 1 2 AGGREGATE min", ":2\r\n"},
+		{"ZUNIONSTORE dst 1 a b", "-ERR syntax error\r\n"},
+		{"ZUNIONSTORE dst 3 a b", "-ERR syntax error\r\n"},
+		{"ZUNIONSTORE dst 0 a", "-ERR syntax error\r\n"},
+		{"ZUNIONSTORE dst -1 a", "-ERR syntax error\r\n"},
+		{"ZUNIONSTORE dst 1 WEIGHTS", ":1\r\n"},
+		{"ZUNIONSTORE dst 1 a AGGREGATE avg", "-ERR syntax error\r\n"},
+		{"ZUNIONSTORE dst 1 a AGGREGATE",
+			"-ERR wrong number of arguments for 'zunionstore' command\r\n"},
+		{"CONFIG GET maxmemory", "*1\r\n$9\r\nmaxmemory\r\n"},
+		{"CONFIG GET", "-ERR wrong number of arguments for 'config|get' command\r\n"},
+		{"CONFIG SET maxmemory 1", "-ERR unknown subcommand 'SET'. Try CONFIG HELP.\r\n"},
+	}
+	for _, test := range tests {
+		c := &testConn{}
+		var cmd redcon.Command
+		for _, arg := range strings.Split(test[0], " ") {
+			cmd.Args = append(cmd.Args, []byte(arg))
+		}
+		mux.ServeRESP(c, cmd)
+		if c.buf.String() != test[1] {
+			t.Fatalf("%s: expected %q, got %q", test[0], test[1], c.buf.String())
+		}
+	}
+	set := h.set
+	if !set.Nx || !set.Get || set.Seconds == nil || *set.Seconds != 10 ||
+		set.Milliseconds != nil {
+		t.Fatalf("unexpected set args: %+v", set)
+	}
+	xread := h.xread
+	if *xread.Count != 10 || len(xread.Streams.Key) != 2 ||
+		string(xread.Streams.Id[1]) != "0" {
+		t.Fatalf("unexpected xread args: %+v", xread)
+	}
+	zunionstore := h.zunionstore
+	if len(zunionstore.Key) != 1 || string(zunionstore.Key[0]) != "WEIGHTS" ||
+		zunionstore.Weight != nil {
+		t.Fatalf("unexpected zunionstore args: %+v", zunionstore)
+	}
+	keys := XreadSpec.Keys([][]byte{[]byte("XREAD"), []byte("STREAMS"),
+		[]byte("a"), []byte("b"), []byte("0"), []byte("0")})
+	if len(keys) != 2 || string(keys[0]) != "a" || string(keys[1]) != "b" {
+		t.Fatalf("unexpected keys: %q", keys)
+	}
+	keys = ZunionstoreSpec.Keys([][]byte{[]byte("ZUNIONSTORE"), []byte("dst"),
+		[]byte("2"), []byte("a"), []byte("b"), []byte("WEIGHTS"), []byte("1"),
+		[]byte("2")})
+	if len(keys) != 3 || string(keys[0]) != "dst" || string(keys[2]) != "b" {
+		t.Fatalf("unexpected keys: %q", keys)
+	}
+}
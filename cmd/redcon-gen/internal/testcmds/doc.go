@@ -0,0 +1,5 @@
+// Package testcmds is generated from the redcon-gen testdata and is used to
+// test that the generated code compiles and parses commands.
+package testcmds
+
+//go:generate go run ../.. -pkg testcmds -o commands.go ../../testdata/*.json
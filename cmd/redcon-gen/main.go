@@ -0,0 +1,71 @@
+// Command redcon-gen generates command stubs from Redis JSON command specs.
+//
+// Redis describes each command in a JSON file, such as commands/get.json in
+// the Redis source tree. For each command, redcon-gen emits an argument
+// struct, a function that parses a redcon.Command into the struct, a
+// redcon.CommandSpec, a handler interface and, when possible, a typed reply
+// helper. A RegisterCommands function registers the commands that are
+// implemented by a handler with a redcon.ServeMux.
+//
+// Usage:
+//
+//	//go:generate go run github.com/tidwall/redcon/cmd/redcon-gen -pkg main -o commands.go specs/*.json
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	pkg := flag.String("pkg", "main", "package name of the generated file")
+	out := flag.String("o", "", "output file (default stdout)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: redcon-gen [flags] file.json ...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var paths []string
+	for _, arg := range flag.Args() {
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			fatal(err)
+		}
+		paths = append(paths, matches...)
+	}
+	var cmds []*command
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			fatal(err)
+		}
+		more, err := parseCommands(data)
+		if err != nil {
+			fatal(fmt.Errorf("%s: %v", path, err))
+		}
+		cmds = append(cmds, more...)
+	}
+	src, err := generate(*pkg, cmds)
+	if err != nil {
+		fatal(err)
+	}
+	if *out == "" {
+		os.Stdout.Write(src)
+		return
+	}
+	if err := ioutil.WriteFile(*out, src, 0666); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "redcon-gen: %v\n", err)
+	os.Exit(1)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// command is a Redis command, as described by a commands/*.json file.
+type command struct {
+	Name          string      `json:"-"`
+	Summary       string      `json:"summary"`
+	Group         string      `json:"group"`
+	Since         string      `json:"since"`
+	Arity         int         `json:"arity"`
+	Container     string      `json:"container"`
+	Flags         []string    `json:"command_flags"`
+	ACLCategories []string    `json:"acl_categories"`
+	KeySpecs      []keySpec   `json:"key_specs"`
+	ReplySchema   *schema     `json:"reply_schema"`
+	Arguments     []*argument `json:"arguments"`
+
+	containerOf bool // has subcommands
+}
+
+type argument struct {
+	Name          string      `json:"name"`
+	Type          string      `json:"type"`
+	Token         string      `json:"token"`
+	Optional      bool        `json:"optional"`
+	Multiple      bool        `json:"multiple"`
+	MultipleToken bool        `json:"multiple_token"`
+	Arguments     []*argument `json:"arguments"`
+
+	// Set while generating
+	field   string // Go field name, empty for flattened oneof arguments
+	typ     string // Go field type
+	elem    string // Go element type
+	flatten bool   // oneof children are fields of the parent struct
+	pointer bool   // optional scalar or block, using a pointer
+}
+
+type keySpec struct {
+	BeginSearch struct {
+		Index *struct {
+			Pos int `json:"pos"`
+		} `json:"index"`
+		Keyword *struct {
+			Keyword   string `json:"keyword"`
+			StartFrom int    `json:"startfrom"`
+		} `json:"keyword"`
+	} `json:"begin_search"`
+	FindKeys struct {
+		Range *struct {
+			LastKey int `json:"lastkey"`
+			Step    int `json:"step"`
+			Limit   int `json:"limit"`
+		} `json:"range"`
+		KeyNum *struct {
+			KeyNumIdx int `json:"keynumidx"`
+			FirstKey  int `json:"firstkey"`
+			Step      int `json:"step"`
+		} `json:"keynum"`
+	} `json:"find_keys"`
+}
+
+type schema struct {
+	Description string      `json:"description"`
+	Type        string      `json:"type"`
+	Const       interface{} `json:"const"`
+	OneOf       []*schema   `json:"oneOf"`
+	AnyOf       []*schema   `json:"anyOf"`
+}
+
+// parseCommands parses a JSON command file, which is an object with one or
+// more commands keyed by name.
+func parseCommands(data []byte) ([]*command, error) {
+	var m map[string]*command
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	var cmds []*command
+	for name, cmd := range m {
+		cmd.Name = name
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool {
+		return cmds[i].fullName() < cmds[j].fullName()
+	})
+	return cmds, nil
+}
+
+// fullName returns the command name, such as "GET" or "CONFIG GET".
+func (cmd *command) fullName() string {
+	if cmd.Container != "" {
+		return cmd.Container + " " + cmd.Name
+	}
+	return cmd.Name
+}
+
+// specName returns the redcon.CommandSpec name, such as "get" or
+// "config|get".
+func (cmd *command) specName() string {
+	if cmd.Container != "" {
+		return strings.ToLower(cmd.Container + "|" + cmd.Name)
+	}
+	return strings.ToLower(cmd.Name)
+}
+
+// goName returns the Go name for the command, such as "Get" or
+// "ConfigGet".
+func (cmd *command) goName() string {
+	return goIdent(cmd.Container) + goIdent(cmd.Name)
+}
+
+// flags returns the lowercase command flags.
+func (cmd *command) flags() []string {
+	var flags []string
+	for _, flag := range cmd.Flags {
+		flags = append(flags, strings.ToLower(flag))
+	}
+	return flags
+}
+
+// categories returns the lowercase ACL categories, including the implicit
+// categories that Redis derives from the command flags.
+func (cmd *command) categories() []string {
+	var cats []string
+	add := func(cat string) {
+		cat = strings.ToLower(cat)
+		for _, c := range cats {
+			if c == cat {
+				return
+			}
+		}
+		cats = append(cats, cat)
+	}
+	for _, cat := range cmd.ACLCategories {
+		add(cat)
+	}
+	flags := cmd.flags()
+	has := func(flag string) bool {
+		for _, f := range flags {
+			if f == flag {
+				return true
+			}
+		}
+		return false
+	}
+	if has("write") {
+		add("write")
+	}
+	if has("readonly") {
+		scripting := false
+		for _, c := range cats {
+			if c == "scripting" {
+				scripting = true
+			}
+		}
+		if !scripting {
+			add("read")
+		}
+	}
+	if has("admin") {
+		add("admin")
+		add("dangerous")
+	}
+	if has("pubsub") {
+		add("pubsub")
+	}
+	if has("fast") {
+		add("fast")
+	}
+	if has("blocking") {
+		add("blocking")
+	}
+	if !has("fast") {
+		add("slow")
+	}
+	return cats
+}
+
+// goIdent converts a Redis name, such as "unix-time-seconds" or "NO-EVICT",
+// into an exported Go identifier.
+func goIdent(name string) string {
+	var b strings.Builder
+	upper := true
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z':
+			if upper {
+				c -= 'a' - 'A'
+			}
+			upper = false
+		case c >= 'A' && c <= 'Z':
+			if !upper {
+				c += 'a' - 'A'
+			}
+			upper = false
+		case c >= '0' && c <= '9':
+			if b.Len() == 0 {
+				b.WriteByte('N')
+			}
+			upper = true
+		default:
+			upper = true
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
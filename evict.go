@@ -0,0 +1,448 @@
+package redcon
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EvictionPolicy is a policy for evicting keys when the memory usage of a
+// keyspace exceeds the maximum, which matches the maxmemory-policy of
+// Redis.
+type EvictionPolicy int
+
+// Eviction policies. The allkeys policies evict any key, and the volatile
+// policies only evict keys with an expiration.
+const (
+	NoEviction     EvictionPolicy = iota // reply -OOM to write commands
+	AllKeysLRU                           // least recently used keys
+	AllKeysLFU                           // least frequently used keys
+	AllKeysRandom                        // random keys
+	VolatileLRU                          // least recently used keys
+	VolatileLFU                          // least frequently used keys
+	VolatileRandom                       // random keys
+	VolatileTTL                          // keys with the shortest TTL
+)
+
+var evictionPolicyNames = []string{
+	"noeviction", "allkeys-lru", "allkeys-lfu", "allkeys-random",
+	"volatile-lru", "volatile-lfu", "volatile-random", "volatile-ttl",
+}
+
+// String returns the name of the policy, such as "allkeys-lru".
+func (p EvictionPolicy) String() string {
+	if p < 0 || int(p) >= len(evictionPolicyNames) {
+		return "unknown"
+	}
+	return evictionPolicyNames[p]
+}
+
+// ParseEvictionPolicy returns the policy of a name, such as "allkeys-lru".
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	for i, s := range evictionPolicyNames {
+		if strings.EqualFold(name, s) {
+			return EvictionPolicy(i), nil
+		}
+	}
+	return 0, errors.New("redcon: invalid eviction policy")
+}
+
+const (
+	evictSamples   = 5  // the keys that are sampled for each eviction
+	evictPoolSize  = 16 // the best candidates that are kept between samples
+	lfuInitVal     = 5  // the counter of a new key
+	lfuLogFactor   = 10
+	lfuDecayPeriod = time.Minute
+)
+
+const errOOM = "OOM command not allowed when used memory > 'maxmemory'."
+
+// Evictor is a Handler that bounds the memory usage of a Keyspace. Before
+// each command, keys are evicted by the policy while the used memory
+// exceeds the maximum, and commands with the "denyoom" flag are replied to
+// with an OOM error when not enough memory could be freed, such as with
+// the NoEviction policy. The flags are those of the specs on the handler,
+// which must be a *ServeMux for OOM errors. Read commands and commands that
+// free memory, such as DEL, are always passed to the handler.
+//
+// The LRU and LFU policies are approximated like Redis does, by sampling
+// keys and evicting the best candidate of a pool, which requires handlers
+// to call Touch for each key that a command reads or writes, including new
+// keys, and Remove for each key that is deleted. The volatile policies
+// sample the keys of the Expirer that is set with SetExpirer.
+//
+//	ev := redcon.NewEvictor(mux, ks, &mu, ks.MemoryUsage)
+//	ev.SetMaxMemory(100 << 20)
+//	ev.SetPolicy(redcon.AllKeysLRU)
+//	redcon.ListenAndServe(":6379", ev.ServeRESP, nil, nil)
+type Evictor struct {
+	handler Handler
+	ks      Keyspace
+	locker  sync.Locker
+	used    func() int64
+	now     func() time.Time
+
+	mu        sync.Mutex
+	maxmemory int64
+	policy    EvictionPolicy
+	exp       *Expirer
+	keys      []string // the tracked keys, for sampling
+	index     map[string]*evictKey
+	pool      []evictCandidate // ordered by score
+	notifier  *Notifier
+	db        int
+	evicted   int64
+}
+
+// evictKey is the access information of a key.
+type evictKey struct {
+	i       int   // the index of the key in keys
+	access  int64 // unix milliseconds of the last access
+	counter uint8 // the logarithmic access counter of LFU
+	decay   int64 // unix minutes that the counter was last decremented
+}
+
+// evictCandidate is a key in the eviction pool, where the best candidate
+// has the highest score.
+type evictCandidate struct {
+	key   string
+	score int64
+}
+
+// NewEvictor returns an Evictor that passes commands to handler. The used
+// function returns the memory usage of the keyspace in bytes, and is called
+// while holding the locker, which is the lock of the keyspace. The locker
+// may be nil when the keyspace is not used concurrently.
+func NewEvictor(handler Handler, ks Keyspace, locker sync.Locker,
+	used func() int64,
+) *Evictor {
+	if handler == nil {
+		panic("redcon: nil handler")
+	}
+	if ks == nil {
+		panic("redcon: nil keyspace")
+	}
+	if used == nil {
+		panic("redcon: nil memory usage")
+	}
+	return &Evictor{
+		handler: handler,
+		ks:      ks,
+		locker:  locker,
+		used:    used,
+		now:     time.Now,
+		index:   make(map[string]*evictKey),
+	}
+}
+
+// SetClock sets the function that returns the current time, which is
+// time.Now by default, such as for a simulated clock in tests. It must be
+// called before the Evictor is used.
+func (ev *Evictor) SetClock(now func() time.Time) {
+	ev.now = now
+}
+
+// SetMaxMemory sets the maximum memory usage in bytes. Zero is unlimited,
+// which is the default.
+func (ev *Evictor) SetMaxMemory(maxmemory int64) {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	ev.maxmemory = maxmemory
+}
+
+// MaxMemory returns the maximum memory usage in bytes.
+func (ev *Evictor) MaxMemory() int64 {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	return ev.maxmemory
+}
+
+// SetPolicy sets the eviction policy, which is NoEviction by default.
+func (ev *Evictor) SetPolicy(policy EvictionPolicy) {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	if policy != ev.policy {
+		ev.policy = policy
+		ev.pool = nil
+	}
+}
+
+// Policy returns the eviction policy.
+func (ev *Evictor) Policy() EvictionPolicy {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	return ev.policy
+}
+
+// SetExpirer sets the Expirer of the keyspace, which is required by the
+// volatile policies. The expirations of evicted keys are removed.
+func (ev *Evictor) SetExpirer(e *Expirer) {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	ev.exp = e
+}
+
+// SetNotifier sets the Notifier for the "evicted" keyspace notifications,
+// which are published for the database. A nil Notifier disables
+// notifications.
+func (ev *Evictor) SetNotifier(n *Notifier, db int) {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	ev.notifier = n
+	ev.db = db
+}
+
+// Evicted returns the number of keys that were evicted.
+func (ev *Evictor) Evicted() int64 {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	return ev.evicted
+}
+
+// Touch records an access of keys, which are tracked for eviction.
+func (ev *Evictor) Touch(keys ...string) {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	now := ev.now()
+	for _, key := range keys {
+		k, ok := ev.index[key]
+		if !ok {
+			k = &evictKey{i: len(ev.keys), counter: lfuInitVal,
+				decay: now.Unix() / 60}
+			ev.index[key] = k
+			ev.keys = append(ev.keys, key)
+		} else {
+			k.counter = lfuIncr(lfuDecr(k, now))
+			k.decay = now.Unix() / 60
+		}
+		k.access = now.UnixNano() / int64(time.Millisecond)
+	}
+}
+
+// lfuDecr returns the counter of a key, which is decremented for each
+// decay period since it was last decremented.
+func lfuDecr(k *evictKey, now time.Time) uint8 {
+	periods := (now.Unix()/60 - k.decay) /
+		int64(lfuDecayPeriod/time.Minute)
+	if periods >= int64(k.counter) {
+		return 0
+	}
+	if periods > 0 {
+		return k.counter - uint8(periods)
+	}
+	return k.counter
+}
+
+// lfuIncr returns a logarithmically incremented counter, where a counter
+// is less likely to be incremented the higher it is.
+func lfuIncr(counter uint8) uint8 {
+	if counter == math.MaxUint8 {
+		return counter
+	}
+	base := float64(counter) - lfuInitVal
+	if base < 0 {
+		base = 0
+	}
+	if rand.Float64() < 1/(base*lfuLogFactor+1) {
+		counter++
+	}
+	return counter
+}
+
+// Remove stops tracking keys, which is used when keys are deleted.
+func (ev *Evictor) Remove(keys ...string) {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	for _, key := range keys {
+		ev.remove(key)
+	}
+}
+
+// remove stops tracking a key. The caller must hold the lock.
+func (ev *Evictor) remove(key string) {
+	k, ok := ev.index[key]
+	if !ok {
+		return
+	}
+	last := len(ev.keys) - 1
+	if k.i != last {
+		ev.keys[k.i] = ev.keys[last]
+		ev.index[ev.keys[k.i]].i = k.i
+	}
+	ev.keys[last] = ""
+	ev.keys = ev.keys[:last]
+	delete(ev.index, key)
+}
+
+// Clear stops tracking all keys, which is used when all keys are deleted.
+func (ev *Evictor) Clear() {
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	ev.keys = nil
+	ev.index = make(map[string]*evictKey)
+	ev.pool = nil
+}
+
+// Evict evicts keys while the used memory exceeds the maximum, and returns
+// false when not enough memory could be freed.
+func (ev *Evictor) Evict() bool {
+	ev.mu.Lock()
+	maxmemory := ev.maxmemory
+	ev.mu.Unlock()
+	if maxmemory <= 0 {
+		return true
+	}
+	if ev.locker != nil {
+		ev.locker.Lock()
+		defer ev.locker.Unlock()
+	}
+	for ev.used() > maxmemory {
+		key, ok := ev.candidate()
+		if !ok {
+			return false
+		}
+		exists := ev.ks.Exists(key)
+		ev.mu.Lock()
+		exp, n, db := ev.exp, ev.notifier, ev.db
+		if exists {
+			ev.evicted++
+		}
+		ev.mu.Unlock()
+		if exp != nil {
+			// a key that does not exist may have a stale expiration, which
+			// would be sampled again
+			exp.Remove(key)
+		}
+		if !exists {
+			continue
+		}
+		ev.ks.Delete(key)
+		if n != nil {
+			n.Notify(db, "evicted", key, NotifyEvicted)
+		}
+	}
+	return true
+}
+
+// candidate removes the best candidate for eviction from the tracked keys,
+// and returns false when there is none. The caller must hold the locker.
+func (ev *Evictor) candidate() (string, bool) {
+	ev.mu.Lock()
+	policy, exp := ev.policy, ev.exp
+	ev.mu.Unlock()
+	volatile := policy >= VolatileLRU
+	if policy == NoEviction || (volatile && exp == nil) {
+		return "", false
+	}
+	// the Expirer is sampled without holding the lock, which avoids lock
+	// ordering issues with Keyspace.Delete
+	var samples []expiry
+	if volatile {
+		n := evictSamples
+		if policy == VolatileRandom {
+			n = 1
+		}
+		if samples = exp.sample(n); len(samples) == 0 {
+			return "", false
+		}
+	}
+	ev.mu.Lock()
+	defer ev.mu.Unlock()
+	switch policy {
+	case AllKeysRandom:
+		if len(ev.keys) == 0 {
+			return "", false
+		}
+		key := ev.keys[rand.Intn(len(ev.keys))]
+		ev.remove(key)
+		return key, true
+	case VolatileRandom:
+		ev.remove(samples[0].key)
+		return samples[0].key, true
+	}
+	if !volatile {
+		if len(ev.keys) == 0 && len(ev.pool) == 0 {
+			return "", false
+		}
+		for i := 0; i < evictSamples && len(ev.keys) > 0; i++ {
+			key := ev.keys[rand.Intn(len(ev.keys))]
+			samples = append(samples, expiry{key: key})
+		}
+	}
+	now := ev.now()
+	for _, x := range samples {
+		var score int64
+		k := ev.index[x.key]
+		switch {
+		case policy == VolatileTTL:
+			score = math.MaxInt64 - x.at
+		case k == nil:
+			// an untracked key has never been accessed
+			score = math.MaxInt64
+		case policy == AllKeysLFU || policy == VolatileLFU:
+			score = math.MaxUint8 - int64(lfuDecr(k, now))
+		default:
+			score = now.UnixNano()/int64(time.Millisecond) - k.access
+		}
+		ev.addCandidate(x.key, score)
+	}
+	if len(ev.pool) == 0 {
+		return "", false
+	}
+	best := ev.pool[len(ev.pool)-1]
+	ev.pool = ev.pool[:len(ev.pool)-1]
+	ev.remove(best.key)
+	return best.key, true
+}
+
+// addCandidate adds a key to the eviction pool, which keeps the best
+// candidates. The caller must hold the lock.
+func (ev *Evictor) addCandidate(key string, score int64) {
+	for i, c := range ev.pool {
+		if c.key == key {
+			ev.pool = append(ev.pool[:i], ev.pool[i+1:]...)
+			break
+		}
+	}
+	i := sort.Search(len(ev.pool), func(i int) bool {
+		return ev.pool[i].score > score
+	})
+	if len(ev.pool) == evictPoolSize {
+		if i == 0 {
+			return
+		}
+		// drop the worst candidate
+		copy(ev.pool, ev.pool[1:i])
+		ev.pool[i-1] = evictCandidate{key, score}
+		return
+	}
+	ev.pool = append(ev.pool, evictCandidate{})
+	copy(ev.pool[i+1:], ev.pool[i:])
+	ev.pool[i] = evictCandidate{key, score}
+}
+
+// ServeRESP evicts keys when the used memory exceeds the maximum, and
+// passes the command to the handler, unless the command has the "denyoom"
+// flag and not enough memory could be freed.
+func (ev *Evictor) ServeRESP(conn Conn, cmd Command) {
+	if !ev.Evict() && ev.denyOOM(cmd) {
+		conn.WriteError(errOOM)
+		return
+	}
+	ev.handler.ServeRESP(conn, cmd)
+}
+
+// denyOOM returns true when a command may not run when the used memory
+// exceeds the maximum.
+func (ev *Evictor) denyOOM(cmd Command) bool {
+	mux, ok := ev.handler.(*ServeMux)
+	if !ok {
+		return false
+	}
+	spec, ok := mux.Command(string(cmd.Args[0]))
+	return ok && spec.HasFlag("denyoom")
+}
@@ -0,0 +1,183 @@
+package redcon
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvictionPolicy(t *testing.T) {
+	for p := NoEviction; p <= VolatileTTL; p++ {
+		res, err := ParseEvictionPolicy(strings.ToUpper(p.String()))
+		if err != nil || res != p {
+			t.Fatalf("expected '%v', got '%v' %v", p, res, err)
+		}
+	}
+	if _, err := ParseEvictionPolicy("allkeys-fifo"); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func TestEvictor(t *testing.T) {
+	ks := &testKeyspace{keys: make(map[string]bool)}
+	mux := NewServeMux()
+	mux.HandleCommand(CommandSpec{Name: "set", Arity: 2,
+		Flags: []string{"write", "denyoom"}}, HandlerFunc(
+		func(conn Conn, cmd Command) {
+			ks.keys[string(cmd.Args[1])] = true
+			conn.WriteString("OK")
+		}))
+	mux.HandleCommand(CommandSpec{Name: "del", Arity: 2,
+		Flags: []string{"write"}}, HandlerFunc(
+		func(conn Conn, cmd Command) {
+			delete(ks.keys, string(cmd.Args[1]))
+			conn.WriteInt(1)
+		}))
+	ev := NewEvictor(mux, ks, &ks.mu, func() int64 {
+		return int64(len(ks.keys))
+	})
+	var ps PubSub
+	n, _ := NewNotifier(&ps, "KEA")
+	ev.SetNotifier(n, 0)
+	sub := ps.NewSubscriber(nil)
+	defer sub.Close()
+	sub.Subscribe("__keyevent@0__:evicted")
+
+	var buf bytes.Buffer
+	c := &conn{wr: NewWriter(&buf)}
+	for _, test := range [][2]string{
+		{"SET a", "+OK"},
+		{"SET b", "+OK"},
+		{"MAXMEMORY 1", ""},
+		{"SET c", "-" + errOOM},
+		{"DEL a", ":1"},
+		{"SET c", "+OK"},
+		{"POLICY allkeys-random", ""},
+		{"SET d", "+OK"},
+	} {
+		args := strings.Split(test[0], " ")
+		switch args[0] {
+		case "MAXMEMORY":
+			var n int64
+			fmt.Sscan(args[1], &n)
+			ev.SetMaxMemory(n)
+			continue
+		case "POLICY":
+			p, _ := ParseEvictionPolicy(args[1])
+			ev.SetPolicy(p)
+			continue
+		}
+		ev.Touch(args[1])
+		res := strings.TrimSuffix(testHandlerDo(ev, c, &buf, args...), "\r\n")
+		if res != test[1] {
+			t.Fatalf("%v: expected '%v', got '%v'", args, test[1], res)
+		}
+	}
+	if len(ks.keys) != 2 || !ks.keys["d"] || ev.Evicted() != 1 {
+		t.Fatalf("unexpected keys %v %v", ks.keys, ev.Evicted())
+	}
+	select {
+	case msg := <-sub.C:
+		if key := string(msg.Message); key != "b" && key != "c" {
+			t.Fatalf("unexpected evicted key '%v'", key)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out")
+	}
+}
+
+func testEvictor(policy EvictionPolicy, n int) (*Evictor, *testKeyspace,
+	*time.Time,
+) {
+	ks := &testKeyspace{keys: make(map[string]bool)}
+	ev := NewEvictor(NewServeMux(), ks, &ks.mu, func() int64 {
+		return int64(len(ks.keys))
+	})
+	t0 := time.Unix(1000, 0)
+	ev.SetClock(func() time.Time { return t0 })
+	ev.SetPolicy(policy)
+	for i := 0; i < n; i++ {
+		key := fmt.Sprint(i)
+		ks.keys[key] = true
+		ev.Touch(key)
+		t0 = t0.Add(time.Second)
+	}
+	return ev, ks, &t0
+}
+
+func TestEvictorLRU(t *testing.T) {
+	ev, ks, _ := testEvictor(AllKeysLRU, 100)
+	ev.Touch("0")
+	ev.SetMaxMemory(50)
+	if !ev.Evict() || len(ks.keys) != 50 || ev.Evicted() != 50 {
+		t.Fatalf("unexpected eviction %v %v", len(ks.keys), ev.Evicted())
+	}
+	// the most recently used keys are not evicted
+	if !ks.keys["0"] || !ks.keys["99"] {
+		t.Fatalf("expected recently used keys, got %v", ks.keys)
+	}
+	ev.Remove("0")
+	ev.SetMaxMemory(1)
+	if !ev.Evict() || !ks.keys["0"] {
+		t.Fatalf("expected an untracked key, got %v", ks.keys)
+	}
+	delete(ks.keys, "0")
+	ev.SetMaxMemory(-1)
+	if !ev.Evict() {
+		t.Fatal("expected no eviction")
+	}
+}
+
+func TestEvictorLFU(t *testing.T) {
+	ev, ks, t0 := testEvictor(AllKeysLFU, 100)
+	for i := 0; i < 1000; i++ {
+		ev.Touch("50")
+	}
+	if c := ev.index["50"].counter; c <= lfuInitVal {
+		t.Fatalf("expected a counter above '%v', got '%v'", lfuInitVal, c)
+	}
+	ev.SetMaxMemory(10)
+	if !ev.Evict() || !ks.keys["50"] {
+		t.Fatalf("expected a frequently used key, got %v", ks.keys)
+	}
+	// counters decay over time
+	*t0 = t0.Add(time.Hour * 5)
+	if c := lfuDecr(ev.index["50"], *t0); c != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, c)
+	}
+}
+
+func TestEvictorVolatile(t *testing.T) {
+	for _, policy := range []EvictionPolicy{VolatileLRU, VolatileLFU,
+		VolatileRandom, VolatileTTL} {
+		ev, ks, t0 := testEvictor(policy, 10)
+		e := NewExpirer(ks, &ks.mu)
+		e.SetClock(func() time.Time { return *t0 })
+		ev.SetMaxMemory(5)
+		if ev.Evict() || len(ks.keys) != 10 {
+			t.Fatalf("%v: expected no expirer", policy)
+		}
+		ev.SetExpirer(e)
+		for i := 0; i < 5; i++ {
+			e.ExpireAt(fmt.Sprint(i), t0.Add(time.Minute), ExpireAlways)
+		}
+		ev.SetMaxMemory(7)
+		if !ev.Evict() || len(ks.keys) != 7 || e.Len() != 2 {
+			t.Fatalf("%v: unexpected eviction %v %v", policy, ks.keys,
+				e.Len())
+		}
+		// keys without an expiration are not evicted
+		ev.SetMaxMemory(1)
+		if ev.Evict() || len(ks.keys) != 5 || e.Len() != 0 {
+			t.Fatalf("%v: unexpected eviction %v %v", policy, ks.keys,
+				e.Len())
+		}
+		for i := 5; i < 10; i++ {
+			if !ks.keys[fmt.Sprint(i)] {
+				t.Fatalf("%v: expected key '%v'", policy, i)
+			}
+		}
+	}
+}
@@ -28,7 +28,7 @@ func main() {
 					conn.WriteError("ERR wrong number of arguments for '" + string(cmd.Args[0]) + "' command")
 					return
 				}
-				count := ps.Publish(string(cmd.Args[1]), string(cmd.Args[2]))
+				count := ps.PublishBytes(cmd.Args[1], cmd.Args[2])
 				conn.WriteInt(count)
 			case "subscribe", "psubscribe":
 				// Subscribe to a pub/sub channel. The `Psubscribe` and
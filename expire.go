@@ -0,0 +1,519 @@
+package redcon
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Keyspace is a store of keys, which is used by an Expirer. The methods are
+// called while the locker of the Expirer is held, and must not call the
+// Expirer.
+type Keyspace interface {
+	// Exists returns true when the key exists.
+	Exists(key string) bool
+	// Delete deletes a key that expired.
+	Delete(key string)
+}
+
+// ExpireCondition is a condition for setting an expiration, which matches
+// the NX, XX, GT and LT options of EXPIRE.
+type ExpireCondition int
+
+const (
+	// ExpireAlways always sets the expiration.
+	ExpireAlways ExpireCondition = iota
+	// ExpireNX sets the expiration when the key has no expiration.
+	ExpireNX
+	// ExpireXX sets the expiration when the key has an expiration.
+	ExpireXX
+	// ExpireGT sets the expiration when it's greater than the current one.
+	// A key without an expiration has an infinite TTL.
+	ExpireGT
+	// ExpireLT sets the expiration when it's less than the current one.
+	ExpireLT
+)
+
+const (
+	expireSamples     = 20 // the keys that are sampled per iteration
+	expireAcceptable  = 5  // an iteration repeats when more keys expired
+	expireDefaultHz   = time.Second / 10
+	expireTimePercent = 25 // the time limit of a cycle, of the interval
+)
+
+// Expirer is an index of key expirations, which implements the EXPIRE,
+// TTL and PERSIST family of commands for a Keyspace.
+//
+// Keys expire lazily when handlers call Check before accessing a key, and
+// actively by a background cycle, which samples keys with an expiration
+// like Redis does. In both cases the key is deleted from the Keyspace and
+// an "expired" keyspace notification is published.
+//
+//	exp := redcon.NewExpirer(ks, &mu)
+//	exp.Start(time.Second / 10)
+//	defer exp.Close()
+//	exp.Register(mux)
+//
+// Handlers that delete or overwrite a key call Remove, such as DEL or SET
+// without KEEPTTL, and handlers that rename a key call Rename.
+type Expirer struct {
+	ks     Keyspace
+	locker sync.Locker
+	now    func() time.Time
+
+	mu       sync.Mutex
+	expires  []expiry       // the keys with an expiration, for sampling
+	index    map[string]int // the index of a key in expires
+	notifier *Notifier
+	db       int
+	limit    time.Duration // the time limit of an active expire cycle
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+type expiry struct {
+	key string
+	at  int64 // unix milliseconds
+}
+
+// unixMilli returns the unix milliseconds of a time, which, unlike unix
+// nanoseconds, covers all of the times of EXPIREAT.
+func unixMilli(t time.Time) int64 {
+	return t.Unix()*1000 + int64(t.Nanosecond())/int64(time.Millisecond)
+}
+
+// fromUnixMilli returns the time of unix milliseconds.
+func fromUnixMilli(ms int64) time.Time {
+	return time.Unix(ms/1000, ms%1000*int64(time.Millisecond))
+}
+
+// NewExpirer returns an Expirer for the keyspace. The locker is the lock of
+// the keyspace, which is held by the handlers that call the Expirer, and
+// by the Expirer when it deletes a key that actively expires. The locker
+// may be nil when the keyspace is not used concurrently.
+func NewExpirer(ks Keyspace, locker sync.Locker) *Expirer {
+	if ks == nil {
+		panic("redcon: nil keyspace")
+	}
+	return &Expirer{
+		ks:     ks,
+		locker: locker,
+		now:    time.Now,
+		index:  make(map[string]int),
+		limit:  expireDefaultHz * expireTimePercent / 100,
+	}
+}
+
+// SetNotifier sets the Notifier for the keyspace notifications, which are
+// published for the database. A nil Notifier disables notifications.
+func (e *Expirer) SetNotifier(n *Notifier, db int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.notifier = n
+	e.db = db
+}
+
+// SetClock sets the function that returns the current time, which is
+// time.Now by default, such as for a simulated clock in tests. It must be
+// called before the Expirer is used.
+func (e *Expirer) SetClock(now func() time.Time) {
+	e.now = now
+}
+
+func (e *Expirer) notify(event, key string, class NotifyClass) {
+	if e.notifier != nil {
+		e.notifier.Notify(e.db, event, key, class)
+	}
+}
+
+// set sets the expiration of a key. The caller must hold the lock.
+func (e *Expirer) set(key string, at int64) {
+	if i, ok := e.index[key]; ok {
+		e.expires[i].at = at
+		return
+	}
+	e.index[key] = len(e.expires)
+	e.expires = append(e.expires, expiry{key, at})
+}
+
+// remove removes the expiration of a key, and returns false when there is
+// none. The caller must hold the lock.
+func (e *Expirer) remove(key string) bool {
+	i, ok := e.index[key]
+	if !ok {
+		return false
+	}
+	last := len(e.expires) - 1
+	if i != last {
+		e.expires[i] = e.expires[last]
+		e.index[e.expires[i].key] = i
+	}
+	e.expires[last] = expiry{}
+	e.expires = e.expires[:last]
+	delete(e.index, key)
+	return true
+}
+
+// expire deletes a key that expired. The caller must hold the lock.
+func (e *Expirer) expire(key string) {
+	e.remove(key)
+	e.ks.Delete(key)
+	e.notify("expired", key, NotifyExpired)
+}
+
+// ExpireAt sets the time that a key expires at, when the key exists and
+// the condition is met, and returns false otherwise. A key is deleted when
+// the time is not in the future, which publishes a "del" notification
+// instead of "expire".
+func (e *Expirer) ExpireAt(key string, at time.Time, cond ExpireCondition,
+) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.checkLocked(key) || !e.ks.Exists(key) {
+		return false
+	}
+	t := unixMilli(at)
+	var ok bool
+	i, exists := e.index[key]
+	switch cond {
+	case ExpireNX:
+		ok = !exists
+	case ExpireXX:
+		ok = exists
+	case ExpireGT:
+		ok = exists && t > e.expires[i].at
+	case ExpireLT:
+		ok = !exists || t < e.expires[i].at
+	default:
+		ok = true
+	}
+	if !ok {
+		return false
+	}
+	if t <= unixMilli(e.now()) {
+		e.remove(key)
+		e.ks.Delete(key)
+		e.notify("del", key, NotifyGeneric)
+	} else {
+		e.set(key, t)
+		e.notify("expire", key, NotifyGeneric)
+	}
+	return true
+}
+
+// Persist removes the expiration of a key, and returns false when the key
+// has no expiration.
+func (e *Expirer) Persist(key string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.checkLocked(key) || !e.remove(key) {
+		return false
+	}
+	e.notify("persist", key, NotifyGeneric)
+	return true
+}
+
+// Remove removes the expiration of a key without a notification, which
+// is used when a key is deleted or overwritten.
+func (e *Expirer) Remove(key string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.remove(key)
+}
+
+// Rename moves the expiration of a key to the new key, which replaces the
+// expiration of the new key.
+func (e *Expirer) Rename(key, newKey string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	i, ok := e.index[key]
+	if !ok {
+		e.remove(newKey)
+		return
+	}
+	at := e.expires[i].at
+	e.remove(key)
+	e.set(newKey, at)
+}
+
+// Clear removes all expirations, which is used when all keys are deleted.
+func (e *Expirer) Clear() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.expires = nil
+	e.index = make(map[string]int)
+}
+
+// ExpiresAt returns the time that a key expires at, and false when it has
+// no expiration.
+func (e *Expirer) ExpiresAt(key string) (time.Time, bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	i, ok := e.index[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	return fromUnixMilli(e.expires[i].at), true
+}
+
+// TTL returns the remaining time to live of a key, and false when it has no
+// expiration.
+func (e *Expirer) TTL(key string) (time.Duration, bool) {
+	at, ok := e.ExpiresAt(key)
+	if !ok {
+		return 0, false
+	}
+	return at.Sub(e.now()), true
+}
+
+// Len returns the number of keys with an expiration.
+func (e *Expirer) Len() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.expires)
+}
+
+// Check deletes a key when it expired, and returns true. Handlers call
+// Check before accessing a key, which is lazy expiry.
+func (e *Expirer) Check(key string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.checkLocked(key)
+}
+
+func (e *Expirer) checkLocked(key string) bool {
+	i, ok := e.index[key]
+	if !ok || e.expires[i].at > unixMilli(e.now()) {
+		return false
+	}
+	e.expire(key)
+	return true
+}
+
+// ActiveExpire runs an active expire cycle, and returns the number of keys
+// that expired. Each iteration of the cycle samples keys with an
+// expiration, and deletes those that expired. The cycle repeats while more
+// than a quarter of the sampled keys expired, up to a time limit.
+func (e *Expirer) ActiveExpire() int {
+	start := time.Now()
+	e.mu.Lock()
+	limit := e.limit
+	e.mu.Unlock()
+	var n int
+	for {
+		expired, sampled := e.activeExpire()
+		n += expired
+		if sampled == 0 || expired <= expireAcceptable ||
+			time.Since(start) > limit {
+			return n
+		}
+	}
+}
+
+// activeExpire runs an iteration of an active expire cycle, and returns the
+// number of keys that expired and were sampled.
+func (e *Expirer) activeExpire() (expired, sampled int) {
+	if e.locker != nil {
+		e.locker.Lock()
+		defer e.locker.Unlock()
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	t := unixMilli(e.now())
+	for ; sampled < expireSamples && len(e.expires) > 0; sampled++ {
+		x := e.expires[rand.Intn(len(e.expires))]
+		if x.at <= t {
+			e.expire(x.key)
+			expired++
+		}
+	}
+	return expired, sampled
+}
+
+// sample returns up to n random keys with an expiration, which is used by
+// the volatile policies of an Evictor.
+func (e *Expirer) sample(n int) []expiry {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if n > len(e.expires) {
+		n = len(e.expires)
+	}
+	samples := make([]expiry, n)
+	for i := range samples {
+		samples[i] = e.expires[rand.Intn(len(e.expires))]
+	}
+	return samples
+}
+
+// Start starts the active expire cycle, which runs at each interval in a
+// background goroutine until Close is called. A zero interval is 100ms,
+// which is the default hz of 10 of Redis.
+func (e *Expirer) Start(interval time.Duration) {
+	if interval <= 0 {
+		interval = expireDefaultHz
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.done != nil {
+		return
+	}
+	e.limit = interval * expireTimePercent / 100
+	e.done = make(chan struct{})
+	e.stopped = make(chan struct{})
+	go func(done, stopped chan struct{}) {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				e.ActiveExpire()
+			case <-done:
+				return
+			}
+		}
+	}(e.done, e.stopped)
+}
+
+// Close stops the active expire cycle, and waits for it to finish. It must
+// not be called while holding the locker.
+func (e *Expirer) Close() error {
+	e.mu.Lock()
+	done, stopped := e.done, e.stopped
+	e.done, e.stopped = nil, nil
+	e.mu.Unlock()
+	if done != nil {
+		close(done)
+		<-stopped
+	}
+	return nil
+}
+
+// Register registers the EXPIRE, PEXPIRE, EXPIREAT, PEXPIREAT, TTL, PTTL,
+// EXPIRETIME, PEXPIRETIME and PERSIST commands on the mux. The handlers
+// hold the locker.
+func (e *Expirer) Register(mux *ServeMux) {
+	spec := func(name string, arity int, flags ...string) CommandSpec {
+		categories := []string{"keyspace", "fast"}
+		if flags[0] == "write" {
+			categories = append(categories, "write")
+		} else {
+			categories = append(categories, "read")
+		}
+		return CommandSpec{Name: name, Arity: arity, Flags: flags,
+			Categories: categories, FirstKey: 1, LastKey: 1, Step: 1}
+	}
+	for _, name := range []string{"expire", "pexpire", "expireat",
+		"pexpireat"} {
+		mux.HandleCommand(spec(name, -3, "write", "fast"),
+			HandlerFunc(e.serveExpire))
+	}
+	for _, name := range []string{"ttl", "pttl", "expiretime",
+		"pexpiretime"} {
+		mux.HandleCommand(spec(name, 2, "readonly", "fast"),
+			HandlerFunc(e.serveTTL))
+	}
+	mux.HandleCommand(spec("persist", 2, "write", "fast"),
+		HandlerFunc(e.servePersist))
+}
+
+func (e *Expirer) lock() func() {
+	if e.locker == nil {
+		return func() {}
+	}
+	e.locker.Lock()
+	return e.locker.Unlock
+}
+
+// ExpireArgs reads the arguments of the EXPIRE, PEXPIRE, EXPIREAT and
+// PEXPIREAT commands, which are "key time [NX|XX|GT|LT]", and returns the
+// key, the time that the key expires at, and the condition.
+func (e *Expirer) ExpireArgs(cmd Command) (string, time.Time,
+	ExpireCondition, error,
+) {
+	name := strings.ToLower(string(cmd.Args[0]))
+	args := NewArgReader(cmd)
+	key := args.String()
+	n := args.Int()
+	cond := ExpireAlways
+	if args.More() {
+		cond = ExpireCondition(args.Enum("NX", "XX", "GT", "LT") + 1)
+	}
+	if err := args.Done(); err != nil {
+		return "", time.Time{}, 0, err
+	}
+	unit := int64(1000)
+	if strings.HasPrefix(name, "p") {
+		unit = 1
+	}
+	var base int64
+	if !strings.HasSuffix(name, "at") {
+		base = unixMilli(e.now())
+	}
+	if n > (math.MaxInt64-base)/unit || n < math.MinInt64/unit {
+		return "", time.Time{}, 0, errors.New("ERR invalid expire time in '" +
+			name + "' command")
+	}
+	return key, fromUnixMilli(base + n*unit), cond, nil
+}
+
+// EXPIRE key seconds [NX|XX|GT|LT]
+// PEXPIRE key milliseconds [NX|XX|GT|LT]
+// EXPIREAT key unix-time-seconds [NX|XX|GT|LT]
+// PEXPIREAT key unix-time-milliseconds [NX|XX|GT|LT]
+func (e *Expirer) serveExpire(conn Conn, cmd Command) {
+	key, at, cond, err := e.ExpireArgs(cmd)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	defer e.lock()()
+	if e.ExpireAt(key, at, cond) {
+		conn.WriteInt(1)
+	} else {
+		conn.WriteInt(0)
+	}
+}
+
+// TTL key
+// PTTL key
+// EXPIRETIME key
+// PEXPIRETIME key
+func (e *Expirer) serveTTL(conn Conn, cmd Command) {
+	name := strings.ToLower(string(cmd.Args[0]))
+	key := string(cmd.Args[1])
+	defer e.lock()()
+	if e.Check(key) || !e.ks.Exists(key) {
+		conn.WriteInt(-2)
+		return
+	}
+	at, ok := e.ExpiresAt(key)
+	if !ok {
+		conn.WriteInt(-1)
+		return
+	}
+	ms := unixMilli(at)
+	switch name {
+	case "ttl":
+		conn.WriteInt64((ms - unixMilli(e.now()) + 500) / 1000)
+	case "pttl":
+		conn.WriteInt64(ms - unixMilli(e.now()))
+	case "expiretime":
+		conn.WriteInt64(ms / 1000)
+	default:
+		conn.WriteInt64(ms)
+	}
+}
+
+// PERSIST key
+func (e *Expirer) servePersist(conn Conn, cmd Command) {
+	defer e.lock()()
+	if e.Persist(string(cmd.Args[1])) {
+		conn.WriteInt(1)
+	} else {
+		conn.WriteInt(0)
+	}
+}
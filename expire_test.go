@@ -0,0 +1,150 @@
+package redcon
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testKeyspace struct {
+	mu   sync.Mutex
+	keys map[string]bool
+}
+
+func (ks *testKeyspace) Exists(key string) bool { return ks.keys[key] }
+func (ks *testKeyspace) Delete(key string)      { delete(ks.keys, key) }
+
+func TestExpirer(t *testing.T) {
+	ks := &testKeyspace{keys: map[string]bool{"a": true, "b": true}}
+	e := NewExpirer(ks, &ks.mu)
+	t0 := time.Unix(1000, 0)
+	e.SetClock(func() time.Time { return t0 })
+	var ps PubSub
+	n, _ := NewNotifier(&ps, "KEA")
+	e.SetNotifier(n, 0)
+	sub := ps.NewSubscriber(nil)
+	defer sub.Close()
+	sub.Psubscribe("__keyevent@0__:*")
+
+	mux := NewServeMux()
+	e.Register(mux)
+	var buf bytes.Buffer
+	c := &conn{wr: NewWriter(&buf)}
+	for _, test := range [][2]string{
+		{"TTL a", ":-1"},
+		{"TTL z", ":-2"},
+		{"EXPIRE z 10", ":0"},
+		{"EXPIRE a 10", ":1"},
+		{"EXPIRE a 20 NX", ":0"},
+		{"EXPIRE a 5 GT", ":0"},
+		{"EXPIRE a 5 LT", ":1"},
+		{"EXPIRE b 5 XX", ":0"},
+		{"EXPIRE b 5 GT", ":0"},
+		{"EXPIRE b 5 LT", ":1"},
+		{"EXPIRE a 5 XY", "-ERR syntax error"},
+		{"EXPIRE a x", "-ERR value is not an integer or out of range"},
+		{"EXPIRE a 9223372036854775807",
+			"-ERR invalid expire time in 'expire' command"},
+		{"TTL a", ":5"},
+		{"PTTL a", ":5000"},
+		{"PEXPIRE a 1500", ":1"},
+		{"TTL a", ":2"},
+		{"PEXPIREAT a 1003000", ":1"},
+		{"EXPIRETIME a", ":1003"},
+		{"PEXPIRETIME a", ":1003000"},
+		{"EXPIREAT b 10000000000", ":1"},
+		{"EXPIRETIME b", ":10000000000"},
+		{"PEXPIRETIME b", ":10000000000000"},
+		{"TTL b", ":9999999000"},
+		{"PERSIST b", ":1"},
+		{"PERSIST b", ":0"},
+		{"TTL b", ":-1"},
+		{"EXPIRE b 0", ":1"},
+		{"TTL b", ":-2"},
+	} {
+		args := strings.Split(test[0], " ")
+		res := strings.TrimSuffix(testHandlerDo(mux, c, &buf, args...), "\r\n")
+		if res != test[1] {
+			t.Fatalf("%v: expected '%v', got '%v'", args, test[1], res)
+		}
+	}
+	if e.Len() != 1 || len(ks.keys) != 1 {
+		t.Fatalf("unexpected lengths %v %v", e.Len(), len(ks.keys))
+	}
+
+	// keys expire lazily
+	if e.Check("a") {
+		t.Fatal("expected no expiration")
+	}
+	t0 = t0.Add(time.Second * 3)
+	if !e.Check("a") || ks.keys["a"] || e.Len() != 0 {
+		t.Fatal("expected an expiration")
+	}
+	var events []string
+	for len(events) < 9 {
+		select {
+		case msg := <-sub.C:
+			events = append(events, strings.TrimPrefix(msg.Channel,
+				"__keyevent@0__:")+" "+string(msg.Message))
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out")
+		}
+	}
+	exp := "expire a,expire a,expire b,expire a,expire a,expire b," +
+		"persist b,del b,expired a"
+	if res := strings.Join(events, ","); res != exp {
+		t.Fatalf("expected '%v', got '%v'", exp, res)
+	}
+
+	// renamed keys keep their expirations
+	ks.keys["c"] = true
+	e.ExpireAt("c", t0.Add(time.Second), ExpireAlways)
+	e.Rename("c", "d")
+	if _, ok := e.TTL("c"); ok {
+		t.Fatal("expected no expiration")
+	}
+	if ttl, ok := e.TTL("d"); !ok || ttl != time.Second {
+		t.Fatalf("unexpected TTL %v %v", ttl, ok)
+	}
+	e.Rename("c", "d")
+	if e.Len() != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, e.Len())
+	}
+}
+
+func TestExpirerActive(t *testing.T) {
+	ks := &testKeyspace{keys: make(map[string]bool)}
+	e := NewExpirer(ks, &ks.mu)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprint(i)
+		ks.keys[key] = true
+		at := time.Now().Add(time.Hour)
+		if i%2 == 0 {
+			at = time.Now().Add(time.Millisecond * 10)
+		}
+		e.ExpireAt(key, at, ExpireAlways)
+	}
+	e.Start(time.Millisecond * 10)
+	defer e.Close()
+	start := time.Now()
+	for {
+		ks.mu.Lock()
+		n := len(ks.keys)
+		ks.mu.Unlock()
+		if n == 500 {
+			break
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatalf("expected '%v' keys, got '%v'", 500, n)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if e.Len() != 500 {
+		t.Fatalf("expected '%v', got '%v'", 500, e.Len())
+	}
+	e.Close()
+	e.Close()
+}
@@ -0,0 +1,322 @@
+package redcon
+
+import (
+	"container/list"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// HistoryMessage is a message in the history of a channel.
+type HistoryMessage struct {
+	ID      string // "<ms>-<seq>"
+	Channel string
+	Message []byte
+}
+
+// historyID is the id of a message in the history, which is the publish
+// time in milliseconds and a sequence number for messages that are
+// published in the same millisecond.
+type historyID struct {
+	ms, seq uint64
+}
+
+func (id historyID) less(other historyID) bool {
+	if id.ms != other.ms {
+		return id.ms < other.ms
+	}
+	return id.seq < other.seq
+}
+
+func (id historyID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+// parseHistoryID parses an id in the "<ms>-<seq>" or "<ms>" format.
+func parseHistoryID(s string) (historyID, bool) {
+	var id historyID
+	var err error
+	ms, seq := s, ""
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		ms, seq = s[:i], s[i+1:]
+		if id.seq, err = strconv.ParseUint(seq, 10, 64); err != nil {
+			return id, false
+		}
+	}
+	if id.ms, err = strconv.ParseUint(ms, 10, 64); err != nil {
+		return id, false
+	}
+	return id, true
+}
+
+type historyItem struct {
+	id   historyID
+	ids  []byte // encoded bulk id
+	bulk []byte // encoded bulk message
+}
+
+// historyRing is a bounded ring buffer of the latest messages of a channel,
+// which grows up to its size.
+type historyRing struct {
+	channel string
+	elem    *list.Element // in the recently published list
+	items   []historyItem
+	size    int
+	start   int
+	count   int
+}
+
+func (r *historyRing) push(item historyItem) {
+	if len(r.items) < r.size {
+		r.items = append(r.items, item)
+		r.count++
+		return
+	}
+	r.items[r.start] = item
+	r.start = (r.start + 1) % len(r.items)
+}
+
+func (r *historyRing) at(i int) *historyItem {
+	return &r.items[(r.start+i)%len(r.items)]
+}
+
+// tail returns the index of the first item of the last count items that
+// are after the id. A zero id and a zero count are not limits.
+func (r *historyRing) tail(count int, since historyID) int {
+	first := sort.Search(r.count, func(i int) bool {
+		return since.less(r.at(i).id)
+	})
+	if count > 0 && r.count-count > first {
+		first = r.count - count
+	}
+	return first
+}
+
+// DefaultHistoryChannels is the default maximum number of channels with a
+// history.
+const DefaultHistoryChannels = 1024
+
+// SetHistory sets the number of messages that are kept in the history of
+// each channel, which allows for subscribers to replay the messages that
+// they missed. Only the messages from Publish are kept, and not those of
+// Spublish. The history of a channel is kept when there are no subscribers,
+// up to the maximum number of channels of SetHistoryChannels. Changing the
+// size clears the history, and zero disables it.
+func (ps *PubSub) SetHistory(size int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.histMu.Lock()
+	defer ps.histMu.Unlock()
+	if size < 0 {
+		size = 0
+	}
+	if int32(size) != atomic.LoadInt32(&ps.histSize) {
+		atomic.StoreInt32(&ps.histSize, int32(size))
+		ps.hist = nil
+		ps.histLRU = nil
+	}
+}
+
+// SetHistoryChannels sets the maximum number of channels with a history.
+// When a message is published to another channel, the history of the
+// channel that was published to least recently is removed. Zero is
+// DefaultHistoryChannels.
+func (ps *PubSub) SetHistoryChannels(n int) {
+	ps.histMu.Lock()
+	defer ps.histMu.Unlock()
+	ps.histChans = n
+	for ps.histLRU != nil && ps.histLRU.Len() > ps.maxHistoryChannels() {
+		ps.evictHistory()
+	}
+}
+
+func (ps *PubSub) maxHistoryChannels() int {
+	if ps.histChans <= 0 {
+		return DefaultHistoryChannels
+	}
+	return ps.histChans
+}
+
+// evictHistory removes the history of the channel that was published to
+// least recently. The caller must hold the history lock.
+func (ps *PubSub) evictHistory() {
+	r := ps.histLRU.Remove(ps.histLRU.Back()).(*historyRing)
+	delete(ps.hist, r.channel)
+}
+
+// History returns the messages in the history of a channel, which are the
+// last count messages after the since id. An empty since returns the last
+// count messages, and a zero count returns all of the messages.
+func (ps *PubSub) History(channel string, count int, since string,
+) ([]HistoryMessage, error) {
+	var sinceID historyID
+	if since != "" {
+		var ok bool
+		if sinceID, ok = parseHistoryID(since); !ok {
+			return nil, errInvalidHistoryID
+		}
+	}
+	ps.histMu.Lock()
+	defer ps.histMu.Unlock()
+	r := ps.hist[channel]
+	if r == nil {
+		return nil, nil
+	}
+	var msgs []HistoryMessage
+	for i := r.tail(count, sinceID); i < r.count; i++ {
+		item := r.at(i)
+		msgs = append(msgs, HistoryMessage{
+			ID:      item.id.String(),
+			Channel: channel,
+			Message: append([]byte(nil), bulkData(item.bulk)...),
+		})
+	}
+	return msgs, nil
+}
+
+var errInvalidHistoryID = errors.New(
+	"ERR Invalid message ID specified for REPLAY")
+
+// record adds a message to the history of the channel, and returns its
+// encoded id. Returns nil when the history is disabled, without taking the
+// history lock. The caller must hold the read lock.
+func (ps *PubSub) record(channel string, bulk []byte) []byte {
+	if atomic.LoadInt32(&ps.histSize) == 0 {
+		return nil
+	}
+	ps.histMu.Lock()
+	defer ps.histMu.Unlock()
+	ms := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+	if ms <= ps.histLast.ms {
+		ps.histLast.seq++
+	} else {
+		ps.histLast = historyID{ms: ms}
+	}
+	if ps.hist == nil {
+		ps.hist = make(map[string]*historyRing)
+		ps.histLRU = list.New()
+	}
+	r := ps.hist[channel]
+	if r == nil {
+		if len(ps.hist) >= ps.maxHistoryChannels() {
+			ps.evictHistory()
+		}
+		r = &historyRing{channel: channel,
+			size: int(atomic.LoadInt32(&ps.histSize))}
+		r.elem = ps.histLRU.PushFront(r)
+		ps.hist[channel] = r
+	} else {
+		ps.histLRU.MoveToFront(r.elem)
+	}
+	item := historyItem{
+		id:   ps.histLast,
+		ids:  AppendBulkString(nil, ps.histLast.String()),
+		bulk: bulk,
+	}
+	r.push(item)
+	return item.ids
+}
+
+// SubscribeReplay subscribes a connection to a channel, like Subscribe,
+// and first sends the last count messages after the since id from the
+// history of the channel. An empty since sends the last count messages, and
+// a zero count sends all of the messages after the since id. There are no
+// gaps or duplicates between the replayed and the published messages.
+//
+// The messages that are sent to the connection for the channel have a
+// fourth element, which is the id of the message, so that the client can
+// resume from the last message that it received.
+func (ps *PubSub) SubscribeReplay(conn Conn, channel string, count int,
+	since string,
+) {
+	replay := &pubSubReplay{count: count}
+	if since != "" {
+		var ok bool
+		if replay.since, ok = parseHistoryID(since); !ok {
+			ps.writeError(conn, errInvalidHistoryID.Error())
+			return
+		}
+	}
+	if atomic.LoadInt32(&ps.histSize) == 0 {
+		ps.writeError(conn, "ERR PubSub history is disabled")
+		return
+	}
+	ps.subscribe(conn, false, false, channel, replay)
+}
+
+// pubSubReplay are the options of a subscription with SubscribeReplay.
+type pubSubReplay struct {
+	count int
+	since historyID
+}
+
+// replay appends the messages from the history of the entry's channel to
+// dst. The caller must hold the lock.
+func (ps *PubSub) replay(dst []byte, entry *pubSubEntry,
+	replay *pubSubReplay) []byte {
+	ps.histMu.Lock()
+	defer ps.histMu.Unlock()
+	r := ps.hist[entry.channel]
+	if r == nil {
+		return dst
+	}
+	head := appendMessageHead(nil, entry, entry.channel)
+	for i := r.tail(replay.count, replay.since); i < r.count; i++ {
+		item := r.at(i)
+		dst = append(dst, head...)
+		dst = append(dst, item.bulk...)
+		dst = append(dst, item.ids...)
+	}
+	return dst
+}
+
+// ServeReplay is a HandlerFunc for the REPLAY command, which subscribes the
+// client to a channel with SubscribeReplay.
+//
+//	REPLAY channel [COUNT count] [SINCE id]
+//
+//	mux.HandleFunc("replay", ps.ServeReplay)
+func (ps *PubSub) ServeReplay(conn Conn, cmd Command) {
+	if len(cmd.Args) < 2 {
+		ps.writeError(conn, "ERR wrong number of arguments for 'replay' "+
+			"command")
+		return
+	}
+	var count int
+	var since string
+	for i := 2; i < len(cmd.Args); i++ {
+		opt := strings.ToLower(string(cmd.Args[i]))
+		if i == len(cmd.Args)-1 || (opt != "count" && opt != "since") {
+			ps.writeError(conn, "ERR syntax error")
+			return
+		}
+		i++
+		if opt == "since" {
+			since = string(cmd.Args[i])
+			continue
+		}
+		n, err := strconv.Atoi(string(cmd.Args[i]))
+		if err != nil || n < 0 {
+			ps.writeError(conn, "ERR value is out of range, must be "+
+				"positive")
+			return
+		}
+		count = n
+	}
+	ps.SubscribeReplay(conn, string(cmd.Args[1]), count, since)
+}
+
+// writeError writes an error to a connection, which may be a subscriber.
+func (ps *PubSub) writeError(conn Conn, msg string) {
+	ps.mu.RLock()
+	sconn, ok := ps.conns[conn]
+	ps.mu.RUnlock()
+	if !ok {
+		conn.WriteError(msg)
+		return
+	}
+	sconn.reply(AppendError(nil, msg))
+}
@@ -0,0 +1,142 @@
+package redcon
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestHistoryRing(t *testing.T) {
+	r := &historyRing{size: 3}
+	for i := 1; i <= 5; i++ {
+		r.push(historyItem{id: historyID{ms: uint64(i)}})
+	}
+	var ids []uint64
+	for i := 0; i < r.count; i++ {
+		ids = append(ids, r.at(i).id.ms)
+	}
+	if fmt.Sprint(ids) != "[3 4 5]" {
+		t.Fatalf("expected '%v', got '%v'", "[3 4 5]", ids)
+	}
+	for _, test := range []struct {
+		count int
+		since uint64
+		exp   int
+	}{
+		{0, 0, 0}, {2, 0, 1}, {0, 3, 1}, {0, 4, 2}, {1, 3, 2}, {0, 9, 3},
+	} {
+		if i := r.tail(test.count, historyID{ms: test.since}); i != test.exp {
+			t.Fatalf("%d %d: expected '%v', got '%v'", test.count, test.since,
+				test.exp, i)
+		}
+	}
+	if id, ok := parseHistoryID("12-3"); !ok || id.String() != "12-3" {
+		t.Fatalf("expected '%v', got '%v'", "12-3", id)
+	}
+	if id, ok := parseHistoryID("12"); !ok || id.String() != "12-0" {
+		t.Fatalf("expected '%v', got '%v'", "12-0", id)
+	}
+	for _, s := range []string{"", "x", "1-x", "-1"} {
+		if _, ok := parseHistoryID(s); ok {
+			t.Fatalf("%s: expected invalid", s)
+		}
+	}
+}
+
+func TestPubSubHistory(t *testing.T) {
+	var ps PubSub
+	ps.SetHistory(3)
+	for i := 0; i < 5; i++ {
+		ps.Publish("a", fmt.Sprintf("m%d", i))
+	}
+	msgs, err := ps.History("a", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 3 || string(msgs[0].Message) != "m2" ||
+		string(msgs[2].Message) != "m4" {
+		t.Fatalf("unexpected history %v", msgs)
+	}
+	if msgs, _ := ps.History("a", 0, msgs[1].ID); len(msgs) != 1 ||
+		string(msgs[0].Message) != "m4" {
+		t.Fatalf("unexpected history %v", msgs)
+	}
+	if _, err := ps.History("a", 0, "x"); err != errInvalidHistoryID {
+		t.Fatalf("expected '%v', got '%v'", errInvalidHistoryID, err)
+	}
+
+	sub, peer := testPipeConn(t, 1)
+	defer peer.nc.Close()
+	ps.ServeReplay(sub, testArgCommand("REPLAY", "a", "COUNT", "2"))
+	exp := "*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n"
+	for _, msg := range msgs[1:] {
+		exp += "*4\r\n$7\r\nmessage\r\n$1\r\na\r\n$2\r\n" + string(msg.Message) +
+			"\r\n" + string(AppendBulkString(nil, msg.ID))
+	}
+	peer.expect(exp)
+
+	// live messages follow the replayed messages, with their ids
+	ps.Publish("a", "m5")
+	msgs, _ = ps.History("a", 1, "")
+	peer.expect("*4\r\n$7\r\nmessage\r\n$1\r\na\r\n$2\r\nm5\r\n" +
+		string(AppendBulkString(nil, msgs[0].ID)))
+
+	// replay from within the subscriber
+	peer.do("REPLAY", "b")
+	peer.expect("*3\r\n$9\r\nsubscribe\r\n$1\r\nb\r\n:2\r\n")
+	peer.do("REPLAY", "b", "SINCE", "x")
+	peer.expect("-ERR Invalid message ID specified for REPLAY\r\n")
+
+	var disabled PubSub
+	var buf bytes.Buffer
+	c := &conn{wr: NewWriter(&buf)}
+	for _, test := range [][2]string{
+		{"REPLAY", "-ERR wrong number of arguments for 'replay' command\r\n"},
+		{"REPLAY a COUNT", "-ERR syntax error\r\n"},
+		{"REPLAY a LIMIT 1", "-ERR syntax error\r\n"},
+		{"REPLAY a COUNT -1", "-ERR value is out of range, must be " +
+			"positive\r\n"},
+		{"REPLAY a", "-ERR PubSub history is disabled\r\n"},
+	} {
+		buf.Reset()
+		disabled.ServeReplay(c, testArgCommand(strings.Split(test[0], " ")...))
+		c.wr.Flush()
+		if buf.String() != test[1] {
+			t.Fatalf("%s: expected '%q', got '%q'", test[0], test[1],
+				buf.String())
+		}
+	}
+}
+
+func TestPubSubHistoryChannels(t *testing.T) {
+	var ps PubSub
+	ps.Publish("a", "m")
+	if ps.hist != nil {
+		t.Fatal("expected no history when disabled")
+	}
+	ps.SetHistory(100)
+	ps.SetHistoryChannels(2)
+	ps.Publish("a", "m1")
+	if r := ps.hist["a"]; len(r.items) != 1 {
+		t.Fatalf("expected a ring of 1 item, got %d", len(r.items))
+	}
+	ps.Publish("b", "m2")
+	ps.Publish("a", "m3")
+	// the history of b is removed, which was published to least recently
+	ps.Publish("c", "m4")
+	for _, test := range []struct {
+		channel string
+		count   int
+	}{{"a", 2}, {"b", 0}, {"c", 1}} {
+		if msgs, _ := ps.History(test.channel, 0, ""); len(msgs) !=
+			test.count {
+			t.Fatalf("%s: expected %d messages, got %d", test.channel,
+				test.count, len(msgs))
+		}
+	}
+	ps.SetHistoryChannels(1)
+	if msgs, _ := ps.History("a", 0, ""); len(msgs) != 0 || len(ps.hist) != 1 {
+		t.Fatalf("unexpected history %v", msgs)
+	}
+}
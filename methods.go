@@ -0,0 +1,205 @@
+package redcon
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+var (
+	connType    = reflect.TypeOf((*Conn)(nil)).Elem()
+	commandType = reflect.TypeOf(Command{})
+	errorType   = reflect.TypeOf((*error)(nil)).Elem()
+	bytesType   = reflect.TypeOf([]byte(nil))
+)
+
+// HandleMethods registers the exported methods of rcvr as commands. The
+// command name is the lowercase method name. For example, a method named
+// HGet is registered as "hget".
+//
+// The method arguments are decoded from the command arguments, in order.
+// Supported argument types are string, []byte, bool, and all integer and
+// float types. The final argument may be variadic. Optionally, the first
+// arguments may be a Conn and/or a Command, which are passed through from
+// the handler.
+//
+// The method results are written to the client using WriteAny. A method
+// may return zero or one value, optionally followed by an error. A
+// non-nil error is written instead of the value, with an "ERR " prefix
+// when the first word is not uppercase, and a method that does
+// not return a value writes OK. A method that has a Conn argument and does
+// not return a value is responsible for writing its own response.
+//
+//	type Store struct { ... }
+//	func (s *Store) Get(key string) ([]byte, error) { ... }
+//	func (s *Store) Set(key string, value []byte) error { ... }
+//
+//	mux.HandleMethods(&Store{})
+//
+// HandleMethods panics when a method has an unsupported signature or when
+// a command has already been registered.
+func (m *ServeMux) HandleMethods(rcvr interface{}) {
+	v := reflect.ValueOf(rcvr)
+	t := v.Type()
+	for i := 0; i < t.NumMethod(); i++ {
+		method := t.Method(i)
+		if method.PkgPath != "" {
+			continue // not exported
+		}
+		h, err := newMethodHandler(v.Method(i))
+		if err != nil {
+			panic("redcon: method " + method.Name + ": " + err.Error())
+		}
+		m.Handle(strings.ToLower(method.Name), h)
+	}
+}
+
+// methodHandler is a Handler that calls a function using reflection.
+type methodHandler struct {
+	fn       reflect.Value
+	conn     bool           // first input is a Conn
+	cmd      bool           // input after the optional Conn is a Command
+	in       []reflect.Type // argument inputs, excluding the Conn and Command
+	variadic bool
+	value    bool // returns a value
+	err      bool // returns an error as the last result
+}
+
+func newMethodHandler(fn reflect.Value) (*methodHandler, error) {
+	t := fn.Type()
+	h := &methodHandler{fn: fn, variadic: t.IsVariadic()}
+	var i int
+	if i < t.NumIn() && t.In(i) == connType {
+		h.conn = true
+		i++
+	}
+	if i < t.NumIn() && t.In(i) == commandType {
+		h.cmd = true
+		i++
+	}
+	for ; i < t.NumIn(); i++ {
+		in := t.In(i)
+		if h.variadic && i == t.NumIn()-1 {
+			in = in.Elem()
+		}
+		if !isMethodArgType(in) {
+			return nil, errors.New("unsupported argument type " + in.String())
+		}
+		h.in = append(h.in, in)
+	}
+	switch t.NumOut() {
+	case 0:
+	case 1:
+		if t.Out(0) == errorType {
+			h.err = true
+		} else {
+			h.value = true
+		}
+	case 2:
+		if t.Out(1) != errorType {
+			return nil, errors.New("last result must be an error")
+		}
+		h.value = true
+		h.err = true
+	default:
+		return nil, errors.New("too many results")
+	}
+	return h, nil
+}
+
+func isMethodArgType(t reflect.Type) bool {
+	if t == bytesType {
+		return true
+	}
+	switch t.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// ServeRESP decodes the command arguments, calls the method, and writes the
+// results.
+func (h *methodHandler) ServeRESP(conn Conn, cmd Command) {
+	nargs := len(cmd.Args) - 1
+	if nargs < len(h.in)-1 || (!h.variadic && nargs != len(h.in)) {
+		conn.WriteError("ERR wrong number of arguments for '" +
+			strings.ToLower(string(cmd.Args[0])) + "' command")
+		return
+	}
+	ins := make([]reflect.Value, 0, 2+nargs)
+	if h.conn {
+		ins = append(ins, reflect.ValueOf(&conn).Elem())
+	}
+	if h.cmd {
+		ins = append(ins, reflect.ValueOf(cmd))
+	}
+	args := NewArgReader(cmd)
+	for i := 0; i < nargs; i++ {
+		t := h.in[len(h.in)-1]
+		if i < len(h.in) {
+			t = h.in[i]
+		}
+		ins = append(ins, decodeMethodArg(args, t))
+	}
+	if err := args.Err(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	outs := h.fn.Call(ins)
+	if h.err {
+		if err := outs[len(outs)-1]; !err.IsNil() {
+			conn.WriteError(prefixERRIfNeeded(err.Interface().(error).Error()))
+			return
+		}
+	}
+	if h.value {
+		conn.WriteAny(outs[0].Interface())
+	} else if !h.conn {
+		conn.WriteString("OK")
+	}
+}
+
+// decodeMethodArg reads the next argument as type t.
+func decodeMethodArg(args *ArgReader, t reflect.Type) reflect.Value {
+	v := reflect.New(t).Elem()
+	if t == bytesType {
+		v.SetBytes(args.Bytes())
+		return v
+	}
+	switch t.Kind() {
+	case reflect.String:
+		v.SetString(args.String())
+	case reflect.Bool:
+		b, err := strconv.ParseBool(args.String())
+		if err != nil {
+			args.Fail(ErrSyntax)
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		reflect.Int64:
+		bits := uint(t.Bits())
+		v.SetInt(args.IntRange(-1<<(bits-1), 1<<(bits-1)-1))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64:
+		n := args.Uint()
+		if t.Bits() < 64 && n > 1<<uint(t.Bits())-1 {
+			args.Fail(ErrNotInteger)
+		}
+		v.SetUint(n)
+	case reflect.Float32:
+		f := args.Float()
+		if math.Abs(f) > math.MaxFloat32 && !math.IsInf(f, 0) {
+			args.Fail(ErrNotFloat)
+		}
+		v.SetFloat(f)
+	case reflect.Float64:
+		v.SetFloat(args.Float())
+	}
+	return v
+}
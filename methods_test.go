@@ -0,0 +1,90 @@
+package redcon
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+type testMethodStore struct {
+	items map[string][]byte
+}
+
+func (s *testMethodStore) Get(key string) ([]byte, error) {
+	return s.items[key], nil
+}
+
+func (s *testMethodStore) Set(key string, value []byte) {
+	s.items[key] = value
+}
+
+func (s *testMethodStore) Del(keys ...string) SimpleInt {
+	var n int
+	for _, key := range keys {
+		if _, ok := s.items[key]; ok {
+			delete(s.items, key)
+			n++
+		}
+	}
+	return SimpleInt(n)
+}
+
+func (s *testMethodStore) Incrby(key string, delta int8) (int64, error) {
+	return 0, errors.New("not implemented")
+}
+
+func (s *testMethodStore) Echo(conn Conn, cmd Command, msg string) {
+	conn.WriteString(strings.ToUpper(string(cmd.Args[0])) + " " + msg)
+}
+
+func (s *testMethodStore) Flag(on bool) error {
+	if !on {
+		return SimpleError(errors.New("OFF flag is off"))
+	}
+	return nil
+}
+
+func TestHandleMethods(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleMethods(&testMethodStore{items: make(map[string][]byte)})
+	var buf bytes.Buffer
+	c := &conn{wr: NewWriter(&buf)}
+	do := func(args ...string) string {
+		buf.Reset()
+		mux.ServeRESP(c, testArgCommand(args...))
+		c.wr.Flush()
+		return buf.String()
+	}
+	tests := [][2]string{
+		{"GET key", "$-1\r\n"},
+		{"SET key value", "+OK\r\n"},
+		{"GET key", "$5\r\nvalue\r\n"},
+		{"GET", "-ERR wrong number of arguments for 'get' command\r\n"},
+		{"SET key", "-ERR wrong number of arguments for 'set' command\r\n"},
+		{"DEL", ":0\r\n"},
+		{"DEL key key2", ":1\r\n"},
+		{"INCRBY key 1000",
+			"-ERR value is not an integer or out of range\r\n"},
+		{"INCRBY key 100", "-ERR not implemented\r\n"},
+		{"ECHO hello", "+ECHO hello\r\n"},
+		{"FLAG 1", "+OK\r\n"},
+		{"FLAG false", "-OFF flag is off\r\n"},
+		{"FLAG maybe", "-ERR syntax error\r\n"},
+	}
+	for _, test := range tests {
+		res := do(strings.Split(test[0], " ")...)
+		if res != test[1] {
+			t.Fatalf("%s: expected '%q', got '%q'", test[0], test[1], res)
+		}
+	}
+}
+
+func TestHandleMethodsInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic")
+		}
+	}()
+	NewServeMux().HandleMethods(struct{ *bytes.Buffer }{})
+}
@@ -0,0 +1,136 @@
+package redcon
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+)
+
+// NotifyClass is a class of keyspace events, which is used to filter the
+// events that are published by a Notifier.
+type NotifyClass uint32
+
+// Keyspace event classes, which match the notify-keyspace-events characters
+// of Redis.
+const (
+	NotifyGeneric  NotifyClass = 1 << iota // 'g' DEL, EXPIRE, RENAME, ...
+	NotifyString                           // '$' string commands
+	NotifyList                             // 'l' list commands
+	NotifySet                              // 's' set commands
+	NotifyHash                             // 'h' hash commands
+	NotifyZSet                             // 'z' sorted set commands
+	NotifyExpired                          // 'x' expired keys
+	NotifyEvicted                          // 'e' evicted keys
+	NotifyStream                           // 't' stream commands
+	NotifyKeyMiss                          // 'm' key misses
+	NotifyModule                           // 'd' module events
+	NotifyNew                              // 'n' new keys
+	notifyKeyspace                         // 'K' __keyspace@<db>__ events
+	notifyKeyevent                         // 'E' __keyevent@<db>__ events
+)
+
+// NotifyAll is the 'A' alias for "g$lshzxetd", which does not include key
+// misses or new keys.
+const NotifyAll = NotifyGeneric | NotifyString | NotifyList | NotifySet |
+	NotifyHash | NotifyZSet | NotifyExpired | NotifyEvicted | NotifyStream |
+	NotifyModule
+
+// notifyChars maps the notify-keyspace-events characters to classes, in
+// the order that they are formatted.
+var notifyChars = []struct {
+	c     byte
+	class NotifyClass
+}{
+	{'g', NotifyGeneric}, {'$', NotifyString}, {'l', NotifyList},
+	{'s', NotifySet}, {'h', NotifyHash}, {'z', NotifyZSet},
+	{'x', NotifyExpired}, {'e', NotifyEvicted}, {'t', NotifyStream},
+	{'d', NotifyModule}, {'K', notifyKeyspace}, {'E', notifyKeyevent},
+	{'m', NotifyKeyMiss}, {'n', NotifyNew},
+}
+
+// Notifier publishes Redis keyspace notifications to a PubSub. Handlers
+// call Notify for each event, and the events are published to the
+// __keyspace@<db>__:<key> and __keyevent@<db>__:<event> channels
+// depending on the flags, which use the notify-keyspace-events format of
+// Redis.
+//
+//	n, _ := redcon.NewNotifier(ps, "KEA")
+//	n.Notify(0, "set", "mykey", redcon.NotifyString)
+type Notifier struct {
+	ps    *PubSub
+	flags uint32
+}
+
+// NewNotifier returns a Notifier that publishes to ps. The flags use the
+// notify-keyspace-events format, such as "KEA" or "Kx". An empty string
+// disables notifications.
+func NewNotifier(ps *PubSub, flags string) (*Notifier, error) {
+	n := &Notifier{ps: ps}
+	if err := n.SetFlags(flags); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// SetFlags sets the flags, which use the notify-keyspace-events format.
+func (n *Notifier) SetFlags(flags string) error {
+	var class NotifyClass
+	for i := 0; i < len(flags); i++ {
+		if flags[i] == 'A' {
+			class |= NotifyAll
+			continue
+		}
+		var ok bool
+		for _, nc := range notifyChars {
+			if nc.c == flags[i] {
+				class |= nc.class
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return errors.New("ERR Invalid event class character. Use " +
+				"'Ag$lshzxeKEtmdn'.")
+		}
+	}
+	atomic.StoreUint32(&n.flags, uint32(class))
+	return nil
+}
+
+// Flags returns the flags in the notify-keyspace-events format.
+func (n *Notifier) Flags() string {
+	class := NotifyClass(atomic.LoadUint32(&n.flags))
+	var b []byte
+	if class&NotifyAll == NotifyAll {
+		b = append(b, 'A')
+		class &^= NotifyAll
+	}
+	for _, nc := range notifyChars {
+		if class&nc.class != 0 {
+			b = append(b, nc.c)
+		}
+	}
+	return string(b)
+}
+
+// Enabled returns true when events of the class are published. This may be
+// used to avoid building events that are not published.
+func (n *Notifier) Enabled(class NotifyClass) bool {
+	flags := NotifyClass(atomic.LoadUint32(&n.flags))
+	return flags&class != 0 && flags&(notifyKeyspace|notifyKeyevent) != 0
+}
+
+// Notify publishes an event, such as "set" or "expired", for a key in the
+// database. The event is not published when its class is not enabled.
+func (n *Notifier) Notify(db int, event, key string, class NotifyClass) {
+	flags := NotifyClass(atomic.LoadUint32(&n.flags))
+	if flags&class == 0 {
+		return
+	}
+	if flags&notifyKeyspace != 0 {
+		n.ps.Publish("__keyspace@"+strconv.Itoa(db)+"__:"+key, event)
+	}
+	if flags&notifyKeyevent != 0 {
+		n.ps.Publish("__keyevent@"+strconv.Itoa(db)+"__:"+event, key)
+	}
+}
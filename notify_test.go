@@ -0,0 +1,51 @@
+package redcon
+
+import "testing"
+
+func TestNotifierFlags(t *testing.T) {
+	n, err := NewNotifier(&PubSub{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range [][2]string{
+		{"KEA", "AKE"}, {"Kx", "xK"}, {"E$lm", "$lEm"}, {"", ""},
+		{"Ag$", "A"}, {"KEAmn", "AKEmn"},
+	} {
+		if err := n.SetFlags(test[0]); err != nil {
+			t.Fatal(err)
+		}
+		if flags := n.Flags(); flags != test[1] {
+			t.Fatalf("%s: expected '%v', got '%v'", test[0], test[1], flags)
+		}
+	}
+	if _, err := NewNotifier(&PubSub{}, "KEQ"); err == nil {
+		t.Fatal("expected error")
+	}
+	n.SetFlags("Kx")
+	if !n.Enabled(NotifyExpired) || n.Enabled(NotifyString) {
+		t.Fatal("invalid enabled classes")
+	}
+	n.SetFlags("x")
+	if n.Enabled(NotifyExpired) {
+		t.Fatal("expected disabled without K or E")
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	var ps PubSub
+	n, _ := NewNotifier(&ps, "K$")
+	sub, peer := testPipeConn(t, 1)
+	defer peer.nc.Close()
+	ps.Psubscribe(sub, "__key*@0__:*")
+	peer.expect("*3\r\n$10\r\npsubscribe\r\n$12\r\n__key*@0__:*\r\n:1\r\n")
+	n.Notify(0, "del", "k1", NotifyGeneric)
+	n.Notify(0, "set", "k1", NotifyString)
+	peer.expect("*4\r\n$8\r\npmessage\r\n$12\r\n__key*@0__:*\r\n" +
+		"$17\r\n__keyspace@0__:k1\r\n$3\r\nset\r\n")
+	n.SetFlags("Eg")
+	n.Notify(1, "del", "k2", NotifyGeneric)
+	n.Notify(0, "del", "k2", NotifyGeneric)
+	peer.expect("*4\r\n$8\r\npmessage\r\n$12\r\n__key*@0__:*\r\n" +
+		"$18\r\n__keyevent@0__:del\r\n$2\r\nk2\r\n")
+	peer.expectNothing()
+}
@@ -0,0 +1,353 @@
+package redcon
+
+import (
+	"strings"
+
+	"github.com/tidwall/btree"
+	"github.com/tidwall/match"
+)
+
+// patternPrefix returns the literal prefix of a glob-style pattern, which
+// is the part before the first special character.
+func patternPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, "*?[\\"); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// patternIndex indexes pattern subscriptions by the literal prefix of their
+// patterns in a trie. Publishing only matches the patterns whose prefix is
+// a prefix of the channel, and identical patterns from different clients
+// are grouped so that each pattern is matched once per message.
+type patternIndex struct {
+	root patternNode
+}
+
+type patternNode struct {
+	children map[byte]*patternNode
+	groups   map[string]map[*pubSubEntry]bool // pattern -> subscribers
+}
+
+// add adds a pattern entry to the index.
+func (idx *patternIndex) add(entry *pubSubEntry) {
+	node := &idx.root
+	prefix := patternPrefix(entry.channel)
+	for i := 0; i < len(prefix); i++ {
+		if node.children == nil {
+			node.children = make(map[byte]*patternNode)
+		}
+		child, ok := node.children[prefix[i]]
+		if !ok {
+			child = &patternNode{}
+			node.children[prefix[i]] = child
+		}
+		node = child
+	}
+	if node.groups == nil {
+		node.groups = make(map[string]map[*pubSubEntry]bool)
+	}
+	group, ok := node.groups[entry.channel]
+	if !ok {
+		group = make(map[*pubSubEntry]bool)
+		node.groups[entry.channel] = group
+	}
+	group[entry] = true
+}
+
+// remove removes a pattern entry from the index, and prunes empty nodes.
+func (idx *patternIndex) remove(entry *pubSubEntry) {
+	prefix := patternPrefix(entry.channel)
+	path := make([]*patternNode, 1, len(prefix)+1)
+	path[0] = &idx.root
+	for i := 0; i < len(prefix); i++ {
+		child, ok := path[i].children[prefix[i]]
+		if !ok {
+			return
+		}
+		path = append(path, child)
+	}
+	node := path[len(path)-1]
+	group := node.groups[entry.channel]
+	delete(group, entry)
+	if len(group) == 0 {
+		delete(node.groups, entry.channel)
+	}
+	for i := len(path) - 1; i > 0; i-- {
+		if len(path[i].groups) > 0 || len(path[i].children) > 0 {
+			break
+		}
+		delete(path[i-1].children, prefix[i-1])
+	}
+}
+
+// match calls iter for each entry with a pattern that matches the channel.
+func (idx *patternIndex) match(channel string,
+	iter func(entry *pubSubEntry),
+) {
+	node := &idx.root
+	for i := 0; ; i++ {
+		for pattern, group := range node.groups {
+			if match.Match(channel, pattern) {
+				for entry := range group {
+					iter(entry)
+				}
+			}
+		}
+		if i == len(channel) {
+			break
+		}
+		child, ok := node.children[channel[i]]
+		if !ok {
+			break
+		}
+		node = child
+	}
+}
+
+// activeChannels returns the channels in the tree that have at least one
+// subscriber and match the pattern. An empty pattern matches all channels.
+// The caller must hold the lock.
+func activeChannels(tr *btree.BTree, pattern string) []string {
+	channels := []string{}
+	if tr == nil {
+		return channels
+	}
+	prefix := patternPrefix(pattern)
+	pivot := &pubSubEntry{channel: prefix}
+	tr.Ascend(pivot, func(item interface{}) bool {
+		entry := item.(*pubSubEntry)
+		if entry.pattern || !strings.HasPrefix(entry.channel, prefix) {
+			return false
+		}
+		if len(channels) > 0 && channels[len(channels)-1] == entry.channel {
+			return true
+		}
+		if pattern == "" || match.Match(entry.channel, pattern) {
+			channels = append(channels, entry.channel)
+		}
+		return true
+	})
+	return channels
+}
+
+// numSub returns the number of subscribers for each channel in the tree.
+// The caller must hold the lock.
+func numSub(tr *btree.BTree, channels []string) []int {
+	counts := make([]int, len(channels))
+	if tr == nil {
+		return counts
+	}
+	for i, channel := range channels {
+		pivot := &pubSubEntry{channel: channel}
+		tr.Ascend(pivot, func(item interface{}) bool {
+			entry := item.(*pubSubEntry)
+			if entry.pattern || entry.channel != channel {
+				return false
+			}
+			counts[i]++
+			return true
+		})
+	}
+	return counts
+}
+
+// Channels returns the active channels, which have at least one subscriber,
+// in sorted order. Pattern subscriptions are not included. An empty pattern
+// returns all channels, otherwise only the channels that match the
+// glob-style pattern are returned.
+func (ps *PubSub) Channels(pattern string) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return activeChannels(ps.chans, pattern)
+}
+
+// NumSub returns the number of subscribers for each channel. Pattern
+// subscriptions are not counted.
+func (ps *PubSub) NumSub(channels ...string) []int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return numSub(ps.chans, channels)
+}
+
+// NumPat returns the number of unique patterns that are subscribed to by
+// all clients.
+func (ps *PubSub) NumPat() int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	if !ps.initd {
+		return 0
+	}
+	var count int
+	var last *pubSubEntry
+	ps.chans.Ascend(&pubSubEntry{pattern: true}, func(item interface{}) bool {
+		entry := item.(*pubSubEntry)
+		if last == nil || last.channel != entry.channel {
+			count++
+		}
+		last = entry
+		return true
+	})
+	return count
+}
+
+// ShardChannels returns the active shard channels, which have at least one
+// subscriber, in sorted order. An empty pattern returns all shard channels.
+func (ps *PubSub) ShardChannels(pattern string) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return activeChannels(ps.schans, pattern)
+}
+
+// ShardNumSub returns the number of subscribers for each shard channel.
+func (ps *PubSub) ShardNumSub(channels ...string) []int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return numSub(ps.schans, channels)
+}
+
+// ServePubsub is a HandlerFunc for the PUBSUB command, which answers
+// PUBSUB CHANNELS, NUMSUB, NUMPAT, SHARDCHANNELS and SHARDNUMSUB.
+//
+//	mux.HandleFunc("pubsub", ps.ServePubsub)
+func (ps *PubSub) ServePubsub(conn Conn, cmd Command) {
+	if len(cmd.Args) < 2 {
+		conn.WriteError("ERR wrong number of arguments for 'pubsub' command")
+		return
+	}
+	sub := strings.ToLower(string(cmd.Args[1]))
+	args := make([]string, len(cmd.Args)-2)
+	for i := range args {
+		args[i] = string(cmd.Args[i+2])
+	}
+	wrongArgs := func() {
+		conn.WriteError("ERR wrong number of arguments for 'pubsub|" + sub +
+			"' command")
+	}
+	switch sub {
+	case "channels", "shardchannels":
+		if len(args) > 1 {
+			wrongArgs()
+			return
+		}
+		var pattern string
+		if len(args) == 1 {
+			pattern = args[0]
+		}
+		if sub == "channels" {
+			conn.WriteAny(ps.Channels(pattern))
+		} else {
+			conn.WriteAny(ps.ShardChannels(pattern))
+		}
+	case "numsub", "shardnumsub":
+		var counts []int
+		if sub == "numsub" {
+			counts = ps.NumSub(args...)
+		} else {
+			counts = ps.ShardNumSub(args...)
+		}
+		conn.WriteArray(len(args) * 2)
+		for i, channel := range args {
+			conn.WriteBulkString(channel)
+			conn.WriteInt(counts[i])
+		}
+	case "numpat":
+		if len(args) != 0 {
+			wrongArgs()
+			return
+		}
+		conn.WriteInt(ps.NumPat())
+	default:
+		conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) +
+			"'. Try PUBSUB HELP.")
+	}
+}
+
+// SubscribeFunc is called before a connection subscribes to a channel, or
+// to a pattern or shard channel. It returns the channel to subscribe to,
+// which may be rewritten, or an error that denies the subscription and is
+// sent to the client.
+type SubscribeFunc func(
+	conn Conn, channel string, pattern, shard bool,
+) (string, error)
+
+// UnsubscribeFunc is called after a connection unsubscribes from a channel,
+// or from a pattern or shard channel.
+type UnsubscribeFunc func(conn Conn, channel string, pattern, shard bool)
+
+// PublishFunc is called before a message is published to a channel, or to
+// a shard channel. It returns the channel to publish to, which may be
+// rewritten, or false to drop the message. The message must not be
+// modified.
+type PublishFunc func(
+	channel string, message []byte, shard bool,
+) (string, bool)
+
+type pubSubHooks struct {
+	subscribe   SubscribeFunc
+	unsubscribe UnsubscribeFunc
+	publish     PublishFunc
+	disconnect  func(conn Conn)
+}
+
+// OnSubscribe sets the function that is called before each subscription,
+// which may deny or rewrite the channel. The client receives the rewritten
+// channel in replies and messages. The function also rewrites the channels
+// of UNSUBSCRIBE, PUNSUBSCRIBE and SUNSUBSCRIBE, ignoring errors, so that
+// rewritten subscriptions can be removed. The channel is checked against
+// the ACL after it's rewritten.
+func (ps *PubSub) OnSubscribe(fn SubscribeFunc) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.hooks.subscribe = fn
+}
+
+// OnUnsubscribe sets the function that is called after each channel that a
+// connection unsubscribes from. It's not called when a subscriber
+// disconnects, see OnDisconnect.
+func (ps *PubSub) OnUnsubscribe(fn UnsubscribeFunc) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.hooks.unsubscribe = fn
+}
+
+// OnPublish sets the function that is called before a message is
+// published, which may drop the message or rewrite the channel. It's not
+// called for the messages that are received from a Broker.
+func (ps *PubSub) OnPublish(fn PublishFunc) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.hooks.publish = fn
+}
+
+// OnDisconnect sets the function that is called after a subscriber has
+// disconnected, and all of its subscriptions have been removed.
+func (ps *PubSub) OnDisconnect(fn func(conn Conn)) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.hooks.disconnect = fn
+}
+
+// beforePublish calls the publish hook and sends the message to the
+// broker. Returns the channel to publish to, or false when the message is
+// dropped.
+func (ps *PubSub) beforePublish(channel string, bulk []byte,
+	shard bool,
+) (string, bool) {
+	ps.mu.RLock()
+	onPublish := ps.hooks.publish
+	broker := ps.broker
+	ps.mu.RUnlock()
+	if onPublish != nil {
+		var ok bool
+		channel, ok = onPublish(channel, bulkData(bulk), shard)
+		if !ok {
+			return "", false
+		}
+	}
+	if broker != nil {
+		broker.Publish(BrokerMessage{Shard: shard, Channel: channel,
+			Message: bulkData(bulk)})
+	}
+	return channel, true
+}
@@ -0,0 +1,429 @@
+package redcon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPubSubIntrospection(t *testing.T) {
+	var ps PubSub
+	if n := ps.NumPat(); n != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, n)
+	}
+	if chans := ps.Channels(""); len(chans) != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, len(chans))
+	}
+	for i := 0; i < 3; i++ {
+		sub, peer := testPipeConn(t, uint64(i+1))
+		defer peer.nc.Close()
+		go func() {
+			for range peer.out {
+			}
+		}()
+		ps.Subscribe(sub, "news.tech")
+		ps.Psubscribe(sub, "news.*")
+		if i > 0 {
+			ps.Subscribe(sub, "news.sports")
+			ps.Psubscribe(sub, fmt.Sprintf("user:%d:*", i))
+			ps.Ssubscribe(sub, "orders")
+		}
+		if i == 2 {
+			ps.Subscribe(sub, "[x]")
+		}
+	}
+	tests := []struct {
+		pattern string
+		exp     string
+	}{
+		{"", "[[x] news.sports news.tech]"},
+		{"news.*", "[news.sports news.tech]"},
+		{"news.t*", "[news.tech]"},
+		{"*.tech", "[news.tech]"},
+		{"\\[x\\]", "[[x]]"},
+		{"nope*", "[]"},
+	}
+	for _, test := range tests {
+		chans := fmt.Sprint(ps.Channels(test.pattern))
+		if chans != test.exp {
+			t.Fatalf("%s: expected '%v', got '%v'", test.pattern, test.exp,
+				chans)
+		}
+	}
+	counts := fmt.Sprint(ps.NumSub("news.tech", "news.sports", "nope"))
+	if counts != "[3 2 0]" {
+		t.Fatalf("expected '%v', got '%v'", "[3 2 0]", counts)
+	}
+	if n := ps.NumPat(); n != 3 {
+		t.Fatalf("expected '%v', got '%v'", 3, n)
+	}
+	if chans := fmt.Sprint(ps.ShardChannels("")); chans != "[orders]" {
+		t.Fatalf("expected '%v', got '%v'", "[orders]", chans)
+	}
+	if counts := fmt.Sprint(ps.ShardNumSub("orders")); counts != "[2]" {
+		t.Fatalf("expected '%v', got '%v'", "[2]", counts)
+	}
+
+	var buf bytes.Buffer
+	c := &conn{wr: NewWriter(&buf)}
+	for _, test := range [][2]string{
+		{"PUBSUB CHANNELS news.t*", "*1\r\n$9\r\nnews.tech\r\n"},
+		{"PUBSUB NUMSUB news.tech nope", "*4\r\n$9\r\nnews.tech\r\n:3\r\n" +
+			"$4\r\nnope\r\n:0\r\n"},
+		{"PUBSUB NUMSUB", "*0\r\n"},
+		{"PUBSUB NUMPAT", ":3\r\n"},
+		{"PUBSUB SHARDCHANNELS", "*1\r\n$6\r\norders\r\n"},
+		{"PUBSUB SHARDNUMSUB orders", "*2\r\n$6\r\norders\r\n:2\r\n"},
+		{"PUBSUB NUMPAT x", "-ERR wrong number of arguments for " +
+			"'pubsub|numpat' command\r\n"},
+		{"PUBSUB NOPE", "-ERR unknown subcommand 'NOPE'. Try PUBSUB " +
+			"HELP.\r\n"},
+	} {
+		buf.Reset()
+		ps.ServePubsub(c, testArgCommand(strings.Split(test[0], " ")...))
+		c.wr.Flush()
+		if buf.String() != test[1] {
+			t.Fatalf("%s: expected '%q', got '%q'", test[0], test[1],
+				buf.String())
+		}
+	}
+}
+
+func TestPatternIndex(t *testing.T) {
+	var idx patternIndex
+	var entries []*pubSubEntry
+	for i, pattern := range []string{"news.*", "news.*", "news.t*", "*",
+		"n?ws.*", "new?.*", "user:*", "news.tech"} {
+		entry := &pubSubEntry{pattern: true, channel: pattern,
+			sconn: &pubSubConn{id: uint64(i + 1)}}
+		entries = append(entries, entry)
+		idx.add(entry)
+	}
+	matched := func(channel string) string {
+		var ids []int
+		idx.match(channel, func(entry *pubSubEntry) {
+			ids = append(ids, int(entry.sconn.id))
+		})
+		sort.Ints(ids)
+		return fmt.Sprint(ids)
+	}
+	for _, test := range [][2]string{
+		{"news.tech", "[1 2 3 4 5 6 8]"},
+		{"news.sports", "[1 2 4 5 6]"},
+		{"mews.tech", "[4]"},
+		{"user:1", "[4 7]"},
+		{"", "[4]"},
+	} {
+		if res := matched(test[0]); res != test[1] {
+			t.Fatalf("%s: expected '%v', got '%v'", test[0], test[1], res)
+		}
+	}
+	for _, entry := range entries {
+		idx.remove(entry)
+	}
+	if len(idx.root.children) != 0 || len(idx.root.groups) != 0 {
+		t.Fatal("expected empty index")
+	}
+}
+
+func TestPublishPatterns(t *testing.T) {
+	var ps PubSub
+	sub, peer := testPipeConn(t, 1)
+	defer peer.nc.Close()
+	ps.Psubscribe(sub, "a.*")
+	peer.expect("*3\r\n$10\r\npsubscribe\r\n$3\r\na.*\r\n:1\r\n")
+	peer.do("PSUBSCRIBE", "b.*", "a.*")
+	peer.expect("*3\r\n$10\r\npsubscribe\r\n$3\r\nb.*\r\n:2\r\n" +
+		"*3\r\n$10\r\npsubscribe\r\n$3\r\na.*\r\n:2\r\n")
+	if n := ps.Publish("c.1", "hi"); n != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, n)
+	}
+	if n := ps.Publish("a.1", "hi"); n != 1 {
+		t.Fatalf("expected '%v', got '%v'", 1, n)
+	}
+	peer.expect("*4\r\n$8\r\npmessage\r\n$3\r\na.*\r\n$3\r\na.1\r\n" +
+		"$2\r\nhi\r\n")
+	peer.do("PUNSUBSCRIBE", "a.*")
+	peer.expect("*3\r\n$12\r\npunsubscribe\r\n$3\r\na.*\r\n:1\r\n")
+	if n := ps.Publish("a.1", "hi"); n != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, n)
+	}
+}
+
+func TestPublishBytes(t *testing.T) {
+	var ps PubSub
+	sub, peer := testPipeConn(t, 1)
+	defer peer.nc.Close()
+	ps.Subscribe(sub, "a")
+	peer.expect("*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n")
+	peer.do("PSUBSCRIBE", "*")
+	peer.expect("*3\r\n$10\r\npsubscribe\r\n$1\r\n*\r\n:1\r\n")
+	peer.do("SSUBSCRIBE", "a")
+	peer.expect("*3\r\n$10\r\nssubscribe\r\n$1\r\na\r\n:1\r\n")
+
+	// the message is binary and the buffer is reused after publishing
+	msg := []byte("x\r\n\x00y")
+	if n := ps.PublishBytes([]byte("a"), msg); n != 2 {
+		t.Fatalf("expected '%v', got '%v'", 2, n)
+	}
+	copy(msg, "zzzzz")
+	peer.expect("*3\r\n$7\r\nmessage\r\n$1\r\na\r\n$5\r\nx\r\n\x00y\r\n" +
+		"*4\r\n$8\r\npmessage\r\n$1\r\n*\r\n$1\r\na\r\n$5\r\nx\r\n\x00y\r\n")
+	if n := ps.SpublishBytes([]byte("a"), msg); n != 1 {
+		t.Fatalf("expected '%v', got '%v'", 1, n)
+	}
+	peer.expect("*3\r\n$8\r\nsmessage\r\n$1\r\na\r\n$5\r\nzzzzz\r\n")
+
+	// a payload is encoded once and published many times
+	payload := NewPayload([]byte("blob"))
+	ps.PublishPayload("b", payload)
+	ps.SpublishPayload("a", payload)
+	peer.expect("*4\r\n$8\r\npmessage\r\n$1\r\n*\r\n$1\r\nb\r\n" +
+		"$4\r\nblob\r\n*3\r\n$8\r\nsmessage\r\n$1\r\na\r\n$4\r\nblob\r\n")
+}
+
+func TestPublishSlowSubscriber(t *testing.T) {
+	subscribe := func(ps *PubSub) (net.Conn, *Reader) {
+		p1, p2 := net.Pipe()
+		go ps.Subscribe(&conn{conn: p1, wr: NewWriter(p1),
+			rd: NewReader(p1), addr: "pipe"}, "ch")
+		exp := "*3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n"
+		b := make([]byte, len(exp))
+		if _, err := io.ReadFull(p2, b); err != nil || string(b) != exp {
+			t.Fatalf("expected '%q', got '%q' %v", exp, b, err)
+		}
+		return p2, NewReader(p2)
+	}
+
+	// the subscriber does not read, so messages that do not fit in the
+	// queue are dropped without blocking the publisher.
+	var ps PubSub
+	ps.SetSubscriberQueue(2, SubscriberDrop)
+	nc, rd := subscribe(&ps)
+	defer nc.Close()
+	var sent int
+	for i := 0; i < 10; i++ {
+		sent += ps.Publish("ch", fmt.Sprint(i))
+	}
+	if sent < 2 || sent > 3 {
+		t.Fatalf("expected 2 or 3 messages, got '%v'", sent)
+	}
+	for i := 0; i < sent; i++ {
+		cmd, err := rd.ReadCommand()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(cmd.Args) != 3 || string(cmd.Args[0]) != "message" ||
+			string(cmd.Args[2]) != fmt.Sprint(i) {
+			t.Fatalf("%d: unexpected message %q", i, cmd.Raw)
+		}
+	}
+	if n := ps.Publish("ch", "again"); n != 1 {
+		t.Fatalf("expected '%v', got '%v'", 1, n)
+	}
+	if cmd, err := rd.ReadCommand(); err != nil ||
+		string(cmd.Args[2]) != "again" {
+		t.Fatalf("unexpected message %q %v", cmd.Raw, err)
+	}
+
+	// the subscriber is disconnected when the queue is full.
+	ps = PubSub{}
+	ps.SetSubscriberQueue(1, SubscriberDisconnect)
+	nc, _ = subscribe(&ps)
+	defer nc.Close()
+	for i := 0; i < 10; i++ {
+		ps.Publish("ch", "hello")
+	}
+	start := time.Now()
+	for ps.NumSub("ch")[0] != 0 {
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("expected the subscriber to be disconnected")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPublishSlowSubscriberCommand(t *testing.T) {
+	// a subscriber that does not read is blocked in the writer, and can
+	// subscribe without blocking the publishers of other channels
+	var ps PubSub
+	ps.SetSubscriberQueue(2, SubscriberDrop)
+	p1, p2 := net.Pipe()
+	defer p2.Close()
+	c := &conn{conn: p1, wr: NewWriter(p1), rd: NewReader(p1), addr: "pipe"}
+	go ps.Subscribe(c, "ch")
+	big := strings.Repeat("x", 1<<16)
+	head := "*3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n"
+	exp := head +
+		"*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$65536\r\n" + big + "\r\n" +
+		"*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$6\r\nqueued\r\n" +
+		"*3\r\n$9\r\nsubscribe\r\n$4\r\nmore\r\n:2\r\n"
+	b := make([]byte, len(exp))
+	if _, err := io.ReadFull(p2, b[:len(head)]); err != nil {
+		t.Fatal(err)
+	}
+	ps.Publish("ch", big)
+	ps.Publish("ch", "queued")
+	go ps.Subscribe(c, "more")
+	sub := ps.NewSubscriber(nil)
+	defer sub.Close()
+	sub.Subscribe("other")
+	published := make(chan bool)
+	go func() {
+		for i := 0; i < 10; i++ {
+			ps.Publish("other", "x")
+			<-sub.C
+		}
+		close(published)
+	}()
+	select {
+	case <-published:
+	case <-time.After(time.Second * 5):
+		t.Fatal("publisher blocked by a slow subscriber")
+	}
+	start := time.Now()
+	for ps.NumSub("more")[0] != 1 {
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// the subscribe reply follows the queued messages
+	if _, err := io.ReadFull(p2, b[len(head):]); err != nil || string(b) != exp {
+		t.Fatalf("expected '%.60q', got '%.60q' %v", exp[len(head):], b[len(head):], err)
+	}
+}
+
+func TestPubSubHooks(t *testing.T) {
+	var ps PubSub
+	events := make(chan string, 16)
+	ps.OnSubscribe(func(conn Conn, channel string, pattern, shard bool) (
+		string, error,
+	) {
+		if strings.Contains(channel, ":") {
+			return "", errors.New("channel not allowed")
+		}
+		return "t1:" + channel, nil
+	})
+	ps.OnUnsubscribe(func(conn Conn, channel string, pattern, shard bool) {
+		events <- "unsubscribe " + channel
+	})
+	ps.OnPublish(func(channel string, message []byte, shard bool) (string,
+		bool,
+	) {
+		events <- "publish " + channel + " " + string(message)
+		return channel, channel != "blocked"
+	})
+	ps.OnDisconnect(func(conn Conn) {
+		events <- "disconnect"
+	})
+	expectEvent := func(exp string) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event != exp {
+				t.Fatalf("expected '%v', got '%v'", exp, event)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatalf("expected '%v', got nothing", exp)
+		}
+	}
+
+	sub, peer := testPipeConn(t, 1)
+	ps.Subscribe(sub, "news")
+	peer.expect("*3\r\n$9\r\nsubscribe\r\n$7\r\nt1:news\r\n:1\r\n")
+	peer.do("SUBSCRIBE", "t2:news")
+	peer.expect("-ERR channel not allowed\r\n")
+	if n := ps.Publish("t1:news", "hi"); n != 1 {
+		t.Fatalf("expected '%v', got '%v'", 1, n)
+	}
+	expectEvent("publish t1:news hi")
+	peer.expect("*3\r\n$7\r\nmessage\r\n$7\r\nt1:news\r\n$2\r\nhi\r\n")
+	if n := ps.Publish("blocked", "hi"); n != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, n)
+	}
+	expectEvent("publish blocked hi")
+	peer.do("UNSUBSCRIBE", "news")
+	peer.expect("*3\r\n$11\r\nunsubscribe\r\n$7\r\nt1:news\r\n:0\r\n")
+	expectEvent("unsubscribe t1:news")
+	peer.nc.Close()
+	expectEvent("disconnect")
+}
+
+// testDiscardConn is a net.Conn that discards writes and blocks reads until
+// it's closed.
+type testDiscardConn struct {
+	once sync.Once
+	done chan struct{}
+}
+
+func newTestDiscardConn() *testDiscardConn {
+	return &testDiscardConn{done: make(chan struct{})}
+}
+
+func (nc *testDiscardConn) Read(b []byte) (int, error) {
+	<-nc.done
+	return 0, io.EOF
+}
+func (nc *testDiscardConn) Write(b []byte) (int, error) { return len(b), nil }
+func (nc *testDiscardConn) Close() error {
+	nc.once.Do(func() { close(nc.done) })
+	return nil
+}
+func (nc *testDiscardConn) LocalAddr() net.Addr                { return nil }
+func (nc *testDiscardConn) RemoteAddr() net.Addr               { return nil }
+func (nc *testDiscardConn) SetDeadline(t time.Time) error      { return nil }
+func (nc *testDiscardConn) SetReadDeadline(t time.Time) error  { return nil }
+func (nc *testDiscardConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// testDiscardSubscriber returns a connection for subscribing, which
+// discards all messages.
+func testDiscardSubscriber(id uint64) (*conn, io.Closer) {
+	nc := newTestDiscardConn()
+	return &conn{conn: nc, wr: NewWriter(nc), rd: NewReader(nc), id: id}, nc
+}
+
+func benchmarkPublishPatterns(b *testing.B, n int) {
+	var ps PubSub
+	ps.SetSubscriberQueue(0, SubscriberBlock)
+	for i := 0; i < n; i++ {
+		c, closer := testDiscardSubscriber(uint64(i + 1))
+		defer closer.Close()
+		ps.Psubscribe(c, fmt.Sprintf("user:%d:*", i))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ps.Publish("user:7:events", "hello")
+	}
+}
+
+func BenchmarkPublishPatterns100(b *testing.B) {
+	benchmarkPublishPatterns(b, 100)
+}
+
+func BenchmarkPublishPatterns10K(b *testing.B) {
+	benchmarkPublishPatterns(b, 10000)
+}
+
+func BenchmarkPublishSharedPattern(b *testing.B) {
+	var ps PubSub
+	ps.SetSubscriberQueue(0, SubscriberBlock)
+	for i := 0; i < 1000; i++ {
+		c, closer := testDiscardSubscriber(uint64(i + 1))
+		defer closer.Close()
+		ps.Psubscribe(c, "events.*")
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ps.Publish("events.login", "hello")
+	}
+}
@@ -0,0 +1,222 @@
+package rdb
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+var errSaving = errors.New("ERR Background save already in progress")
+
+// Snapshot is called by a Persister to save the data. It captures the data,
+// such as by copying it, and returns a function that writes the entries to
+// w, which may be called in the background.
+type Snapshot func() func(w *Writer) error
+
+// Persister saves the data of a server to an RDB file, and loads it again,
+// like the SAVE, BGSAVE and DEBUG RELOAD commands of Redis.
+//
+//	p := rdb.NewPersister("dump.rdb", s.SaveRDB, s.LoadRDB)
+//	if err := p.Load(); err != nil && !os.IsNotExist(err) {
+//		log.Fatal(err)
+//	}
+//	p.Register(mux)
+type Persister struct {
+	path     string
+	snapshot Snapshot
+	load     func(rd *Reader) error
+	now      func() time.Time
+
+	mu       sync.Mutex
+	saving   bool
+	lastSave time.Time
+	wg       sync.WaitGroup
+}
+
+// NewPersister returns a Persister of the RDB file at path, which saves the
+// data of the snapshot and passes the file to load.
+func NewPersister(path string, snapshot Snapshot,
+	load func(rd *Reader) error) *Persister {
+	return &Persister{path: path, snapshot: snapshot, load: load,
+		now: time.Now, lastSave: time.Now()}
+}
+
+// start marks a save as running, and captures the data.
+func (p *Persister) start() (func(w *Writer) error, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.saving {
+		return nil, errSaving
+	}
+	p.saving = true
+	return p.snapshot(), nil
+}
+
+func (p *Persister) finish(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.saving = false
+	if err == nil {
+		p.lastSave = p.now()
+	}
+}
+
+// Save saves the data to the file.
+func (p *Persister) Save() error {
+	write, err := p.start()
+	if err != nil {
+		return err
+	}
+	err = p.saveFile(write)
+	p.finish(err)
+	return err
+}
+
+// BackgroundSave captures the data and saves it to the file in the
+// background. The returned channel receives the result of the save.
+func (p *Persister) BackgroundSave() (<-chan error, error) {
+	write, err := p.start()
+	if err != nil {
+		return nil, err
+	}
+	done := make(chan error, 1)
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		err := p.saveFile(write)
+		p.finish(err)
+		done <- err
+	}()
+	return done, nil
+}
+
+// Saving returns true while a save is running.
+func (p *Persister) Saving() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.saving
+}
+
+// LastSave returns the time of the last successful save, which is the time
+// that the Persister was created before the first save.
+func (p *Persister) LastSave() time.Time {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastSave
+}
+
+// saveFile writes a temporary file that replaces the file when it is
+// complete.
+func (p *Persister) saveFile(write func(w *Writer) error) error {
+	tmp := p.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+	w := NewWriter(f)
+	w.WriteAux("redis-bits", strconv.Itoa(32<<(^uint(0)>>63))) // 32 or 64
+	w.WriteAux("ctime", strconv.FormatInt(p.now().Unix(), 10))
+	if err := write(w); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, p.path)
+}
+
+// Load reads the file and passes it to the load function. The error
+// satisfies os.IsNotExist when there is no file.
+func (p *Persister) Load() error {
+	f, err := os.Open(p.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return p.load(NewReader(f))
+}
+
+// Close waits for a background save to finish.
+func (p *Persister) Close() error {
+	p.wg.Wait()
+	return nil
+}
+
+// Register adds the SAVE, BGSAVE, LASTSAVE and DEBUG RELOAD commands to the
+// mux.
+func (p *Persister) Register(mux *redcon.ServeMux) {
+	admin := []string{"admin", "noscript", "no-async-loading"}
+	mux.HandleCommand(redcon.CommandSpec{Name: "save", Arity: 1,
+		Flags:      admin,
+		Categories: []string{"admin", "slow", "dangerous"}},
+		redcon.HandlerFunc(func(conn redcon.Conn, cmd redcon.Command) {
+			if err := p.Save(); err != nil {
+				conn.WriteError(errReply(err))
+				return
+			}
+			conn.WriteString("OK")
+		}))
+	mux.HandleCommand(redcon.CommandSpec{Name: "bgsave", Arity: -1,
+		Flags:      admin,
+		Categories: []string{"admin", "slow", "dangerous"}},
+		redcon.HandlerFunc(func(conn redcon.Conn, cmd redcon.Command) {
+			if len(cmd.Args) > 2 || (len(cmd.Args) == 2 &&
+				strings.ToLower(string(cmd.Args[1])) != "schedule") {
+				conn.WriteError("ERR syntax error")
+				return
+			}
+			if _, err := p.BackgroundSave(); err != nil {
+				conn.WriteError(err.Error())
+				return
+			}
+			conn.WriteString("Background saving started")
+		}))
+	mux.HandleCommand(redcon.CommandSpec{Name: "lastsave", Arity: 1,
+		Flags:      []string{"loading", "stale", "fast"},
+		Categories: []string{"admin", "fast", "dangerous"}},
+		redcon.HandlerFunc(func(conn redcon.Conn, cmd redcon.Command) {
+			conn.WriteInt64(p.LastSave().Unix())
+		}))
+	mux.HandleCommand(redcon.CommandSpec{Name: "debug", Arity: -2,
+		Flags:      admin,
+		Categories: []string{"admin", "slow", "dangerous"}},
+		redcon.HandlerFunc(func(conn redcon.Conn, cmd redcon.Command) {
+			sub := strings.ToLower(string(cmd.Args[1]))
+			if sub != "reload" || len(cmd.Args) != 2 {
+				conn.WriteError("ERR unknown subcommand '" +
+					string(cmd.Args[1]) + "'. Try DEBUG HELP.")
+				return
+			}
+			if err := p.Save(); err != nil {
+				conn.WriteError(errReply(err))
+				return
+			}
+			if err := p.Load(); err != nil {
+				conn.WriteError("ERR Error trying to load the RDB dump: " +
+					err.Error())
+				return
+			}
+			conn.WriteString("OK")
+		}))
+}
+
+// errReply returns the reply of a failed save.
+func errReply(err error) string {
+	if err == errSaving {
+		return err.Error()
+	}
+	return "ERR " + err.Error()
+}
@@ -0,0 +1,180 @@
+package rdb
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// testPersister returns a Persister of a map of strings.
+func testPersister(path string) (*Persister, map[string]string, *sync.Mutex) {
+	var mu sync.Mutex
+	keys := make(map[string]string)
+	p := NewPersister(path, func() func(w *Writer) error {
+		mu.Lock()
+		defer mu.Unlock()
+		var entries []*Entry
+		for key, value := range keys {
+			entries = append(entries, &Entry{Key: key, Value: []byte(value)})
+		}
+		return func(w *Writer) error {
+			for _, e := range entries {
+				if err := w.WriteEntry(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	}, func(rd *Reader) error {
+		mu.Lock()
+		defer mu.Unlock()
+		for key := range keys {
+			delete(keys, key)
+		}
+		for {
+			e, err := rd.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			keys[e.Key] = string(e.Value.([]byte))
+		}
+	})
+	p.now = func() time.Time { return time.Unix(1000, 0) }
+	return p, keys, &mu
+}
+
+func TestPersister(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	p, keys, _ := testPersister(path)
+	defer p.Close()
+	if err := p.Load(); !os.IsNotExist(err) {
+		t.Fatalf("expected a missing file, got '%v'", err)
+	}
+	keys["a"] = "1"
+	keys["b"] = "2"
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if p.LastSave().Unix() != 1000 {
+		t.Fatalf("unexpected last save %v", p.LastSave())
+	}
+	keys["c"] = "3"
+	done, err := p.BackgroundSave()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	p2, keys2, _ := testPersister(path)
+	if err := p2.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys2) != 3 || keys2["a"] != "1" || keys2["c"] != "3" {
+		t.Fatalf("unexpected keys %v", keys2)
+	}
+	f, _ := os.Open(path)
+	rd := NewReader(f)
+	rd.Next()
+	f.Close()
+	if rd.Aux()["ctime"] != "1000" {
+		t.Fatalf("unexpected aux %v", rd.Aux())
+	}
+
+	// a failed save leaves the file
+	p3 := NewPersister(path, func() func(w *Writer) error {
+		return func(w *Writer) error {
+			return w.WriteEntry(&Entry{Key: "x", Value: 1})
+		}
+	}, nil)
+	if err := p3.Save(); err != errUnsupported {
+		t.Fatalf("expected '%v', got '%v'", errUnsupported, err)
+	}
+	if err := p2.Load(); err != nil || len(keys2) != 3 {
+		t.Fatalf("unexpected load %v %v", keys2, err)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("expected no temporary file, got '%v'", err)
+	}
+}
+
+func TestPersisterCommands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	p, keys, mu := testPersister(path)
+	defer p.Close()
+	mux := redcon.NewServeMux()
+	p.Register(mux)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go redcon.Serve(ln, mux.ServeRESP, nil, nil)
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	rd := bufio.NewReader(nc)
+	do := func(args ...string) string {
+		t.Helper()
+		buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+		for _, arg := range args {
+			buf = redcon.AppendBulkString(buf, arg)
+		}
+		nc.Write(buf)
+		nc.SetReadDeadline(time.Now().Add(time.Second * 5))
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return line[:len(line)-2]
+	}
+
+	mu.Lock()
+	keys["a"] = "1"
+	mu.Unlock()
+	for _, test := range [][2]string{
+		{"SAVE", "+OK"},
+		{"LASTSAVE", ":1000"},
+		{"BGSAVE SCHEDULE", "+Background saving started"},
+		{"BGSAVE NOW", "-ERR syntax error"},
+		{"DEBUG SLEEP", "-ERR unknown subcommand 'SLEEP'. Try DEBUG HELP."},
+	} {
+		args := strings.Fields(test[0])
+		if res := do(args...); res != test[1] {
+			t.Fatalf("%v: expected '%v', got '%v'", args, test[1], res)
+		}
+		if args[0] == "BGSAVE" {
+			for p.Saving() {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}
+
+	// DEBUG RELOAD saves and loads the data
+	mu.Lock()
+	keys["b"] = "2"
+	mu.Unlock()
+	if res := do("DEBUG", "RELOAD"); res != "+OK" {
+		t.Fatalf("unexpected reply '%v'", res)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(keys) != 2 || keys["b"] != "2" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
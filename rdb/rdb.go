@@ -0,0 +1,180 @@
+// Package rdb encodes and decodes Redis RDB files, which allows for
+// migrating data between Redis and redcon servers, and for saving and
+// loading the data of a server with the SAVE, BGSAVE and DEBUG RELOAD
+// commands using a Persister.
+//
+// Reader decodes strings, lists, sets, sorted sets and hashes in all of
+// their encodings, including ziplists, listpacks, intsets and quicklists,
+// along with expirations and aux fields, and verifies the CRC64 checksum.
+// Streams and module types are not supported.
+//
+//	rd := rdb.NewReader(f)
+//	for {
+//		e, err := rd.Next()
+//		if err == io.EOF {
+//			break
+//		}
+//		...
+//	}
+//
+// Writer encodes values in the plain encodings, which are loaded by all
+// versions of Redis.
+package rdb
+
+import (
+	"errors"
+	"hash/crc64"
+	"time"
+)
+
+// Version is the RDB version of the files that are written. Files of this
+// version and older are read.
+const Version = 9
+
+// maxVersion is the newest RDB version that is read.
+const maxVersion = 12
+
+// Value types.
+const (
+	typeString          = 0
+	typeList            = 1
+	typeSet             = 2
+	typeZSet            = 3
+	typeHash            = 4
+	typeZSet2           = 5
+	typeHashZipmap      = 9
+	typeListZiplist     = 10
+	typeSetIntset       = 11
+	typeZSetZiplist     = 12
+	typeHashZiplist     = 13
+	typeListQuicklist   = 14
+	typeHashListpack    = 16
+	typeZSetListpack    = 17
+	typeListQuicklist2  = 18
+	typeSetListpack     = 20
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+)
+
+// Opcodes.
+const (
+	opSlotInfo     = 0xF4
+	opFunction2    = 0xF5
+	opModuleAux    = 0xF7
+	opIdle         = 0xF8
+	opFreq         = 0xF9
+	opAux          = 0xFA
+	opResizeDB     = 0xFB
+	opExpireTimeMS = 0xFC
+	opExpireTime   = 0xFD
+	opSelectDB     = 0xFE
+	opEOF          = 0xFF
+)
+
+// Length encodings.
+const (
+	len6Bit  = 0
+	len14Bit = 1
+	len32Bit = 0x80
+	len64Bit = 0x81
+	lenEnc   = 3
+	encInt8  = 0
+	encInt16 = 1
+	encInt32 = 2
+	encLZF   = 3
+)
+
+var (
+	// ErrChecksum is returned when the checksum of a file does not match.
+	ErrChecksum = errors.New("rdb: checksum mismatch")
+	// ErrFormat is returned for a file that is not a valid RDB file.
+	ErrFormat = errors.New("rdb: invalid format")
+
+	errUnsupported = errors.New("rdb: unsupported type")
+)
+
+// Entry is a key of an RDB file.
+//
+// The values are []byte for strings, List, Set, Hash and ZSet.
+type Entry struct {
+	DB      int
+	Key     string
+	Value   interface{}
+	Expires time.Time // zero when the key does not expire
+}
+
+// List is the value of a list key.
+type List [][]byte
+
+// Set is the value of a set key.
+type Set map[string]struct{}
+
+// Hash is the value of a hash key.
+type Hash map[string][]byte
+
+// ZSet is the value of a sorted set key, which is ordered by score.
+type ZSet []ZMember
+
+// ZMember is a member of a sorted set.
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// crcTable is the table of the CRC64 Jones polynomial, which is used by
+// Redis in its reflected form.
+var crcTable = crc64.MakeTable(0x95AC9329AC4BC9B5)
+
+// crc updates a CRC64 Jones checksum. The checksum of Redis has no initial
+// or final inversion, unlike the checksums of the hash/crc64 package.
+func crc(sum uint64, p []byte) uint64 {
+	return ^crc64.Update(^sum, crcTable, p)
+}
+
+// lzfDecompress decompresses LZF data to a buffer of the uncompressed
+// length.
+func lzfDecompress(in []byte, n int) ([]byte, error) {
+	// a back reference of 3 bytes expands to at most 264 bytes
+	if n > len(in)*88 {
+		return nil, ErrFormat
+	}
+	out := make([]byte, 0, n)
+	for i := 0; i < len(in); {
+		ctrl := int(in[i])
+		i++
+		if ctrl < 32 {
+			// a literal run
+			ctrl++
+			if i+ctrl > len(in) {
+				return nil, ErrFormat
+			}
+			out = append(out, in[i:i+ctrl]...)
+			i += ctrl
+			continue
+		}
+		// a back reference
+		length := ctrl >> 5
+		if length == 7 {
+			if i >= len(in) {
+				return nil, ErrFormat
+			}
+			length += int(in[i])
+			i++
+		}
+		if i >= len(in) {
+			return nil, ErrFormat
+		}
+		ref := len(out) - ((ctrl & 0x1f) << 8) - int(in[i]) - 1
+		i++
+		if ref < 0 {
+			return nil, ErrFormat
+		}
+		for j := 0; j < length+2; j++ {
+			out = append(out, out[ref+j])
+		}
+	}
+	if len(out) != n {
+		return nil, ErrFormat
+	}
+	return out, nil
+}
@@ -0,0 +1,41 @@
+package rdb
+
+import "testing"
+
+func TestCRC(t *testing.T) {
+	if sum := crc(0, []byte("123456789")); sum != 0xe9c6d914c4b8d9ca {
+		t.Fatalf("unexpected checksum %x", sum)
+	}
+	// the checksum is updated incrementally
+	if sum := crc(crc(0, []byte("1234")), []byte("56789")); sum !=
+		0xe9c6d914c4b8d9ca {
+		t.Fatalf("unexpected checksum %x", sum)
+	}
+}
+
+func TestLZF(t *testing.T) {
+	// a literal run of "abc" followed by a back reference of 6 bytes
+	in := []byte{2, 'a', 'b', 'c', 4 << 5, 2}
+	out, err := lzfDecompress(in, 9)
+	if err != nil || string(out) != "abcabcabc" {
+		t.Fatalf("unexpected '%s' %v", out, err)
+	}
+	// a long back reference that overlaps its output
+	in = []byte{0, 'x', 7 << 5, 3, 0}
+	out, err = lzfDecompress(in, 13)
+	if err != nil || string(out) != "xxxxxxxxxxxxx" {
+		t.Fatalf("unexpected '%s' %v", out, err)
+	}
+	for _, in := range [][]byte{
+		{2, 'a', 'b'},
+		{0, 'a', 1 << 5, 5},
+		{0, 'a', 7 << 5},
+	} {
+		if _, err := lzfDecompress(in, 3); err != ErrFormat {
+			t.Fatalf("%v: expected '%v', got '%v'", in, ErrFormat, err)
+		}
+	}
+	if _, err := lzfDecompress([]byte{0, 'a'}, 2); err != ErrFormat {
+		t.Fatalf("expected '%v', got '%v'", ErrFormat, err)
+	}
+}
@@ -0,0 +1,712 @@
+package rdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Reader reads the entries of an RDB file.
+type Reader struct {
+	rd      *bufio.Reader
+	sum     uint64 // the checksum of the bytes that were read
+	version int
+	aux     map[string]string
+	db      int
+	started bool
+	done    bool
+}
+
+// NewReader returns a Reader that reads an RDB file from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{rd: bufio.NewReader(r), aux: make(map[string]string)}
+}
+
+// Version returns the RDB version of the file, which is known after the
+// first call to Next.
+func (r *Reader) Version() int {
+	return r.version
+}
+
+// Aux returns the aux fields that were read, such as "redis-ver".
+func (r *Reader) Aux() map[string]string {
+	return r.aux
+}
+
+// readChunk is the largest read that is allocated at once. Longer reads
+// grow as the data is read, so that a corrupt length does not allocate
+// more than the size of the file.
+const readChunk = 1 << 16
+
+// read reads n bytes.
+func (r *Reader) read(n uint64) ([]byte, error) {
+	if n > math.MaxInt32 {
+		return nil, ErrFormat
+	}
+	var b []byte
+	if n <= readChunk {
+		b = make([]byte, n)
+		if _, err := io.ReadFull(r.rd, b); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	} else {
+		var buf bytes.Buffer
+		if _, err := io.CopyN(&buf, r.rd, int64(n)); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		b = buf.Bytes()
+	}
+	r.sum = crc(r.sum, b)
+	return b, nil
+}
+
+func (r *Reader) readByte() (byte, error) {
+	b, err := r.read(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// readLength reads a length, which is a special encoding of a string when
+// encoded is true.
+func (r *Reader) readLength() (n uint64, encoded bool, err error) {
+	b, err := r.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case len6Bit:
+		return uint64(b & 0x3f), false, nil
+	case len14Bit:
+		c, err := r.readByte()
+		return uint64(b&0x3f)<<8 | uint64(c), false, err
+	case lenEnc:
+		return uint64(b & 0x3f), true, nil
+	}
+	switch b {
+	case len32Bit:
+		p, err := r.read(4)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(p)), false, nil
+	case len64Bit:
+		p, err := r.read(8)
+		if err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(p), false, nil
+	}
+	return 0, false, ErrFormat
+}
+
+// readLen reads a length that is not a special encoding.
+func (r *Reader) readLen() (uint64, error) {
+	n, encoded, err := r.readLength()
+	if err == nil && encoded {
+		err = ErrFormat
+	}
+	return n, err
+}
+
+// readString reads a string, which may be encoded as an integer or
+// compressed.
+func (r *Reader) readString() ([]byte, error) {
+	n, encoded, err := r.readLength()
+	if err != nil {
+		return nil, err
+	}
+	if !encoded {
+		return r.read(n)
+	}
+	switch n {
+	case encInt8, encInt16, encInt32:
+		p, err := r.read(1 << n)
+		if err != nil {
+			return nil, err
+		}
+		var x int64
+		switch n {
+		case encInt8:
+			x = int64(int8(p[0]))
+		case encInt16:
+			x = int64(int16(binary.LittleEndian.Uint16(p)))
+		default:
+			x = int64(int32(binary.LittleEndian.Uint32(p)))
+		}
+		return []byte(strconv.FormatInt(x, 10)), nil
+	case encLZF:
+		clen, err := r.readLen()
+		if err != nil {
+			return nil, err
+		}
+		ulen, err := r.readLen()
+		if err != nil {
+			return nil, err
+		}
+		p, err := r.read(clen)
+		if err != nil {
+			return nil, err
+		}
+		if ulen > math.MaxInt32 {
+			return nil, ErrFormat
+		}
+		return lzfDecompress(p, int(ulen))
+	}
+	return nil, ErrFormat
+}
+
+// readScore reads a score of the ZSET type, which is a string.
+func (r *Reader) readScore() (float64, error) {
+	n, err := r.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	p, err := r.read(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	return parseScore(p)
+}
+
+func parseScore(p []byte) (float64, error) {
+	f, err := strconv.ParseFloat(string(p), 64)
+	if err != nil {
+		return 0, ErrFormat
+	}
+	return f, nil
+}
+
+// header reads the magic string and version of the file.
+func (r *Reader) header() error {
+	p, err := r.read(9)
+	if err != nil {
+		return err
+	}
+	if string(p[:5]) != "REDIS" {
+		return ErrFormat
+	}
+	version, err := strconv.Atoi(string(p[5:]))
+	if err != nil {
+		return ErrFormat
+	}
+	if version < 1 || version > maxVersion {
+		return errors.New("rdb: unsupported version " + strconv.Itoa(version))
+	}
+	r.version = version
+	return nil
+}
+
+// Next reads the next entry, and returns io.EOF at the end of the file,
+// after verifying the checksum.
+func (r *Reader) Next() (*Entry, error) {
+	if r.done {
+		return nil, io.EOF
+	}
+	if !r.started {
+		if err := r.header(); err != nil {
+			return nil, err
+		}
+		r.started = true
+	}
+	var expires time.Time
+	for {
+		op, err := r.readByte()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case opAux:
+			key, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			value, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			r.aux[string(key)] = string(value)
+		case opResizeDB:
+			if _, err := r.readLen(); err != nil {
+				return nil, err
+			}
+			if _, err := r.readLen(); err != nil {
+				return nil, err
+			}
+		case opSlotInfo:
+			for i := 0; i < 3; i++ {
+				if _, err := r.readLen(); err != nil {
+					return nil, err
+				}
+			}
+		case opSelectDB:
+			db, err := r.readLen()
+			if err != nil {
+				return nil, err
+			}
+			if db > math.MaxInt32 {
+				return nil, ErrFormat
+			}
+			r.db = int(db)
+		case opExpireTimeMS:
+			p, err := r.read(8)
+			if err != nil {
+				return nil, err
+			}
+			ms := int64(binary.LittleEndian.Uint64(p))
+			expires = time.Unix(ms/1000, ms%1000*int64(time.Millisecond))
+		case opExpireTime:
+			p, err := r.read(4)
+			if err != nil {
+				return nil, err
+			}
+			expires = time.Unix(int64(int32(binary.LittleEndian.Uint32(p))), 0)
+		case opIdle:
+			if _, err := r.readLen(); err != nil {
+				return nil, err
+			}
+		case opFreq:
+			if _, err := r.readByte(); err != nil {
+				return nil, err
+			}
+		case opModuleAux, opFunction2:
+			return nil, errUnsupported
+		case opEOF:
+			r.done = true
+			if r.version >= 5 {
+				sum := r.sum
+				p, err := r.read(8)
+				if err != nil {
+					return nil, err
+				}
+				exp := binary.LittleEndian.Uint64(p)
+				if exp != 0 && exp != sum {
+					return nil, ErrChecksum
+				}
+			}
+			return nil, io.EOF
+		default:
+			key, err := r.readString()
+			if err != nil {
+				return nil, err
+			}
+			value, err := r.readValue(op)
+			if err != nil {
+				return nil, err
+			}
+			return &Entry{DB: r.db, Key: string(key), Value: value,
+				Expires: expires}, nil
+		}
+	}
+}
+
+// readStrings reads a length followed by strings.
+func (r *Reader) readStrings(pairs bool) ([][]byte, error) {
+	n, err := r.readLen()
+	if err != nil {
+		return nil, err
+	}
+	if pairs {
+		n *= 2
+	}
+	var values [][]byte
+	for i := uint64(0); i < n; i++ {
+		value, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// readValue reads a value of a type.
+func (r *Reader) readValue(typ byte) (interface{}, error) {
+	switch typ {
+	case typeString:
+		return r.readString()
+	case typeList:
+		values, err := r.readStrings(false)
+		return List(values), err
+	case typeSet:
+		values, err := r.readStrings(false)
+		return newSet(values), err
+	case typeHash:
+		values, err := r.readStrings(true)
+		return newHash(values), err
+	case typeZSet, typeZSet2:
+		return r.readZSet(typ)
+	case typeListQuicklist, typeListQuicklist2:
+		return r.readQuicklist(typ)
+	}
+	switch typ {
+	case typeHashZipmap, typeListZiplist, typeSetIntset, typeZSetZiplist,
+		typeHashZiplist, typeHashListpack, typeZSetListpack, typeSetListpack:
+	default:
+		return nil, errUnsupported
+	}
+	// the remaining types are encoded in a string
+	p, err := r.readString()
+	if err != nil {
+		return nil, err
+	}
+	var values [][]byte
+	switch typ {
+	case typeHashZipmap:
+		values, err = zipmapValues(p)
+	case typeListZiplist, typeZSetZiplist, typeHashZiplist:
+		values, err = ziplistValues(p)
+	case typeSetIntset:
+		values, err = intsetValues(p)
+	default:
+		values, err = listpackValues(p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch typ {
+	case typeListZiplist:
+		return List(values), nil
+	case typeSetIntset, typeSetListpack:
+		return newSet(values), nil
+	case typeZSetZiplist, typeZSetListpack:
+		return newZSet(values)
+	}
+	if len(values)%2 != 0 {
+		return nil, ErrFormat
+	}
+	return newHash(values), nil
+}
+
+func (r *Reader) readZSet(typ byte) (ZSet, error) {
+	n, err := r.readLen()
+	if err != nil {
+		return nil, err
+	}
+	var z ZSet
+	for i := uint64(0); i < n; i++ {
+		member, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		var score float64
+		if typ == typeZSet2 {
+			var p []byte
+			if p, err = r.read(8); err == nil {
+				score = math.Float64frombits(binary.LittleEndian.Uint64(p))
+			}
+		} else {
+			score, err = r.readScore()
+		}
+		if err != nil {
+			return nil, err
+		}
+		z = append(z, ZMember{string(member), score})
+	}
+	z.sort()
+	return z, nil
+}
+
+func (r *Reader) readQuicklist(typ byte) (List, error) {
+	n, err := r.readLen()
+	if err != nil {
+		return nil, err
+	}
+	var l List
+	for i := uint64(0); i < n; i++ {
+		container := uint64(quicklistNodePacked)
+		if typ == typeListQuicklist2 {
+			if container, err = r.readLen(); err != nil {
+				return nil, err
+			}
+		}
+		p, err := r.readString()
+		if err != nil {
+			return nil, err
+		}
+		var values [][]byte
+		switch {
+		case container == quicklistNodePlain:
+			values = [][]byte{p}
+		case container != quicklistNodePacked:
+			return nil, ErrFormat
+		case typ == typeListQuicklist:
+			values, err = ziplistValues(p)
+		default:
+			values, err = listpackValues(p)
+		}
+		if err != nil {
+			return nil, err
+		}
+		l = append(l, values...)
+	}
+	return l, nil
+}
+
+func newSet(values [][]byte) Set {
+	s := make(Set, len(values))
+	for _, value := range values {
+		s[string(value)] = struct{}{}
+	}
+	return s
+}
+
+func newHash(values [][]byte) Hash {
+	h := make(Hash, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		h[string(values[i])] = values[i+1]
+	}
+	return h
+}
+
+// newZSet returns a sorted set of members that are followed by scores.
+func newZSet(values [][]byte) (ZSet, error) {
+	if len(values)%2 != 0 {
+		return nil, ErrFormat
+	}
+	z := make(ZSet, 0, len(values)/2)
+	for i := 0; i < len(values); i += 2 {
+		score, err := parseScore(values[i+1])
+		if err != nil {
+			return nil, err
+		}
+		z = append(z, ZMember{string(values[i]), score})
+	}
+	z.sort()
+	return z, nil
+}
+
+// sort orders the members by score, and by member for equal scores.
+func (z ZSet) sort() {
+	sort.Slice(z, func(i, j int) bool {
+		if z[i].Score != z[j].Score {
+			return z[i].Score < z[j].Score
+		}
+		return z[i].Member < z[j].Member
+	})
+}
+
+// cursor reads the encoded values of a string, where an out of range read
+// sets the error.
+type cursor struct {
+	b   []byte
+	i   int
+	err error
+}
+
+func (c *cursor) next(n int) []byte {
+	if c.err != nil || n < 0 || n > len(c.b)-c.i {
+		c.err = ErrFormat
+		return make([]byte, 8)
+	}
+	p := c.b[c.i : c.i+n]
+	c.i += n
+	return p
+}
+
+func (c *cursor) done() bool {
+	return c.err != nil || c.i >= len(c.b)
+}
+
+func formatInt(x int64) []byte {
+	return []byte(strconv.FormatInt(x, 10))
+}
+
+// ziplistValues returns the values of a ziplist.
+func ziplistValues(p []byte) ([][]byte, error) {
+	c := &cursor{b: p}
+	c.next(10) // zlbytes, zltail and zllen
+	var values [][]byte
+	for !c.done() {
+		if c.b[c.i] == 0xff {
+			return values, nil
+		}
+		if c.next(1)[0] == 0xfe {
+			c.next(4) // prevlen
+		}
+		enc := c.next(1)[0]
+		var value []byte
+		switch enc >> 6 {
+		case 0:
+			value = c.next(int(enc & 0x3f))
+		case 1:
+			value = c.next(int(enc&0x3f)<<8 | int(c.next(1)[0]))
+		case 2:
+			value = c.next(int(binary.BigEndian.Uint32(c.next(4))))
+		default:
+			switch enc {
+			case 0xc0:
+				value = formatInt(int64(int16(
+					binary.LittleEndian.Uint16(c.next(2)))))
+			case 0xd0:
+				value = formatInt(int64(int32(
+					binary.LittleEndian.Uint32(c.next(4)))))
+			case 0xe0:
+				value = formatInt(int64(
+					binary.LittleEndian.Uint64(c.next(8))))
+			case 0xf0:
+				b := c.next(3)
+				x := int32(uint32(b[0])<<8|uint32(b[1])<<16|
+					uint32(b[2])<<24) >> 8
+				value = formatInt(int64(x))
+			case 0xfe:
+				value = formatInt(int64(int8(c.next(1)[0])))
+			default:
+				if enc < 0xf1 || enc > 0xfd {
+					return nil, ErrFormat
+				}
+				value = formatInt(int64(enc&0x0f) - 1)
+			}
+		}
+		values = append(values, value)
+	}
+	if c.err == nil {
+		c.err = ErrFormat // missing the end byte
+	}
+	return nil, c.err
+}
+
+// listpackValues returns the values of a listpack.
+func listpackValues(p []byte) ([][]byte, error) {
+	c := &cursor{b: p}
+	c.next(6) // total bytes and number of elements
+	var values [][]byte
+	for !c.done() {
+		start := c.i
+		enc := c.next(1)[0]
+		var value []byte
+		switch {
+		case enc == 0xff:
+			return values, nil
+		case enc&0x80 == 0:
+			value = formatInt(int64(enc))
+		case enc&0xc0 == 0x80:
+			value = c.next(int(enc & 0x3f))
+		case enc&0xe0 == 0xc0:
+			x := int64(enc&0x1f)<<8 | int64(c.next(1)[0])
+			if x >= 1<<12 {
+				x -= 1 << 13
+			}
+			value = formatInt(x)
+		case enc&0xf0 == 0xe0:
+			value = c.next(int(enc&0x0f)<<8 | int(c.next(1)[0]))
+		case enc == 0xf0:
+			value = c.next(int(binary.LittleEndian.Uint32(c.next(4))))
+		case enc == 0xf1:
+			value = formatInt(int64(int16(
+				binary.LittleEndian.Uint16(c.next(2)))))
+		case enc == 0xf2:
+			b := c.next(3)
+			x := int32(uint32(b[0])<<8|uint32(b[1])<<16|
+				uint32(b[2])<<24) >> 8
+			value = formatInt(int64(x))
+		case enc == 0xf3:
+			value = formatInt(int64(int32(
+				binary.LittleEndian.Uint32(c.next(4)))))
+		case enc == 0xf4:
+			value = formatInt(int64(binary.LittleEndian.Uint64(c.next(8))))
+		default:
+			return nil, ErrFormat
+		}
+		// the backlen is the length of the entry, in 1 to 5 bytes
+		switch n := c.i - start; {
+		case n <= 127:
+			c.next(1)
+		case n < 16383:
+			c.next(2)
+		case n < 2097151:
+			c.next(3)
+		case n < 268435455:
+			c.next(4)
+		default:
+			c.next(5)
+		}
+		values = append(values, value)
+	}
+	if c.err == nil {
+		c.err = ErrFormat
+	}
+	return nil, c.err
+}
+
+// intsetValues returns the values of an intset.
+func intsetValues(p []byte) ([][]byte, error) {
+	c := &cursor{b: p}
+	size := int(binary.LittleEndian.Uint32(c.next(4)))
+	n := int(binary.LittleEndian.Uint32(c.next(4)))
+	if c.err != nil || (size != 2 && size != 4 && size != 8) ||
+		n != (len(p)-8)/size {
+		return nil, ErrFormat
+	}
+	values := make([][]byte, n)
+	for i := range values {
+		b := c.next(size)
+		switch size {
+		case 2:
+			values[i] = formatInt(int64(int16(binary.LittleEndian.Uint16(b))))
+		case 4:
+			values[i] = formatInt(int64(int32(binary.LittleEndian.Uint32(b))))
+		default:
+			values[i] = formatInt(int64(binary.LittleEndian.Uint64(b)))
+		}
+	}
+	return values, c.err
+}
+
+// zipmapValues returns the keys and values of a zipmap, which is the hash
+// encoding of RDB versions before 4.
+func zipmapValues(p []byte) ([][]byte, error) {
+	c := &cursor{b: p}
+	c.next(1) // zmlen
+	readLen := func() (int, bool) {
+		n := c.next(1)[0]
+		switch n {
+		case 0xff:
+			return 0, false
+		case 0xfe:
+			return int(binary.LittleEndian.Uint32(c.next(4))), true
+		}
+		return int(n), true
+	}
+	var values [][]byte
+	for !c.done() {
+		n, ok := readLen()
+		if !ok {
+			return values, nil
+		}
+		key := c.next(n)
+		n, ok = readLen()
+		if !ok {
+			return nil, ErrFormat
+		}
+		free := int(c.next(1)[0])
+		value := c.next(n)
+		c.next(free)
+		values = append(values, key, value)
+	}
+	if c.err == nil {
+		c.err = ErrFormat
+	}
+	return nil, c.err
+}
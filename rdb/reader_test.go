@@ -0,0 +1,253 @@
+package rdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// testFile returns an RDB file of a version, which ends with the checksum.
+func testFile(version string, body ...[]byte) []byte {
+	b := []byte("REDIS" + version)
+	for _, p := range body {
+		b = append(b, p...)
+	}
+	b = append(b, opEOF)
+	p := make([]byte, 8)
+	binary.LittleEndian.PutUint64(p, crc(0, b))
+	return append(b, p...)
+}
+
+// testString returns a string with a 6-bit or 14-bit length.
+func testString(s string) []byte {
+	if len(s) < 64 {
+		return append([]byte{byte(len(s))}, s...)
+	}
+	return append([]byte{byte(len(s)>>8) | len14Bit<<6, byte(len(s))}, s...)
+}
+
+// testZiplist returns a ziplist string of the encoded entries.
+func testZiplist(entries ...[]byte) []byte {
+	b := make([]byte, 10)
+	for _, entry := range entries {
+		b = append(append(b, 0), entry...)
+	}
+	return testString(string(append(b, 0xff)))
+}
+
+// testListpack returns a listpack string of the encoded entries.
+func testListpack(entries ...[]byte) []byte {
+	b := make([]byte, 6)
+	for _, entry := range entries {
+		b = append(append(b, entry...), byte(len(entry)))
+	}
+	return testString(string(append(b, 0xff)))
+}
+
+func testBytes(values ...string) [][]byte {
+	var b [][]byte
+	for _, value := range values {
+		b = append(b, []byte(value))
+	}
+	return b
+}
+
+func testReadAll(t *testing.T, data []byte) []*Entry {
+	t.Helper()
+	rd := NewReader(bytes.NewReader(data))
+	var entries []*Entry
+	for {
+		e, err := rd.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, e)
+	}
+	if _, err := rd.Next(); err != io.EOF {
+		t.Fatalf("expected '%v', got '%v'", io.EOF, err)
+	}
+	return entries
+}
+
+func TestReader(t *testing.T) {
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	data := testFile("0011",
+		join([]byte{opAux}, testString("redis-ver"), testString("7.0.0")),
+		[]byte{opAux}, testString("redis-bits"), []byte{0xc0, 64},
+		[]byte{opSelectDB, 0, opResizeDB, 9, 1},
+		// a string that expires, and integer and compressed strings
+		[]byte{opExpireTimeMS}, []byte{0xe8, 0x03, 0, 0, 0, 0, 0, 0},
+		[]byte{typeString}, testString("s"), testString("v"),
+		[]byte{opIdle, 5, typeString}, testString("i"), []byte{0xc1, 0x18, 0xfc},
+		[]byte{opFreq, 3, typeString}, testString("z"),
+		[]byte{0xc3, 6, 9, 2, 'a', 'b', 'c', 4 << 5, 2},
+		// a ziplist of strings and integers
+		[]byte{typeListZiplist}, testString("zl"), testZiplist(
+			[]byte{1, 'a'},
+			[]byte{0x40, 2, 'b', 'c'},
+			[]byte{0x80, 0, 0, 0, 1, 'd'},
+			[]byte{0xfd},
+			[]byte{0xf1},
+			[]byte{0xfe, 0xfb},
+			[]byte{0xc0, 0xe8, 0x03},
+			[]byte{0xf0, 0xfb, 0xff, 0xff},
+			[]byte{0xd0, 0, 0, 0, 0x80},
+			[]byte{0xe0, 1, 0, 0, 0, 0, 0, 0, 0}),
+		// a listpack of strings and integers
+		[]byte{typeSetListpack}, testString("lp"), testListpack(
+			[]byte{0x81, 'a'},
+			[]byte{0xe0, 2, 'b', 'c'},
+			[]byte{0xf0, 1, 0, 0, 0, 'd'},
+			[]byte{0x7f},
+			[]byte{0xdf, 0x9c},
+			[]byte{0xf1, 0xd4, 0xfe},
+			[]byte{0xf2, 0, 0, 0x80},
+			[]byte{0xf3, 0xff, 0xff, 0xff, 0x7f},
+			[]byte{0xf4, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}),
+		[]byte{typeSetIntset}, testString("is"), testString(string([]byte{
+			2, 0, 0, 0, 2, 0, 0, 0, 0xfe, 0xff, 1, 0})),
+		[]byte{typeHashListpack}, testString("h"), testListpack(
+			[]byte{0x81, 'f'}, []byte{0x05}, []byte{0x81, 'g'},
+			[]byte{0x82, 'h', 'i'}),
+		[]byte{typeHashZiplist}, testString("hz"), testZiplist(
+			[]byte{1, 'f'}, []byte{0xf2}),
+		[]byte{typeHashZipmap}, testString("hm"), testString(string([]byte{
+			1, 1, 'f', 2, 1, 'a', 'b', 0, 0xff})),
+		[]byte{typeZSetZiplist}, testString("zz"), testZiplist(
+			[]byte{1, 'b'}, []byte{3, '1', '.', '5'}, []byte{1, 'a'},
+			[]byte{0xf3}),
+		[]byte{typeZSetListpack}, testString("zp"), testListpack(
+			[]byte{0x81, 'a'}, []byte{0x81, '1'}),
+		[]byte{typeListQuicklist}, testString("ql"),
+		[]byte{2}, testZiplist([]byte{1, 'a'}), testZiplist([]byte{0xf3}),
+		[]byte{typeListQuicklist2}, testString("ql2"),
+		[]byte{2, quicklistNodePlain}, testString("plain"),
+		[]byte{quicklistNodePacked}, testListpack([]byte{0x81, 'x'}),
+		// plain encodings in another database
+		[]byte{opSelectDB, 2, opExpireTime, 0x0a, 0, 0, 0, typeList},
+		testString("l"), []byte{2}, testString("a"), testString("b"),
+		[]byte{typeSet}, testString("set"), []byte{1}, testString("a"),
+		[]byte{typeHash}, testString("hash"), []byte{1}, testString("f"),
+		testString("v"),
+		[]byte{typeZSet}, testString("z1"), []byte{2}, testString("a"),
+		[]byte{3, '2', '.', '5'}, testString("b"), []byte{254},
+		[]byte{typeZSet2}, testString("z2"), []byte{1}, testString("a"),
+		[]byte{0, 0, 0, 0, 0, 0, 0xf8, 0x3f},
+	)
+	rd := NewReader(bytes.NewReader(data))
+	if _, err := rd.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if rd.Version() != 11 {
+		t.Fatalf("expected version 11, got %d", rd.Version())
+	}
+	aux := map[string]string{"redis-ver": "7.0.0", "redis-bits": "64"}
+	if !reflect.DeepEqual(rd.Aux(), aux) {
+		t.Fatalf("expected %v, got %v", aux, rd.Aux())
+	}
+	entries := testReadAll(t, data)
+	exp := []*Entry{
+		{0, "s", []byte("v"), time.Unix(1, 0)},
+		{0, "i", []byte("-1000"), time.Time{}},
+		{0, "z", []byte("abcabcabc"), time.Time{}},
+		{0, "zl", List(testBytes("a", "bc", "d", "12", "0", "-5",
+			"1000", "-5", "-2147483648", "1")), time.Time{}},
+		{0, "lp", newSet(testBytes("a", "bc", "d", "127", "-100", "-300",
+			"-8388608", "2147483647", "-1")), time.Time{}},
+		{0, "is", newSet(testBytes("-2", "1")), time.Time{}},
+		{0, "h", Hash{"f": []byte("5"), "g": []byte("hi")}, time.Time{}},
+		{0, "hz", Hash{"f": []byte("1")}, time.Time{}},
+		{0, "hm", Hash{"f": []byte("ab")}, time.Time{}},
+		{0, "zz", ZSet{{"b", 1.5}, {"a", 2}}, time.Time{}},
+		{0, "zp", ZSet{{"a", 1}}, time.Time{}},
+		{0, "ql", List(testBytes("a", "2")), time.Time{}},
+		{0, "ql2", List(testBytes("plain", "x")), time.Time{}},
+		{2, "l", List(testBytes("a", "b")), time.Unix(10, 0)},
+		{2, "set", newSet(testBytes("a")), time.Time{}},
+		{2, "hash", Hash{"f": []byte("v")}, time.Time{}},
+		{2, "z1", ZSet{{"a", 2.5}, {"b", math.Inf(1)}}, time.Time{}},
+		{2, "z2", ZSet{{"a", 1.5}}, time.Time{}},
+	}
+	if len(entries) != len(exp) {
+		t.Fatalf("expected %d entries, got %d", len(exp), len(entries))
+	}
+	for i, e := range entries {
+		if e.DB != exp[i].DB || e.Key != exp[i].Key ||
+			!e.Expires.Equal(exp[i].Expires) ||
+			!reflect.DeepEqual(e.Value, exp[i].Value) {
+			t.Fatalf("expected %v, got %v", exp[i], e)
+		}
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	data := testFile("0009", []byte{typeString}, testString("a"),
+		testString("b"))
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for _, test := range []struct {
+		data []byte
+		err  error
+	}{
+		{append([]byte("REDIX"), data[5:]...), ErrFormat},
+		{data[:len(data)-8], io.ErrUnexpectedEOF},
+		{data[:12], io.ErrUnexpectedEOF},
+		{append(append([]byte(nil), data[:len(data)-1]...),
+			data[len(data)-1]^1), ErrChecksum},
+		{testFile("0009", []byte{typeString}, testString("a"),
+			[]byte{0xc4}), ErrFormat},
+		{testFile("0009", []byte{typeSetIntset}, testString("a"),
+			testString(string([]byte{3, 0, 0, 0, 0, 0, 0, 0}))), ErrFormat},
+		{testFile("0009", []byte{typeListZiplist}, testString("a"),
+			testString(string(make([]byte, 10)))), ErrFormat},
+		{testFile("0009", []byte{typeListZiplist}, testString("a"),
+			testZiplist([]byte{0x05, 'a'})), ErrFormat},
+		{testFile("0009", []byte{15}, testString("a")), errUnsupported},
+		// corrupt lengths
+		{testFile("0009", []byte{typeString}, testString("a"),
+			[]byte{len32Bit, 0x7f, 0xff, 0xff, 0xff, 'b'}), io.ErrUnexpectedEOF},
+		{testFile("0009", []byte{typeString}, testString("a"),
+			[]byte{lenEnc<<6 | encLZF, 1, len32Bit, 0x7f, 0xff, 0xff, 0xff,
+				0}), ErrFormat},
+		{testFile("0009", []byte{opModuleAux}), errUnsupported},
+	} {
+		rd := NewReader(bytes.NewReader(test.data))
+		var err error
+		for err == nil {
+			_, err = rd.Next()
+		}
+		if err != test.err {
+			t.Fatalf("%q: expected '%v', got '%v'", test.data, test.err, err)
+		}
+	}
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Fatalf("expected less than 1MB of allocations, got %d", n)
+	}
+	if _, err := NewReader(bytes.NewReader([]byte("REDIS0013"))).Next(); err ==
+		nil || err == ErrFormat {
+		t.Fatalf("expected an unsupported version, got '%v'", err)
+	}
+
+	// a zero checksum is not verified
+	data = append(data[:len(data)-8], make([]byte, 8)...)
+	if entries := testReadAll(t, data); len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	// files before version 5 have no checksum
+	data = []byte("REDIS0004\x00\x01a\x01b\xff")
+	if entries := testReadAll(t, data); len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+}
@@ -0,0 +1,179 @@
+package rdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Writer writes entries to an RDB file. The file is complete after Close.
+type Writer struct {
+	wr      *bufio.Writer
+	sum     uint64 // the checksum of the bytes that were written
+	db      int
+	started bool
+	err     error
+}
+
+// NewWriter returns a Writer that writes an RDB file to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{wr: bufio.NewWriter(w), db: -1}
+}
+
+func (w *Writer) write(p []byte) {
+	if w.err != nil {
+		return
+	}
+	if !w.started {
+		w.started = true
+		w.write([]byte(fmt.Sprintf("REDIS%04d", Version)))
+	}
+	w.sum = crc(w.sum, p)
+	_, w.err = w.wr.Write(p)
+}
+
+func (w *Writer) writeByte(b byte) {
+	w.write([]byte{b})
+}
+
+func (w *Writer) writeLength(n uint64) {
+	switch {
+	case n < 1<<6:
+		w.writeByte(byte(n))
+	case n < 1<<14:
+		w.write([]byte{byte(n>>8) | len14Bit<<6, byte(n)})
+	case n <= math.MaxUint32:
+		p := []byte{len32Bit, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(p[1:], uint32(n))
+		w.write(p)
+	default:
+		p := []byte{len64Bit, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(p[1:], n)
+		w.write(p)
+	}
+}
+
+// writeString writes a string, which is encoded as an integer when it is
+// the canonical form of a small integer.
+func (w *Writer) writeString(p []byte) {
+	if len(p) > 0 && len(p) <= 11 {
+		x, err := strconv.ParseInt(string(p), 10, 32)
+		if err == nil && strconv.FormatInt(x, 10) == string(p) {
+			switch {
+			case x >= math.MinInt8 && x <= math.MaxInt8:
+				w.write([]byte{lenEnc<<6 | encInt8, byte(x)})
+			case x >= math.MinInt16 && x <= math.MaxInt16:
+				b := []byte{lenEnc<<6 | encInt16, 0, 0}
+				binary.LittleEndian.PutUint16(b[1:], uint16(x))
+				w.write(b)
+			default:
+				b := []byte{lenEnc<<6 | encInt32, 0, 0, 0, 0}
+				binary.LittleEndian.PutUint32(b[1:], uint32(x))
+				w.write(b)
+			}
+			return
+		}
+	}
+	w.writeLength(uint64(len(p)))
+	w.write(p)
+}
+
+// WriteAux writes an aux field, such as "redis-ver".
+func (w *Writer) WriteAux(key, value string) error {
+	w.writeByte(opAux)
+	w.writeString([]byte(key))
+	w.writeString([]byte(value))
+	return w.err
+}
+
+// WriteEntry writes an entry. The fields of hashes and the members of sets
+// are written in order.
+func (w *Writer) WriteEntry(e *Entry) error {
+	var typ byte
+	switch e.Value.(type) {
+	case []byte:
+		typ = typeString
+	case List:
+		typ = typeList
+	case Set:
+		typ = typeSet
+	case Hash:
+		typ = typeHash
+	case ZSet:
+		typ = typeZSet2
+	default:
+		return errUnsupported
+	}
+	if e.DB != w.db {
+		w.writeByte(opSelectDB)
+		w.writeLength(uint64(e.DB))
+		w.db = e.DB
+	}
+	if !e.Expires.IsZero() {
+		p := make([]byte, 9)
+		p[0] = opExpireTimeMS
+		ms := e.Expires.Unix()*1000 +
+			int64(e.Expires.Nanosecond())/int64(time.Millisecond)
+		binary.LittleEndian.PutUint64(p[1:], uint64(ms))
+		w.write(p)
+	}
+	w.writeByte(typ)
+	w.writeString([]byte(e.Key))
+	switch v := e.Value.(type) {
+	case []byte:
+		w.writeString(v)
+	case List:
+		w.writeLength(uint64(len(v)))
+		for _, value := range v {
+			w.writeString(value)
+		}
+	case Set:
+		members := make([]string, 0, len(v))
+		for member := range v {
+			members = append(members, member)
+		}
+		sort.Strings(members)
+		w.writeLength(uint64(len(members)))
+		for _, member := range members {
+			w.writeString([]byte(member))
+		}
+	case Hash:
+		fields := make([]string, 0, len(v))
+		for field := range v {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		w.writeLength(uint64(len(fields)))
+		for _, field := range fields {
+			w.writeString([]byte(field))
+			w.writeString(v[field])
+		}
+	case ZSet:
+		w.writeLength(uint64(len(v)))
+		p := make([]byte, 8)
+		for _, m := range v {
+			w.writeString([]byte(m.Member))
+			binary.LittleEndian.PutUint64(p, math.Float64bits(m.Score))
+			w.write(p)
+		}
+	}
+	return w.err
+}
+
+// Close writes the end of the file and its checksum, and flushes the
+// writes. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	w.writeByte(opEOF)
+	p := make([]byte, 8)
+	binary.LittleEndian.PutUint64(p, w.sum)
+	w.write(p)
+	if w.err != nil {
+		return w.err
+	}
+	return w.wr.Flush()
+}
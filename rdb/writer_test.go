@@ -0,0 +1,84 @@
+package rdb
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWriter(t *testing.T) {
+	long := strings.Repeat("x", 20000)
+	entries := []*Entry{
+		{0, "s", []byte("v"), time.Unix(1700000000, 123000000)},
+		{0, "i8", []byte("-12"), time.Time{}},
+		{0, "i16", []byte("1000"), time.Time{}},
+		{0, "i32", []byte("-2147483648"), time.Time{}},
+		{0, "i64", []byte("2147483648"), time.Time{}},
+		{0, "zero", []byte("007"), time.Time{}},
+		{0, "empty", []byte{}, time.Time{}},
+		{0, long, []byte(long), time.Time{}},
+		{0, "big", bytes.Repeat([]byte("y"), readChunk*3+1), time.Time{}},
+		{1, "l", List(testBytes("a", "1", "b")), time.Time{}},
+		{1, "set", newSet(testBytes("a", "b", "100")), time.Time{}},
+		{3, "h", Hash{"f": []byte("1"), "g": []byte("v")}, time.Time{}},
+		{3, "z", ZSet{{"a", math.Inf(-1)}, {"b", 1.5}}, time.Unix(10, 0)},
+	}
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if err := w.WriteAux("redis-bits", "64"); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if err := w.WriteEntry(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.WriteEntry(&Entry{Key: "x", Value: 1}); err != errUnsupported {
+		t.Fatalf("expected '%v', got '%v'", errUnsupported, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("REDIS0009")) {
+		t.Fatalf("unexpected header %q", buf.Bytes()[:9])
+	}
+	// the integers are encoded in 2, 3 and 5 bytes
+	for _, enc := range [][]byte{
+		{3, 'i', '1', '6', 0xc1, 0xe8, 0x03},
+		{3, 'i', '3', '2', 0xc2, 0, 0, 0, 0x80},
+		{3, 'i', '6', '4', 10},
+	} {
+		if !bytes.Contains(buf.Bytes(), enc) {
+			t.Fatalf("expected %q", enc)
+		}
+	}
+
+	rd := NewReader(bytes.NewReader(buf.Bytes()))
+	res := testReadAll(t, buf.Bytes())
+	if len(res) != len(entries) {
+		t.Fatalf("expected %d entries, got %d", len(entries), len(res))
+	}
+	for i, e := range res {
+		if e.DB != entries[i].DB || e.Key != entries[i].Key ||
+			!e.Expires.Equal(entries[i].Expires) ||
+			!reflect.DeepEqual(e.Value, entries[i].Value) {
+			t.Fatalf("expected %v, got %v", entries[i], e)
+		}
+	}
+	rd.Next()
+	if rd.Aux()["redis-bits"] != "64" {
+		t.Fatalf("unexpected aux %v", rd.Aux())
+	}
+
+	// an empty file
+	buf.Reset()
+	if err := NewWriter(&buf).Close(); err != nil {
+		t.Fatal(err)
+	}
+	if res := testReadAll(t, buf.Bytes()); len(res) != 0 {
+		t.Fatalf("expected no entries, got %d", len(res))
+	}
+}
@@ -3,17 +3,19 @@ package redcon
 
 import (
 	"bufio"
+	"container/list"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tidwall/btree"
-	"github.com/tidwall/match"
 )
 
 var (
@@ -375,6 +377,8 @@ func serve(s *Server) error {
 			rd:   NewReader(lnconn),
 		}
 		s.mu.Lock()
+		s.nextid++
+		c.id = s.nextid
 		c.idleClose = s.idleClose
 		s.conns[c] = true
 		s.mu.Unlock()
@@ -394,8 +398,10 @@ func handle(s *Server, c *conn) {
 	var err error
 	defer func() {
 		if err != errDetached {
-			// do not close the connection when a detach is detected.
+			// do not close the connection when a detach is detected. The
+			// hooks are called when the detached connection is closed.
 			c.conn.Close()
+			c.runCloseHooks()
 		}
 		func() {
 			// remove the conn from the server
@@ -423,11 +429,16 @@ func handle(s *Server, c *conn) {
 				if err, ok := err.(*errProtocol); ok {
 					// All protocol errors should attempt a response to
 					// the client. Ignore write errors.
+					c.pushMu.Lock()
 					c.wr.WriteError("ERR " + err.Error())
 					c.wr.Flush()
+					c.pushMu.Unlock()
 				}
 				return err
 			}
+			c.pushMu.Lock()
+			c.busy = true
+			c.pushMu.Unlock()
 			c.cmds = cmds
 			for len(c.cmds) > 0 {
 				cmd := c.cmds[0]
@@ -445,24 +456,113 @@ func handle(s *Server, c *conn) {
 			if c.closed {
 				return nil
 			}
-			if err := c.wr.Flush(); err != nil {
+			if err := c.flushPush(); err != nil {
 				return err
 			}
 		}
 	}()
 }
 
+// onClose registers a function that is called when the connection is
+// closed. Registering a function with the same key replaces the previous
+// function.
+func (c *conn) onClose(key interface{}, fn func()) {
+	if c.closeHooks == nil {
+		c.closeHooks = make(map[interface{}]func())
+	}
+	c.closeHooks[key] = fn
+}
+
+// runCloseHooks calls the functions that were registered with onClose.
+func (c *conn) runCloseHooks() {
+	hooks := c.closeHooks
+	c.closeHooks = nil
+	for _, hook := range hooks {
+		hook()
+	}
+}
+
+// push writes a frame, such as a RESP3 push, to the connection from any
+// goroutine. The frame is written after the replies of the commands that
+// are currently being handled, or immediately when the connection is idle.
+func (c *conn) push(frame []byte) {
+	c.pushMu.Lock()
+	defer c.pushMu.Unlock()
+	switch {
+	case c.pushFn != nil:
+		c.pushFn(frame)
+	case c.busy || c.detached:
+		// a detached connection writes the frames when it is flushed
+		c.pushBuf = append(c.pushBuf, frame...)
+	default:
+		c.wr.b = append(c.wr.b, frame...)
+		c.wr.Flush()
+	}
+}
+
+// setPushFn sets the function that writes the push frames of a detached
+// connection, such as through the writer of a subscriber. The pending
+// frames are passed to fn.
+func (c *conn) setPushFn(fn func(frame []byte)) {
+	c.pushMu.Lock()
+	defer c.pushMu.Unlock()
+	if len(c.pushBuf) > 0 {
+		fn(c.pushBuf)
+		c.pushBuf = nil
+	}
+	c.pushFn = fn
+}
+
+// flushPush appends the pending push frames and flushes the connection.
+func (c *conn) flushPush() error {
+	c.pushMu.Lock()
+	defer c.pushMu.Unlock()
+	c.wr.b = append(c.wr.b, c.pushBuf...)
+	c.pushBuf = nil
+	c.busy = false
+	return c.wr.Flush()
+}
+
+// writeMap writes a map header, which is a RESP3 map or, for RESP2, an
+// array with two elements for each pair.
+func (c *conn) writeMap(n int) {
+	if c.proto == 3 {
+		c.wr.WriteRaw(AppendMap(nil, n))
+	} else {
+		c.wr.WriteArray(n * 2)
+	}
+}
+
 // conn represents a client connection
 type conn struct {
-	conn      net.Conn
-	wr        *Writer
-	rd        *Reader
-	addr      string
-	ctx       interface{}
-	detached  bool
-	closed    bool
-	cmds      []Command
-	idleClose time.Duration
+	conn         net.Conn
+	wr           *Writer
+	rd           *Reader
+	addr         string
+	ctx          interface{}
+	detached     bool
+	closed       bool
+	cmds         []Command
+	idleClose    time.Duration
+	id           uint64
+	name         string
+	user         string                 // authenticated user
+	authed       bool                   // user has been authenticated
+	authChecked  bool                   // the default user has been checked for a password
+	multi        bool                   // in a MULTI transaction
+	multiErr     bool                   // a queued command was invalid
+	multiCmds    []Command              // queued commands
+	execing      bool                   // running the commands of EXEC
+	watched      []string               // watched keys, guarded by the TxHandler
+	watchDirty   bool                   // a watched key was touched
+	closeHooks   map[interface{}]func() // called when the conn is closed
+	proto        int                    // RESP protocol version from HELLO
+	pushMu       sync.Mutex             // guards busy, pushBuf and pushFn
+	busy         bool                   // the conn is handling commands
+	pushBuf      []byte                 // pending push frames
+	pushFn       func(frame []byte)     // writes push frames when detached
+	trackCaching bool                   // CLIENT CACHING was called for the next command
+	propagate    func(args [][]byte)    // receives the commands of Propagate
 }
 
 func (c *conn) Close() error {
@@ -508,6 +608,63 @@ func BaseWriter(c Conn) *Writer {
 	return nil
 }
 
+// baseConn returns the underlying server connection, if any
+func baseConn(c Conn) *conn {
+	switch c := c.(type) {
+	case *conn:
+		return c
+	case *detachedConn:
+		return c.conn
+	}
+	return nil
+}
+
+// WatchClose returns a channel that is closed when the client of the
+// connection disconnects, which allows for a handler that blocks, such as
+// for a blocking command, to stop early. The stop function must be called
+// before the handler returns. Commands that the client sends in the
+// meantime are not lost, but the client is not watched after that.
+//
+//	closed, stop := redcon.WatchClose(conn)
+//	defer stop()
+//	select {
+//	case <-ready:
+//	case <-closed:
+//	    return
+//	}
+func WatchClose(conn Conn) (closed <-chan struct{}, stop func()) {
+	done := make(chan struct{})
+	c := baseConn(conn)
+	if c == nil || c.conn == nil || c.rd == nil {
+		return done, func() {}
+	}
+	// The reader is not used while the handler blocks, so peeking at the
+	// buffered reader keeps the commands that are read for later.
+	c.conn.SetReadDeadline(time.Time{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		if _, err := c.rd.rd.Peek(1); err != nil {
+			if err, ok := err.(net.Error); ok && err.Timeout() {
+				return
+			}
+			close(done)
+		}
+	}()
+	var once sync.Once
+	return done, func() {
+		once.Do(func() {
+			select {
+			case <-exited:
+			default:
+				c.conn.SetReadDeadline(time.Now())
+				<-exited
+				c.conn.SetReadDeadline(time.Time{})
+			}
+		})
+	}
+}
+
 // DetachedConn represents a connection that is detached from the server
 type DetachedConn interface {
 	// Conn is the original connection
@@ -522,9 +679,14 @@ type DetachedConn interface {
 // a detached connection. This is useful for operations such as PubSub.
 // The detached connection must be closed by calling Close() when done.
 // All writes such as WriteString() will not be written to the client
-// until Flush() is called.
+// until Flush() is called. The functions that are called when the
+// connection is closed, such as to stop client tracking, are called when
+// the detached connection is closed.
 func (c *conn) Detach() DetachedConn {
+	c.pushMu.Lock()
 	c.detached = true
+	c.busy = false
+	c.pushMu.Unlock()
 	cmds := c.cmds
 	c.cmds = nil
 	return &detachedConn{conn: c, cmds: cmds}
@@ -535,11 +697,24 @@ type detachedConn struct {
 	cmds []Command
 }
 
-// Flush writes and Write* calls to the client.
+// Flush writes and Write* calls to the client, followed by the pending push
+// frames.
 func (dc *detachedConn) Flush() error {
+	dc.pushMu.Lock()
+	dc.wr.b = append(dc.wr.b, dc.pushBuf...)
+	dc.pushBuf = nil
+	dc.pushMu.Unlock()
 	return dc.conn.wr.Flush()
 }
 
+// Close closes the connection, and calls the functions that are registered
+// to be called when the connection is closed.
+func (dc *detachedConn) Close() error {
+	err := dc.conn.Close()
+	dc.runCloseHooks()
+	return err
+}
+
 // ReadCommand read the next command from the client.
 func (dc *detachedConn) ReadCommand() (Command, error) {
 	if len(dc.cmds) > 0 {
@@ -578,6 +753,7 @@ type Server struct {
 	ln        net.Listener
 	done      bool
 	idleClose time.Duration
+	nextid    uint64
 
 	// AcceptError is an optional function used to handle Accept errors.
 	AcceptError func(err error)
@@ -1074,6 +1250,7 @@ func (f HandlerFunc) ServeRESP(conn Conn, cmd Command) {
 // ServeMux is an RESP command multiplexer.
 type ServeMux struct {
 	handlers map[string]Handler
+	specs    map[string]CommandSpec
 }
 
 // NewServeMux allocates and returns a new ServeMux.
@@ -1112,6 +1289,11 @@ func (m *ServeMux) ServeRESP(conn Conn, cmd Command) {
 	command := strings.ToLower(string(cmd.Args[0]))
 
 	if handler, ok := m.handlers[command]; ok {
+		if spec, ok := m.specs[command]; ok && !spec.CheckArity(len(cmd.Args)) {
+			conn.WriteError("ERR wrong number of arguments for '" + command +
+				"' command")
+			return
+		}
 		handler.ServeRESP(conn, cmd)
 	} else {
 		conn.WriteError("ERR unknown command '" + command + "'")
@@ -1124,84 +1306,568 @@ type PubSub struct {
 	nextid uint64
 	initd  bool
 	chans  *btree.BTree
+	schans *btree.BTree // shard channels
+	pats   patternIndex // pattern entries, which are also in chans
 	conns  map[Conn]*pubSubConn
+	acl    *ACL
+	broker Broker
+	hooks  pubSubHooks
+
+	histMu    sync.Mutex // protects the history, which is written by Publish
+	histSize  int32      // accessed atomically
+	histChans int        // maximum number of channels with a history
+	hist      map[string]*historyRing
+	histLRU   *list.List // rings, the most recently published first
+	histLast  historyID
+
+	queueSize   int // zero is DefaultSubscriberQueueSize
+	queuePolicy SubscriberPolicy
+}
+
+// SubscriberPolicy is what happens when a message is published to a
+// subscriber that has a full message queue.
+type SubscriberPolicy int
+
+const (
+	// SubscriberDisconnect closes the connection of the subscriber, which
+	// is the default.
+	SubscriberDisconnect SubscriberPolicy = iota
+	// SubscriberDrop drops the message for the subscriber.
+	SubscriberDrop
+	// SubscriberBlock blocks the publisher until there's room in the queue.
+	SubscriberBlock
+)
+
+// DefaultSubscriberQueueSize is the default number of messages that may be
+// queued for a subscriber.
+const DefaultSubscriberQueueSize = 1024
+
+// SetSubscriberQueue sets the maximum number of messages that may be queued
+// for each subscriber, and what happens when the queue is full. Messages
+// are written to subscribers in the background, so that a slow subscriber
+// does not stall publishers. The settings apply to new subscribers.
+func (ps *PubSub) SetSubscriberQueue(size int, policy SubscriberPolicy) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if size <= 0 {
+		size = DefaultSubscriberQueueSize
+	}
+	ps.queueSize = size
+	ps.queuePolicy = policy
+}
+
+// SetACL sets the ACL that is used to check the channel permissions of
+// subscribers. Subscribers are only sent messages for channels that they
+// are permitted to access.
+func (ps *PubSub) SetACL(acl *ACL) {
+	ps.mu.Lock()
+	ps.acl = acl
+	ps.mu.Unlock()
 }
 
 // Subscribe a connection to PubSub
 func (ps *PubSub) Subscribe(conn Conn, channel string) {
-	ps.subscribe(conn, false, channel)
+	ps.subscribe(conn, false, false, channel, nil)
 }
 
 // Psubscribe a connection to PubSub
 func (ps *PubSub) Psubscribe(conn Conn, channel string) {
-	ps.subscribe(conn, true, channel)
+	ps.subscribe(conn, true, false, channel, nil)
+}
+
+// Ssubscribe a connection to a shard channel. Shard channels are a separate
+// namespace from the channels of Subscribe, and their messages are only
+// sent with Spublish.
+func (ps *PubSub) Ssubscribe(conn Conn, channel string) {
+	ps.subscribe(conn, false, true, channel, nil)
+}
+
+// Spublish publishes a message to the subscribers of a shard channel, and
+// returns the number of subscribers that received the message.
+func (ps *PubSub) Spublish(channel, message string) int {
+	return ps.spublish(channel, AppendBulkString(nil, message), false)
+}
+
+// SpublishBytes is like Spublish, but the channel and message are bytes.
+func (ps *PubSub) SpublishBytes(channel, message []byte) int {
+	return ps.spublish(string(channel), AppendBulk(nil, message), false)
+}
+
+// SpublishPayload is like Spublish, but the message is a Payload that was
+// encoded with NewPayload.
+func (ps *PubSub) SpublishPayload(channel string, payload *Payload) int {
+	return ps.spublish(channel, payload.bulk, false)
+}
+
+// spublish queues an encoded bulk message to the shard channel subscribers.
+// Messages that did not come from the broker are passed to beforePublish.
+func (ps *PubSub) spublish(channel string, bulk []byte, received bool) int {
+	if !received {
+		var ok bool
+		if channel, ok = ps.beforePublish(channel, bulk, true); !ok {
+			return 0
+		}
+	}
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	if !ps.initd {
+		return 0
+	}
+	var sent int
+	var head []byte
+	var local *Message
+	pivot := &pubSubEntry{shard: true, channel: channel}
+	ps.schans.Ascend(pivot, func(item interface{}) bool {
+		entry := item.(*pubSubEntry)
+		if entry.channel != pivot.channel {
+			return false
+		}
+		if ps.denied(entry) {
+			return true
+		}
+		var msg pubSubMessage
+		if entry.sconn.fn != nil {
+			if local == nil {
+				local = &Message{Shard: true, Channel: channel,
+					Message: bulkData(bulk)}
+			}
+			msg.local = local
+		} else {
+			if head == nil {
+				head = appendMessageHead(nil, entry, channel)
+			}
+			msg.head, msg.bulk = head, bulk
+		}
+		if entry.sconn.enqueue(msg) {
+			sent++
+		}
+		return true
+	})
+	return sent
+}
+
+// init initializes the PubSub instance. The caller must hold the lock.
+func (ps *PubSub) init() {
+	if !ps.initd {
+		ps.conns = make(map[Conn]*pubSubConn)
+		ps.chans = btree.New(byEntry)
+		ps.schans = btree.New(byEntry)
+		ps.initd = true
+	}
+}
+
+// denied returns true when the ACL denies the subscriber of an entry access
+// to its channel. Subscribers that were created with NewSubscriber are not
+// checked.
+func (ps *PubSub) denied(entry *pubSubEntry) bool {
+	return ps.acl != nil && entry.sconn.fn == nil &&
+		!ps.acl.CheckChannel(entry.sconn.user, entry.channel, entry.pattern)
+}
+
+// tree returns the btree for an entry.
+func (ps *PubSub) tree(entry *pubSubEntry) *btree.BTree {
+	if entry.shard {
+		return ps.schans
+	}
+	return ps.chans
+}
+
+// addEntry adds an entry to its btree and, for patterns, the pattern index.
+// The caller must hold the lock.
+func (ps *PubSub) addEntry(entry *pubSubEntry) {
+	ps.tree(entry).Set(entry)
+	if entry.pattern {
+		ps.pats.add(entry)
+	}
+}
+
+// removeEntry removes an entry that was added with addEntry. The caller
+// must hold the lock.
+func (ps *PubSub) removeEntry(entry *pubSubEntry) {
+	ps.tree(entry).Delete(entry)
+	if entry.pattern {
+		ps.pats.remove(entry)
+	}
+}
+
+// Payload is a message that is encoded once, and which may be published
+// any number of times to any number of subscribers without being encoded or
+// copied again. This is useful for large messages.
+type Payload struct {
+	bulk []byte
+}
+
+// NewPayload returns a Payload for the message. The message is copied, so
+// it may be reused after the call.
+func NewPayload(message []byte) *Payload {
+	return &Payload{bulk: AppendBulk(nil, message)}
 }
 
 // Publish a message to subscribers
 func (ps *PubSub) Publish(channel, message string) int {
+	return ps.publish(channel, AppendBulkString(nil, message), false)
+}
+
+// PublishBytes is like Publish, but the channel and message are bytes, such
+// as the arguments of a command. The message is copied, so it may be reused
+// after the call.
+func (ps *PubSub) PublishBytes(channel, message []byte) int {
+	return ps.publish(string(channel), AppendBulk(nil, message), false)
+}
+
+// PublishPayload is like Publish, but the message is a Payload that was
+// encoded with NewPayload.
+func (ps *PubSub) PublishPayload(channel string, payload *Payload) int {
+	return ps.publish(channel, payload.bulk, false)
+}
+
+// publish queues an encoded bulk message to the channel and pattern
+// subscribers. The bulk is shared by all of the subscribers. Messages that
+// did not come from the broker are passed to beforePublish.
+func (ps *PubSub) publish(channel string, bulk []byte, received bool) int {
+	if !received {
+		var ok bool
+		if channel, ok = ps.beforePublish(channel, bulk, false); !ok {
+			return 0
+		}
+	}
 	ps.mu.RLock()
 	defer ps.mu.RUnlock()
+	id := ps.record(channel, bulk)
 	if !ps.initd {
 		return 0
 	}
 	var sent int
-	// write messages to all clients that are subscribed on the channel
+	// queue messages to all clients that are subscribed on the channel. The
+	// message head is encoded once and shared by all of the subscribers.
+	var head, idHead []byte
+	var local *Message
 	pivot := &pubSubEntry{pattern: false, channel: channel}
 	ps.chans.Ascend(pivot, func(item interface{}) bool {
 		entry := item.(*pubSubEntry)
 		if entry.channel != pivot.channel || entry.pattern != pivot.pattern {
 			return false
 		}
-		entry.sconn.writeMessage(entry.pattern, "", channel, message)
-		sent++
+		if ps.denied(entry) {
+			return true
+		}
+		msg := pubSubMessage{head: head, bulk: bulk}
+		if entry.sconn.fn != nil {
+			if local == nil {
+				local = &Message{Channel: channel, Message: bulkData(bulk)}
+			}
+			msg = pubSubMessage{local: local}
+		} else if entry.ids && id != nil {
+			if idHead == nil {
+				idHead = appendMessageHead(nil, entry, channel)
+			}
+			msg.head, msg.tail = idHead, id
+		} else if head == nil {
+			head = appendMessageHead(nil, &pubSubEntry{}, channel)
+			msg.head = head
+		}
+		if entry.sconn.enqueue(msg) {
+			sent++
+		}
 		return true
 	})
 
-	// match on and write all psubscribe clients
-	pivot = &pubSubEntry{pattern: true}
+	// match on and queue to all psubscribe clients. The entries of a
+	// pattern are matched together, so the pmessage head is encoded once
+	// for each pattern.
+	var phead []byte
+	var ppattern string
+	var plocal *Message
+	ps.pats.match(channel, func(entry *pubSubEntry) {
+		if ps.denied(entry) {
+			return
+		}
+		var msg pubSubMessage
+		if entry.sconn.fn != nil {
+			if plocal == nil || plocal.Pattern != entry.channel {
+				plocal = &Message{Pattern: entry.channel, Channel: channel,
+					Message: bulkData(bulk)}
+			}
+			msg.local = plocal
+		} else {
+			if phead == nil || ppattern != entry.channel {
+				phead = appendMessageHead(nil, entry, channel)
+				ppattern = entry.channel
+			}
+			msg.head, msg.bulk = phead, bulk
+		}
+		if entry.sconn.enqueue(msg) {
+			sent++
+		}
+	})
+
+	return sent
+}
+
+// hasConn returns true when the connection with the id is a subscriber.
+func (ps *PubSub) hasConn(id uint64) bool {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	for conn := range ps.conns {
+		if c := baseConn(conn); c != nil && c.id == id {
+			return true
+		}
+	}
+	return false
+}
+
+// sendInvalidate writes a client tracking invalidation message to the
+// client with the id, when it's subscribed to the __redis__:invalidate
+// channel. Nil keys invalidate all keys. Returns false when the client is
+// not subscribed.
+func (ps *PubSub) sendInvalidate(id uint64, keys []string) bool {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	if !ps.initd {
+		return false
+	}
+	var sent bool
+	pivot := &pubSubEntry{channel: "__redis__:invalidate"}
 	ps.chans.Ascend(pivot, func(item interface{}) bool {
 		entry := item.(*pubSubEntry)
-		if match.Match(channel, entry.channel) {
-			entry.sconn.writeMessage(entry.pattern, entry.channel, channel,
-				message)
+		if entry.channel != pivot.channel || entry.pattern {
+			return false
 		}
-		sent++
-		return true
+		if c := baseConn(entry.sconn.conn); c == nil || c.id != id {
+			return true
+		}
+		b := AppendArray(nil, 3)
+		b = AppendBulkString(b, "message")
+		b = AppendBulkString(b, entry.channel)
+		if keys == nil {
+			b = AppendNull(b)
+		} else {
+			b = AppendArray(b, len(keys))
+			for _, key := range keys {
+				b = AppendBulkString(b, key)
+			}
+		}
+		entry.sconn.reply(b)
+		sent = true
+		return false
 	})
-
 	return sent
 }
 
 type pubSubConn struct {
 	id      uint64
+	user    string
 	mu      sync.Mutex
 	conn    Conn
 	dconn   DetachedConn
 	entries map[*pubSubEntry]bool
+
+	queue  chan pubSubMessage // written by the writer
+	policy SubscriberPolicy
+	done   chan struct{} // closed when the subscriber has disconnected
+	once   sync.Once     // disconnect once
+	dmu    sync.Once     // close done once
+
+	// The replies to commands, such as SUBSCRIBE, are not limited by the
+	// queue size. They are written by the writer in order with the queued
+	// messages, by the sequence numbers of both.
+	seq     uint64 // the last sequence number, accessed atomically
+	rmu     sync.Mutex
+	replies []pubSubReply
+	wake    chan struct{} // signals the writer of a reply
+
+	fn    func(msg Message) // receives the messages of a Subscriber
+	close func()            // closes a Subscriber
 }
 
 type pubSubEntry struct {
 	pattern bool
+	shard   bool
+	ids     bool // messages include the history id, see SubscribeReplay
 	sconn   *pubSubConn
 	channel string
 }
 
-func (sconn *pubSubConn) writeMessage(pat bool, pchan, channel, msg string) {
-	sconn.mu.Lock()
-	defer sconn.mu.Unlock()
-	if pat {
-		sconn.dconn.WriteArray(4)
-		sconn.dconn.WriteBulkString("pmessage")
-		sconn.dconn.WriteBulkString(pchan)
-		sconn.dconn.WriteBulkString(channel)
-		sconn.dconn.WriteBulkString(msg)
-	} else {
-		sconn.dconn.WriteArray(3)
-		sconn.dconn.WriteBulkString("message")
-		sconn.dconn.WriteBulkString(channel)
-		sconn.dconn.WriteBulkString(msg)
+// kind returns the subscription kind, such as "subscribe", "psubscribe" or
+// "ssubscribe", with an optional prefix.
+func (entry *pubSubEntry) kind(prefix string) string {
+	if entry.pattern {
+		return "p" + prefix + "subscribe"
+	}
+	if entry.shard {
+		return "s" + prefix + "subscribe"
+	}
+	return prefix + "subscribe"
+}
+
+// pubSubMessage is a queued message, which is the encoded head, the encoded
+// bulk payload and an optional encoded tail. All may be shared by many
+// subscribers.
+type pubSubMessage struct {
+	seq   uint64
+	head  []byte
+	bulk  []byte
+	tail  []byte
+	local *Message // for a Subscriber
+}
+
+// pubSubReply is a queued reply to a command of a subscriber.
+type pubSubReply struct {
+	seq uint64
+	b   []byte
+}
+
+// appendMessageHead appends the head of an encoded message, pmessage or
+// smessage for the entry to dst, which is everything but the payload.
+func appendMessageHead(dst []byte, entry *pubSubEntry, channel string) []byte {
+	switch {
+	case entry.pattern:
+		dst = AppendArray(dst, 4)
+		dst = AppendBulkString(dst, "pmessage")
+		dst = AppendBulkString(dst, entry.channel)
+	case entry.shard:
+		dst = AppendArray(dst, 3)
+		dst = AppendBulkString(dst, "smessage")
+	case entry.ids:
+		dst = AppendArray(dst, 4)
+		dst = AppendBulkString(dst, "message")
+	default:
+		dst = AppendArray(dst, 3)
+		dst = AppendBulkString(dst, "message")
+	}
+	return AppendBulkString(dst, channel)
+}
+
+// enqueue adds a message to the queue of the subscriber, which is
+// written by the writer goroutine. When the queue is full the policy of the
+// subscriber is applied. Returns false when the message was not queued.
+func (sconn *pubSubConn) enqueue(msg pubSubMessage) bool {
+	msg.seq = atomic.AddUint64(&sconn.seq, 1)
+	select {
+	case sconn.queue <- msg:
+		return true
+	case <-sconn.done:
+		return false
+	default:
+	}
+	switch sconn.policy {
+	case SubscriberBlock:
+		select {
+		case sconn.queue <- msg:
+			return true
+		case <-sconn.done:
+			return false
+		}
+	case SubscriberDrop:
+		return false
+	default:
+		sconn.disconnect()
+		return false
+	}
+}
+
+// disconnect closes the network connection of the subscriber, which ends
+// the bgrunner.
+func (sconn *pubSubConn) disconnect() {
+	sconn.once.Do(func() {
+		if sconn.close != nil {
+			// the caller may hold the PubSub lock
+			go sconn.close()
+		} else if c := baseConn(sconn.conn); c != nil && c.conn != nil {
+			c.conn.Close()
+		}
+	})
+}
+
+// closeDone closes the done channel, which stops the writer and unblocks
+// the publishers that are waiting for room in the queue.
+func (sconn *pubSubConn) closeDone() {
+	sconn.dmu.Do(func() { close(sconn.done) })
+}
+
+// reply queues the reply to a command, which is written after the messages
+// that were queued before it. A reply never blocks, so it may be queued
+// while holding the PubSub lock.
+func (sconn *pubSubConn) reply(b []byte) {
+	sconn.rmu.Lock()
+	sconn.replies = append(sconn.replies,
+		pubSubReply{seq: atomic.AddUint64(&sconn.seq, 1), b: b})
+	sconn.rmu.Unlock()
+	select {
+	case sconn.wake <- struct{}{}:
+	default:
+	}
+}
+
+// writeReplies writes the queued replies that are before the sequence
+// number. The caller must hold the lock.
+func (sconn *pubSubConn) writeReplies(before uint64) {
+	sconn.rmu.Lock()
+	defer sconn.rmu.Unlock()
+	var n int
+	for n < len(sconn.replies) && sconn.replies[n].seq < before {
+		sconn.dconn.WriteRaw(sconn.replies[n].b)
+		n++
+	}
+	sconn.replies = append(sconn.replies[:0], sconn.replies[n:]...)
+}
+
+// writeMessage writes a queued message, after the replies that were queued
+// before it. The caller must hold the lock.
+func (sconn *pubSubConn) writeMessage(msg pubSubMessage) {
+	sconn.writeReplies(msg.seq)
+	sconn.dconn.WriteRaw(msg.head)
+	sconn.dconn.WriteRaw(msg.bulk)
+	if msg.tail != nil {
+		sconn.dconn.WriteRaw(msg.tail)
+	}
+}
+
+// writeQueued writes the messages that are waiting in the queue and the
+// replies, and flushes them. The caller must hold the lock.
+func (sconn *pubSubConn) writeQueued() {
+	for {
+		select {
+		case msg := <-sconn.queue:
+			sconn.writeMessage(msg)
+		default:
+			// the messages that were queued before the replies are written
+			sconn.writeReplies(math.MaxUint64)
+			sconn.dconn.Flush()
+			return
+		}
+	}
+}
+
+// writer runs in the background and writes the queued messages and replies
+// to the subscriber. All of the messages that are waiting in the queue are
+// written together with a single flush. The messages of a Subscriber are
+// passed to its function instead.
+func (sconn *pubSubConn) writer() {
+	for {
+		select {
+		case msg := <-sconn.queue:
+			if sconn.fn != nil {
+				select {
+				case <-sconn.done:
+					return
+				default:
+					sconn.fn(*msg.local)
+				}
+				continue
+			}
+			sconn.mu.Lock()
+			sconn.writeMessage(msg)
+			sconn.writeQueued()
+			sconn.mu.Unlock()
+		case <-sconn.wake:
+			sconn.mu.Lock()
+			sconn.writeQueued()
+			sconn.mu.Unlock()
+		case <-sconn.done:
+			return
+		}
 	}
-	sconn.dconn.Flush()
 }
 
 // bgrunner runs in the background and reads incoming commands from the
@@ -1211,14 +1877,19 @@ func (sconn *pubSubConn) bgrunner(ps *PubSub) {
 		// client connection has ended, disconnect from the PubSub instances
 		// and close the network connection.
 		ps.mu.Lock()
-		defer ps.mu.Unlock()
 		for entry := range sconn.entries {
-			ps.chans.Delete(entry)
+			ps.removeEntry(entry)
 		}
 		delete(ps.conns, sconn.conn)
+		sconn.closeDone()
+		onDisconnect := ps.hooks.disconnect
+		ps.mu.Unlock()
 		sconn.mu.Lock()
-		defer sconn.mu.Unlock()
 		sconn.dconn.Close()
+		sconn.mu.Unlock()
+		if onDisconnect != nil {
+			onDisconnect(sconn.conn)
+		}
 	}()
 	for {
 		cmd, err := sconn.dconn.ReadCommand()
@@ -1229,41 +1900,44 @@ func (sconn *pubSubConn) bgrunner(ps *PubSub) {
 			continue
 		}
 		switch strings.ToLower(string(cmd.Args[0])) {
-		case "psubscribe", "subscribe":
+		case "psubscribe", "subscribe", "ssubscribe":
 			if len(cmd.Args) < 2 {
-				func() {
-					sconn.mu.Lock()
-					defer sconn.mu.Unlock()
-					sconn.dconn.WriteError(fmt.Sprintf("ERR wrong number of "+
-						"arguments for '%s'", cmd.Args[0]))
-					sconn.dconn.Flush()
-				}()
+				sconn.reply(AppendError(nil, fmt.Sprintf("ERR wrong number "+
+					"of arguments for '%s'", cmd.Args[0])))
 				continue
 			}
 			command := strings.ToLower(string(cmd.Args[0]))
 			for i := 1; i < len(cmd.Args); i++ {
-				if command == "psubscribe" {
+				switch command {
+				case "psubscribe":
 					ps.Psubscribe(sconn.conn, string(cmd.Args[i]))
-				} else {
+				case "ssubscribe":
+					ps.Ssubscribe(sconn.conn, string(cmd.Args[i]))
+				default:
 					ps.Subscribe(sconn.conn, string(cmd.Args[i]))
 				}
 			}
-		case "unsubscribe", "punsubscribe":
-			pattern := strings.ToLower(string(cmd.Args[0])) == "punsubscribe"
+		case "replay":
+			ps.ServeReplay(sconn.conn, cmd)
+		case "unsubscribe", "punsubscribe", "sunsubscribe":
+			command := strings.ToLower(string(cmd.Args[0]))
+			pattern := command == "punsubscribe"
+			shard := command == "sunsubscribe"
 			if len(cmd.Args) == 1 {
-				ps.unsubscribe(sconn.conn, pattern, true, "")
+				ps.unsubscribe(sconn.conn, pattern, shard, true, "")
 			} else {
 				for i := 1; i < len(cmd.Args); i++ {
 					channel := string(cmd.Args[i])
-					ps.unsubscribe(sconn.conn, pattern, false, channel)
+					ps.unsubscribe(sconn.conn, pattern, shard, false,
+						channel)
 				}
 			}
 		case "quit":
+			sconn.reply(AppendOK(nil))
 			func() {
 				sconn.mu.Lock()
 				defer sconn.mu.Unlock()
-				sconn.dconn.WriteString("OK")
-				sconn.dconn.Flush()
+				sconn.writeQueued()
 				sconn.dconn.Close()
 			}()
 			return
@@ -1274,32 +1948,17 @@ func (sconn *pubSubConn) bgrunner(ps *PubSub) {
 			case 2:
 				msg = string(cmd.Args[1])
 			default:
-				func() {
-					sconn.mu.Lock()
-					defer sconn.mu.Unlock()
-					sconn.dconn.WriteError(fmt.Sprintf("ERR wrong number of "+
-						"arguments for '%s'", cmd.Args[0]))
-					sconn.dconn.Flush()
-				}()
+				sconn.reply(AppendError(nil, fmt.Sprintf("ERR wrong number "+
+					"of arguments for '%s'", cmd.Args[0])))
 				continue
 			}
-			func() {
-				sconn.mu.Lock()
-				defer sconn.mu.Unlock()
-				sconn.dconn.WriteArray(2)
-				sconn.dconn.WriteBulkString("pong")
-				sconn.dconn.WriteBulkString(msg)
-				sconn.dconn.Flush()
-			}()
+			b := AppendArray(nil, 2)
+			b = AppendBulkString(b, "pong")
+			sconn.reply(AppendBulkString(b, msg))
 		default:
-			func() {
-				sconn.mu.Lock()
-				defer sconn.mu.Unlock()
-				sconn.dconn.WriteError(fmt.Sprintf("ERR Can't execute '%s': "+
-					"only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are "+
-					"allowed in this context", cmd.Args[0]))
-				sconn.dconn.Flush()
-			}()
+			sconn.reply(AppendError(nil, fmt.Sprintf("ERR Can't execute "+
+				"'%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT "+
+				"are allowed in this context", cmd.Args[0])))
 		}
 	}
 }
@@ -1333,104 +1992,164 @@ func byEntry(a, b interface{}) bool {
 	return aid < bid
 }
 
-func (ps *PubSub) subscribe(conn Conn, pattern bool, channel string) {
+func (ps *PubSub) subscribe(conn Conn, pattern, shard bool, channel string,
+	replay *pubSubReplay,
+) {
+	// the hook is called without the lock, so that it may use the PubSub
+	ps.mu.RLock()
+	onSubscribe := ps.hooks.subscribe
+	ps.mu.RUnlock()
+	var denied error
+	if onSubscribe != nil {
+		channel, denied = onSubscribe(conn, channel, pattern, shard)
+	}
+
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 
-	// initialize the PubSub instance
-	if !ps.initd {
-		ps.conns = make(map[Conn]*pubSubConn)
-		ps.chans = btree.New(byEntry)
-		ps.initd = true
-	}
+	ps.init()
 
 	// fetch the pubSubConn
 	sconn, ok := ps.conns[conn]
+
+	// check the channel permissions
+	if denied == nil && ps.acl != nil {
+		denied = ps.acl.checkChannel(conn, channel, pattern)
+	}
+	if denied != nil {
+		msg := prefixERRIfNeeded(denied.Error())
+		if !ok {
+			conn.WriteError(msg)
+			return
+		}
+		sconn.reply(AppendError(nil, msg))
+		return
+	}
 	if !ok {
 		// initialize a new pubSubConn, which runs on a detached connection,
 		// and attach it to the PubSub channels/conn btree
 		ps.nextid++
 		dconn := conn.Detach()
+		size := ps.queueSize
+		if size == 0 {
+			size = DefaultSubscriberQueueSize
+		}
 		sconn = &pubSubConn{
 			id:      ps.nextid,
+			user:    aclConnUser(conn),
 			conn:    conn,
 			dconn:   dconn,
 			entries: make(map[*pubSubEntry]bool),
+			queue:   make(chan pubSubMessage, size),
+			policy:  ps.queuePolicy,
+			done:    make(chan struct{}),
+			wake:    make(chan struct{}, 1),
+		}
+		if c := baseConn(dconn); c != nil {
+			// push frames, such as invalidation messages, are written with
+			// the replies
+			c.setPushFn(sconn.reply)
 		}
 		ps.conns[conn] = sconn
 	}
-	sconn.mu.Lock()
-	defer sconn.mu.Unlock()
 
-	// add an entry to the pubsub btree
+	// add an entry to the pubsub btree, unless the client is already
+	// subscribed to the channel.
 	entry := &pubSubEntry{
 		pattern: pattern,
+		shard:   shard,
 		channel: channel,
 		sconn:   sconn,
 	}
-	ps.chans.Set(entry)
-	sconn.entries[entry] = true
-
-	// send a message to the client
-	sconn.dconn.WriteArray(3)
-	if pattern {
-		sconn.dconn.WriteBulkString("psubscribe")
+	if item := ps.tree(entry).Get(entry); item != nil {
+		entry = item.(*pubSubEntry)
 	} else {
-		sconn.dconn.WriteBulkString("subscribe")
+		ps.addEntry(entry)
+		sconn.entries[entry] = true
 	}
-	sconn.dconn.WriteBulkString(channel)
+
+	// queue a reply to the client, which is written by the writer without
+	// holding the lock
+	b := AppendArray(nil, 3)
+	b = AppendBulkString(b, entry.kind(""))
+	b = AppendBulkString(b, channel)
 	var count int
-	for entry := range sconn.entries {
-		if entry.pattern == pattern {
+	for e := range sconn.entries {
+		if e.pattern == pattern && e.shard == shard {
 			count++
 		}
 	}
-	sconn.dconn.WriteInt(count)
-	sconn.dconn.Flush()
+	b = AppendInt(b, int64(count))
+	if replay != nil {
+		// publishing is blocked by the lock, so the replayed messages are
+		// followed by the published messages without gaps
+		entry.ids = true
+		b = ps.replay(b, entry, replay)
+	}
+	sconn.reply(b)
 
 	// start the background client operation
 	if !ok {
 		go sconn.bgrunner(ps)
+		go sconn.writer()
 	}
 }
 
-func (ps *PubSub) unsubscribe(conn Conn, pattern, all bool, channel string) {
+func (ps *PubSub) unsubscribe(conn Conn, pattern, shard, all bool,
+	channel string,
+) {
+	// rewrite the channel in the same way as it was when subscribing
+	ps.mu.RLock()
+	hooks := ps.hooks
+	ps.mu.RUnlock()
+	if !all && hooks.subscribe != nil {
+		if rewritten, err := hooks.subscribe(conn, channel, pattern,
+			shard); err == nil {
+			channel = rewritten
+		}
+	}
+	var removed []string
+	defer func() {
+		if hooks.unsubscribe != nil {
+			for _, channel := range removed {
+				hooks.unsubscribe(conn, channel, pattern, shard)
+			}
+		}
+	}()
+
 	ps.mu.Lock()
 	defer ps.mu.Unlock()
 	// fetch the pubSubConn. This must exist
 	sconn := ps.conns[conn]
-	sconn.mu.Lock()
-	defer sconn.mu.Unlock()
 
+	kind := (&pubSubEntry{pattern: pattern, shard: shard}).kind("un")
+	var b []byte
 	removeEntry := func(entry *pubSubEntry) {
 		if entry != nil {
-			ps.chans.Delete(entry)
+			ps.removeEntry(entry)
 			delete(sconn.entries, entry)
+			removed = append(removed, entry.channel)
 		}
-		sconn.dconn.WriteArray(3)
-		if pattern {
-			sconn.dconn.WriteBulkString("punsubscribe")
-		} else {
-			sconn.dconn.WriteBulkString("unsubscribe")
-		}
+		b = AppendArray(b, 3)
+		b = AppendBulkString(b, kind)
 		if entry != nil {
-			sconn.dconn.WriteBulkString(entry.channel)
+			b = AppendBulkString(b, entry.channel)
 		} else {
-			sconn.dconn.WriteNull()
+			b = AppendNull(b)
 		}
 		var count int
 		for entry := range sconn.entries {
-			if entry.pattern == pattern {
+			if entry.pattern == pattern && entry.shard == shard {
 				count++
 			}
 		}
-		sconn.dconn.WriteInt(count)
+		b = AppendInt(b, int64(count))
 	}
 	if all {
-		// unsubscribe from all (p)subscribe entries
+		// unsubscribe from all (p|s)subscribe entries
 		var entries []*pubSubEntry
 		for entry := range sconn.entries {
-			if entry.pattern == pattern {
+			if entry.pattern == pattern && entry.shard == shard {
 				entries = append(entries, entry)
 			}
 		}
@@ -1442,15 +2161,18 @@ func (ps *PubSub) unsubscribe(conn Conn, pattern, all bool, channel string) {
 			}
 		}
 	} else {
-		// unsubscribe single channel from (p)subscribe.
+		// unsubscribe single channel from (p|s)subscribe.
 		for entry := range sconn.entries {
-			if entry.pattern == pattern && entry.channel == channel {
+			if entry.pattern == pattern && entry.shard == shard &&
+				entry.channel == channel {
 				removeEntry(entry)
 				break
 			}
 		}
 	}
-	sconn.dconn.Flush()
+	if b != nil {
+		sconn.reply(b)
+	}
 }
 
 // SetIdleClose will automatically close idle connections after the specified
@@ -767,3 +767,157 @@ func TestPubSub(t *testing.T) {
 	// stop the timeout
 	final <- true
 }
+
+// testPeer is the client side of a server connection that uses a pipe.
+type testPeer struct {
+	t   *testing.T
+	nc  net.Conn
+	out chan string
+}
+
+// testPipeConn returns a server connection with the id, and the client side
+// of the connection.
+func testPipeConn(t *testing.T, id uint64) (*conn, *testPeer) {
+	p1, p2 := net.Pipe()
+	peer := &testPeer{t: t, nc: p2, out: make(chan string, 64)}
+	go func() {
+		b := make([]byte, 4096)
+		for {
+			n, err := p2.Read(b)
+			if err != nil {
+				close(peer.out)
+				return
+			}
+			peer.out <- string(b[:n])
+		}
+	}()
+	c := &conn{conn: p1, wr: NewWriter(p1), rd: NewReader(p1), id: id,
+		addr: "pipe"}
+	return c, peer
+}
+
+// expect reads from the connection until exp is received.
+func (p *testPeer) expect(exp string) {
+	p.t.Helper()
+	var res string
+	for len(res) < len(exp) {
+		select {
+		case s, ok := <-p.out:
+			if !ok {
+				p.t.Fatalf("expected '%q', got '%q' and closed", exp, res)
+			}
+			res += s
+		case <-time.After(time.Second * 5):
+			p.t.Fatalf("expected '%q', got '%q' and timed out", exp, res)
+		}
+	}
+	if res != exp {
+		p.t.Fatalf("expected '%q', got '%q'", exp, res)
+	}
+}
+
+// expectNothing checks that nothing is received for a short time.
+func (p *testPeer) expectNothing() {
+	p.t.Helper()
+	select {
+	case s := <-p.out:
+		p.t.Fatalf("expected nothing, got '%q'", s)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+// do sends a command to the server.
+func (p *testPeer) do(args ...string) {
+	p.t.Helper()
+	var b []byte
+	b = AppendArray(b, len(args))
+	for _, arg := range args {
+		b = AppendBulkString(b, arg)
+	}
+	if _, err := p.nc.Write(b); err != nil {
+		p.t.Fatal(err)
+	}
+}
+
+func TestWatchClose(t *testing.T) {
+	c, peer := testPipeConn(t, 1)
+	closed, stop := WatchClose(c)
+	if _, err := peer.nc.Write([]byte("PING\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	select {
+	case <-closed:
+		t.Fatal("expected open")
+	default:
+	}
+	// the command that was sent while watching is not lost
+	cmd, err := c.rd.ReadCommand()
+	if err != nil || string(cmd.Args[0]) != "PING" {
+		t.Fatalf("expected '%v', got '%q' %v", "PING", cmd.Args, err)
+	}
+
+	// stop interrupts the watcher
+	closed, stop = WatchClose(c)
+	stop()
+	select {
+	case <-closed:
+		t.Fatal("expected open")
+	default:
+	}
+
+	closed, stop = WatchClose(c)
+	defer stop()
+	peer.nc.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 5):
+		t.Fatal("expected closed")
+	}
+}
+
+func TestPubSubShard(t *testing.T) {
+	var ps PubSub
+	sub, peer := testPipeConn(t, 1)
+	defer peer.nc.Close()
+	ps.Ssubscribe(sub, "s1")
+	peer.expect("*3\r\n$10\r\nssubscribe\r\n$2\r\ns1\r\n:1\r\n")
+	if n := ps.Publish("s1", "hi"); n != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, n)
+	}
+	if n := ps.Spublish("s1", "hi"); n != 1 {
+		t.Fatalf("expected '%v', got '%v'", 1, n)
+	}
+	peer.expect("*3\r\n$8\r\nsmessage\r\n$2\r\ns1\r\n$2\r\nhi\r\n")
+	peer.do("SUBSCRIBE", "s1")
+	peer.expect("*3\r\n$9\r\nsubscribe\r\n$2\r\ns1\r\n:1\r\n")
+	peer.do("SSUBSCRIBE", "s2")
+	peer.expect("*3\r\n$10\r\nssubscribe\r\n$2\r\ns2\r\n:2\r\n")
+	peer.do("SUNSUBSCRIBE", "s1")
+	peer.expect("*3\r\n$12\r\nsunsubscribe\r\n$2\r\ns1\r\n:1\r\n")
+	if n := ps.Spublish("s1", "hi"); n != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, n)
+	}
+	if n := ps.Publish("s1", "hi"); n != 1 {
+		t.Fatalf("expected '%v', got '%v'", 1, n)
+	}
+	peer.expect("*3\r\n$7\r\nmessage\r\n$2\r\ns1\r\n$2\r\nhi\r\n")
+	peer.do("SUNSUBSCRIBE")
+	peer.expect("*3\r\n$12\r\nsunsubscribe\r\n$2\r\ns2\r\n:0\r\n")
+	peer.do("GET", "key")
+	peer.expect("-ERR Can't execute 'GET': only (P|S)SUBSCRIBE / " +
+		"(P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context\r\n")
+	peer.nc.Close()
+	for i := 0; ; i++ {
+		ps.mu.RLock()
+		n := len(ps.conns) + ps.chans.Len() + ps.schans.Len()
+		ps.mu.RUnlock()
+		if n == 0 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("expected empty pubsub")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
@@ -448,6 +448,17 @@ func AppendArray(b []byte, n int) []byte {
 	return appendPrefix(b, '*', int64(n))
 }
 
+// AppendMap appends a RESP3 map header to the input bytes. The header must
+// be followed by n key/value pairs.
+func AppendMap(b []byte, n int) []byte {
+	return appendPrefix(b, '%', int64(n))
+}
+
+// AppendPush appends a RESP3 push header to the input bytes.
+func AppendPush(b []byte, n int) []byte {
+	return appendPrefix(b, '>', int64(n))
+}
+
 // AppendBulk appends a Redis protocol bulk byte slice to the input bytes.
 func AppendBulk(b []byte, bulk []byte) []byte {
 	b = appendPrefix(b, '$', int64(len(bulk)))
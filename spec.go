@@ -0,0 +1,160 @@
+package redcon
+
+import (
+	"sort"
+	"strings"
+)
+
+// CommandSpec describes a command. It's modeled after the Redis COMMAND INFO
+// reply and is used by ServeMux to validate the number of arguments before
+// calling the handler.
+type CommandSpec struct {
+	// Name is the lowercase command name. Subcommands use the
+	// "container|subcommand" form, such as "config|get".
+	Name string
+	// Arity is the number of arguments, including the command name.
+	// A negative value means at least -Arity arguments.
+	// Zero means that the number of arguments is not checked.
+	Arity int
+	// Flags are the lowercase command flags, such as "write", "readonly",
+	// "denyoom", "admin", "noscript" and "fast".
+	Flags []string
+	// Categories are the lowercase ACL categories, without the "@" prefix,
+	// such as "read", "string" and "fast".
+	Categories []string
+	// FirstKey is the position of the first key argument. Zero means
+	// that the command has no keys.
+	FirstKey int
+	// LastKey is the position of the last key argument. A negative value
+	// is relative to the end of the arguments, where -1 is the last one.
+	LastKey int
+	// Step is the number of arguments between each key argument.
+	Step int
+	// KeysFunc is an optional function that returns the keys for commands
+	// where the key positions are not fixed, such as ZUNIONSTORE.
+	// It overrides FirstKey, LastKey and Step.
+	KeysFunc func(args [][]byte) [][]byte
+	// Subcommands of a container command, such as CONFIG.
+	Subcommands []CommandSpec
+}
+
+// HasFlag returns true when the command has the flag.
+func (spec CommandSpec) HasFlag(flag string) bool {
+	for _, f := range spec.Flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// InCategory returns true when the command is in the ACL category.
+func (spec CommandSpec) InCategory(category string) bool {
+	for _, c := range spec.Categories {
+		if c == category {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckArity returns true when the number of arguments, including the
+// command name, is valid for the command.
+func (spec CommandSpec) CheckArity(nargs int) bool {
+	if spec.Arity > 0 {
+		return nargs == spec.Arity
+	}
+	return nargs >= -spec.Arity
+}
+
+// Keys returns the key arguments of the command.
+func (spec CommandSpec) Keys(args [][]byte) [][]byte {
+	if spec.KeysFunc != nil {
+		return spec.KeysFunc(args)
+	}
+	if spec.FirstKey <= 0 || spec.FirstKey >= len(args) {
+		return nil
+	}
+	last := spec.LastKey
+	if last < 0 {
+		last = len(args) + last
+	}
+	if last >= len(args) {
+		last = len(args) - 1
+	}
+	step := spec.Step
+	if step <= 0 {
+		step = 1
+	}
+	var keys [][]byte
+	for i := spec.FirstKey; i <= last; i += step {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// Subcommand returns the spec of a subcommand.
+func (spec CommandSpec) Subcommand(name string) (CommandSpec, bool) {
+	name = spec.Name + "|" + strings.ToLower(name)
+	for _, sub := range spec.Subcommands {
+		if sub.Name == name {
+			return sub, true
+		}
+	}
+	return CommandSpec{}, false
+}
+
+// KeyNumKeys returns the keys of a command where the number of keys is an
+// argument, such as "ZUNIONSTORE destination numkeys key [key ...]".
+// The keynum position is the index of the numkeys argument and first is the
+// index of the first key, relative to the keynum position.
+func KeyNumKeys(args [][]byte, keynum, first, step int) [][]byte {
+	if keynum >= len(args) {
+		return nil
+	}
+	n, ok := parseInt(args[keynum])
+	if !ok || n <= 0 {
+		return nil
+	}
+	if step <= 0 {
+		step = 1
+	}
+	var keys [][]byte
+	for i, j := keynum+first, 0; i < len(args) && j < n; i, j = i+step, j+1 {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+// HandleCommand registers the handler for the command spec.
+// The number of arguments is checked using the spec arity before calling
+// the handler.
+// If a handler already exists for command, HandleCommand panics.
+func (m *ServeMux) HandleCommand(spec CommandSpec, handler Handler) {
+	spec.Name = strings.ToLower(spec.Name)
+	m.Handle(spec.Name, handler)
+	if m.specs == nil {
+		m.specs = make(map[string]CommandSpec)
+	}
+	m.specs[spec.Name] = spec
+}
+
+// Command returns the spec for a command that was registered using
+// HandleCommand.
+func (m *ServeMux) Command(command string) (CommandSpec, bool) {
+	spec, ok := m.specs[strings.ToLower(command)]
+	return spec, ok
+}
+
+// Commands returns the specs for all commands that were registered using
+// HandleCommand, ordered by name.
+func (m *ServeMux) Commands() []CommandSpec {
+	specs := make([]CommandSpec, 0, len(m.specs))
+	for _, spec := range m.specs {
+		specs = append(specs, spec)
+	}
+	sort.Slice(specs, func(i, j int) bool {
+		return specs[i].Name < specs[j].Name
+	})
+	return specs
+}
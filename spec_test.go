@@ -0,0 +1,70 @@
+package redcon
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCommandSpec(t *testing.T) {
+	args := testArgCommand("MSET", "k1", "v1", "k2", "v2").Args
+	spec := CommandSpec{Name: "mset", Arity: -3, FirstKey: 1, LastKey: -1,
+		Step: 2, Flags: []string{"write", "denyoom"}}
+	keys := spec.Keys(args)
+	if len(keys) != 2 || string(keys[0]) != "k1" || string(keys[1]) != "k2" {
+		t.Fatalf("expected '%v', got '%q'", "[k1 k2]", keys)
+	}
+	if !spec.HasFlag("write") || spec.HasFlag("readonly") {
+		t.Fatal("invalid flags")
+	}
+	if spec.CheckArity(2) || !spec.CheckArity(3) || !spec.CheckArity(5) {
+		t.Fatal("invalid arity")
+	}
+	spec = CommandSpec{Name: "get", Arity: 2, FirstKey: 1, LastKey: 1,
+		Step: 1}
+	if !spec.CheckArity(2) || spec.CheckArity(3) {
+		t.Fatal("invalid arity")
+	}
+	if keys := spec.Keys(testArgCommand("GET").Args); len(keys) != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, len(keys))
+	}
+	keys = KeyNumKeys(testArgCommand("ZUNIONSTORE", "dst", "2", "a", "b",
+		"WEIGHTS", "1", "2").Args, 2, 1, 1)
+	if len(keys) != 2 || string(keys[0]) != "a" || string(keys[1]) != "b" {
+		t.Fatalf("expected '%v', got '%q'", "[a b]", keys)
+	}
+	spec = CommandSpec{Name: "config", Arity: -2,
+		Subcommands: []CommandSpec{{Name: "config|get", Arity: -3}}}
+	if _, ok := spec.Subcommand("GET"); !ok {
+		t.Fatal("expected subcommand")
+	}
+}
+
+func TestServeMuxHandleCommand(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleCommand(CommandSpec{Name: "GET", Arity: 2},
+		HandlerFunc(func(conn Conn, cmd Command) {
+			conn.WriteNull()
+		}))
+	mux.HandleFunc("ping", func(conn Conn, cmd Command) {
+		conn.WriteString("PONG")
+	})
+	if _, ok := mux.Command("get"); !ok {
+		t.Fatal("expected get spec")
+	}
+	if _, ok := mux.Command("ping"); ok {
+		t.Fatal("expected no ping spec")
+	}
+	if specs := mux.Commands(); len(specs) != 1 || specs[0].Name != "get" {
+		t.Fatalf("expected '%v', got '%v'", "get", specs)
+	}
+	var buf bytes.Buffer
+	c := &conn{wr: NewWriter(&buf)}
+	mux.ServeRESP(c, testArgCommand("get", "key", "extra"))
+	mux.ServeRESP(c, testArgCommand("get", "key"))
+	mux.ServeRESP(c, testArgCommand("ping", "extra"))
+	c.wr.Flush()
+	exp := "-ERR wrong number of arguments for 'get' command\r\n$-1\r\n+PONG\r\n"
+	if buf.String() != exp {
+		t.Fatalf("expected '%q', got '%q'", exp, buf.String())
+	}
+}
@@ -0,0 +1,226 @@
+package store
+
+import (
+	"strings"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+func (s *Store) genericCommands() []Command {
+	return []Command{
+		command("del", -2, "write", "keyspace write slow", 1, -1, 1, s.cmdDel),
+		command("unlink", -2, "write fast", "keyspace write fast", 1, -1, 1,
+			s.cmdDel),
+		command("exists", -2, "readonly fast", "keyspace read fast", 1, -1,
+			1, s.cmdExists),
+		command("type", 2, "readonly fast", "keyspace read fast", 1, 1, 1,
+			s.cmdType),
+		command("keys", 2, "readonly", "keyspace read slow dangerous", 0, 0,
+			0, s.cmdKeys),
+		command("dbsize", 1, "readonly fast", "keyspace read fast", 0, 0, 0,
+			s.cmdDBSize),
+		command("flushdb", -1, "write", "keyspace write slow dangerous", 0,
+			0, 0, s.cmdFlushDB),
+		command("flushall", -1, "write", "keyspace write slow dangerous", 0,
+			0, 0, s.cmdFlushDB),
+		command("expire", -3, "write fast", "keyspace write fast", 1, 1, 1,
+			s.cmdExpire),
+		command("pexpire", -3, "write fast", "keyspace write fast", 1, 1, 1,
+			s.cmdExpire),
+		command("expireat", -3, "write fast", "keyspace write fast", 1, 1, 1,
+			s.cmdExpire),
+		command("pexpireat", -3, "write fast", "keyspace write fast", 1, 1,
+			1, s.cmdExpire),
+		command("ttl", 2, "readonly fast", "keyspace read fast", 1, 1, 1,
+			s.cmdTTL),
+		command("pttl", 2, "readonly fast", "keyspace read fast", 1, 1, 1,
+			s.cmdTTL),
+		command("expiretime", 2, "readonly fast", "keyspace read fast", 1, 1,
+			1, s.cmdTTL),
+		command("pexpiretime", 2, "readonly fast", "keyspace read fast", 1,
+			1, 1, s.cmdTTL),
+		command("persist", 2, "write fast", "keyspace write fast", 1, 1, 1,
+			s.cmdPersist),
+		command("rename", 3, "write", "keyspace write slow", 1, 2, 1,
+			s.cmdRename),
+		command("renamenx", 3, "write fast", "keyspace write fast", 1, 2, 1,
+			s.cmdRename),
+	}
+}
+
+// DEL key [key ...]
+// UNLINK key [key ...]
+func (s *Store) cmdDel(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	for _, key := range cmd.Args[1:] {
+		if s.del(string(key)) {
+			s.notify(conn, "del", string(key), redcon.NotifyGeneric)
+			n++
+		}
+	}
+	conn.WriteInt(n)
+}
+
+// EXISTS key [key ...]
+func (s *Store) cmdExists(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int
+	for _, key := range cmd.Args[1:] {
+		if _, ok := s.lookup(string(key)); ok {
+			n++
+		}
+	}
+	conn.WriteInt(n)
+}
+
+// TYPE key
+func (s *Store) cmdType(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, _ := s.lookup(string(cmd.Args[1]))
+	conn.WriteString(typeName(value))
+}
+
+// KEYS pattern
+func (s *Store) cmdKeys(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.match(string(cmd.Args[1]))
+	conn.WriteArray(len(keys))
+	for _, key := range keys {
+		conn.WriteBulkString(key)
+	}
+}
+
+// DBSIZE
+func (s *Store) cmdDBSize(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn.WriteInt(len(s.keys))
+}
+
+// FLUSHDB [ASYNC|SYNC]
+// FLUSHALL [ASYNC|SYNC]
+func (s *Store) cmdFlushDB(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	if args.More() {
+		args.Enum("ASYNC", "SYNC")
+	}
+	if err := args.Done(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.modified != nil {
+		for key := range s.keys {
+			s.modified(conn, key)
+		}
+	}
+	s.keys = make(map[string]interface{})
+	s.exp.Clear()
+	conn.WriteString("OK")
+}
+
+// EXPIRE key seconds [NX|XX|GT|LT]
+// PEXPIRE key milliseconds [NX|XX|GT|LT]
+// EXPIREAT key unix-time-seconds [NX|XX|GT|LT]
+// PEXPIREAT key unix-time-milliseconds [NX|XX|GT|LT]
+func (s *Store) cmdExpire(conn redcon.Conn, cmd redcon.Command) {
+	key, expires, cond, err := s.exp.ExpireArgs(cmd)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.exp.ExpireAt(key, expires, cond) {
+		conn.WriteInt(0)
+		return
+	}
+	if s.modified != nil {
+		s.modified(conn, key)
+	}
+	conn.WriteInt(1)
+}
+
+// TTL key
+// PTTL key
+// EXPIRETIME key
+// PEXPIRETIME key
+func (s *Store) cmdTTL(conn redcon.Conn, cmd redcon.Command) {
+	name := strings.ToLower(string(cmd.Args[0]))
+	key := string(cmd.Args[1])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.lookup(key); !ok {
+		conn.WriteInt(-2)
+		return
+	}
+	expires, ok := s.exp.ExpiresAt(key)
+	if !ok {
+		conn.WriteInt(-1)
+		return
+	}
+	ms := expires.UnixNano() / int64(time.Millisecond)
+	ttl := int64(expires.Sub(now()) / time.Millisecond)
+	switch name {
+	case "ttl":
+		conn.WriteInt64((ttl + 500) / 1000)
+	case "pttl":
+		conn.WriteInt64(ttl)
+	case "expiretime":
+		conn.WriteInt64(ms / 1000)
+	default:
+		conn.WriteInt64(ms)
+	}
+}
+
+// PERSIST key
+func (s *Store) cmdPersist(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := string(cmd.Args[1])
+	if !s.exp.Persist(key) {
+		conn.WriteInt(0)
+		return
+	}
+	if s.modified != nil {
+		s.modified(conn, key)
+	}
+	conn.WriteInt(1)
+}
+
+// RENAME key newkey
+// RENAMENX key newkey
+func (s *Store) cmdRename(conn redcon.Conn, cmd redcon.Command) {
+	nx := strings.EqualFold(string(cmd.Args[0]), "renamenx")
+	key, newKey := string(cmd.Args[1]), string(cmd.Args[2])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.lookup(key)
+	if !ok {
+		conn.WriteError(errNoSuchKey.Error())
+		return
+	}
+	if _, ok := s.lookup(newKey); ok && nx {
+		conn.WriteInt(0)
+		return
+	}
+	if key != newKey {
+		delete(s.keys, key)
+		s.keys[newKey] = value
+		s.exp.Rename(key, newKey)
+		s.notify(conn, "rename_from", key, redcon.NotifyGeneric)
+		s.notify(conn, "rename_to", newKey, redcon.NotifyGeneric)
+	}
+	if nx {
+		conn.WriteInt(1)
+	} else {
+		conn.WriteString("OK")
+	}
+}
@@ -0,0 +1,323 @@
+package store
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// Hash is the value of a hash key, which maps fields to values.
+type Hash map[string][]byte
+
+func (s *Store) hashCommands() []Command {
+	return []Command{
+		command("hset", -4, "write denyoom fast", "write hash fast", 1, 1, 1,
+			s.cmdHSet),
+		command("hmset", -4, "write denyoom fast", "write hash fast", 1, 1,
+			1, s.cmdHSet),
+		command("hsetnx", 4, "write denyoom fast", "write hash fast", 1, 1,
+			1, s.cmdHSetNX),
+		command("hget", 3, "readonly fast", "read hash fast", 1, 1, 1,
+			s.cmdHGet),
+		command("hmget", -3, "readonly fast", "read hash fast", 1, 1, 1,
+			s.cmdHMGet),
+		command("hdel", -3, "write fast", "write hash fast", 1, 1, 1,
+			s.cmdHDel),
+		command("hlen", 2, "readonly fast", "read hash fast", 1, 1, 1,
+			s.cmdHLen),
+		command("hstrlen", 3, "readonly fast", "read hash fast", 1, 1, 1,
+			s.cmdHStrlen),
+		command("hexists", 3, "readonly fast", "read hash fast", 1, 1, 1,
+			s.cmdHExists),
+		command("hgetall", 2, "readonly", "read hash slow", 1, 1, 1,
+			s.cmdHGetAll),
+		command("hkeys", 2, "readonly", "read hash slow", 1, 1, 1,
+			s.cmdHGetAll),
+		command("hvals", 2, "readonly", "read hash slow", 1, 1, 1,
+			s.cmdHGetAll),
+		command("hincrby", 4, "write denyoom fast", "write hash fast", 1, 1,
+			1, s.cmdHIncrBy),
+		command("hincrbyfloat", 4, "write denyoom fast", "write hash fast",
+			1, 1, 1, s.cmdHIncrByFloat),
+	}
+}
+
+// hash returns the hash of a key, which is nil when the key does not exist
+// unless create is true. The caller must hold the lock.
+func (s *Store) hash(key string, create bool) (Hash, error) {
+	value, ok := s.lookup(key)
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+		h := make(Hash)
+		s.set(key, h)
+		return h, nil
+	}
+	h, ok := value.(Hash)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return h, nil
+}
+
+// HSET key field value [field value ...]
+// HMSET key field value [field value ...]
+func (s *Store) cmdHSet(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args)%2 != 0 {
+		conn.WriteError("ERR wrong number of arguments for '" +
+			strings.ToLower(string(cmd.Args[0])) + "' command")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := string(cmd.Args[1])
+	h, err := s.hash(key, true)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	var n int
+	for i := 2; i < len(cmd.Args); i += 2 {
+		field := string(cmd.Args[i])
+		if _, ok := h[field]; !ok {
+			n++
+		}
+		h[field] = append([]byte(nil), cmd.Args[i+1]...)
+	}
+	s.notify(conn, "hset", key, redcon.NotifyHash)
+	if strings.EqualFold(string(cmd.Args[0]), "hmset") {
+		conn.WriteString("OK")
+	} else {
+		conn.WriteInt(n)
+	}
+}
+
+// HSETNX key field value
+func (s *Store) cmdHSetNX(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, field := string(cmd.Args[1]), string(cmd.Args[2])
+	h, err := s.hash(key, true)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if _, ok := h[field]; ok {
+		conn.WriteInt(0)
+		return
+	}
+	h[field] = append([]byte(nil), cmd.Args[3]...)
+	s.notify(conn, "hset", key, redcon.NotifyHash)
+	conn.WriteInt(1)
+}
+
+// HGET key field
+func (s *Store) cmdHGet(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, err := s.hash(string(cmd.Args[1]), false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if value, ok := h[string(cmd.Args[2])]; ok {
+		conn.WriteBulk(value)
+	} else {
+		conn.WriteNull()
+	}
+}
+
+// HMGET key field [field ...]
+func (s *Store) cmdHMGet(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, err := s.hash(string(cmd.Args[1]), false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	conn.WriteArray(len(cmd.Args) - 2)
+	for _, field := range cmd.Args[2:] {
+		if value, ok := h[string(field)]; ok {
+			conn.WriteBulk(value)
+		} else {
+			conn.WriteNull()
+		}
+	}
+}
+
+// HDEL key field [field ...]
+func (s *Store) cmdHDel(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := string(cmd.Args[1])
+	h, err := s.hash(key, false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	var n int
+	for _, field := range cmd.Args[2:] {
+		if _, ok := h[string(field)]; ok {
+			delete(h, string(field))
+			n++
+		}
+	}
+	if n > 0 {
+		s.notify(conn, "hdel", key, redcon.NotifyHash)
+		s.deleteIfEmpty(conn, key)
+	}
+	conn.WriteInt(n)
+}
+
+// HLEN key
+func (s *Store) cmdHLen(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, err := s.hash(string(cmd.Args[1]), false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	conn.WriteInt(len(h))
+}
+
+// HSTRLEN key field
+func (s *Store) cmdHStrlen(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, err := s.hash(string(cmd.Args[1]), false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	conn.WriteInt(len(h[string(cmd.Args[2])]))
+}
+
+// HEXISTS key field
+func (s *Store) cmdHExists(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, err := s.hash(string(cmd.Args[1]), false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if _, ok := h[string(cmd.Args[2])]; ok {
+		conn.WriteInt(1)
+	} else {
+		conn.WriteInt(0)
+	}
+}
+
+// HGETALL key
+// HKEYS key
+// HVALS key
+func (s *Store) cmdHGetAll(conn redcon.Conn, cmd redcon.Command) {
+	name := strings.ToLower(string(cmd.Args[0]))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, err := s.hash(string(cmd.Args[1]), false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	// the fields are ordered, which makes the replies deterministic
+	fields := make([]string, 0, len(h))
+	for field := range h {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	if name == "hgetall" {
+		conn.WriteArray(len(fields) * 2)
+	} else {
+		conn.WriteArray(len(fields))
+	}
+	for _, field := range fields {
+		if name != "hvals" {
+			conn.WriteBulkString(field)
+		}
+		if name != "hkeys" {
+			conn.WriteBulk(h[field])
+		}
+	}
+}
+
+// HINCRBY key field increment
+func (s *Store) cmdHIncrBy(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key, field := args.String(), args.String()
+	delta := args.Int()
+	if err := args.Err(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, err := s.hash(key, false)
+	var n int64
+	if value, ok := h[field]; ok && err == nil {
+		if n, err = parseInt(value); err != nil {
+			err = errHashNotInteger
+		}
+	}
+	if err == nil && ((delta > 0 && n > math.MaxInt64-delta) ||
+		(delta < 0 && n < math.MinInt64-delta)) {
+		err = errOverflow
+	}
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	n += delta
+	s.setField(conn, key, h, field, []byte(strconv.FormatInt(n, 10)),
+		"hincrby")
+	conn.WriteInt64(n)
+}
+
+// HINCRBYFLOAT key field increment
+func (s *Store) cmdHIncrByFloat(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key, field := args.String(), args.String()
+	delta := args.Float()
+	if err := args.Err(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, err := s.hash(key, false)
+	var f float64
+	if value, ok := h[field]; ok && err == nil {
+		if f, err = parseFloat(value); err != nil {
+			err = errHashNotFloat
+		}
+	}
+	if err == nil && (math.IsInf(f+delta, 0) || math.IsNaN(f+delta)) {
+		err = errNaNOrInf
+	}
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	value := []byte(formatFloat(f + delta))
+	s.setField(conn, key, h, field, value, "hincrbyfloat")
+	conn.WriteBulk(value)
+}
+
+// setField sets the field of a hash, which is created when it's nil. The
+// caller must hold the lock.
+func (s *Store) setField(conn redcon.Conn, key string, h Hash, field string,
+	value []byte, event string,
+) {
+	if h == nil {
+		h = make(Hash)
+		s.set(key, h)
+	}
+	h[field] = value
+	s.notify(conn, event, key, redcon.NotifyHash)
+}
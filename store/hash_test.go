@@ -0,0 +1,44 @@
+package store
+
+import "testing"
+
+func TestHash(t *testing.T) {
+	c := testServer(t, New())
+	c.run([][]string{
+		{"HSET", "h", "a", "1", "b", "2", ":2"},
+		{"HSET", "h", "a", "3", "c", "4", ":1"},
+		{"HSET", "h", "a", "-ERR wrong number of arguments for 'hset' " +
+			"command"},
+		{"HMSET", "h", "d", "5", "+OK"},
+		{"HSETNX", "h", "a", "x", ":0"},
+		{"HSETNX", "h", "e", "6", ":1"},
+		{"HGET", "h", "a", "3"},
+		{"HGET", "h", "z", "nil"},
+		{"HGET", "z", "a", "nil"},
+		{"HMGET", "h", "a", "z", "b", "[3 nil 2]"},
+		{"HLEN", "h", ":5"},
+		{"HSTRLEN", "h", "a", ":1"},
+		{"HEXISTS", "h", "a", ":1"},
+		{"HEXISTS", "h", "z", ":0"},
+		{"HDEL", "h", "d", "e", "z", ":2"},
+		{"HGETALL", "h", "[a 3 b 2 c 4]"},
+		{"HKEYS", "h", "[a b c]"},
+		{"HVALS", "h", "[3 2 4]"},
+		{"HGETALL", "z", "[]"},
+		{"HINCRBY", "h", "a", "2", ":5"},
+		{"HINCRBY", "h", "n", "-2", ":-2"},
+		{"HINCRBY", "h", "a", "x", "-ERR value is not an integer or out of " +
+			"range"},
+		{"HINCRBYFLOAT", "h", "a", "0.5", "5.5"},
+		{"HINCRBY", "h", "a", "1", "-ERR hash value is not an integer"},
+		{"HSET", "h", "s", "x", ":1"},
+		{"HINCRBYFLOAT", "h", "s", "1", "-ERR hash value is not a float"},
+		{"HINCRBYFLOAT", "new", "f", "1.5", "1.5"},
+		{"HDEL", "h", "a", "b", "c", "n", "s", ":5"},
+		{"EXISTS", "h", ":0"},
+		{"SET", "s", "x", "+OK"},
+		{"HGET", "s", "a", wrongType},
+		{"HSET", "s", "a", "1", wrongType},
+		{"HINCRBY", "s", "a", "1", wrongType},
+	})
+}
@@ -0,0 +1,439 @@
+package store
+
+import (
+	"bytes"
+	"errors"
+	"math"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// List is the value of a list key, which is a sequence of values.
+type List struct {
+	items [][]byte
+	off   int // the free space at the front of items
+}
+
+// NewList returns a List with the values.
+func NewList(values ...[]byte) *List {
+	l := &List{}
+	l.PushBack(values...)
+	return l
+}
+
+// Len returns the number of values.
+func (l *List) Len() int {
+	return len(l.items) - l.off
+}
+
+// Index returns the value at index i, which must be less than Len.
+func (l *List) Index(i int) []byte {
+	return l.items[l.off+i]
+}
+
+// Values returns the values.
+func (l *List) Values() [][]byte {
+	return append([][]byte(nil), l.items[l.off:]...)
+}
+
+// PushFront inserts values at the front, one after the other, like LPUSH.
+func (l *List) PushFront(values ...[]byte) {
+	if l.off < len(values) {
+		n := l.Len()
+		off := n/2 + len(values) + 8
+		items := make([][]byte, off+n)
+		copy(items[off:], l.items[l.off:])
+		l.items, l.off = items, off
+	}
+	for _, value := range values {
+		l.off--
+		l.items[l.off] = value
+	}
+}
+
+// PushBack appends values at the back, like RPUSH.
+func (l *List) PushBack(values ...[]byte) {
+	l.items = append(l.items, values...)
+}
+
+// PopFront removes and returns the first value.
+func (l *List) PopFront() []byte {
+	value := l.items[l.off]
+	l.items[l.off] = nil
+	l.off++
+	return value
+}
+
+// PopBack removes and returns the last value.
+func (l *List) PopBack() []byte {
+	value := l.items[len(l.items)-1]
+	l.items[len(l.items)-1] = nil
+	l.items = l.items[:len(l.items)-1]
+	return value
+}
+
+// set replaces the values.
+func (l *List) set(values [][]byte) {
+	l.items, l.off = values, 0
+}
+
+var errIndexOutOfRange = errors.New("ERR index out of range")
+
+func (s *Store) listCommands() []Command {
+	return []Command{
+		command("lpush", -3, "write denyoom fast", "write list fast", 1, 1,
+			1, s.cmdPush),
+		command("rpush", -3, "write denyoom fast", "write list fast", 1, 1,
+			1, s.cmdPush),
+		command("lpushx", -3, "write denyoom fast", "write list fast", 1, 1,
+			1, s.cmdPush),
+		command("rpushx", -3, "write denyoom fast", "write list fast", 1, 1,
+			1, s.cmdPush),
+		command("lpop", -2, "write fast", "write list fast", 1, 1, 1,
+			s.cmdPop),
+		command("rpop", -2, "write fast", "write list fast", 1, 1, 1,
+			s.cmdPop),
+		command("llen", 2, "readonly fast", "read list fast", 1, 1, 1,
+			s.cmdLLen),
+		command("lrange", 4, "readonly", "read list slow", 1, 1, 1,
+			s.cmdLRange),
+		command("lindex", 3, "readonly", "read list slow", 1, 1, 1,
+			s.cmdLIndex),
+		command("lset", 4, "write denyoom", "write list slow", 1, 1, 1,
+			s.cmdLSet),
+		command("ltrim", 4, "write", "write list slow", 1, 1, 1, s.cmdLTrim),
+		command("lrem", 4, "write", "write list slow", 1, 1, 1, s.cmdLRem),
+		command("linsert", 5, "write denyoom", "write list slow", 1, 1, 1,
+			s.cmdLInsert),
+	}
+}
+
+// list returns the list of a key, which is nil when the key does not exist
+// unless create is true. The caller must hold the lock.
+func (s *Store) list(key string, create bool) (*List, error) {
+	value, ok := s.lookup(key)
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+		l := &List{}
+		s.set(key, l)
+		return l, nil
+	}
+	l, ok := value.(*List)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return l, nil
+}
+
+// LPUSH key element [element ...]
+// RPUSH key element [element ...]
+// LPUSHX key element [element ...]
+// RPUSHX key element [element ...]
+func (s *Store) cmdPush(conn redcon.Conn, cmd redcon.Command) {
+	name := strings.ToLower(string(cmd.Args[0]))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := string(cmd.Args[1])
+	l, err := s.list(key, !strings.HasSuffix(name, "x"))
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if l == nil {
+		conn.WriteInt(0)
+		return
+	}
+	values := make([][]byte, len(cmd.Args)-2)
+	for i, arg := range cmd.Args[2:] {
+		values[i] = append([]byte(nil), arg...)
+	}
+	if name[0] == 'l' {
+		l.PushFront(values...)
+		s.notify(conn, "lpush", key, redcon.NotifyList)
+	} else {
+		l.PushBack(values...)
+		s.notify(conn, "rpush", key, redcon.NotifyList)
+	}
+	conn.WriteInt(l.Len())
+}
+
+// LPOP key [count]
+// RPOP key [count]
+func (s *Store) cmdPop(conn redcon.Conn, cmd redcon.Command) {
+	name := strings.ToLower(string(cmd.Args[0]))
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	count := -1
+	if args.More() {
+		count = int(args.IntRange(0, math.MaxInt32))
+	}
+	if err := args.Done(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, err := s.list(key, false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if l == nil {
+		if count < 0 {
+			conn.WriteNull()
+		} else {
+			conn.WriteArray(-1)
+		}
+		return
+	}
+	n := count
+	if n < 0 {
+		n = 1
+	} else {
+		if n > l.Len() {
+			n = l.Len()
+		}
+		conn.WriteArray(n)
+	}
+	for i := 0; i < n; i++ {
+		if name == "lpop" {
+			conn.WriteBulk(l.PopFront())
+		} else {
+			conn.WriteBulk(l.PopBack())
+		}
+	}
+	if n > 0 {
+		s.notify(conn, name, key, redcon.NotifyList)
+		s.deleteIfEmpty(conn, key)
+	}
+}
+
+// LLEN key
+func (s *Store) cmdLLen(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, err := s.list(string(cmd.Args[1]), false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	var n int
+	if l != nil {
+		n = l.Len()
+	}
+	conn.WriteInt(n)
+}
+
+// LRANGE key start stop
+func (s *Store) cmdLRange(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	start, stop := args.Int(), args.Int()
+	if err := args.Err(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, err := s.list(key, false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	var i, j int
+	if l != nil {
+		i, j, _ = indexRange(start, stop, l.Len())
+	}
+	conn.WriteArray(j - i)
+	for ; i < j; i++ {
+		conn.WriteBulk(l.Index(i))
+	}
+}
+
+// listIndex converts an index, which may be negative, to an index of a
+// list, and returns false when it's out of range.
+func listIndex(l *List, index int64) (int, bool) {
+	if l == nil {
+		return 0, false
+	}
+	if index < 0 {
+		index += int64(l.Len())
+	}
+	if index < 0 || index >= int64(l.Len()) {
+		return 0, false
+	}
+	return int(index), true
+}
+
+// LINDEX key index
+func (s *Store) cmdLIndex(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	index := args.Int()
+	if err := args.Err(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, err := s.list(key, false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if i, ok := listIndex(l, index); ok {
+		conn.WriteBulk(l.Index(i))
+	} else {
+		conn.WriteNull()
+	}
+}
+
+// LSET key index element
+func (s *Store) cmdLSet(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	index := args.Int()
+	value := args.Bytes()
+	if err := args.Err(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, err := s.list(key, false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if l == nil {
+		conn.WriteError(errNoSuchKey.Error())
+		return
+	}
+	i, ok := listIndex(l, index)
+	if !ok {
+		conn.WriteError(errIndexOutOfRange.Error())
+		return
+	}
+	l.items[l.off+i] = append([]byte(nil), value...)
+	s.notify(conn, "lset", key, redcon.NotifyList)
+	conn.WriteString("OK")
+}
+
+// LTRIM key start stop
+func (s *Store) cmdLTrim(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	start, stop := args.Int(), args.Int()
+	if err := args.Err(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, err := s.list(key, false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if l != nil {
+		i, j, _ := indexRange(start, stop, l.Len())
+		l.set(append([][]byte(nil), l.items[l.off+i:l.off+j]...))
+		s.notify(conn, "ltrim", key, redcon.NotifyList)
+		s.deleteIfEmpty(conn, key)
+	}
+	conn.WriteString("OK")
+}
+
+// LREM key count element
+func (s *Store) cmdLRem(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	count := args.Int()
+	value := args.Bytes()
+	if err := args.Err(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, err := s.list(key, false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if l == nil {
+		conn.WriteInt(0)
+		return
+	}
+	// a negative count removes from the back, which is done by reversing
+	values := l.Values()
+	if count < 0 {
+		reverse(values)
+	}
+	var n int64
+	kept := values[:0]
+	for _, v := range values {
+		if (count == 0 || n < count || n < -count) && bytes.Equal(v, value) {
+			n++
+			continue
+		}
+		kept = append(kept, v)
+	}
+	if count < 0 {
+		reverse(kept)
+	}
+	l.set(kept)
+	if n > 0 {
+		s.notify(conn, "lrem", key, redcon.NotifyList)
+		s.deleteIfEmpty(conn, key)
+	}
+	conn.WriteInt64(n)
+}
+
+func reverse(values [][]byte) {
+	for i, j := 0, len(values)-1; i < j; i, j = i+1, j-1 {
+		values[i], values[j] = values[j], values[i]
+	}
+}
+
+// LINSERT key <BEFORE|AFTER> pivot element
+func (s *Store) cmdLInsert(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	after := args.Enum("BEFORE", "AFTER") == 1
+	pivot, value := args.Bytes(), args.Bytes()
+	if err := args.Err(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, err := s.list(key, false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if l == nil {
+		conn.WriteInt(0)
+		return
+	}
+	for i := 0; i < l.Len(); i++ {
+		if !bytes.Equal(l.Index(i), pivot) {
+			continue
+		}
+		if after {
+			i++
+		}
+		values := l.Values()
+		values = append(values[:i], append([][]byte{
+			append([]byte(nil), value...)}, values[i:]...)...)
+		l.set(values)
+		s.notify(conn, "linsert", key, redcon.NotifyList)
+		conn.WriteInt(l.Len())
+		return
+	}
+	conn.WriteInt(-1)
+}
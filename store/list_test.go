@@ -0,0 +1,66 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestList(t *testing.T) {
+	l := NewList()
+	for i := 0; i < 100; i++ {
+		l.PushFront([]byte(fmt.Sprint(i)))
+		l.PushBack([]byte(fmt.Sprint(i)))
+	}
+	if l.Len() != 200 || string(l.Index(0)) != "99" ||
+		string(l.Index(199)) != "99" {
+		t.Fatalf("unexpected list %v %s %s", l.Len(), l.Index(0),
+			l.Index(199))
+	}
+	for i := 99; i >= 0; i-- {
+		if front, back := string(l.PopFront()), string(l.PopBack()); front !=
+			fmt.Sprint(i) || back != fmt.Sprint(i) {
+			t.Fatalf("unexpected values %v %v", front, back)
+		}
+	}
+
+	c := testServer(t, New())
+	c.run([][]string{
+		{"LPUSHX", "l", "a", ":0"},
+		{"RPUSH", "l", "c", "d", ":2"},
+		{"LPUSH", "l", "b", "a", ":4"},
+		{"RPUSHX", "l", "e", ":5"},
+		{"LRANGE", "l", "0", "-1", "[a b c d e]"},
+		{"LRANGE", "l", "-2", "100", "[d e]"},
+		{"LRANGE", "l", "3", "1", "[]"},
+		{"LRANGE", "z", "0", "-1", "[]"},
+		{"LLEN", "l", ":5"},
+		{"LINDEX", "l", "-1", "e"},
+		{"LINDEX", "l", "5", "nil"},
+		{"LSET", "l", "1", "B", "+OK"},
+		{"LSET", "l", "10", "B", "-ERR index out of range"},
+		{"LSET", "z", "0", "B", "-ERR no such key"},
+		{"LPOP", "l", "a"},
+		{"RPOP", "l", "2", "[e d]"},
+		{"LPOP", "z", "nil"},
+		{"LPOP", "z", "1", "nil"},
+		{"LPOP", "l", "-1", "-ERR value is not an integer or out of range"},
+		{"RPUSH", "l", "x", "c", "x", "c", ":6"},
+		{"LREM", "l", "-1", "c", ":1"},
+		{"LRANGE", "l", "0", "-1", "[B c x c x]"},
+		{"LREM", "l", "1", "c", ":1"},
+		{"LREM", "l", "0", "x", ":2"},
+		{"LRANGE", "l", "0", "-1", "[B c]"},
+		{"LINSERT", "l", "BEFORE", "c", "b", ":3"},
+		{"LINSERT", "l", "AFTER", "c", "d", ":4"},
+		{"LINSERT", "l", "AFTER", "z", "d", ":-1"},
+		{"LINSERT", "l", "MIDDLE", "c", "d", "-ERR syntax error"},
+		{"LRANGE", "l", "0", "-1", "[B b c d]"},
+		{"LTRIM", "l", "1", "-2", "+OK"},
+		{"LRANGE", "l", "0", "-1", "[b c]"},
+		{"LTRIM", "l", "5", "10", "+OK"},
+		{"EXISTS", "l", ":0"},
+		{"SET", "s", "x", "+OK"},
+		{"LPUSH", "s", "x", wrongType},
+		{"LRANGE", "s", "0", "1", wrongType},
+	})
+}
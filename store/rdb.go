@@ -0,0 +1,121 @@
+package store
+
+import (
+	"io"
+
+	"github.com/tidwall/redcon"
+	"github.com/tidwall/redcon/rdb"
+)
+
+// SaveRDB captures the data of the Store, and returns a function that
+// writes it to an RDB file, which is an rdb.Snapshot.
+//
+//	p := rdb.NewPersister("dump.rdb", s.SaveRDB, s.LoadRDB)
+func (s *Store) SaveRDB() func(w *rdb.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var entries []rdb.Entry
+	for _, key := range s.match("*") {
+		e := rdb.Entry{Key: key, Value: rdbValue(s.keys[key])}
+		e.Expires, _ = s.exp.ExpiresAt(key)
+		entries = append(entries, e)
+	}
+	return func(w *rdb.Writer) error {
+		for i := range entries {
+			if err := w.WriteEntry(&entries[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// rdbValue returns a copy of a value as an rdb value.
+func rdbValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return append([]byte(nil), v...)
+	case Hash:
+		h := make(rdb.Hash, len(v))
+		for field, value := range v {
+			h[field] = value
+		}
+		return h
+	case *List:
+		return rdb.List(v.Values())
+	case Set:
+		set := make(rdb.Set, len(v))
+		for member := range v {
+			set[member] = struct{}{}
+		}
+		return set
+	case *ZSet:
+		var z rdb.ZSet
+		for _, m := range v.Members() {
+			z = append(z, rdb.ZMember{Member: m.Member, Score: m.Score})
+		}
+		return z
+	}
+	return nil
+}
+
+// LoadRDB replaces the data of the Store with the keys of database 0 of an
+// RDB file, which is the load function of an rdb.Persister. Keys that
+// expired are skipped. The data is unchanged when the file can't be read.
+func (s *Store) LoadRDB(rd *rdb.Reader) error {
+	var entries []*rdb.Entry
+	for {
+		e, err := rd.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if e.DB == 0 {
+			entries = append(entries, e)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.modified != nil {
+		for key := range s.keys {
+			s.modified(nil, key)
+		}
+	}
+	s.keys = make(map[string]interface{})
+	s.exp.Clear()
+	t := now()
+	for _, e := range entries {
+		if !e.Expires.IsZero() && !e.Expires.After(t) {
+			continue
+		}
+		s.set(e.Key, storeValue(e.Value))
+		if !e.Expires.IsZero() {
+			s.exp.ExpireAt(e.Key, e.Expires, redcon.ExpireAlways)
+		}
+		if s.modified != nil {
+			s.modified(nil, e.Key)
+		}
+	}
+	return nil
+}
+
+// storeValue returns the value of the Store for an rdb value.
+func storeValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case rdb.List:
+		return NewList(v...)
+	case rdb.Set:
+		return Set(v)
+	case rdb.Hash:
+		return Hash(v)
+	case rdb.ZSet:
+		z := NewZSet()
+		for _, m := range v {
+			z.Add(m.Member, m.Score)
+		}
+		return z
+	}
+	return value
+}
@@ -0,0 +1,52 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/tidwall/redcon/rdb"
+)
+
+func TestRDB(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Unix(1000, 0) }
+	s := New()
+	c := testServer(t, s)
+	c.run([][]string{
+		{"SET", "s", "x", "+OK"},
+		{"SET", "n", "12", "+OK"},
+		{"HSET", "h", "a", "1", "b", "2", ":2"},
+		{"RPUSH", "l", "a", "b", "c", ":3"},
+		{"SADD", "set", "a", "b", ":2"},
+		{"ZADD", "z", "1.5", "a", "-inf", "b", ":2"},
+		{"EXPIRE", "l", "100", ":1"},
+		{"EXPIRE", "s", "10", ":1"},
+	})
+	path := filepath.Join(t.TempDir(), "dump.rdb")
+	p := rdb.NewPersister(path, s.SaveRDB, s.LoadRDB)
+	if err := p.Save(); err != nil {
+		t.Fatal(err)
+	}
+	c.run([][]string{{"SET", "x", "1", "+OK"}})
+
+	// the keys that expired since the save are not loaded
+	now = func() time.Time { return time.Unix(1050, 0) }
+	if err := p.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if expires, _ := s.Expires("l"); expires.Unix() != 1100 {
+		t.Fatalf("unexpected expiration %v", expires)
+	}
+	c.run([][]string{
+		{"GET", "s", "nil"},
+		{"GET", "x", "nil"},
+		{"GET", "n", "12"},
+		{"HGETALL", "h", "[a 1 b 2]"},
+		{"LRANGE", "l", "0", "-1", "[a b c]"},
+		{"SMEMBERS", "set", "[a b]"},
+		{"ZRANGE", "z", "0", "-1", "WITHSCORES", "[b -inf a 1.5]"},
+		{"TTL", "l", ":50"},
+		{"DBSIZE", ":5"},
+	})
+}
@@ -0,0 +1,374 @@
+package store
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/tidwall/redcon"
+)
+
+// Set is the value of a set key, which is a collection of unique members.
+type Set map[string]struct{}
+
+// members returns the members, ordered by member.
+func (set Set) members() []string {
+	members := make([]string, 0, len(set))
+	for member := range set {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// randomMembers returns up to n distinct members, chosen at random.
+func (set Set) randomMembers(n int) []string {
+	members := make([]string, 0, len(set))
+	for member := range set {
+		members = append(members, member)
+	}
+	if n > len(members) {
+		n = len(members)
+	}
+	for i := 0; i < n; i++ {
+		j := i + rand.Intn(len(members)-i)
+		members[i], members[j] = members[j], members[i]
+	}
+	return members[:n]
+}
+
+func (s *Store) setCommands() []Command {
+	return []Command{
+		command("sadd", -3, "write denyoom fast", "write set fast", 1, 1, 1,
+			s.cmdSAdd),
+		command("srem", -3, "write fast", "write set fast", 1, 1, 1,
+			s.cmdSRem),
+		command("scard", 2, "readonly fast", "read set fast", 1, 1, 1,
+			s.cmdSCard),
+		command("sismember", 3, "readonly fast", "read set fast", 1, 1, 1,
+			s.cmdSIsMember),
+		command("smismember", -3, "readonly fast", "read set fast", 1, 1, 1,
+			s.cmdSIsMember),
+		command("smembers", 2, "readonly", "read set slow", 1, 1, 1,
+			s.cmdSMembers),
+		command("spop", -2, "write fast", "write set fast", 1, 1, 1,
+			s.cmdSPop),
+		command("srandmember", -2, "readonly", "read set slow", 1, 1, 1,
+			s.cmdSRandMember),
+		command("smove", 4, "write fast", "write set fast", 1, 2, 1,
+			s.cmdSMove),
+		command("sinter", -2, "readonly", "read set slow", 1, -1, 1,
+			s.cmdSetOp),
+		command("sunion", -2, "readonly", "read set slow", 1, -1, 1,
+			s.cmdSetOp),
+		command("sdiff", -2, "readonly", "read set slow", 1, -1, 1,
+			s.cmdSetOp),
+		command("sinterstore", -3, "write denyoom", "write set slow", 1, -1,
+			1, s.cmdSetOp),
+		command("sunionstore", -3, "write denyoom", "write set slow", 1, -1,
+			1, s.cmdSetOp),
+		command("sdiffstore", -3, "write denyoom", "write set slow", 1, -1,
+			1, s.cmdSetOp),
+	}
+}
+
+// setValue returns the set of a key, which is nil when the key does not
+// exist unless create is true. The caller must hold the lock.
+func (s *Store) setValue(key string, create bool) (Set, error) {
+	value, ok := s.lookup(key)
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+		set := make(Set)
+		s.set(key, set)
+		return set, nil
+	}
+	set, ok := value.(Set)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return set, nil
+}
+
+// SADD key member [member ...]
+func (s *Store) cmdSAdd(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := string(cmd.Args[1])
+	set, err := s.setValue(key, true)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	var n int
+	for _, member := range cmd.Args[2:] {
+		if _, ok := set[string(member)]; !ok {
+			set[string(member)] = struct{}{}
+			n++
+		}
+	}
+	if n > 0 {
+		s.notify(conn, "sadd", key, redcon.NotifySet)
+	}
+	conn.WriteInt(n)
+}
+
+// SREM key member [member ...]
+func (s *Store) cmdSRem(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := string(cmd.Args[1])
+	set, err := s.setValue(key, false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	var n int
+	for _, member := range cmd.Args[2:] {
+		if _, ok := set[string(member)]; ok {
+			delete(set, string(member))
+			n++
+		}
+	}
+	if n > 0 {
+		s.notify(conn, "srem", key, redcon.NotifySet)
+		s.deleteIfEmpty(conn, key)
+	}
+	conn.WriteInt(n)
+}
+
+// SCARD key
+func (s *Store) cmdSCard(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set, err := s.setValue(string(cmd.Args[1]), false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	conn.WriteInt(len(set))
+}
+
+// SISMEMBER key member
+// SMISMEMBER key member [member ...]
+func (s *Store) cmdSIsMember(conn redcon.Conn, cmd redcon.Command) {
+	multi := strings.EqualFold(string(cmd.Args[0]), "smismember")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set, err := s.setValue(string(cmd.Args[1]), false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if multi {
+		conn.WriteArray(len(cmd.Args) - 2)
+	}
+	for _, member := range cmd.Args[2:] {
+		if _, ok := set[string(member)]; ok {
+			conn.WriteInt(1)
+		} else {
+			conn.WriteInt(0)
+		}
+	}
+}
+
+// SMEMBERS key
+func (s *Store) cmdSMembers(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set, err := s.setValue(string(cmd.Args[1]), false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	writeMembers(conn, set.members())
+}
+
+func writeMembers(conn redcon.Conn, members []string) {
+	conn.WriteArray(len(members))
+	for _, member := range members {
+		conn.WriteBulkString(member)
+	}
+}
+
+// SPOP key [count]
+func (s *Store) cmdSPop(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	count := -1
+	if args.More() {
+		count = int(args.IntRange(0, math.MaxInt32))
+	}
+	if err := args.Done(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set, err := s.setValue(key, false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	n := count
+	if n < 0 {
+		n = 1
+	}
+	members := set.randomMembers(n)
+	for _, member := range members {
+		delete(set, member)
+	}
+	if count < 0 {
+		if len(members) == 0 {
+			conn.WriteNull()
+		} else {
+			conn.WriteBulkString(members[0])
+		}
+	} else {
+		writeMembers(conn, members)
+	}
+	if len(members) > 0 {
+		// the popped members are written to an AOF
+		args := [][]byte{[]byte("SREM"), cmd.Args[1]}
+		for _, member := range members {
+			args = append(args, []byte(member))
+		}
+		redcon.Propagate(conn, args...)
+		s.notify(conn, "spop", key, redcon.NotifySet)
+		s.deleteIfEmpty(conn, key)
+	}
+}
+
+// SRANDMEMBER key [count]
+func (s *Store) cmdSRandMember(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	var count int
+	hasCount := args.More()
+	if hasCount {
+		count = int(args.IntRange(-math.MaxInt32, math.MaxInt32))
+	}
+	if err := args.Done(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	set, err := s.setValue(key, false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if !hasCount {
+		if members := set.randomMembers(1); len(members) == 0 {
+			conn.WriteNull()
+		} else {
+			conn.WriteBulkString(members[0])
+		}
+		return
+	}
+	if count >= 0 {
+		writeMembers(conn, set.randomMembers(count))
+		return
+	}
+	// a negative count allows the same member to be returned many times
+	var members []string
+	if len(set) > 0 {
+		all := set.members()
+		members = make([]string, -count)
+		for i := range members {
+			members[i] = all[rand.Intn(len(all))]
+		}
+	}
+	writeMembers(conn, members)
+}
+
+// SMOVE source destination member
+func (s *Store) cmdSMove(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	src, dst := string(cmd.Args[1]), string(cmd.Args[2])
+	member := string(cmd.Args[3])
+	srcSet, err := s.setValue(src, false)
+	if err == nil {
+		_, err = s.setValue(dst, false)
+	}
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if _, ok := srcSet[member]; !ok {
+		conn.WriteInt(0)
+		return
+	}
+	delete(srcSet, member)
+	s.notify(conn, "srem", src, redcon.NotifySet)
+	dstSet, _ := s.setValue(dst, true)
+	dstSet[member] = struct{}{}
+	s.notify(conn, "sadd", dst, redcon.NotifySet)
+	s.deleteIfEmpty(conn, src)
+	conn.WriteInt(1)
+}
+
+// SINTER key [key ...]
+// SUNION key [key ...]
+// SDIFF key [key ...]
+// SINTERSTORE destination key [key ...]
+// SUNIONSTORE destination key [key ...]
+// SDIFFSTORE destination key [key ...]
+func (s *Store) cmdSetOp(conn redcon.Conn, cmd redcon.Command) {
+	name := strings.ToLower(string(cmd.Args[0]))
+	store := strings.HasSuffix(name, "store")
+	keys := cmd.Args[1:]
+	if store {
+		keys = keys[1:]
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sets := make([]Set, len(keys))
+	for i, key := range keys {
+		var err error
+		if sets[i], err = s.setValue(string(key), false); err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+	}
+	result := make(Set)
+	for member := range sets[0] {
+		result[member] = struct{}{}
+	}
+	for _, set := range sets[1:] {
+		switch {
+		case strings.HasPrefix(name, "sinter"):
+			for member := range result {
+				if _, ok := set[member]; !ok {
+					delete(result, member)
+				}
+			}
+		case strings.HasPrefix(name, "sunion"):
+			for member := range set {
+				result[member] = struct{}{}
+			}
+		default:
+			for member := range set {
+				delete(result, member)
+			}
+		}
+	}
+	if !store {
+		writeMembers(conn, result.members())
+		return
+	}
+	dst := string(cmd.Args[1])
+	if len(result) == 0 {
+		if s.del(dst) {
+			s.notify(conn, "del", dst, redcon.NotifyGeneric)
+		}
+	} else {
+		s.set(dst, result)
+		s.notify(conn, name, dst, redcon.NotifySet)
+	}
+	conn.WriteInt(len(result))
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"bytes"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/redcon"
+)
+
+func TestSet(t *testing.T) {
+	c := testServer(t, New())
+	c.run([][]string{
+		{"SADD", "a", "1", "2", "3", "3", ":3"},
+		{"SADD", "a", "3", "4", ":1"},
+		{"SADD", "b", "3", "4", "5", ":3"},
+		{"SCARD", "a", ":4"},
+		{"SCARD", "z", ":0"},
+		{"SISMEMBER", "a", "1", ":1"},
+		{"SISMEMBER", "a", "5", ":0"},
+		{"SMISMEMBER", "a", "1", "5", "[:1 :0]"},
+		{"SMEMBERS", "a", "[1 2 3 4]"},
+		{"SINTER", "a", "b", "[3 4]"},
+		{"SINTER", "a", "z", "[]"},
+		{"SUNION", "a", "b", "z", "[1 2 3 4 5]"},
+		{"SDIFF", "a", "b", "[1 2]"},
+		{"SINTERSTORE", "c", "a", "b", ":2"},
+		{"SMEMBERS", "c", "[3 4]"},
+		{"SUNIONSTORE", "c", "c", "z", ":2"},
+		{"SDIFFSTORE", "c", "c", "b", ":0"},
+		{"EXISTS", "c", ":0"},
+		{"SREM", "a", "1", "9", ":1"},
+		{"SMOVE", "a", "c", "2", ":1"},
+		{"SMOVE", "a", "c", "2", ":0"},
+		{"SMEMBERS", "c", "[2]"},
+		{"SPOP", "c", "2"},
+		{"EXISTS", "c", ":0"},
+		{"SPOP", "c", "nil"},
+		{"SRANDMEMBER", "c", "nil"},
+		{"SRANDMEMBER", "c", "2", "[]"},
+		{"SRANDMEMBER", "c", "-2", "[]"},
+		{"SADD", "c", "1", ":1"},
+		{"SRANDMEMBER", "c", "1"},
+		{"SRANDMEMBER", "c", "3", "[1]"},
+		{"SRANDMEMBER", "c", "-3", "[1 1 1]"},
+		{"SCARD", "c", ":1"},
+		{"DEL", "c", ":1"},
+		{"SET", "s", "x", "+OK"},
+		{"SADD", "s", "x", wrongType},
+		{"SINTER", "a", "s", wrongType},
+		{"SMOVE", "a", "s", "3", wrongType},
+	})
+
+	// the members are popped in random order
+	res := strings.Fields(strings.Trim(c.do("SPOP", "b", "5"), "[]"))
+	sort.Strings(res)
+	if strings.Join(res, " ") != "3 4 5" {
+		t.Fatalf("expected '%v', got '%v'", "3 4 5", res)
+	}
+	c.run([][]string{{"EXISTS", "b", ":0"}})
+
+	// every member is eventually chosen
+	c.run([][]string{{"SADD", "b", "1", "2", "3", ":3"}})
+	seen := make(map[string]bool)
+	for i := 0; i < 100 && len(seen) < 3; i++ {
+		seen[c.do("SRANDMEMBER", "b")] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("expected 3 members, got %v", seen)
+	}
+	res = strings.Fields(strings.Trim(c.do("SRANDMEMBER", "b", "2"), "[]"))
+	if len(res) != 2 || res[0] == res[1] {
+		t.Fatalf("expected 2 distinct members, got '%v'", res)
+	}
+}
+
+func TestSetAOF(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	open := func() (*Store, *redcon.AOF) {
+		s := New()
+		mux := redcon.NewServeMux()
+		s.Register(mux)
+		aof, err := redcon.OpenAOF(path, mux, redcon.FsyncNo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s, aof
+	}
+	s, aof := open()
+	c := testServe(t, aof.ServeRESP)
+	c.run([][]string{
+		{"SADD", "a", "1", "2", "3", "4", "5", ":5"},
+		{"SADD", "b", "x", ":1"},
+		{"SPOP", "b", "x"},
+		{"SPOP", "b", "nil"},
+	})
+	c.do("SPOP", "a", "2")
+	c.do("SPOP", "a")
+	aof.Close()
+
+	// the popped members are removed when the file is loaded
+	s2, aof := open()
+	defer aof.Close()
+	if _, err := aof.Load(); err != nil {
+		t.Fatal(err)
+	}
+	var exp, res bytes.Buffer
+	s.Snapshot()(redcon.NewWriter(&exp))
+	s2.Snapshot()(redcon.NewWriter(&res))
+	if exp.String() != res.String() || s2.Len() != 1 {
+		t.Fatalf("expected %q, got %q", exp.String(), res.String())
+	}
+}
@@ -0,0 +1,69 @@
+package store
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// Snapshot captures the data of the Store, and returns a function that
+// writes the commands that recreate the data to w, which is a
+// redcon.AOFSnapshot for rewriting an append-only file.
+//
+//	aof.RegisterRewrite(s.Snapshot)
+func (s *Store) Snapshot() func(w *redcon.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var cmds [][][]byte
+	for _, key := range s.match("*") {
+		cmds = append(cmds, snapshotCommand(key, s.keys[key]))
+		if expires, ok := s.exp.ExpiresAt(key); ok {
+			ms := expires.UnixNano() / int64(time.Millisecond)
+			cmds = append(cmds, [][]byte{[]byte("PEXPIREAT"), []byte(key),
+				[]byte(strconv.FormatInt(ms, 10))})
+		}
+	}
+	return func(w *redcon.Writer) error {
+		for _, args := range cmds {
+			w.WriteArray(len(args))
+			for _, arg := range args {
+				w.WriteBulk(arg)
+			}
+			if err := w.Flush(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// snapshotCommand returns the command that sets a key to a value, which is
+// a copy of the value.
+func snapshotCommand(key string, value interface{}) [][]byte {
+	var args [][]byte
+	switch v := value.(type) {
+	case []byte:
+		return [][]byte{[]byte("SET"), []byte(key),
+			append([]byte(nil), v...)}
+	case Hash:
+		args = [][]byte{[]byte("HSET"), []byte(key)}
+		for field, value := range v {
+			args = append(args, []byte(field), value)
+		}
+	case *List:
+		args = append([][]byte{[]byte("RPUSH"), []byte(key)}, v.Values()...)
+	case Set:
+		args = [][]byte{[]byte("SADD"), []byte(key)}
+		for _, member := range v.members() {
+			args = append(args, []byte(member))
+		}
+	case *ZSet:
+		args = [][]byte{[]byte("ZADD"), []byte(key)}
+		for _, m := range v.Members() {
+			args = append(args, []byte(formatFloat(m.Score)),
+				[]byte(m.Member))
+		}
+	}
+	return args
+}
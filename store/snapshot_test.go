@@ -0,0 +1,59 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tidwall/redcon"
+)
+
+func TestSnapshot(t *testing.T) {
+	s := New()
+	c := testServer(t, s)
+	c.run([][]string{
+		{"SET", "s", "x", "+OK"},
+		{"APPEND", "s", "y", ":2"},
+		{"HSET", "h", "a", "1", "b", "2", ":2"},
+		{"RPUSH", "l", "a", "b", "c", ":3"},
+		{"SADD", "set", "a", "b", ":2"},
+		{"ZADD", "z", "1.5", "a", "-inf", "b", ":2"},
+		{"PEXPIREAT", "l", "7258118400000", ":1"},
+	})
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write := s.Snapshot()
+	c.run([][]string{{"SET", "s", "z", "+OK"}})
+	if err := write(redcon.NewWriter(f)); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	// the snapshot is loaded from an append-only file
+	s = New()
+	mux := redcon.NewServeMux()
+	s.Register(mux)
+	aof, err := redcon.OpenAOF(path, mux, redcon.FsyncNo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer aof.Close()
+	if n, err := aof.Load(); err != nil || n != 6 {
+		t.Fatalf("unexpected load %v %v", n, err)
+	}
+	if expires, _ := s.Expires("l"); expires.UTC().Year() != 2200 {
+		t.Fatalf("unexpected expiration %v", expires)
+	}
+	c = testServer(t, s)
+	c.run([][]string{
+		{"GET", "s", "xy"},
+		{"HGETALL", "h", "[a 1 b 2]"},
+		{"LRANGE", "l", "0", "-1", "[a b c]"},
+		{"SMEMBERS", "set", "[a b]"},
+		{"ZRANGE", "z", "0", "-1", "WITHSCORES", "[b -inf a 1.5]"},
+		{"DBSIZE", ":5"},
+	})
+}
@@ -0,0 +1,365 @@
+// Package store is an in-memory key-value store for redcon servers, which
+// implements the core Redis commands for strings, hashes, lists, sets and
+// sorted sets, including expirations.
+//
+//	s := store.New()
+//	mux := redcon.NewServeMux()
+//	s.Register(mux)
+//	redcon.ListenAndServe(":6379", mux.ServeRESP, nil, nil)
+//
+// Commands may be overridden by registering them on the mux with
+// HandleCommand before calling Register, and the handlers of the Store
+// may be wrapped using Commands.
+package store
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/match"
+	"github.com/tidwall/redcon"
+)
+
+var (
+	// ErrWrongType is returned for a key that holds a value of another type
+	// than the command operates on.
+	ErrWrongType = errors.New("WRONGTYPE Operation against a key holding " +
+		"the wrong kind of value")
+
+	errNoSuchKey = errors.New("ERR no such key")
+	errOverflow  = errors.New("ERR increment or decrement would overflow")
+	errNaNOrInf  = errors.New("ERR increment would produce NaN or Infinity")
+
+	errHashNotInteger = errors.New("ERR hash value is not an integer")
+	errHashNotFloat   = errors.New("ERR hash value is not a float")
+)
+
+// now returns the current time, which is replaced by tests.
+var now = time.Now
+
+// Store is an in-memory key-value store, which is safe for concurrent use.
+//
+// The values are []byte for strings, Hash, *List, Set and *ZSet. Values
+// that are passed to or returned from the Store must not be modified, except
+// in Update.
+//
+// Keys expire lazily when they are accessed, and actively after calling
+// Start, using a redcon.Expirer.
+type Store struct {
+	mu       sync.Mutex
+	keys     map[string]interface{}
+	exp      *redcon.Expirer
+	notifier *redcon.Notifier
+	modified func(conn redcon.Conn, key string)
+}
+
+// New returns an empty Store.
+func New() *Store {
+	s := &Store{keys: make(map[string]interface{})}
+	s.exp = redcon.NewExpirer(keyspace{s}, &s.mu)
+	s.exp.SetClock(func() time.Time { return now() })
+	return s
+}
+
+// keyspace is the redcon.Keyspace of a Store, which is used by the
+// Expirer while the Store is locked.
+type keyspace struct{ s *Store }
+
+func (ks keyspace) Exists(key string) bool {
+	_, ok := ks.s.keys[key]
+	return ok
+}
+
+func (ks keyspace) Delete(key string) {
+	delete(ks.s.keys, key)
+	if ks.s.modified != nil {
+		ks.s.modified(nil, key)
+	}
+}
+
+// Start starts actively expiring keys, which runs at each interval until
+// Close is called. A zero interval is 100ms.
+func (s *Store) Start(interval time.Duration) {
+	s.exp.Start(interval)
+}
+
+// Close stops actively expiring keys.
+func (s *Store) Close() error {
+	return s.exp.Close()
+}
+
+// SetNotifier sets the Notifier for keyspace notifications of the
+// commands, such as "set" and "del" events. A nil Notifier disables
+// notifications.
+func (s *Store) SetNotifier(n *redcon.Notifier) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.notifier = n
+	s.exp.SetNotifier(n, 0)
+}
+
+// OnModified sets a function that is called for each key that is modified
+// by a command, such as for TxHandler.Touch or Tracker.Invalidate. It's
+// called while the Store is locked, and with a nil conn for keys that
+// expire.
+func (s *Store) OnModified(fn func(conn redcon.Conn, key string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.modified = fn
+}
+
+// Get returns the value of a key.
+func (s *Store) Get(key string) (value interface{}, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lookup(key)
+}
+
+// Set sets the value of a key. The key expires at the time unless it's
+// zero.
+func (s *Store) Set(key string, value interface{}, expires time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.set(key, value)
+	if !expires.IsZero() {
+		s.exp.ExpireAt(key, expires, redcon.ExpireAlways)
+	}
+}
+
+// Delete deletes a key, and returns false when it does not exist.
+func (s *Store) Delete(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.del(key)
+}
+
+// Expires returns the time that a key expires at, which is zero when the
+// key does not expire, and false when the key does not exist.
+func (s *Store) Expires(key string) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.lookup(key); !ok {
+		return time.Time{}, false
+	}
+	expires, _ := s.exp.ExpiresAt(key)
+	return expires, true
+}
+
+// Keys returns the keys that match the glob-style pattern, ordered by key.
+func (s *Store) Keys(pattern string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.match(pattern)
+}
+
+// Len returns the number of keys, including keys that expired but were not
+// deleted yet.
+func (s *Store) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.keys)
+}
+
+// Update calls fn with the value of a key while the Store is locked, and
+// sets the key to the value that fn returns, or deletes the key when fn
+// returns false. This allows for atomically modifying a value, such as in a
+// command that overrides a command of the Store. The expiration of the key
+// is kept, and the Store must not be used by fn.
+func (s *Store) Update(key string,
+	fn func(value interface{}, ok bool) (interface{}, bool),
+) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, exists := s.lookup(key)
+	value, ok := fn(value, exists)
+	switch {
+	case !ok:
+		s.del(key)
+	case exists:
+		s.keys[key] = value
+	default:
+		s.set(key, value)
+	}
+}
+
+// lookup returns the value of a key, and deletes the key when it expired.
+// The caller must hold the lock.
+func (s *Store) lookup(key string) (interface{}, bool) {
+	if s.exp.Check(key) {
+		return nil, false
+	}
+	value, ok := s.keys[key]
+	return value, ok
+}
+
+// match returns the keys that match the pattern, ordered by key, and
+// deletes the keys that expired. The caller must hold the lock.
+func (s *Store) match(pattern string) []string {
+	var keys []string
+	for key := range s.keys {
+		if !s.exp.Check(key) &&
+			(pattern == "*" || match.Match(key, pattern)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// set sets the value of a key, which does not expire. The caller must hold
+// the lock.
+func (s *Store) set(key string, value interface{}) {
+	s.keys[key] = value
+	s.exp.Remove(key)
+}
+
+// del deletes a key. The caller must hold the lock.
+func (s *Store) del(key string) bool {
+	if _, ok := s.lookup(key); !ok {
+		return false
+	}
+	delete(s.keys, key)
+	s.exp.Remove(key)
+	return true
+}
+
+// emptyValue reports whether a value is an empty collection, which is
+// deleted.
+func emptyValue(value interface{}) bool {
+	switch v := value.(type) {
+	case Hash:
+		return len(v) == 0
+	case *List:
+		return v.Len() == 0
+	case Set:
+		return len(v) == 0
+	case *ZSet:
+		return v.Len() == 0
+	}
+	return false
+}
+
+// deleteIfEmpty deletes a key that holds an empty collection. The caller
+// must hold the lock.
+func (s *Store) deleteIfEmpty(conn redcon.Conn, key string) {
+	if value, ok := s.keys[key]; ok && emptyValue(value) {
+		delete(s.keys, key)
+		s.exp.Remove(key)
+		s.notify(conn, "del", key, redcon.NotifyGeneric)
+	}
+}
+
+// notify sends a keyspace notification for a key that was modified. The
+// caller must hold the lock.
+func (s *Store) notify(conn redcon.Conn, event, key string,
+	class redcon.NotifyClass,
+) {
+	if s.notifier != nil {
+		s.notifier.Notify(0, event, key, class)
+	}
+	if s.modified != nil {
+		s.modified(conn, key)
+	}
+}
+
+// typeName returns the name of the type of a value, as returned by TYPE.
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case []byte:
+		return "string"
+	case Hash:
+		return "hash"
+	case *List:
+		return "list"
+	case Set:
+		return "set"
+	case *ZSet:
+		return "zset"
+	}
+	return "none"
+}
+
+// formatFloat formats a float like Redis, which is "inf" or "-inf" for
+// infinities.
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// parseInt parses a string value as an integer.
+func parseInt(b []byte) (int64, error) {
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0, redcon.ErrNotInteger
+	}
+	return n, nil
+}
+
+// parseFloat parses a string value as a float.
+func parseFloat(b []byte) (float64, error) {
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, redcon.ErrNotFloat
+	}
+	return f, nil
+}
+
+// Command is a command of the Store.
+type Command struct {
+	Spec    redcon.CommandSpec
+	Handler redcon.HandlerFunc
+}
+
+// command returns a Command. The flags and categories are space-separated.
+func command(name string, arity int, flags, categories string,
+	firstKey, lastKey, step int, handler redcon.HandlerFunc,
+) Command {
+	return Command{
+		Spec: redcon.CommandSpec{
+			Name:       name,
+			Arity:      arity,
+			Flags:      strings.Fields(flags),
+			Categories: strings.Fields(categories),
+			FirstKey:   firstKey,
+			LastKey:    lastKey,
+			Step:       step,
+		},
+		Handler: handler,
+	}
+}
+
+// Commands returns the commands of the Store, ordered by name.
+func (s *Store) Commands() []Command {
+	var cmds []Command
+	cmds = append(cmds, s.genericCommands()...)
+	cmds = append(cmds, s.stringCommands()...)
+	cmds = append(cmds, s.hashCommands()...)
+	cmds = append(cmds, s.listCommands()...)
+	cmds = append(cmds, s.setCommands()...)
+	cmds = append(cmds, s.zsetCommands()...)
+	sort.Slice(cmds, func(i, j int) bool {
+		return cmds[i].Spec.Name < cmds[j].Spec.Name
+	})
+	return cmds
+}
+
+// Register registers the commands of the Store on the mux. Commands that
+// were registered on the mux with HandleCommand are skipped, which allows
+// for overriding commands by registering them before calling Register.
+func (s *Store) Register(mux *redcon.ServeMux) {
+	for _, cmd := range s.Commands() {
+		if _, ok := mux.Command(cmd.Spec.Name); !ok {
+			mux.HandleCommand(cmd.Spec, cmd.Handler)
+		}
+	}
+}
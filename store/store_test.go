@@ -0,0 +1,284 @@
+package store
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+type testClient struct {
+	t  *testing.T
+	nc net.Conn
+	rd *bufio.Reader
+}
+
+// testServer serves the Store, and returns a connected client.
+func testServer(t *testing.T, s *Store) *testClient {
+	mux := redcon.NewServeMux()
+	s.Register(mux)
+	return testServe(t, mux.ServeRESP)
+}
+
+// testServe serves the handler, and returns a connected client.
+func testServe(t *testing.T, handler func(conn redcon.Conn,
+	cmd redcon.Command),
+) *testClient {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go redcon.Serve(ln, handler, nil, nil)
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+	return &testClient{t: t, nc: nc, rd: bufio.NewReader(nc)}
+}
+
+// do sends a command and reads the reply, which is formatted like
+// "[a [b c] nil :1]".
+func (c *testClient) do(args ...string) string {
+	c.t.Helper()
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = redcon.AppendBulkString(buf, arg)
+	}
+	if _, err := c.nc.Write(buf); err != nil {
+		c.t.Fatal(err)
+	}
+	c.nc.SetReadDeadline(time.Now().Add(time.Second * 5))
+	var read func() string
+	read = func() string {
+		line, err := c.rd.ReadString('\n')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		line = line[:len(line)-2]
+		switch line[0] {
+		case '+', '-', ':':
+			return line
+		case '$':
+			n, _ := strconv.Atoi(line[1:])
+			if n < 0 {
+				return "nil"
+			}
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(c.rd, data); err != nil {
+				c.t.Fatal(err)
+			}
+			return string(data[:n])
+		case '*':
+			n, _ := strconv.Atoi(line[1:])
+			if n < 0 {
+				return "nil"
+			}
+			items := make([]string, n)
+			for i := range items {
+				items[i] = read()
+			}
+			return "[" + strings.Join(items, " ") + "]"
+		}
+		c.t.Fatalf("invalid reply %q", line)
+		return ""
+	}
+	return read()
+}
+
+// run runs commands, where the last argument of each is the expected
+// reply.
+func (c *testClient) run(tests [][]string) {
+	c.t.Helper()
+	for _, test := range tests {
+		args, exp := test[:len(test)-1], test[len(test)-1]
+		if res := c.do(args...); res != exp {
+			c.t.Fatalf("%v: expected '%v', got '%v'", args, exp, res)
+		}
+	}
+}
+
+const wrongType = "-WRONGTYPE Operation against a key holding the wrong " +
+	"kind of value"
+
+func TestGeneric(t *testing.T) {
+	defer func() { now = time.Now }()
+	t0 := time.Unix(1000, 0)
+	now = func() time.Time { return t0 }
+	s := New()
+	c := testServer(t, s)
+	c.run([][]string{
+		{"SET", "a", "1", "+OK"},
+		{"SET", "b", "2", "+OK"},
+		{"SADD", "c", "x", ":1"},
+		{"EXISTS", "a", "a", "z", ":2"},
+		{"TYPE", "a", "+string"},
+		{"TYPE", "c", "+set"},
+		{"TYPE", "z", "+none"},
+		{"KEYS", "*", "[a b c]"},
+		{"KEYS", "[ab]", "[]"},
+		{"KEYS", "?", "[a b c]"},
+		{"DBSIZE", ":3"},
+		{"TTL", "a", ":-1"},
+		{"TTL", "z", ":-2"},
+		{"EXPIRE", "a", "10", ":1"},
+		{"EXPIRE", "a", "20", "NX", ":0"},
+		{"EXPIRE", "a", "5", "GT", ":0"},
+		{"EXPIRE", "a", "5", "LT", ":1"},
+		{"EXPIRE", "b", "5", "XX", ":0"},
+		{"EXPIRE", "z", "5", ":0"},
+		{"EXPIRE", "a", "x", "-ERR value is not an integer or out of range"},
+		{"TTL", "a", ":5"},
+		{"PTTL", "a", ":5000"},
+		{"PEXPIREAT", "b", "1010400", ":1"},
+		{"TTL", "b", ":10"},
+		{"EXPIRETIME", "b", ":1010"},
+		{"PEXPIRETIME", "b", ":1010400"},
+		{"EXPIRETIME", "a", ":1005"},
+		{"EXPIRETIME", "c", ":-1"},
+		{"EXPIREAT", "c", "1100", ":1"},
+		{"PERSIST", "c", ":1"},
+		{"PERSIST", "c", ":0"},
+		{"TTL", "c", ":-1"},
+	})
+
+	// keys expire when they are accessed
+	t0 = t0.Add(time.Second * 5)
+	c.run([][]string{
+		{"GET", "a", "nil"},
+		{"EXISTS", "a", ":0"},
+		{"KEYS", "*", "[b c]"},
+		{"PTTL", "b", ":5400"},
+	})
+	if s.Len() != 2 {
+		t.Fatalf("expected '%v', got '%v'", 2, s.Len())
+	}
+	c.run([][]string{
+		{"EXPIRE", "c", "-1", ":1"},
+		{"EXISTS", "c", ":0"},
+		{"RENAME", "z", "y", "-ERR no such key"},
+		{"SET", "d", "4", "+OK"},
+		{"RENAME", "b", "e", "+OK"},
+		{"RENAMENX", "e", "d", ":0"},
+		{"RENAMENX", "e", "f", ":1"},
+		{"KEYS", "*", "[d f]"},
+		{"DEL", "d", "f", "z", ":2"},
+		{"SET", "a", "1", "+OK"},
+		{"FLUSHDB", "+OK"},
+		{"FLUSHALL", "NOW", "-ERR syntax error"},
+		{"DBSIZE", ":0"},
+	})
+}
+
+func TestStoreAPI(t *testing.T) {
+	s := New()
+	s.Set("a", []byte("1"), time.Time{})
+	s.Set("b", NewList([]byte("x")), time.Now().Add(time.Hour))
+	if value, ok := s.Get("a"); !ok || string(value.([]byte)) != "1" {
+		t.Fatalf("unexpected value %v %v", value, ok)
+	}
+	if expires, ok := s.Expires("b"); !ok || expires.IsZero() {
+		t.Fatalf("unexpected expiration %v %v", expires, ok)
+	}
+	s.Update("a", func(value interface{}, ok bool) (interface{}, bool) {
+		n, _ := strconv.Atoi(string(value.([]byte)))
+		return []byte(strconv.Itoa(n + 1)), true
+	})
+	if value, _ := s.Get("a"); string(value.([]byte)) != "2" {
+		t.Fatalf("expected '%v', got '%v'", "2", value)
+	}
+	s.Update("b", func(value interface{}, ok bool) (interface{}, bool) {
+		return nil, false
+	})
+	if keys := strings.Join(s.Keys("*"), " "); keys != "a" {
+		t.Fatalf("expected '%v', got '%v'", "a", keys)
+	}
+	if !s.Delete("a") || s.Delete("a") {
+		t.Fatal("expected a single delete")
+	}
+}
+
+func TestStoreActiveExpire(t *testing.T) {
+	s := New()
+	for i := 0; i < 100; i++ {
+		var expires time.Time
+		if i%2 == 0 {
+			expires = time.Now().Add(time.Millisecond * 10)
+		}
+		s.Set(strconv.Itoa(i), []byte("x"), expires)
+	}
+	s.Start(time.Millisecond * 10)
+	defer s.Close()
+	deadline := time.Now().Add(time.Second * 5)
+	for s.Len() != 50 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected '%v', got '%v'", 50, s.Len())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestStoreHooks(t *testing.T) {
+	var ps redcon.PubSub
+	n, _ := redcon.NewNotifier(&ps, "KEA")
+	msgs := make(chan redcon.Message, 16)
+	sub := ps.NewSubscriber(func(msg redcon.Message) { msgs <- msg })
+	defer sub.Close()
+	sub.Psubscribe("__keyevent@0__:*")
+	var modified []string
+	s := New()
+	s.SetNotifier(n)
+	s.OnModified(func(conn redcon.Conn, key string) {
+		modified = append(modified, key)
+	})
+
+	// commands may be overridden
+	mux := redcon.NewServeMux()
+	mux.HandleCommand(redcon.CommandSpec{Name: "get", Arity: 2},
+		redcon.HandlerFunc(func(conn redcon.Conn, cmd redcon.Command) {
+			conn.WriteString("OVERRIDDEN")
+		}))
+	s.Register(mux)
+	if _, ok := mux.Command("set"); !ok {
+		t.Fatal("expected the set command")
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go redcon.Serve(ln, mux.ServeRESP, nil, nil)
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	c := &testClient{t: t, nc: nc, rd: bufio.NewReader(nc)}
+	c.run([][]string{
+		{"SET", "a", "1", "+OK"},
+		{"GET", "a", "+OVERRIDDEN"},
+		{"LPUSH", "l", "x", ":1"},
+		{"LPOP", "l", "x"},
+	})
+	for _, exp := range []string{"set a", "lpush l", "lpop l", "del l"} {
+		select {
+		case msg := <-msgs:
+			res := strings.TrimPrefix(msg.Channel, "__keyevent@0__:") + " " +
+				string(msg.Message)
+			if res != exp {
+				t.Fatalf("expected '%v', got '%v'", exp, res)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out")
+		}
+	}
+	if res := strings.Join(modified, " "); res != "a l l l" {
+		t.Fatalf("expected '%v', got '%v'", "a l l l", res)
+	}
+}
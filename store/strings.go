@@ -0,0 +1,448 @@
+package store
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+func (s *Store) stringCommands() []Command {
+	return []Command{
+		command("get", 2, "readonly fast", "read string fast", 1, 1, 1,
+			s.cmdGet),
+		command("set", -3, "write denyoom", "write string slow", 1, 1, 1,
+			s.cmdSet),
+		command("setnx", 3, "write denyoom fast", "write string fast", 1, 1,
+			1, s.cmdSetNX),
+		command("setex", 4, "write denyoom", "write string slow", 1, 1, 1,
+			s.cmdSetEX),
+		command("psetex", 4, "write denyoom", "write string slow", 1, 1, 1,
+			s.cmdSetEX),
+		command("getset", 3, "write denyoom fast", "write string fast", 1, 1,
+			1, s.cmdGetSet),
+		command("getdel", 2, "write fast", "write string fast", 1, 1, 1,
+			s.cmdGetDel),
+		command("mget", -2, "readonly fast", "read string fast", 1, -1, 1,
+			s.cmdMGet),
+		command("mset", -3, "write denyoom", "write string slow", 1, -1, 2,
+			s.cmdMSet),
+		command("msetnx", -3, "write denyoom", "write string slow", 1, -1, 2,
+			s.cmdMSet),
+		command("incr", 2, "write denyoom fast", "write string fast", 1, 1,
+			1, s.cmdIncr),
+		command("decr", 2, "write denyoom fast", "write string fast", 1, 1,
+			1, s.cmdIncr),
+		command("incrby", 3, "write denyoom fast", "write string fast", 1, 1,
+			1, s.cmdIncr),
+		command("decrby", 3, "write denyoom fast", "write string fast", 1, 1,
+			1, s.cmdIncr),
+		command("incrbyfloat", 3, "write denyoom fast", "write string fast",
+			1, 1, 1, s.cmdIncrByFloat),
+		command("append", 3, "write denyoom fast", "write string fast", 1, 1,
+			1, s.cmdAppend),
+		command("strlen", 2, "readonly fast", "read string fast", 1, 1, 1,
+			s.cmdStrlen),
+		command("getrange", 4, "readonly", "read string slow", 1, 1, 1,
+			s.cmdGetRange),
+	}
+}
+
+// str returns the string value of a key, and false when the key does not
+// exist. The caller must hold the lock.
+func (s *Store) str(key string) ([]byte, bool, error) {
+	v, ok := s.lookup(key)
+	if !ok {
+		return nil, false, nil
+	}
+	value, ok := v.([]byte)
+	if !ok {
+		return nil, false, ErrWrongType
+	}
+	return value, true, nil
+}
+
+// setStr sets the string value of a key, which is copied. The caller must
+// hold the lock.
+func (s *Store) setStr(conn redcon.Conn, key string, value []byte) {
+	s.set(key, append([]byte(nil), value...))
+	s.notify(conn, "set", key, redcon.NotifyString)
+}
+
+// GET key
+func (s *Store) cmdGet(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok, err := s.str(string(cmd.Args[1]))
+	switch {
+	case err != nil:
+		conn.WriteError(err.Error())
+	case !ok:
+		conn.WriteNull()
+	default:
+		conn.WriteBulk(value)
+	}
+}
+
+// SET key value [NX|XX] [GET] [EX seconds|PX milliseconds|
+// EXAT unix-time-seconds|PXAT unix-time-milliseconds|KEEPTTL]
+func (s *Store) cmdSet(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key, value := args.String(), args.Bytes()
+	var nx, xx, get, keepTTL bool
+	var ttls int
+	var expires time.Time
+	for args.More() {
+		switch {
+		case args.Flag("NX"):
+			nx = true
+		case args.Flag("XX"):
+			xx = true
+		case args.Flag("GET"):
+			get = true
+		case args.Flag("KEEPTTL"):
+			keepTTL = true
+		case args.PeekFlag("EX", "PX", "EXAT", "PXAT"):
+			expires = readExpires(args)
+			ttls++
+		default:
+			args.Fail(redcon.ErrSyntax)
+		}
+	}
+	if (nx && xx) || (keepTTL && ttls > 0) || ttls > 1 {
+		args.Fail(redcon.ErrSyntax)
+	}
+	if err := args.Err(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, exists := s.lookup(key)
+	old, isStr := prev.([]byte)
+	if exists && get && !isStr {
+		conn.WriteError(ErrWrongType.Error())
+		return
+	}
+	if (nx && exists) || (xx && !exists) {
+		if get {
+			writeOld(conn, exists, old)
+		} else {
+			conn.WriteNull()
+		}
+		return
+	}
+	if keepTTL && exists {
+		s.keys[key] = append([]byte(nil), value...)
+		s.notify(conn, "set", key, redcon.NotifyString)
+	} else {
+		s.setStr(conn, key, value)
+	}
+	if ttls > 0 {
+		s.exp.ExpireAt(key, expires, redcon.ExpireAlways)
+	}
+	if get {
+		writeOld(conn, exists, old)
+	} else {
+		conn.WriteString("OK")
+	}
+}
+
+// readExpires reads an "EX seconds", "PX milliseconds", "EXAT
+// unix-time-seconds" or "PXAT unix-time-milliseconds" option.
+func readExpires(args *redcon.ArgReader) time.Time {
+	i := args.Enum("EX", "PX", "EXAT", "PXAT")
+	unit := time.Second
+	if i%2 == 1 {
+		unit = time.Millisecond
+	}
+	d := args.Duration(unit)
+	if i < 2 {
+		return now().Add(d)
+	}
+	return time.Unix(0, int64(d))
+}
+
+// writeOld writes the previous value of SET with the GET option.
+func writeOld(conn redcon.Conn, exists bool, old []byte) {
+	if !exists {
+		conn.WriteNull()
+	} else {
+		conn.WriteBulk(old)
+	}
+}
+
+// SETNX key value
+func (s *Store) cmdSetNX(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := string(cmd.Args[1])
+	if _, ok := s.lookup(key); ok {
+		conn.WriteInt(0)
+		return
+	}
+	s.setStr(conn, key, cmd.Args[2])
+	conn.WriteInt(1)
+}
+
+// SETEX key seconds value
+// PSETEX key milliseconds value
+func (s *Store) cmdSetEX(conn redcon.Conn, cmd redcon.Command) {
+	unit := time.Second
+	if strings.EqualFold(string(cmd.Args[0]), "psetex") {
+		unit = time.Millisecond
+	}
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	d := args.Duration(unit)
+	value := args.Bytes()
+	if err := args.Done(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setStr(conn, key, value)
+	s.exp.ExpireAt(key, now().Add(d), redcon.ExpireAlways)
+	conn.WriteString("OK")
+}
+
+// GETSET key value
+func (s *Store) cmdGetSet(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := string(cmd.Args[1])
+	old, ok, err := s.str(key)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.setStr(conn, key, cmd.Args[2])
+	if ok {
+		conn.WriteBulk(old)
+	} else {
+		conn.WriteNull()
+	}
+}
+
+// GETDEL key
+func (s *Store) cmdGetDel(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := string(cmd.Args[1])
+	value, ok, err := s.str(key)
+	switch {
+	case err != nil:
+		conn.WriteError(err.Error())
+	case !ok:
+		conn.WriteNull()
+	default:
+		s.del(key)
+		s.notify(conn, "del", key, redcon.NotifyGeneric)
+		conn.WriteBulk(value)
+	}
+}
+
+// MGET key [key ...]
+func (s *Store) cmdMGet(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	conn.WriteArray(len(cmd.Args) - 1)
+	for _, key := range cmd.Args[1:] {
+		// keys of other types are null
+		value, ok, err := s.str(string(key))
+		if ok && err == nil {
+			conn.WriteBulk(value)
+		} else {
+			conn.WriteNull()
+		}
+	}
+}
+
+// MSET key value [key value ...]
+// MSETNX key value [key value ...]
+func (s *Store) cmdMSet(conn redcon.Conn, cmd redcon.Command) {
+	nx := strings.EqualFold(string(cmd.Args[0]), "msetnx")
+	if len(cmd.Args)%2 != 1 {
+		conn.WriteError("ERR wrong number of arguments for '" +
+			strings.ToLower(string(cmd.Args[0])) + "' command")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if nx {
+		for i := 1; i < len(cmd.Args); i += 2 {
+			if _, ok := s.lookup(string(cmd.Args[i])); ok {
+				conn.WriteInt(0)
+				return
+			}
+		}
+	}
+	for i := 1; i < len(cmd.Args); i += 2 {
+		s.setStr(conn, string(cmd.Args[i]), cmd.Args[i+1])
+	}
+	if nx {
+		conn.WriteInt(1)
+	} else {
+		conn.WriteString("OK")
+	}
+}
+
+// INCR key
+// DECR key
+// INCRBY key increment
+// DECRBY key decrement
+func (s *Store) cmdIncr(conn redcon.Conn, cmd redcon.Command) {
+	name := strings.ToLower(string(cmd.Args[0]))
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	delta := int64(1)
+	if args.More() {
+		delta = args.Int()
+	}
+	if strings.HasPrefix(name, "decr") {
+		if delta == math.MinInt64 {
+			args.Fail(redcon.ErrNotInteger)
+		}
+		delta = -delta
+	}
+	if err := args.Err(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok, err := s.str(key)
+	var n int64
+	if err == nil && ok {
+		n, err = parseInt(value)
+	}
+	if err == nil && ((delta > 0 && n > math.MaxInt64-delta) ||
+		(delta < 0 && n < math.MinInt64-delta)) {
+		err = errOverflow
+	}
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	n += delta
+	s.updateStr(conn, key, []byte(strconv.FormatInt(n, 10)), "incrby")
+	conn.WriteInt64(n)
+}
+
+// INCRBYFLOAT key increment
+func (s *Store) cmdIncrByFloat(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	delta := args.Float()
+	if err := args.Err(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok, err := s.str(key)
+	var f float64
+	if err == nil && ok {
+		f, err = parseFloat(value)
+	}
+	if err == nil && (math.IsInf(f+delta, 0) || math.IsNaN(f+delta)) {
+		err = errNaNOrInf
+	}
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	value = []byte(formatFloat(f + delta))
+	s.updateStr(conn, key, value, "incrbyfloat")
+	conn.WriteBulk(value)
+}
+
+// updateStr sets the string value of a key and keeps the expiration. The
+// caller must hold the lock.
+func (s *Store) updateStr(conn redcon.Conn, key string, value []byte,
+	event string,
+) {
+	if _, ok := s.lookup(key); ok {
+		s.keys[key] = value
+	} else {
+		s.set(key, value)
+	}
+	s.notify(conn, event, key, redcon.NotifyString)
+}
+
+// APPEND key value
+func (s *Store) cmdAppend(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := string(cmd.Args[1])
+	value, _, err := s.str(key)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	// the value is copied, because it may be returned by Get
+	value = append(value[:len(value):len(value)], cmd.Args[2]...)
+	s.updateStr(conn, key, value, "append")
+	conn.WriteInt(len(value))
+}
+
+// STRLEN key
+func (s *Store) cmdStrlen(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, _, err := s.str(string(cmd.Args[1]))
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	conn.WriteInt(len(value))
+}
+
+// GETRANGE key start end
+func (s *Store) cmdGetRange(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	start, end := args.Int(), args.Int()
+	if err := args.Err(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, _, err := s.str(key)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	i, j, ok := indexRange(start, end, len(value))
+	if !ok {
+		conn.WriteBulk(nil)
+		return
+	}
+	conn.WriteBulk(value[i:j])
+}
+
+// indexRange converts an inclusive range of indexes, where negative indexes
+// are relative to the end, to a slice range for a length. It returns false
+// for an empty range.
+func indexRange(start, end int64, n int) (int, int, bool) {
+	if start < 0 {
+		start += int64(n)
+	}
+	if end < 0 {
+		end += int64(n)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= int64(n) {
+		end = int64(n) - 1
+	}
+	if start > end || start >= int64(n) {
+		return 0, 0, false
+	}
+	return int(start), int(end) + 1, true
+}
@@ -0,0 +1,83 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStrings(t *testing.T) {
+	defer func() { now = time.Now }()
+	t0 := time.Unix(1000, 0)
+	now = func() time.Time { return t0 }
+	c := testServer(t, New())
+	c.run([][]string{
+		{"GET", "a", "nil"},
+		{"SET", "a", "1", "+OK"},
+		{"SET", "a", "2", "NX", "nil"},
+		{"SET", "b", "2", "XX", "nil"},
+		{"SET", "a", "2", "XX", "GET", "1"},
+		{"SET", "a", "3", "NX", "XX", "-ERR syntax error"},
+		{"SET", "a", "3", "EX", "1", "PX", "1", "-ERR syntax error"},
+		{"SET", "a", "3", "EX", "0",
+			"-ERR invalid expire time in 'set' command"},
+		{"SET", "a", "3", "EX", "10", "+OK"},
+		{"SET", "a", "4", "KEEPTTL", "+OK"},
+		{"TTL", "a", ":10"},
+		{"SET", "a", "5", "+OK"},
+		{"TTL", "a", ":-1"},
+		{"SET", "a", "6", "PXAT", "1005000", "+OK"},
+		{"TTL", "a", ":5"},
+		{"SETNX", "a", "7", ":0"},
+		{"SETNX", "b", "1", ":1"},
+		{"SETEX", "c", "2", "x", "+OK"},
+		{"PSETEX", "d", "2500", "y", "+OK"},
+		{"PTTL", "d", ":2500"},
+		{"SETEX", "c", "0", "x", "-ERR invalid expire time in 'setex' command"},
+		{"GETSET", "c", "z", "x"},
+		{"TTL", "c", ":-1"},
+		{"GETDEL", "c", "z"},
+		{"GETDEL", "c", "nil"},
+		{"MSET", "a", "1", "b", "2", "+OK"},
+		{"MSET", "a", "1", "b", "-ERR wrong number of arguments for 'mset' " +
+			"command"},
+		{"MSETNX", "b", "3", "c", "3", ":0"},
+		{"MSETNX", "c", "3", "e", "5", ":1"},
+		{"LPUSH", "l", "x", ":1"},
+		{"MGET", "a", "b", "c", "l", "z", "[1 2 3 nil nil]"},
+		{"GET", "l", wrongType},
+		{"SET", "l", "x", "GET", wrongType},
+		{"INCR", "a", ":2"},
+		{"INCRBY", "a", "10", ":12"},
+		{"DECR", "a", ":11"},
+		{"DECRBY", "a", "20", ":-9"},
+		{"INCR", "n", ":1"},
+		{"INCR", "l", wrongType},
+		{"SET", "a", "x", "+OK"},
+		{"INCR", "a", "-ERR value is not an integer or out of range"},
+		{"SET", "a", "9223372036854775807", "+OK"},
+		{"INCR", "a", "-ERR increment or decrement would overflow"},
+		{"DECRBY", "a", "-9223372036854775808",
+			"-ERR value is not an integer or out of range"},
+		{"SET", "f", "10.5", "+OK"},
+		{"INCRBYFLOAT", "f", "0.1", "10.6"},
+		{"INCRBYFLOAT", "f", "-5e3", "-4989.4"},
+		{"INCRBYFLOAT", "f", "inf",
+			"-ERR increment would produce NaN or Infinity"},
+		{"INCRBYFLOAT", "a", "x", "-ERR value is not a valid float"},
+		{"APPEND", "s", "hello", ":5"},
+		{"APPEND", "s", " world", ":11"},
+		{"STRLEN", "s", ":11"},
+		{"STRLEN", "z", ":0"},
+		{"GETRANGE", "s", "0", "4", "hello"},
+		{"GETRANGE", "s", "-5", "-1", "world"},
+		{"GETRANGE", "s", "5", "1", ""},
+		{"GETRANGE", "s", "0", "100", "hello world"},
+	})
+
+	// the values are copied from the command arguments
+	c.run([][]string{
+		{"SET", "k", "aaaa", "+OK"},
+		{"SET", "j", "bbbb", "+OK"},
+		{"GET", "k", "aaaa"},
+	})
+}
@@ -0,0 +1,675 @@
+package store
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/tidwall/btree"
+	"github.com/tidwall/redcon"
+)
+
+// ZMember is a member of a ZSet and its score.
+type ZMember struct {
+	Member string
+	Score  float64
+}
+
+// ZSet is the value of a sorted set key, which is a collection of unique
+// members that are ordered by score, and then by member.
+type ZSet struct {
+	scores map[string]float64
+	tree   *btree.BTree // *ZMember ordered by score and member
+}
+
+func byScore(a, b interface{}) bool {
+	za, zb := a.(*ZMember), b.(*ZMember)
+	if za.Score != zb.Score {
+		return za.Score < zb.Score
+	}
+	return za.Member < zb.Member
+}
+
+// NewZSet returns an empty ZSet.
+func NewZSet() *ZSet {
+	return &ZSet{
+		scores: make(map[string]float64),
+		tree:   btree.New(byScore),
+	}
+}
+
+// Len returns the number of members.
+func (z *ZSet) Len() int {
+	return len(z.scores)
+}
+
+// Score returns the score of a member, and false when it's not a member.
+func (z *ZSet) Score(member string) (float64, bool) {
+	score, ok := z.scores[member]
+	return score, ok
+}
+
+// Add adds a member or updates its score, and returns true when the member
+// was added.
+func (z *ZSet) Add(member string, score float64) bool {
+	prev, ok := z.scores[member]
+	if ok {
+		if prev == score {
+			return false
+		}
+		z.tree.Delete(&ZMember{member, prev})
+	}
+	z.scores[member] = score
+	z.tree.Set(&ZMember{member, score})
+	return !ok
+}
+
+// Remove removes a member, and returns false when it's not a member.
+func (z *ZSet) Remove(member string) bool {
+	score, ok := z.scores[member]
+	if !ok {
+		return false
+	}
+	delete(z.scores, member)
+	z.tree.Delete(&ZMember{member, score})
+	return true
+}
+
+// Members returns the members, ordered by score.
+func (z *ZSet) Members() []ZMember {
+	return z.byRank(0, z.Len(), false)
+}
+
+// byRank returns the members from rank i to j, exclusive. The ranks are in
+// descending order when rev is true.
+func (z *ZSet) byRank(i, j int, rev bool) []ZMember {
+	members := make([]ZMember, 0, j-i)
+	for ; i < j; i++ {
+		rank := i
+		if rev {
+			rank = z.Len() - 1 - i
+		}
+		members = append(members, *z.tree.GetAt(rank).(*ZMember))
+	}
+	return members
+}
+
+// rank returns the rank of a member, in ascending order.
+func (z *ZSet) rank(member string) (int, bool) {
+	score, ok := z.scores[member]
+	if !ok {
+		return 0, false
+	}
+	var rank int
+	z.tree.Ascend(nil, func(item interface{}) bool {
+		if zm := item.(*ZMember); zm.Score == score && zm.Member == member {
+			return false
+		}
+		rank++
+		return true
+	})
+	return rank, true
+}
+
+// scoreBound is the min or max of a score range.
+type scoreBound struct {
+	score     float64
+	exclusive bool
+}
+
+var errMinMaxNotFloat = errors.New("ERR min or max is not a float")
+
+func parseScoreBound(s string) (scoreBound, error) {
+	var b scoreBound
+	if strings.HasPrefix(s, "(") {
+		b.exclusive = true
+		s = s[1:]
+	}
+	f, err := parseFloat([]byte(s))
+	if err != nil {
+		return b, errMinMaxNotFloat
+	}
+	b.score = f
+	return b, nil
+}
+
+func (b scoreBound) aboveMin(score float64) bool {
+	return score > b.score || (!b.exclusive && score == b.score)
+}
+
+func (b scoreBound) belowMax(score float64) bool {
+	return score < b.score || (!b.exclusive && score == b.score)
+}
+
+// byScore returns the members with a score from min to max, skipping
+// offset members and returning up to count members when count is not
+// negative. The members are in descending order when rev is true.
+func (z *ZSet) byScore(min, max scoreBound, offset, count int, rev bool,
+) []ZMember {
+	var members []ZMember
+	iter := func(item interface{}) bool {
+		zm := item.(*ZMember)
+		if (rev && zm.Score < min.score) || (!rev && zm.Score > max.score) {
+			return false
+		}
+		if !min.aboveMin(zm.Score) || !max.belowMax(zm.Score) {
+			// an exclusive bound
+			return true
+		}
+		if offset > 0 {
+			offset--
+			return true
+		}
+		if count >= 0 && len(members) == count {
+			return false
+		}
+		members = append(members, *zm)
+		return true
+	}
+	switch {
+	case !rev:
+		z.tree.Ascend(&ZMember{Score: min.score}, iter)
+	case math.IsInf(max.score, 1):
+		z.tree.Descend(nil, iter)
+	default:
+		// the pivot is greater than all members with the max score
+		pivot := &ZMember{Score: math.Nextafter(max.score, math.Inf(1))}
+		z.tree.Descend(pivot, iter)
+	}
+	return members
+}
+
+func (s *Store) zsetCommands() []Command {
+	return []Command{
+		command("zadd", -4, "write denyoom fast", "write sortedset fast", 1,
+			1, 1, s.cmdZAdd),
+		command("zincrby", 4, "write denyoom fast", "write sortedset fast", 1,
+			1, 1, s.cmdZIncrBy),
+		command("zrem", -3, "write fast", "write sortedset fast", 1, 1, 1,
+			s.cmdZRem),
+		command("zcard", 2, "readonly fast", "read sortedset fast", 1, 1, 1,
+			s.cmdZCard),
+		command("zscore", 3, "readonly fast", "read sortedset fast", 1, 1, 1,
+			s.cmdZScore),
+		command("zmscore", -3, "readonly fast", "read sortedset fast", 1, 1,
+			1, s.cmdZScore),
+		command("zcount", 4, "readonly fast", "read sortedset fast", 1, 1, 1,
+			s.cmdZCount),
+		command("zrank", 3, "readonly fast", "read sortedset fast", 1, 1, 1,
+			s.cmdZRank),
+		command("zrevrank", 3, "readonly fast", "read sortedset fast", 1, 1,
+			1, s.cmdZRank),
+		command("zrange", -4, "readonly", "read sortedset slow", 1, 1, 1,
+			s.cmdZRange),
+		command("zrevrange", -4, "readonly", "read sortedset slow", 1, 1, 1,
+			s.cmdZRange),
+		command("zrangebyscore", -4, "readonly", "read sortedset slow", 1, 1,
+			1, s.cmdZRange),
+		command("zrevrangebyscore", -4, "readonly", "read sortedset slow", 1,
+			1, 1, s.cmdZRange),
+		command("zremrangebyrank", 4, "write", "write sortedset slow", 1, 1,
+			1, s.cmdZRemRange),
+		command("zremrangebyscore", 4, "write", "write sortedset slow", 1, 1,
+			1, s.cmdZRemRange),
+		command("zpopmin", -2, "write fast", "write sortedset fast", 1, 1, 1,
+			s.cmdZPop),
+		command("zpopmax", -2, "write fast", "write sortedset fast", 1, 1, 1,
+			s.cmdZPop),
+	}
+}
+
+// zset returns the sorted set of a key, which is nil when the key does not
+// exist unless create is true. The caller must hold the lock.
+func (s *Store) zset(key string, create bool) (*ZSet, error) {
+	value, ok := s.lookup(key)
+	if !ok {
+		if !create {
+			return nil, nil
+		}
+		z := NewZSet()
+		s.set(key, z)
+		return z, nil
+	}
+	z, ok := value.(*ZSet)
+	if !ok {
+		return nil, ErrWrongType
+	}
+	return z, nil
+}
+
+func writeZMembers(conn redcon.Conn, members []ZMember, withScores bool) {
+	if withScores {
+		conn.WriteArray(len(members) * 2)
+	} else {
+		conn.WriteArray(len(members))
+	}
+	for _, zm := range members {
+		conn.WriteBulkString(zm.Member)
+		if withScores {
+			conn.WriteBulkString(formatFloat(zm.Score))
+		}
+	}
+}
+
+// ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+func (s *Store) cmdZAdd(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	var nx, xx, gt, lt, ch, incr bool
+	for {
+		if args.Flag("NX") {
+			nx = true
+		} else if args.Flag("XX") {
+			xx = true
+		} else if args.Flag("GT") {
+			gt = true
+		} else if args.Flag("LT") {
+			lt = true
+		} else if args.Flag("CH") {
+			ch = true
+		} else if args.Flag("INCR") {
+			incr = true
+		} else {
+			break
+		}
+	}
+	var members []ZMember
+	for args.More() {
+		score := args.Float()
+		members = append(members, ZMember{args.String(), score})
+	}
+	if err := args.Err(); err != nil {
+		if err != redcon.ErrNotFloat {
+			err = redcon.ErrSyntax
+		}
+		conn.WriteError(err.Error())
+		return
+	}
+	switch {
+	case len(members) == 0:
+		conn.WriteError(redcon.ErrSyntax.Error())
+		return
+	case nx && xx:
+		conn.WriteError("ERR XX and NX options at the same time are not " +
+			"compatible")
+		return
+	case (gt && lt) || (nx && (gt || lt)):
+		conn.WriteError("ERR GT, LT, and/or NX options at the same time " +
+			"are not compatible")
+		return
+	case incr && len(members) > 1:
+		conn.WriteError("ERR INCR option supports a single increment-" +
+			"element pair")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z, err := s.zset(key, !xx)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	var added, changed int
+	var result *float64
+	for _, zm := range members {
+		if z == nil {
+			break
+		}
+		prev, exists := z.Score(zm.Member)
+		if (nx && exists) || (xx && !exists) {
+			continue
+		}
+		score := zm.Score
+		if incr {
+			score += prev
+			if math.IsNaN(score) {
+				s.deleteIfEmpty(conn, key)
+				conn.WriteError("ERR resulting score is not a number (NaN)")
+				return
+			}
+		}
+		if exists && ((gt && score <= prev) || (lt && score >= prev)) {
+			continue
+		}
+		result = &score
+		if !exists {
+			added++
+		} else if score != prev {
+			changed++
+		}
+		z.Add(zm.Member, score)
+	}
+	if added+changed > 0 {
+		if incr {
+			s.notify(conn, "zincr", key, redcon.NotifyZSet)
+		} else {
+			s.notify(conn, "zadd", key, redcon.NotifyZSet)
+		}
+	}
+	s.deleteIfEmpty(conn, key)
+	switch {
+	case incr && result == nil:
+		conn.WriteNull()
+	case incr:
+		conn.WriteBulkString(formatFloat(*result))
+	case ch:
+		conn.WriteInt(added + changed)
+	default:
+		conn.WriteInt(added)
+	}
+}
+
+// ZINCRBY key increment member
+func (s *Store) cmdZIncrBy(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	delta := args.Float()
+	member := args.String()
+	if err := args.Err(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z, err := s.zset(key, true)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	prev, _ := z.Score(member)
+	score := prev + delta
+	if math.IsNaN(score) {
+		s.deleteIfEmpty(conn, key)
+		conn.WriteError("ERR resulting score is not a number (NaN)")
+		return
+	}
+	z.Add(member, score)
+	s.notify(conn, "zincr", key, redcon.NotifyZSet)
+	conn.WriteBulkString(formatFloat(score))
+}
+
+// ZREM key member [member ...]
+func (s *Store) cmdZRem(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := string(cmd.Args[1])
+	z, err := s.zset(key, false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	var n int
+	for _, member := range cmd.Args[2:] {
+		if z != nil && z.Remove(string(member)) {
+			n++
+		}
+	}
+	if n > 0 {
+		s.notify(conn, "zrem", key, redcon.NotifyZSet)
+		s.deleteIfEmpty(conn, key)
+	}
+	conn.WriteInt(n)
+}
+
+// ZCARD key
+func (s *Store) cmdZCard(conn redcon.Conn, cmd redcon.Command) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z, err := s.zset(string(cmd.Args[1]), false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	var n int
+	if z != nil {
+		n = z.Len()
+	}
+	conn.WriteInt(n)
+}
+
+// ZSCORE key member
+// ZMSCORE key member [member ...]
+func (s *Store) cmdZScore(conn redcon.Conn, cmd redcon.Command) {
+	multi := strings.EqualFold(string(cmd.Args[0]), "zmscore")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z, err := s.zset(string(cmd.Args[1]), false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if multi {
+		conn.WriteArray(len(cmd.Args) - 2)
+	}
+	for _, member := range cmd.Args[2:] {
+		var score float64
+		var ok bool
+		if z != nil {
+			score, ok = z.Score(string(member))
+		}
+		if ok {
+			conn.WriteBulkString(formatFloat(score))
+		} else {
+			conn.WriteNull()
+		}
+	}
+}
+
+// ZCOUNT key min max
+func (s *Store) cmdZCount(conn redcon.Conn, cmd redcon.Command) {
+	min, err := parseScoreBound(string(cmd.Args[2]))
+	var max scoreBound
+	if err == nil {
+		max, err = parseScoreBound(string(cmd.Args[3]))
+	}
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z, err := s.zset(string(cmd.Args[1]), false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	var n int
+	if z != nil {
+		n = len(z.byScore(min, max, 0, -1, false))
+	}
+	conn.WriteInt(n)
+}
+
+// ZRANK key member
+// ZREVRANK key member
+func (s *Store) cmdZRank(conn redcon.Conn, cmd redcon.Command) {
+	rev := strings.EqualFold(string(cmd.Args[0]), "zrevrank")
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z, err := s.zset(string(cmd.Args[1]), false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if z == nil {
+		conn.WriteNull()
+		return
+	}
+	rank, ok := z.rank(string(cmd.Args[2]))
+	switch {
+	case !ok:
+		conn.WriteNull()
+	case rev:
+		conn.WriteInt(z.Len() - 1 - rank)
+	default:
+		conn.WriteInt(rank)
+	}
+}
+
+// ZRANGE key start stop [BYSCORE] [REV] [LIMIT offset count] [WITHSCORES]
+// ZREVRANGE key start stop [WITHSCORES]
+// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+// ZREVRANGEBYSCORE key max min [WITHSCORES] [LIMIT offset count]
+func (s *Store) cmdZRange(conn redcon.Conn, cmd redcon.Command) {
+	name := strings.ToLower(string(cmd.Args[0]))
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	first, second := args.String(), args.String()
+	byScore := strings.HasSuffix(name, "byscore")
+	rev := strings.HasPrefix(name, "zrev")
+	var withScores, limit bool
+	offset, count := 0, -1
+	for args.More() {
+		switch {
+		case args.Flag("WITHSCORES"):
+			withScores = true
+		case name == "zrange" && args.Flag("BYSCORE"):
+			byScore = true
+		case name == "zrange" && args.Flag("REV"):
+			rev = true
+		case name != "zrevrange" && args.Flag("LIMIT"):
+			offset, count = int(args.Int()), int(args.Int())
+			limit = true
+		default:
+			args.Fail(redcon.ErrSyntax)
+		}
+	}
+	if err := args.Err(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if limit && !byScore {
+		conn.WriteError("ERR syntax error, LIMIT is only supported in " +
+			"combination with either BYSCORE or BYLEX")
+		return
+	}
+	var start, stop int64
+	var min, max scoreBound
+	var err error
+	if byScore {
+		if rev {
+			first, second = second, first
+		}
+		if min, err = parseScoreBound(first); err == nil {
+			max, err = parseScoreBound(second)
+		}
+	} else {
+		start, err = strconv.ParseInt(first, 10, 64)
+		if err == nil {
+			stop, err = strconv.ParseInt(second, 10, 64)
+		}
+		if err != nil {
+			err = redcon.ErrNotInteger
+		}
+	}
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z, err := s.zset(key, false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	var members []ZMember
+	switch {
+	case z == nil || offset < 0:
+	case byScore:
+		members = z.byScore(min, max, offset, count, rev)
+	default:
+		if i, j, ok := indexRange(start, stop, z.Len()); ok {
+			members = z.byRank(i, j, rev)
+		}
+	}
+	writeZMembers(conn, members, withScores)
+}
+
+// ZREMRANGEBYRANK key start stop
+// ZREMRANGEBYSCORE key min max
+func (s *Store) cmdZRemRange(conn redcon.Conn, cmd redcon.Command) {
+	byScore := strings.EqualFold(string(cmd.Args[0]), "zremrangebyscore")
+	var start, stop int64
+	var min, max scoreBound
+	var err error
+	if byScore {
+		if min, err = parseScoreBound(string(cmd.Args[2])); err == nil {
+			max, err = parseScoreBound(string(cmd.Args[3]))
+		}
+	} else {
+		if start, err = parseInt(cmd.Args[2]); err == nil {
+			stop, err = parseInt(cmd.Args[3])
+		}
+	}
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := string(cmd.Args[1])
+	z, err := s.zset(key, false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	var members []ZMember
+	switch {
+	case z == nil:
+	case byScore:
+		members = z.byScore(min, max, 0, -1, false)
+	default:
+		if i, j, ok := indexRange(start, stop, z.Len()); ok {
+			members = z.byRank(i, j, false)
+		}
+	}
+	for _, zm := range members {
+		z.Remove(zm.Member)
+	}
+	if len(members) > 0 {
+		s.notify(conn, strings.ToLower(string(cmd.Args[0])), key,
+			redcon.NotifyZSet)
+		s.deleteIfEmpty(conn, key)
+	}
+	conn.WriteInt(len(members))
+}
+
+// ZPOPMIN key [count]
+// ZPOPMAX key [count]
+func (s *Store) cmdZPop(conn redcon.Conn, cmd redcon.Command) {
+	name := strings.ToLower(string(cmd.Args[0]))
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	count := 1
+	if args.More() {
+		count = int(args.IntRange(0, math.MaxInt32))
+	}
+	if err := args.Done(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	z, err := s.zset(key, false)
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	var members []ZMember
+	if z != nil {
+		if count > z.Len() {
+			count = z.Len()
+		}
+		members = z.byRank(0, count, name == "zpopmax")
+	}
+	for _, zm := range members {
+		z.Remove(zm.Member)
+	}
+	if len(members) > 0 {
+		s.notify(conn, name, key, redcon.NotifyZSet)
+		s.deleteIfEmpty(conn, key)
+	}
+	writeZMembers(conn, members, true)
+}
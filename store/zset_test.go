@@ -0,0 +1,70 @@
+package store
+
+import "testing"
+
+func TestZSet(t *testing.T) {
+	c := testServer(t, New())
+	c.run([][]string{
+		{"ZADD", "z", "1", "a", "2", "b", "3", "c", ":3"},
+		{"ZADD", "z", "2", "a", "4", "d", ":1"},
+		{"ZADD", "z", "CH", "1", "a", "5", "e", ":2"},
+		{"ZADD", "z", "NX", "10", "a", ":0"},
+		{"ZADD", "z", "XX", "10", "x", ":0"},
+		{"ZADD", "z", "GT", "CH", "0", "a", "10", "b", ":1"},
+		{"ZADD", "z", "LT", "CH", "2", "b", ":1"},
+		{"ZADD", "z", "INCR", "1", "a", "2"},
+		{"ZADD", "z", "INCR", "NX", "1", "a", "nil"},
+		{"ZADD", "z", "NX", "XX", "1", "a", "-ERR XX and NX options at the " +
+			"same time are not compatible"},
+		{"ZADD", "z", "GT", "LT", "1", "a", "-ERR GT, LT, and/or NX " +
+			"options at the same time are not compatible"},
+		{"ZADD", "z", "INCR", "1", "a", "1", "b", "-ERR INCR option " +
+			"supports a single increment-element pair"},
+		{"ZADD", "z", "x", "a", "-ERR value is not a valid float"},
+		{"ZADD", "z", "1", "a", "2", "-ERR syntax error"},
+		{"ZADD", "new", "XX", "1", "a", ":0"},
+		{"EXISTS", "new", ":0"},
+		{"ZCARD", "z", ":5"},
+		{"ZSCORE", "z", "a", "2"},
+		{"ZSCORE", "z", "x", "nil"},
+		{"ZMSCORE", "z", "a", "x", "[2 nil]"},
+		{"ZRANGE", "z", "0", "-1", "WITHSCORES",
+			"[a 2 b 2 c 3 d 4 e 5]"},
+		{"ZREVRANGE", "z", "0", "1", "[e d]"},
+		{"ZRANGE", "z", "-2", "10", "REV", "[b a]"},
+		{"ZRANK", "z", "c", ":2"},
+		{"ZREVRANK", "z", "c", ":2"},
+		{"ZRANK", "z", "x", "nil"},
+		{"ZCOUNT", "z", "2", "(4", ":3"},
+		{"ZCOUNT", "z", "-inf", "+inf", ":5"},
+		{"ZCOUNT", "z", "x", "1", "-ERR min or max is not a float"},
+		{"ZRANGEBYSCORE", "z", "(2", "5", "[c d e]"},
+		{"ZRANGEBYSCORE", "z", "2", "5", "LIMIT", "1", "2", "[b c]"},
+		{"ZREVRANGEBYSCORE", "z", "4", "(2", "WITHSCORES", "[d 4 c 3]"},
+		{"ZREVRANGEBYSCORE", "z", "+inf", "-inf", "LIMIT", "0", "1", "[e]"},
+		{"ZRANGE", "z", "(5", "+inf", "BYSCORE", "[]"},
+		{"ZRANGE", "z", "4", "2", "BYSCORE", "REV", "[d c b a]"},
+		{"ZRANGE", "z", "0", "1", "LIMIT", "0", "1", "-ERR syntax error, " +
+			"LIMIT is only supported in combination with either BYSCORE or " +
+			"BYLEX"},
+		{"ZINCRBY", "z", "-1.5", "e", "3.5"},
+		{"ZINCRBY", "z", "inf", "e", "inf"},
+		{"ZINCRBY", "z", "-inf", "e", "-ERR resulting score is not a " +
+			"number (NaN)"},
+		{"ZRANGE", "z", "-1", "-1", "WITHSCORES", "[e inf]"},
+		{"ZREM", "z", "e", "x", ":1"},
+		{"ZPOPMIN", "z", "a", "-ERR value is not an integer or out " +
+			"of range"},
+		{"ZPOPMIN", "z", "[a 2]"},
+		{"ZPOPMAX", "z", "2", "[d 4 c 3]"},
+		{"ZADD", "z", "1", "a", "3", "c", "4", "d", ":3"},
+		{"ZREMRANGEBYSCORE", "z", "(1", "3", ":2"},
+		{"ZREMRANGEBYRANK", "z", "0", "0", ":1"},
+		{"ZRANGE", "z", "0", "-1", "[d]"},
+		{"ZREM", "z", "d", ":1"},
+		{"EXISTS", "z", ":0"},
+		{"SET", "s", "x", "+OK"},
+		{"ZADD", "s", "1", "a", wrongType},
+		{"ZRANGE", "s", "0", "1", wrongType},
+	})
+}
@@ -0,0 +1,1068 @@
+package stream
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+// Store stores the streams of a Handler by key, which allows for using
+// the storage of the application. The Handler serializes all calls.
+type Store interface {
+	// Get returns the stream for the key, or nil when there is none.
+	Get(key string) *Stream
+	// Set sets the stream for the key.
+	Set(key string, s *Stream)
+}
+
+// mapStore is the default Store, which is a map.
+type mapStore map[string]*Stream
+
+func (m mapStore) Get(key string) *Stream    { return m[key] }
+func (m mapStore) Set(key string, s *Stream) { m[key] = s }
+
+// Handler implements the stream commands for a redcon.ServeMux.
+//
+//	h := stream.NewHandler(nil)
+//	h.Register(mux)
+//
+// The XREAD and XREADGROUP commands with the BLOCK option block the
+// connection until there are new entries, the timeout elapses, or the
+// client disconnects.
+//
+// The commands pass their effects to redcon.Propagate for a redcon.AOF,
+// such as XADD with the generated ID, and the deliveries of XREADGROUP as
+// XCLAIM and XGROUP SETID.
+type Handler struct {
+	mu      sync.Mutex
+	store   Store
+	waiters map[string]map[chan struct{}]bool
+}
+
+// NewHandler returns a Handler that uses the store. A nil store keeps the
+// streams in memory.
+func NewHandler(store Store) *Handler {
+	if store == nil {
+		store = mapStore{}
+	}
+	return &Handler{
+		store:   store,
+		waiters: make(map[string]map[chan struct{}]bool),
+	}
+}
+
+// Register registers the stream commands with their specs on the mux.
+func (h *Handler) Register(mux *redcon.ServeMux) {
+	keyAt1 := func(name string, arity int, flags ...string) redcon.CommandSpec {
+		categories := []string{"stream"}
+		for _, flag := range flags {
+			switch flag {
+			case "write":
+				categories = append(categories, "write")
+			case "readonly":
+				categories = append(categories, "read")
+			case "fast", "blocking":
+				categories = append(categories, flag)
+			}
+		}
+		return redcon.CommandSpec{Name: name, Arity: arity, Flags: flags,
+			Categories: categories, FirstKey: 1, LastKey: 1, Step: 1}
+	}
+	xread := keyAt1("xread", -4, "readonly", "blocking")
+	xread.KeysFunc = streamsKeys
+	xreadgroup := keyAt1("xreadgroup", -7, "write", "blocking")
+	xreadgroup.KeysFunc = streamsKeys
+	xgroup := keyAt1("xgroup", -2, "write")
+	xgroup.FirstKey = 2
+	xgroup.LastKey = 2
+	for _, cmd := range []struct {
+		spec    redcon.CommandSpec
+		handler redcon.HandlerFunc
+	}{
+		{keyAt1("xadd", -5, "write", "denyoom", "fast"), h.xadd},
+		{keyAt1("xlen", 2, "readonly", "fast"), h.xlen},
+		{keyAt1("xrange", -4, "readonly"), h.xrange},
+		{keyAt1("xrevrange", -4, "readonly"), h.xrange},
+		{keyAt1("xdel", -3, "write", "fast"), h.xdel},
+		{keyAt1("xtrim", -4, "write"), h.xtrim},
+		{xread, h.xread},
+		{xgroup, h.xgroup},
+		{xreadgroup, h.xreadgroup},
+		{keyAt1("xack", -4, "write", "fast"), h.xack},
+		{keyAt1("xpending", -3, "readonly"), h.xpending},
+		{keyAt1("xclaim", -6, "write", "fast"), h.xclaim},
+		{keyAt1("xautoclaim", -6, "write", "fast"), h.xautoclaim},
+	} {
+		mux.HandleCommand(cmd.spec, cmd.handler)
+	}
+}
+
+// streamsKeys returns the keys of XREAD and XREADGROUP, which are the first
+// half of the arguments after STREAMS.
+func streamsKeys(args [][]byte) [][]byte {
+	for i := 1; i < len(args); i++ {
+		if strings.EqualFold(string(args[i]), "streams") {
+			rest := args[i+1:]
+			return rest[:len(rest)/2]
+		}
+	}
+	return nil
+}
+
+// Add adds an entry to the stream for the key, like XADD, and wakes the
+// clients that are blocked on the stream.
+func (h *Handler) Add(key, id string, fields [][]byte) (ID, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.add(key, id, fields, false)
+}
+
+// add adds an entry. The caller must hold the lock.
+func (h *Handler) add(key, id string, fields [][]byte, nomkstream bool,
+) (ID, error) {
+	s := h.store.Get(key)
+	created := s == nil
+	if created {
+		if nomkstream {
+			return ID{}, errNoStream
+		}
+		s = New()
+	}
+	newID, err := s.Add(id, fields)
+	if err != nil {
+		return ID{}, err
+	}
+	if created {
+		h.store.Set(key, s)
+	}
+	h.wake(key)
+	return newID, nil
+}
+
+var errNoStream = errors.New("no stream")
+
+// wait registers a channel that receives when one of the streams changes.
+// The caller must hold the lock.
+func (h *Handler) wait(keys []string) chan struct{} {
+	ch := make(chan struct{}, 1)
+	for _, key := range keys {
+		if h.waiters[key] == nil {
+			h.waiters[key] = make(map[chan struct{}]bool)
+		}
+		h.waiters[key][ch] = true
+	}
+	return ch
+}
+
+// unwait unregisters a channel from wait. The caller must hold the lock.
+func (h *Handler) unwait(keys []string, ch chan struct{}) {
+	for _, key := range keys {
+		delete(h.waiters[key], ch)
+		if len(h.waiters[key]) == 0 {
+			delete(h.waiters, key)
+		}
+	}
+}
+
+// wake wakes the clients that wait on the stream. The caller must hold the
+// lock.
+func (h *Handler) wake(key string) {
+	for ch := range h.waiters[key] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// block calls read until it replies, the timeout elapses or the client
+// disconnects. The read function is called with the lock held, and returns
+// false when there is nothing to reply yet. A negative timeout does not
+// block, and zero blocks forever. A null array is written when there is
+// nothing to reply.
+func (h *Handler) block(conn redcon.Conn, keys []string, timeout time.Duration,
+	read func() bool,
+) {
+	h.mu.Lock()
+	if read() {
+		h.mu.Unlock()
+		return
+	}
+	if timeout < 0 {
+		h.mu.Unlock()
+		conn.WriteArray(-1)
+		return
+	}
+	closed, stop := redcon.WatchClose(conn)
+	defer stop()
+	var timer <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+	for {
+		ch := h.wait(keys)
+		h.mu.Unlock()
+		var timedOut, disconnected bool
+		select {
+		case <-ch:
+		case <-timer:
+			timedOut = true
+		case <-closed:
+			disconnected = true
+		}
+		h.mu.Lock()
+		h.unwait(keys, ch)
+		switch {
+		case disconnected:
+			h.mu.Unlock()
+			return
+		case timedOut:
+			h.mu.Unlock()
+			conn.WriteArray(-1)
+			return
+		case read():
+			h.mu.Unlock()
+			return
+		}
+	}
+}
+
+// parseRangeID parses the start or end of a range, which may be "-", "+"
+// or an ID. The ID is exclusive when it's prefixed with "(".
+func parseRangeID(s string, end bool) (ID, bool, error) {
+	exclusive := strings.HasPrefix(s, "(")
+	if exclusive {
+		s = s[1:]
+	}
+	var id ID
+	switch s {
+	case "-":
+		if exclusive {
+			return id, false, ErrInvalidID
+		}
+	case "+":
+		if exclusive {
+			return id, false, ErrInvalidID
+		}
+		id = MaxID
+	default:
+		var seq uint64
+		if end {
+			seq = math.MaxUint64
+		}
+		var err error
+		if id, err = parseID(s, seq); err != nil {
+			return id, false, err
+		}
+	}
+	if exclusive {
+		// an exclusive range may be empty
+		var ok bool
+		if end {
+			id, ok = id.prev()
+		} else {
+			id, ok = id.next()
+		}
+		return id, ok, nil
+	}
+	return id, true, nil
+}
+
+// readMaxLen reads the "[=|~] threshold" of the MAXLEN option.
+func readMaxLen(args *redcon.ArgReader) int {
+	if !args.Flag("=") {
+		args.Flag("~")
+	}
+	return int(args.IntRange(0, math.MaxInt32))
+}
+
+// readCount reads the argument of the COUNT option.
+func readCount(args *redcon.ArgReader) int {
+	return int(args.IntRange(0, math.MaxInt32))
+}
+
+// readIdle reads a milliseconds argument of an idle time, which may be
+// zero.
+func readIdle(args *redcon.ArgReader) time.Duration {
+	ms := args.IntRange(0, math.MaxInt64/int64(time.Millisecond))
+	return time.Duration(ms) * time.Millisecond
+}
+
+// readBlock reads the milliseconds argument of the BLOCK option.
+func readBlock(args *redcon.ArgReader) time.Duration {
+	ms := args.Int()
+	if args.Err() == nil && ms < 0 {
+		args.Fail(errors.New("ERR timeout is negative"))
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func writeEntry(conn redcon.Conn, entry Entry) {
+	conn.WriteArray(2)
+	conn.WriteBulkString(entry.ID.String())
+	if entry.Fields == nil {
+		conn.WriteNull()
+		return
+	}
+	conn.WriteArray(len(entry.Fields))
+	for _, field := range entry.Fields {
+		conn.WriteBulk(field)
+	}
+}
+
+func writeEntries(conn redcon.Conn, entries []Entry) {
+	conn.WriteArray(len(entries))
+	for _, entry := range entries {
+		writeEntry(conn, entry)
+	}
+}
+
+func writeIDs(conn redcon.Conn, ids []ID) {
+	conn.WriteArray(len(ids))
+	for _, id := range ids {
+		conn.WriteBulkString(id.String())
+	}
+}
+
+// propagate passes the command of args to redcon.Propagate.
+func propagate(conn redcon.Conn, args ...string) {
+	bulks := make([][]byte, len(args))
+	for i, arg := range args {
+		bulks[i] = []byte(arg)
+	}
+	redcon.Propagate(conn, bulks...)
+}
+
+// propagateClaim propagates a pending entry as XCLAIM, which restores its
+// consumer, delivery time and delivery count. The caller must hold the
+// lock.
+func propagateClaim(conn redcon.Conn, key string, g *Group, id ID) {
+	item := g.pending.Get(&PendingEntry{ID: id})
+	if item == nil {
+		return
+	}
+	pe := item.(*PendingEntry)
+	ms := pe.DeliveryTime.UnixNano() / int64(time.Millisecond)
+	propagate(conn, "XCLAIM", key, g.name, pe.Consumer, "0", id.String(),
+		"TIME", strconv.FormatInt(ms, 10), "RETRYCOUNT",
+		strconv.Itoa(pe.DeliveryCount), "FORCE", "JUSTID")
+}
+
+// propagateAck propagates the removal of pending entries as XACK.
+func propagateAck(conn redcon.Conn, key string, g *Group, ids []ID) {
+	if len(ids) == 0 {
+		return
+	}
+	args := []string{"XACK", key, g.name}
+	for _, id := range ids {
+		args = append(args, id.String())
+	}
+	propagate(conn, args...)
+}
+
+func wrongArgs(conn redcon.Conn, name string) {
+	conn.WriteError("ERR wrong number of arguments for '" + name +
+		"' command")
+}
+
+func noGroup(conn redcon.Conn, key, group string) {
+	conn.WriteError("NOGROUP No such key '" + key + "' or consumer group '" +
+		group + "'")
+}
+
+// XADD key [NOMKSTREAM] [MAXLEN [=|~] threshold] <*|id> field value ...
+func (h *Handler) xadd(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	var nomkstream bool
+	maxLen := -1
+	for {
+		if args.Flag("NOMKSTREAM") {
+			nomkstream = true
+		} else if args.Flag("MAXLEN") {
+			maxLen = readMaxLen(args)
+		} else {
+			break
+		}
+	}
+	id := args.String()
+	fields := args.Rest()
+	if err := args.Err(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		wrongArgs(conn, "xadd")
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	newID, err := h.add(key, id, fields, nomkstream)
+	if err == errNoStream {
+		conn.WriteNull()
+		return
+	}
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if maxLen >= 0 {
+		h.store.Get(key).Trim(maxLen)
+	}
+	// the generated ID is propagated
+	added := append([][]byte(nil), cmd.Args...)
+	added[len(added)-len(fields)-1] = []byte(newID.String())
+	redcon.Propagate(conn, added...)
+	conn.WriteBulkString(newID.String())
+}
+
+// XLEN key
+func (h *Handler) xlen(conn redcon.Conn, cmd redcon.Command) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var n int
+	if s := h.store.Get(string(cmd.Args[1])); s != nil {
+		n = s.Len()
+	}
+	conn.WriteInt(n)
+}
+
+// XRANGE key start end [COUNT count]
+// XREVRANGE key end start [COUNT count]
+func (h *Handler) xrange(conn redcon.Conn, cmd redcon.Command) {
+	rev := strings.EqualFold(string(cmd.Args[0]), "xrevrange")
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	first, second := args.String(), args.String()
+	var count int
+	if args.Flag("COUNT") {
+		count = readCount(args)
+	}
+	if err := args.Done(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	if rev {
+		first, second = second, first
+	}
+	start, ok1, err := parseRangeID(first, false)
+	if err == nil {
+		var end ID
+		var ok2 bool
+		end, ok2, err = parseRangeID(second, true)
+		if err == nil {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			s := h.store.Get(key)
+			if s == nil || !ok1 || !ok2 || (count == 0 && len(cmd.Args) > 4) {
+				conn.WriteArray(0)
+			} else if rev {
+				writeEntries(conn, s.RevRange(end, start, count))
+			} else {
+				writeEntries(conn, s.Range(start, end, count))
+			}
+			return
+		}
+	}
+	conn.WriteError(err.Error())
+}
+
+// XDEL key id [id ...]
+func (h *Handler) xdel(conn redcon.Conn, cmd redcon.Command) {
+	var ids []ID
+	for _, arg := range cmd.Args[2:] {
+		id, err := ParseID(string(arg))
+		if err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+		ids = append(ids, id)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var n int
+	if s := h.store.Get(string(cmd.Args[1])); s != nil {
+		n = s.Delete(ids...)
+	}
+	conn.WriteInt(n)
+}
+
+// XTRIM key MAXLEN [=|~] threshold
+func (h *Handler) xtrim(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key := args.String()
+	if !args.Flag("MAXLEN") {
+		args.Fail(redcon.ErrSyntax)
+	}
+	maxLen := readMaxLen(args)
+	if err := args.Done(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var n int
+	if s := h.store.Get(key); s != nil {
+		n = s.Trim(maxLen)
+	}
+	conn.WriteInt(n)
+}
+
+// readStreams reads the "STREAMS key [key ...] id [id ...]" arguments.
+func readStreams(args *redcon.ArgReader, name string) ([]string, []string,
+	error,
+) {
+	if !args.Flag("STREAMS") {
+		args.Fail(redcon.ErrSyntax)
+	}
+	rest := args.Rest()
+	if err := args.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(rest) == 0 || len(rest)%2 != 0 {
+		return nil, nil, errors.New("ERR Unbalanced '" + name + "' list of " +
+			"streams: for each stream key an ID or '$' must be specified.")
+	}
+	keys := make([]string, len(rest)/2)
+	ids := make([]string, len(rest)/2)
+	for i := range keys {
+		keys[i] = string(rest[i])
+		ids[i] = string(rest[len(keys)+i])
+	}
+	return keys, ids, nil
+}
+
+// XREAD [COUNT count] [BLOCK milliseconds] STREAMS key [key ...] id [id ...]
+func (h *Handler) xread(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	var count int
+	block := time.Duration(-1)
+	for {
+		if args.Flag("COUNT") {
+			count = readCount(args)
+		} else if args.Flag("BLOCK") {
+			block = readBlock(args)
+		} else {
+			break
+		}
+	}
+	keys, sids, err := readStreams(args, "xread")
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	ids := make([]ID, len(keys))
+	last := make([]bool, len(keys))
+	for i, sid := range sids {
+		if sid == "$" {
+			last[i] = true
+		} else if ids[i], err = ParseID(sid); err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+	}
+	var resolved bool
+	h.block(conn, keys, block, func() bool {
+		if !resolved {
+			// "$" is the last ID when the command is called
+			for i, key := range keys {
+				if s := h.store.Get(key); s != nil && last[i] {
+					ids[i] = s.LastID()
+				}
+			}
+			resolved = true
+		}
+		var n int
+		results := make([][]Entry, len(keys))
+		for i, key := range keys {
+			if s := h.store.Get(key); s != nil {
+				results[i] = s.After(ids[i], count)
+				if len(results[i]) > 0 {
+					n++
+				}
+			}
+		}
+		if n == 0 {
+			return false
+		}
+		conn.WriteArray(n)
+		for i, key := range keys {
+			if len(results[i]) > 0 {
+				conn.WriteArray(2)
+				conn.WriteBulkString(key)
+				writeEntries(conn, results[i])
+			}
+		}
+		return true
+	})
+}
+
+// XGROUP CREATE key group <id|$> [MKSTREAM]
+// XGROUP SETID key group <id|$>
+// XGROUP DESTROY key group
+// XGROUP CREATECONSUMER key group consumer
+// XGROUP DELCONSUMER key group consumer
+func (h *Handler) xgroup(conn redcon.Conn, cmd redcon.Command) {
+	sub := strings.ToLower(string(cmd.Args[1]))
+	var arity int
+	switch sub {
+	case "create":
+		arity = -5
+	case "setid":
+		arity = 5
+	case "destroy":
+		arity = 4
+	case "createconsumer", "delconsumer":
+		arity = 5
+	default:
+		conn.WriteError("ERR unknown subcommand '" + string(cmd.Args[1]) +
+			"'. Try XGROUP HELP.")
+		return
+	}
+	if !(redcon.CommandSpec{Arity: arity}).CheckArity(len(cmd.Args)) {
+		wrongArgs(conn, "xgroup|"+sub)
+		return
+	}
+	key, group := string(cmd.Args[2]), string(cmd.Args[3])
+	var mkstream bool
+	if sub == "create" {
+		for _, arg := range cmd.Args[5:] {
+			if !strings.EqualFold(string(arg), "mkstream") {
+				conn.WriteError(redcon.ErrSyntax.Error())
+				return
+			}
+			mkstream = true
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.store.Get(key)
+	if s == nil {
+		if !mkstream {
+			conn.WriteError("ERR The XGROUP subcommand requires the key to " +
+				"exist. Note that for CREATE you may want to use the " +
+				"MKSTREAM option to create an empty stream automatically.")
+			return
+		}
+		s = New()
+		h.store.Set(key, s)
+	}
+	// parseGroupID parses the id of CREATE and SETID, where $ is the last ID
+	parseGroupID := func() (ID, bool) {
+		if string(cmd.Args[4]) == "$" {
+			return s.LastID(), true
+		}
+		id, err := ParseID(string(cmd.Args[4]))
+		if err != nil {
+			conn.WriteError(err.Error())
+			return id, false
+		}
+		return id, true
+	}
+	if sub == "create" {
+		id, ok := parseGroupID()
+		if !ok {
+			return
+		}
+		if _, err := s.CreateGroup(group, id); err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+		conn.WriteString("OK")
+		return
+	}
+	g := s.Group(group)
+	if g == nil {
+		if sub == "destroy" {
+			conn.WriteInt(0)
+			return
+		}
+		conn.WriteError("NOGROUP No such consumer group '" + group +
+			"' for key name '" + key + "'")
+		return
+	}
+	switch sub {
+	case "setid":
+		if id, ok := parseGroupID(); ok {
+			g.SetLastID(id)
+			conn.WriteString("OK")
+		}
+	case "destroy":
+		s.DestroyGroup(group)
+		h.wake(key)
+		conn.WriteInt(1)
+	case "createconsumer":
+		if g.CreateConsumer(string(cmd.Args[4])) {
+			conn.WriteInt(1)
+		} else {
+			conn.WriteInt(0)
+		}
+	case "delconsumer":
+		conn.WriteInt(g.DeleteConsumer(string(cmd.Args[4])))
+	}
+}
+
+// XREADGROUP GROUP group consumer [COUNT count] [BLOCK milliseconds]
+// [NOACK] STREAMS key [key ...] id [id ...]
+func (h *Handler) xreadgroup(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	if !args.Flag("GROUP") {
+		args.Fail(redcon.ErrSyntax)
+	}
+	group, consumer := args.String(), args.String()
+	var count int
+	var noack bool
+	block := time.Duration(-1)
+	for {
+		if args.Flag("COUNT") {
+			count = readCount(args)
+		} else if args.Flag("BLOCK") {
+			block = readBlock(args)
+		} else if args.Flag("NOACK") {
+			noack = true
+		} else {
+			break
+		}
+	}
+	keys, sids, err := readStreams(args, "xreadgroup")
+	if err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	ids := make([]ID, len(keys))
+	var history bool
+	for i, sid := range sids {
+		if sid == ">" {
+			continue
+		}
+		if ids[i], err = ParseID(sid); err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+		history = true
+	}
+	if history {
+		// pending entries are returned right away
+		block = -1
+	}
+	h.block(conn, keys, block, func() bool {
+		groups := make([]*Group, len(keys))
+		for i, key := range keys {
+			if s := h.store.Get(key); s != nil {
+				groups[i] = s.Group(group)
+			}
+			if groups[i] == nil {
+				conn.WriteError("NOGROUP No such key '" + key + "' or " +
+					"consumer group '" + group + "' in XREADGROUP with " +
+					"GROUP option")
+				return true
+			}
+		}
+		// the deliveries are propagated as XCLAIM and XGROUP SETID
+		redcon.Propagate(conn)
+		var n int
+		results := make([][]Entry, len(keys))
+		for i, key := range keys {
+			g := groups[i]
+			if _, ok := g.consumers[consumer]; !ok {
+				propagate(conn, "XGROUP", "CREATECONSUMER", key, group,
+					consumer)
+			}
+			if sids[i] == ">" {
+				results[i] = g.ReadNew(consumer, count, noack)
+				if len(results[i]) > 0 {
+					n++
+				}
+			} else {
+				results[i] = g.ReadHistory(consumer, ids[i], count)
+				n++
+			}
+			for _, entry := range results[i] {
+				if entry.Fields != nil && (sids[i] != ">" || !noack) {
+					propagateClaim(conn, key, g, entry.ID)
+				}
+			}
+			if sids[i] == ">" && len(results[i]) > 0 {
+				propagate(conn, "XGROUP", "SETID", key, group,
+					g.lastID.String())
+			}
+		}
+		if n == 0 {
+			return false
+		}
+		conn.WriteArray(n)
+		for i, key := range keys {
+			if sids[i] != ">" || len(results[i]) > 0 {
+				conn.WriteArray(2)
+				conn.WriteBulkString(key)
+				writeEntries(conn, results[i])
+			}
+		}
+		return true
+	})
+}
+
+// group returns the consumer group for a key, and writes a NOGROUP error
+// when it does not exist. The caller must hold the lock.
+func (h *Handler) group(conn redcon.Conn, key, group string) *Group {
+	var g *Group
+	if s := h.store.Get(key); s != nil {
+		g = s.Group(group)
+	}
+	if g == nil {
+		noGroup(conn, key, group)
+	}
+	return g
+}
+
+// XACK key group id [id ...]
+func (h *Handler) xack(conn redcon.Conn, cmd redcon.Command) {
+	var ids []ID
+	for _, arg := range cmd.Args[3:] {
+		id, err := ParseID(string(arg))
+		if err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+		ids = append(ids, id)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var n int
+	if s := h.store.Get(string(cmd.Args[1])); s != nil {
+		if g := s.Group(string(cmd.Args[2])); g != nil {
+			n = g.Ack(ids...)
+		}
+	}
+	conn.WriteInt(n)
+}
+
+// XPENDING key group [[IDLE min-idle-time] start end count [consumer]]
+func (h *Handler) xpending(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key, group := args.String(), args.String()
+	extended := args.More()
+	var minIdle time.Duration
+	var start, end ID
+	var ok1, ok2 bool
+	var count int
+	var consumer string
+	if extended {
+		if args.Flag("IDLE") {
+			minIdle = readIdle(args)
+		}
+		first, second := args.String(), args.String()
+		count = int(args.Int())
+		if args.More() {
+			consumer = args.String()
+		}
+		if err := args.Done(); err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+		var err error
+		if start, ok1, err = parseRangeID(first, false); err == nil {
+			end, ok2, err = parseRangeID(second, true)
+		}
+		if err != nil {
+			conn.WriteError(err.Error())
+			return
+		}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	g := h.group(conn, key, group)
+	if g == nil {
+		return
+	}
+	if !extended {
+		summary := g.Pending()
+		conn.WriteArray(4)
+		conn.WriteInt(summary.Count)
+		if summary.Count == 0 {
+			conn.WriteNull()
+			conn.WriteNull()
+			conn.WriteArray(-1)
+			return
+		}
+		conn.WriteBulkString(summary.Lowest.String())
+		conn.WriteBulkString(summary.Highest.String())
+		consumers := g.Consumers()
+		conn.WriteArray(len(summary.Consumers))
+		for _, c := range consumers {
+			if n, ok := summary.Consumers[c.Name]; ok {
+				conn.WriteArray(2)
+				conn.WriteBulkString(c.Name)
+				conn.WriteBulkString(strconv.Itoa(n))
+			}
+		}
+		return
+	}
+	if !ok1 || !ok2 || count <= 0 {
+		conn.WriteArray(0)
+		return
+	}
+	entries := g.PendingRange(start, end, count, consumer, minIdle)
+	t := now()
+	conn.WriteArray(len(entries))
+	for _, pe := range entries {
+		conn.WriteArray(4)
+		conn.WriteBulkString(pe.ID.String())
+		conn.WriteBulkString(pe.Consumer)
+		conn.WriteInt64(int64(t.Sub(pe.DeliveryTime) / time.Millisecond))
+		conn.WriteInt(pe.DeliveryCount)
+	}
+}
+
+// XCLAIM key group consumer min-idle-time id [id ...] [IDLE ms]
+// [TIME unix-time-milliseconds] [RETRYCOUNT count] [FORCE] [JUSTID]
+// [LASTID lastid]
+func (h *Handler) xclaim(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key, group, consumer := args.String(), args.String(), args.String()
+	minIdle := readIdle(args)
+	var ids []ID
+	for args.More() {
+		id, err := ParseID(string(args.Peek()))
+		if err != nil {
+			break
+		}
+		args.Bytes()
+		ids = append(ids, id)
+	}
+	if len(ids) == 0 {
+		// the first id is invalid
+		args.Fail(ErrInvalidID)
+	}
+	var opts ClaimOptions
+	var lastID *ID
+	for args.More() {
+		switch {
+		case args.Flag("IDLE"):
+			opts.Idle = readIdle(args)
+		case args.Flag("TIME"):
+			ms := args.Int()
+			opts.Idle = now().Sub(time.Unix(0, ms*int64(time.Millisecond)))
+			if opts.Idle < 0 {
+				opts.Idle = 0
+			}
+		case args.Flag("RETRYCOUNT"):
+			opts.RetryCount = int(args.IntRange(0, math.MaxInt32))
+		case args.Flag("FORCE"):
+			opts.Force = true
+		case args.Flag("JUSTID"):
+			opts.JustID = true
+		case args.Flag("LASTID"):
+			id, err := ParseID(args.String())
+			if err != nil {
+				args.Fail(err)
+			}
+			lastID = &id
+		default:
+			args.Fail(redcon.ErrSyntax)
+		}
+	}
+	if err := args.Err(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	g := h.group(conn, key, group)
+	if g == nil {
+		return
+	}
+	// the claims are propagated with explicit IDs and times
+	redcon.Propagate(conn)
+	if _, ok := g.consumers[consumer]; !ok {
+		propagate(conn, "XGROUP", "CREATECONSUMER", key, group, consumer)
+	}
+	if lastID != nil && g.LastID().Less(*lastID) {
+		g.SetLastID(*lastID)
+		propagate(conn, "XGROUP", "SETID", key, group, lastID.String())
+	}
+	var deleted []ID
+	for _, id := range ids {
+		_, exists := g.stream.Get(id)
+		if !exists && g.pending.Get(&PendingEntry{ID: id}) != nil {
+			deleted = append(deleted, id)
+		}
+	}
+	propagateAck(conn, key, g, deleted)
+	entries := g.Claim(consumer, minIdle, ids, opts)
+	for _, entry := range entries {
+		propagateClaim(conn, key, g, entry.ID)
+	}
+	if opts.JustID {
+		claimed := make([]ID, len(entries))
+		for i, entry := range entries {
+			claimed[i] = entry.ID
+		}
+		writeIDs(conn, claimed)
+		return
+	}
+	writeEntries(conn, entries)
+}
+
+// XAUTOCLAIM key group consumer min-idle-time start [COUNT count] [JUSTID]
+func (h *Handler) xautoclaim(conn redcon.Conn, cmd redcon.Command) {
+	args := redcon.NewArgReader(cmd)
+	key, group, consumer := args.String(), args.String(), args.String()
+	minIdle := readIdle(args)
+	start, _, err := parseRangeID(args.String(), false)
+	if err != nil {
+		args.Fail(err)
+	}
+	count := 100
+	var justID bool
+	for args.More() {
+		switch {
+		case args.Flag("COUNT"):
+			count = int(args.IntRange(1, math.MaxInt32))
+		case args.Flag("JUSTID"):
+			justID = true
+		default:
+			args.Fail(redcon.ErrSyntax)
+		}
+	}
+	if err := args.Err(); err != nil {
+		conn.WriteError(err.Error())
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	g := h.group(conn, key, group)
+	if g == nil {
+		return
+	}
+	// the claims are propagated with explicit IDs and times
+	redcon.Propagate(conn)
+	if _, ok := g.consumers[consumer]; !ok {
+		propagate(conn, "XGROUP", "CREATECONSUMER", key, group, consumer)
+	}
+	next, entries, deleted := g.AutoClaim(consumer, minIdle, start, count,
+		justID)
+	propagateAck(conn, key, g, deleted)
+	for _, entry := range entries {
+		propagateClaim(conn, key, g, entry.ID)
+	}
+	conn.WriteArray(3)
+	conn.WriteBulkString(next.String())
+	if justID {
+		claimed := make([]ID, len(entries))
+		for i, entry := range entries {
+			claimed[i] = entry.ID
+		}
+		writeIDs(conn, claimed)
+	} else {
+		writeEntries(conn, entries)
+	}
+	writeIDs(conn, deleted)
+}
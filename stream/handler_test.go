@@ -0,0 +1,351 @@
+package stream
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tidwall/redcon"
+)
+
+type testClient struct {
+	t  *testing.T
+	nc net.Conn
+	rd *bufio.Reader
+}
+
+func testServer(t *testing.T) (*Handler, func() *testClient) {
+	h := NewHandler(nil)
+	mux := redcon.NewServeMux()
+	h.Register(mux)
+	return h, testServe(t, mux.ServeRESP)
+}
+
+// testServe serves the handler, and returns a function that connects a
+// client.
+func testServe(t *testing.T, handler func(conn redcon.Conn,
+	cmd redcon.Command),
+) func() *testClient {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go redcon.Serve(ln, handler, nil, nil)
+	return func() *testClient {
+		nc, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { nc.Close() })
+		return &testClient{t: t, nc: nc, rd: bufio.NewReader(nc)}
+	}
+}
+
+// send writes a command without reading the reply.
+func (c *testClient) send(args ...string) {
+	c.t.Helper()
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = redcon.AppendBulkString(buf, arg)
+	}
+	if _, err := c.nc.Write(buf); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// reply reads a reply, which is formatted like "[a [b c] nil 1]".
+func (c *testClient) reply() string {
+	c.t.Helper()
+	c.nc.SetReadDeadline(time.Now().Add(time.Second * 5))
+	var read func() string
+	read = func() string {
+		line, err := c.rd.ReadString('\n')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		line = line[:len(line)-2]
+		switch line[0] {
+		case '+', '-', ':':
+			return line
+		case '$':
+			n, _ := strconv.Atoi(line[1:])
+			if n < 0 {
+				return "nil"
+			}
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(c.rd, data); err != nil {
+				c.t.Fatal(err)
+			}
+			return string(data[:n])
+		case '*':
+			n, _ := strconv.Atoi(line[1:])
+			if n < 0 {
+				return "nil"
+			}
+			items := make([]string, n)
+			for i := range items {
+				items[i] = read()
+			}
+			return "[" + strings.Join(items, " ") + "]"
+		}
+		c.t.Fatalf("invalid reply %q", line)
+		return ""
+	}
+	return read()
+}
+
+func (c *testClient) do(args ...string) string {
+	c.t.Helper()
+	c.send(args...)
+	return c.reply()
+}
+
+func (c *testClient) expect(exp string, args ...string) {
+	c.t.Helper()
+	if res := c.do(args...); res != exp {
+		c.t.Fatalf("%v: expected '%v', got '%v'", args, exp, res)
+	}
+}
+
+func TestHandler(t *testing.T) {
+	_, dial := testServer(t)
+	c := dial()
+	c.expect("1-0", "XADD", "s", "1", "a", "1")
+	c.expect("1-1", "XADD", "s", "1-*", "b", "2")
+	c.expect("2-0", "XADD", "s", "MAXLEN", "=", "3", "2-0", "c", "3")
+	c.expect("-"+ErrIDTooSmall.Error(), "XADD", "s", "2-0", "d", "4")
+	c.expect("-ERR wrong number of arguments for 'xadd' command",
+		"XADD", "s", "*", "d")
+	c.expect("nil", "XADD", "none", "NOMKSTREAM", "*", "a", "1")
+	c.expect(":3", "XLEN", "s")
+	c.expect(":0", "XLEN", "none")
+	c.expect("[[1-0 [a 1]] [1-1 [b 2]] [2-0 [c 3]]]", "XRANGE", "s", "-", "+")
+	c.expect("[[1-1 [b 2]]]", "XRANGE", "s", "(1-0", "1")
+	c.expect("[[2-0 [c 3]] [1-1 [b 2]]]", "XREVRANGE", "s", "+", "-",
+		"COUNT", "2")
+	c.expect("[]", "XRANGE", "s", "-", "+", "COUNT", "0")
+	c.expect("-"+ErrInvalidID.Error(), "XRANGE", "s", "x", "+")
+	c.expect(":1", "XDEL", "s", "1-1", "5-0")
+	c.expect(":1", "XTRIM", "s", "MAXLEN", "~", "1")
+	c.expect("[[2-0 [c 3]]]", "XRANGE", "s", "-", "+")
+
+	c.expect("[[s [[2-0 [c 3]]]]]", "XREAD", "STREAMS", "s", "none", "0", "0")
+	c.expect("nil", "XREAD", "STREAMS", "s", "$")
+	c.expect("-ERR Unbalanced 'xread' list of streams: for each stream key "+
+		"an ID or '$' must be specified.", "XREAD", "STREAMS", "s", "t", "0")
+	c.expect("nil", "XREAD", "BLOCK", "10", "STREAMS", "s", "$")
+}
+
+func TestHandlerGroups(t *testing.T) {
+	_, dial := testServer(t)
+	c := dial()
+	c.expect("-ERR The XGROUP subcommand requires the key to exist. Note "+
+		"that for CREATE you may want to use the MKSTREAM option to create "+
+		"an empty stream automatically.", "XGROUP", "CREATE", "s", "g", "$")
+	c.expect("+OK", "XGROUP", "CREATE", "s", "g", "$", "MKSTREAM")
+	c.expect("-"+ErrBusyGroup.Error(), "XGROUP", "CREATE", "s", "g", "$")
+	c.expect("-ERR unknown subcommand 'NOPE'. Try XGROUP HELP.",
+		"XGROUP", "NOPE")
+	c.expect(":1", "XGROUP", "CREATECONSUMER", "s", "g", "c1")
+	c.expect("1-0", "XADD", "s", "1", "a", "1")
+	c.expect("2-0", "XADD", "s", "2", "b", "2")
+	c.expect("[[s [[1-0 [a 1]]]]]", "XREADGROUP", "GROUP", "g", "c1",
+		"COUNT", "1", "STREAMS", "s", ">")
+	c.expect("[[s [[2-0 [b 2]]]]]", "XREADGROUP", "GROUP", "g", "c2",
+		"STREAMS", "s", ">")
+	c.expect("[[s [[1-0 [a 1]]]]]", "XREADGROUP", "GROUP", "g", "c1",
+		"BLOCK", "0", "STREAMS", "s", "0")
+	c.expect("-NOGROUP No such key 's' or consumer group 'x' in XREADGROUP "+
+		"with GROUP option", "XREADGROUP", "GROUP", "x", "c1",
+		"STREAMS", "s", ">")
+	c.expect("[:2 1-0 2-0 [[c1 1] [c2 1]]]", "XPENDING", "s", "g")
+	c.expect("-NOGROUP No such key 's' or consumer group 'x'",
+		"XPENDING", "s", "x")
+	res := c.do("XPENDING", "s", "g", "-", "+", "10", "c1")
+	if !strings.HasPrefix(res, "[[1-0 c1 :") || !strings.HasSuffix(res,
+		" :2]]") {
+		t.Fatalf("unexpected reply %v", res)
+	}
+	c.expect("[2-0]", "XCLAIM", "s", "g", "c1", "0", "2-0", "JUSTID")
+	c.expect("[0-0 [[1-0 [a 1]] [2-0 [b 2]]] []]", "XAUTOCLAIM", "s", "g",
+		"c2", "0", "-")
+	c.expect(":1", "XACK", "s", "g", "1-0", "3-0")
+	c.expect(":1", "XGROUP", "DELCONSUMER", "s", "g", "c2")
+	c.expect("[:0 nil nil nil]", "XPENDING", "s", "g")
+	c.expect("+OK", "XGROUP", "SETID", "s", "g", "0")
+	c.expect(":1", "XGROUP", "DESTROY", "s", "g")
+	c.expect(":0", "XGROUP", "DESTROY", "s", "g")
+}
+
+func TestHandlerBlock(t *testing.T) {
+	h, dial := testServer(t)
+	c1, c2 := dial(), dial()
+	c1.expect("+OK", "XGROUP", "CREATE", "s", "g", "$", "MKSTREAM")
+
+	// a blocked XREAD receives the entries added by other clients
+	c1.send("XREAD", "BLOCK", "0", "STREAMS", "s", "$")
+	time.Sleep(time.Millisecond * 20)
+	c2.expect("1-0", "XADD", "s", "1", "a", "1")
+	if res := c1.reply(); res != "[[s [[1-0 [a 1]]]]]" {
+		t.Fatalf("unexpected reply %v", res)
+	}
+
+	// and so does a blocked XREADGROUP, also for entries of Handler.Add
+	c1.send("XREADGROUP", "GROUP", "g", "c", "BLOCK", "0", "STREAMS", "s",
+		">")
+	if res := c1.reply(); res != "[[s [[1-0 [a 1]]]]]" {
+		t.Fatalf("unexpected reply %v", res)
+	}
+	c1.send("XREADGROUP", "GROUP", "g", "c", "BLOCK", "0", "STREAMS", "s",
+		">")
+	time.Sleep(time.Millisecond * 20)
+	if _, err := h.Add("s", "2", [][]byte{[]byte("b"), []byte("2")}); err !=
+		nil {
+		t.Fatal(err)
+	}
+	if res := c1.reply(); res != "[[s [[2-0 [b 2]]]]]" {
+		t.Fatalf("unexpected reply %v", res)
+	}
+
+	// a destroyed group fails the blocked XREADGROUP
+	c1.send("XREADGROUP", "GROUP", "g", "c", "BLOCK", "0", "STREAMS", "s",
+		">")
+	time.Sleep(time.Millisecond * 20)
+	c2.expect(":1", "XGROUP", "DESTROY", "s", "g")
+	if res := c1.reply(); !strings.HasPrefix(res, "-NOGROUP") {
+		t.Fatalf("unexpected reply %v", res)
+	}
+
+	// the connection continues after a blocked command timed out
+	c1.send("XREAD", "BLOCK", "20", "STREAMS", "s", "$")
+	c1.send("XLEN", "s")
+	for _, exp := range []string{"nil", ":2"} {
+		if res := c1.reply(); res != exp {
+			t.Fatalf("expected '%v', got '%v'", exp, res)
+		}
+	}
+
+	// a client that disconnects stops waiting
+	c3 := dial()
+	c3.send("XREAD", "BLOCK", "0", "STREAMS", "s", "$")
+	time.Sleep(time.Millisecond * 20)
+	c3.nc.Close()
+	start := time.Now()
+	for {
+		h.mu.Lock()
+		n := len(h.waiters)
+		h.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatal(fmt.Sprintf("expected no waiters, got %d", n))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// testDump formats a stream with its groups and pending entries.
+func testDump(h *Handler, key string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.store.Get(key)
+	var b strings.Builder
+	fmt.Fprintf(&b, "%v %d\n", s.LastID(), s.EntriesAdded())
+	for _, entry := range s.Range(ID{}, MaxID, 0) {
+		fmt.Fprintf(&b, "%v %q\n", entry.ID, entry.Fields)
+	}
+	for _, g := range s.Groups() {
+		fmt.Fprintf(&b, "%s %v\n", g.Name(), g.LastID())
+		for _, c := range g.Consumers() {
+			fmt.Fprintf(&b, "%s %d\n", c.Name, c.Pending())
+		}
+		g.pending.Ascend(nil, func(item interface{}) bool {
+			pe := item.(*PendingEntry)
+			fmt.Fprintf(&b, "%v %s %d %d\n", pe.ID, pe.Consumer,
+				pe.DeliveryTime.UnixNano(), pe.DeliveryCount)
+			return true
+		})
+	}
+	return b.String()
+}
+
+func TestHandlerAOF(t *testing.T) {
+	ms := int64(1000000)
+	defer func() { now = time.Now }()
+	now = func() time.Time {
+		return time.Unix(0, atomic.LoadInt64(&ms)*int64(time.Millisecond))
+	}
+	path := filepath.Join(t.TempDir(), "appendonly.aof")
+	open := func() (*Handler, *redcon.AOF) {
+		h := NewHandler(nil)
+		mux := redcon.NewServeMux()
+		h.Register(mux)
+		aof, err := redcon.OpenAOF(path, mux, redcon.FsyncNo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h, aof
+	}
+	h, aof := open()
+	connect := testServe(t, aof.ServeRESP)
+	c := connect()
+	for _, test := range []struct {
+		ms   int64
+		args string
+		exp  string
+	}{
+		{1000000, "XADD s * a 1", "1000000-0"},
+		{1000000, "XADD s * b 2", "1000000-1"},
+		{1000000, "XGROUP CREATE s g 0", "+OK"},
+		{1000000, "XREADGROUP GROUP g alice COUNT 1 STREAMS s >",
+			"[[s [[1000000-0 [a 1]]]]]"},
+		{1000001, "XREADGROUP GROUP g bob STREAMS s >",
+			"[[s [[1000000-1 [b 2]]]]]"},
+		{1000002, "XREADGROUP GROUP g alice STREAMS s 0",
+			"[[s [[1000000-0 [a 1]]]]]"},
+		{1000003, "XCLAIM s g bob 1 1000000-0 JUSTID", "[1000000-0]"},
+		{1000004, "XCLAIM s g carol 3600000 1000000-0", "[]"},
+		{1000005, "XADD s * c 3", "1000005-0"},
+		{1000005, "XREADGROUP GROUP g dave NOACK STREAMS s >",
+			"[[s [[1000005-0 [c 3]]]]]"},
+		{1000006, "XDEL s 1000000-1", ":1"},
+		{1000007, "XAUTOCLAIM s g erin 0 0-0",
+			"[0-0 [[1000000-0 [a 1]]] [1000000-1]]"},
+	} {
+		atomic.StoreInt64(&ms, test.ms)
+		c.expect(test.exp, strings.Split(test.args, " ")...)
+	}
+
+	// a blocked XREADGROUP is written when it receives an entry
+	c2 := connect()
+	c2.send("XREADGROUP", "GROUP", "g", "frank", "BLOCK", "0", "STREAMS",
+		"s", ">")
+	time.Sleep(time.Millisecond * 50)
+	atomic.StoreInt64(&ms, 1000008)
+	c.expect("1000008-0", "XADD", "s", "*", "d", "4")
+	if res := c2.reply(); res != "[[s [[1000008-0 [d 4]]]]]" {
+		t.Fatalf("unexpected reply %q", res)
+	}
+	exp := testDump(h, "s")
+	aof.Close()
+
+	// the file is loaded later, with the same IDs and delivery times
+	atomic.StoreInt64(&ms, 2000000)
+	h, aof = open()
+	defer aof.Close()
+	if _, err := aof.Load(); err != nil {
+		t.Fatal(err)
+	}
+	if res := testDump(h, "s"); res != exp {
+		t.Fatalf("expected:\n%v\ngot:\n%v", exp, res)
+	}
+}
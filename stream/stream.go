@@ -0,0 +1,664 @@
+// Package stream implements Redis streams for redcon servers.
+//
+// A Stream is an in-memory append-only log of entries with consumer groups,
+// which may be used on its own. The Handler adds the XADD, XRANGE, XREAD,
+// XGROUP, XREADGROUP, XACK, XCLAIM, XAUTOCLAIM and related commands to a
+// redcon.ServeMux, including blocking reads.
+package stream
+
+import (
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tidwall/btree"
+)
+
+var (
+	// ErrInvalidID is returned for an invalid stream ID.
+	ErrInvalidID = errors.New("ERR Invalid stream ID specified as stream " +
+		"command argument")
+	// ErrIDTooSmall is returned by Add for an ID that is not greater than
+	// the last ID of the stream.
+	ErrIDTooSmall = errors.New("ERR The ID specified in XADD is equal or " +
+		"smaller than the target stream top item")
+	// ErrIDZero is returned by Add for the 0-0 ID.
+	ErrIDZero = errors.New("ERR The ID specified in XADD must be greater " +
+		"than 0-0")
+	// ErrBusyGroup is returned by CreateGroup when the group exists.
+	ErrBusyGroup = errors.New("BUSYGROUP Consumer Group name already exists")
+)
+
+// now returns the current time, which is replaced by tests.
+var now = time.Now
+
+// ID is the ID of a stream entry, which is the time in milliseconds and a
+// sequence number for entries that are added in the same millisecond.
+type ID struct {
+	Ms  uint64
+	Seq uint64
+}
+
+// MaxID is the greatest ID, which is "+" in range queries.
+var MaxID = ID{math.MaxUint64, math.MaxUint64}
+
+// ParseID parses an ID in the "<ms>-<seq>" or "<ms>" format. The sequence
+// number is zero when it's omitted.
+func ParseID(s string) (ID, error) {
+	return parseID(s, 0)
+}
+
+// parseID parses an ID, and uses seq when the sequence number is omitted.
+func parseID(s string, seq uint64) (ID, error) {
+	var id ID
+	var err error
+	ms := s
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		ms = s[:i]
+		if seq, err = strconv.ParseUint(s[i+1:], 10, 64); err != nil {
+			return id, ErrInvalidID
+		}
+	}
+	if id.Ms, err = strconv.ParseUint(ms, 10, 64); err != nil {
+		return id, ErrInvalidID
+	}
+	id.Seq = seq
+	return id, nil
+}
+
+// String returns the ID in the "<ms>-<seq>" format.
+func (id ID) String() string {
+	return strconv.FormatUint(id.Ms, 10) + "-" + strconv.FormatUint(id.Seq, 10)
+}
+
+// Less returns true when id is less than other.
+func (id ID) Less(other ID) bool {
+	if id.Ms != other.Ms {
+		return id.Ms < other.Ms
+	}
+	return id.Seq < other.Seq
+}
+
+// next returns the ID that follows id, and false when id is MaxID.
+func (id ID) next() (ID, bool) {
+	switch {
+	case id.Seq < math.MaxUint64:
+		return ID{id.Ms, id.Seq + 1}, true
+	case id.Ms < math.MaxUint64:
+		return ID{id.Ms + 1, 0}, true
+	}
+	return id, false
+}
+
+// prev returns the ID that precedes id, and false when id is 0-0.
+func (id ID) prev() (ID, bool) {
+	switch {
+	case id.Seq > 0:
+		return ID{id.Ms, id.Seq - 1}, true
+	case id.Ms > 0:
+		return ID{id.Ms - 1, math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// Entry is a stream entry. The fields are field-value pairs.
+type Entry struct {
+	ID     ID
+	Fields [][]byte
+}
+
+// Stream is an append-only log of entries, which are ordered by ID. A
+// Stream is not safe for concurrent use.
+type Stream struct {
+	entries []Entry
+	lastID  ID
+	added   uint64
+	groups  map[string]*Group
+}
+
+// New returns an empty Stream.
+func New() *Stream {
+	return &Stream{}
+}
+
+// Len returns the number of entries.
+func (s *Stream) Len() int {
+	return len(s.entries)
+}
+
+// LastID returns the ID of the last entry that was added, which may have
+// been deleted since.
+func (s *Stream) LastID() ID {
+	return s.lastID
+}
+
+// EntriesAdded returns the number of entries that were ever added.
+func (s *Stream) EntriesAdded() uint64 {
+	return s.added
+}
+
+// Add adds an entry and returns its ID. The id is "*" for an ID that is
+// generated from the current time, "<ms>-*" for a generated sequence
+// number, or an explicit "<ms>-<seq>" that is greater than the last ID. The
+// fields are copied.
+func (s *Stream) Add(id string, fields [][]byte) (ID, error) {
+	var newID ID
+	switch {
+	case id == "*":
+		ms := uint64(now().UnixNano() / int64(time.Millisecond))
+		if ms > s.lastID.Ms {
+			newID = ID{Ms: ms}
+		} else {
+			var ok bool
+			if newID, ok = s.lastID.next(); !ok {
+				return ID{}, ErrIDTooSmall
+			}
+		}
+	case strings.HasSuffix(id, "-*"):
+		ms, err := strconv.ParseUint(id[:len(id)-2], 10, 64)
+		if err != nil {
+			return ID{}, ErrInvalidID
+		}
+		switch {
+		case ms < s.lastID.Ms:
+			return ID{}, ErrIDTooSmall
+		case ms == s.lastID.Ms:
+			if s.lastID.Seq == math.MaxUint64 {
+				return ID{}, ErrIDTooSmall
+			}
+			newID = ID{ms, s.lastID.Seq + 1}
+		case ms == 0:
+			newID = ID{0, 1}
+		default:
+			newID = ID{Ms: ms}
+		}
+	default:
+		var err error
+		if newID, err = ParseID(id); err != nil {
+			return ID{}, err
+		}
+	}
+	if newID == (ID{}) {
+		return ID{}, ErrIDZero
+	}
+	if !s.lastID.Less(newID) {
+		return ID{}, ErrIDTooSmall
+	}
+	entry := Entry{ID: newID, Fields: make([][]byte, len(fields))}
+	for i, field := range fields {
+		entry.Fields[i] = append([]byte(nil), field...)
+	}
+	s.entries = append(s.entries, entry)
+	s.lastID = newID
+	s.added++
+	return newID, nil
+}
+
+// search returns the index of the first entry with an ID that is not less
+// than id.
+func (s *Stream) search(id ID) int {
+	return sort.Search(len(s.entries), func(i int) bool {
+		return !s.entries[i].ID.Less(id)
+	})
+}
+
+// Get returns the entry with the ID.
+func (s *Stream) Get(id ID) (Entry, bool) {
+	i := s.search(id)
+	if i < len(s.entries) && s.entries[i].ID == id {
+		return s.entries[i], true
+	}
+	return Entry{}, false
+}
+
+// Range returns the entries from start to end, inclusive, in ascending
+// order. A zero count returns all of the entries.
+func (s *Stream) Range(start, end ID, count int) []Entry {
+	var entries []Entry
+	for i := s.search(start); i < len(s.entries); i++ {
+		if end.Less(s.entries[i].ID) || (count > 0 && len(entries) == count) {
+			break
+		}
+		entries = append(entries, s.entries[i])
+	}
+	return entries
+}
+
+// RevRange returns the entries from end to start, inclusive, in descending
+// order. A zero count returns all of the entries.
+func (s *Stream) RevRange(end, start ID, count int) []Entry {
+	var entries []Entry
+	i := len(s.entries) - 1
+	if next, ok := end.next(); ok {
+		i = s.search(next) - 1
+	}
+	for ; i >= 0; i-- {
+		if s.entries[i].ID.Less(start) || (count > 0 && len(entries) == count) {
+			break
+		}
+		entries = append(entries, s.entries[i])
+	}
+	return entries
+}
+
+// After returns the entries with an ID that is greater than id. A zero
+// count returns all of the entries.
+func (s *Stream) After(id ID, count int) []Entry {
+	start, ok := id.next()
+	if !ok {
+		return nil
+	}
+	return s.Range(start, MaxID, count)
+}
+
+// Delete deletes entries, and returns the number of entries that were
+// deleted.
+func (s *Stream) Delete(ids ...ID) int {
+	var n int
+	for _, id := range ids {
+		i := s.search(id)
+		if i < len(s.entries) && s.entries[i].ID == id {
+			s.entries = append(s.entries[:i], s.entries[i+1:]...)
+			n++
+		}
+	}
+	return n
+}
+
+// Trim deletes the oldest entries so that there are at most maxLen entries,
+// and returns the number of entries that were deleted.
+func (s *Stream) Trim(maxLen int) int {
+	if maxLen < 0 || len(s.entries) <= maxLen {
+		return 0
+	}
+	n := len(s.entries) - maxLen
+	entries := make([]Entry, maxLen)
+	copy(entries, s.entries[n:])
+	s.entries = entries
+	return n
+}
+
+// CreateGroup creates a consumer group, which delivers the entries after
+// the id.
+func (s *Stream) CreateGroup(name string, id ID) (*Group, error) {
+	if _, ok := s.groups[name]; ok {
+		return nil, ErrBusyGroup
+	}
+	if s.groups == nil {
+		s.groups = make(map[string]*Group)
+	}
+	g := &Group{
+		stream:    s,
+		name:      name,
+		lastID:    id,
+		pending:   btree.New(byPendingID),
+		consumers: make(map[string]*Consumer),
+	}
+	s.groups[name] = g
+	return g, nil
+}
+
+// Group returns a consumer group, or nil when it does not exist.
+func (s *Stream) Group(name string) *Group {
+	return s.groups[name]
+}
+
+// Groups returns the consumer groups, ordered by name.
+func (s *Stream) Groups() []*Group {
+	groups := make([]*Group, 0, len(s.groups))
+	for _, g := range s.groups {
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].name < groups[j].name
+	})
+	return groups
+}
+
+// DestroyGroup deletes a consumer group, and returns false when it does
+// not exist.
+func (s *Stream) DestroyGroup(name string) bool {
+	if _, ok := s.groups[name]; !ok {
+		return false
+	}
+	delete(s.groups, name)
+	return true
+}
+
+// Group is a consumer group, which delivers each entry of a stream to one
+// of its consumers. Delivered entries are pending until acknowledged.
+type Group struct {
+	stream    *Stream
+	name      string
+	lastID    ID
+	pending   *btree.BTree // *PendingEntry ordered by ID
+	consumers map[string]*Consumer
+}
+
+// Consumer is a consumer of a group.
+type Consumer struct {
+	Name     string
+	SeenTime time.Time // the last time the consumer read or claimed
+	pending  map[ID]*PendingEntry
+}
+
+// Pending returns the number of pending entries of the consumer.
+func (c *Consumer) Pending() int {
+	return len(c.pending)
+}
+
+// PendingEntry is an entry that was delivered to a consumer, and is not
+// acknowledged yet.
+type PendingEntry struct {
+	ID            ID
+	Consumer      string
+	DeliveryTime  time.Time
+	DeliveryCount int
+}
+
+func byPendingID(a, b interface{}) bool {
+	return a.(*PendingEntry).ID.Less(b.(*PendingEntry).ID)
+}
+
+// Name returns the name of the group.
+func (g *Group) Name() string {
+	return g.name
+}
+
+// LastID returns the ID of the last entry that was delivered.
+func (g *Group) LastID() ID {
+	return g.lastID
+}
+
+// SetLastID sets the ID of the last entry that was delivered.
+func (g *Group) SetLastID(id ID) {
+	g.lastID = id
+}
+
+// Consumers returns the consumers, ordered by name.
+func (g *Group) Consumers() []*Consumer {
+	consumers := make([]*Consumer, 0, len(g.consumers))
+	for _, c := range g.consumers {
+		consumers = append(consumers, c)
+	}
+	sort.Slice(consumers, func(i, j int) bool {
+		return consumers[i].Name < consumers[j].Name
+	})
+	return consumers
+}
+
+// consumer returns a consumer, which is created when it does not exist.
+func (g *Group) consumer(name string) *Consumer {
+	c, ok := g.consumers[name]
+	if !ok {
+		c = &Consumer{Name: name, pending: make(map[ID]*PendingEntry)}
+		g.consumers[name] = c
+	}
+	c.SeenTime = now()
+	return c
+}
+
+// CreateConsumer creates a consumer, and returns false when it exists.
+func (g *Group) CreateConsumer(name string) bool {
+	if _, ok := g.consumers[name]; ok {
+		return false
+	}
+	g.consumer(name)
+	return true
+}
+
+// DeleteConsumer deletes a consumer and its pending entries, and returns
+// the number of pending entries that were deleted.
+func (g *Group) DeleteConsumer(name string) int {
+	c, ok := g.consumers[name]
+	if !ok {
+		return 0
+	}
+	for _, pe := range c.pending {
+		g.pending.Delete(pe)
+	}
+	delete(g.consumers, name)
+	return len(c.pending)
+}
+
+// ReadNew delivers the entries that were not delivered to any consumer
+// yet, and adds them to the pending entries of the consumer unless noack
+// is true. A zero count delivers all of the entries.
+func (g *Group) ReadNew(consumer string, count int, noack bool) []Entry {
+	c := g.consumer(consumer)
+	entries := g.stream.After(g.lastID, count)
+	t := now()
+	for _, entry := range entries {
+		g.lastID = entry.ID
+		if noack {
+			continue
+		}
+		pe := &PendingEntry{ID: entry.ID, DeliveryTime: t, DeliveryCount: 1}
+		if prev := g.pending.Get(pe); prev != nil {
+			g.removePending(prev.(*PendingEntry))
+		}
+		g.addPending(pe, c)
+	}
+	return entries
+}
+
+// ReadHistory delivers the pending entries of the consumer with an ID that
+// is greater than id again. Entries that were deleted from the stream have
+// nil fields. A zero count delivers all of the entries.
+func (g *Group) ReadHistory(consumer string, id ID, count int) []Entry {
+	c := g.consumer(consumer)
+	start, ok := id.next()
+	if !ok {
+		return nil
+	}
+	var entries []Entry
+	t := now()
+	g.pending.Ascend(&PendingEntry{ID: start}, func(item interface{}) bool {
+		if count > 0 && len(entries) == count {
+			return false
+		}
+		pe := item.(*PendingEntry)
+		if pe.Consumer != c.Name {
+			return true
+		}
+		entry, ok := g.stream.Get(pe.ID)
+		if !ok {
+			entry = Entry{ID: pe.ID}
+		}
+		pe.DeliveryTime = t
+		pe.DeliveryCount++
+		entries = append(entries, entry)
+		return true
+	})
+	return entries
+}
+
+func (g *Group) addPending(pe *PendingEntry, c *Consumer) {
+	pe.Consumer = c.Name
+	c.pending[pe.ID] = pe
+	g.pending.Set(pe)
+}
+
+func (g *Group) removePending(pe *PendingEntry) {
+	if c, ok := g.consumers[pe.Consumer]; ok {
+		delete(c.pending, pe.ID)
+	}
+	g.pending.Delete(pe)
+}
+
+// Ack acknowledges entries, which removes them from the pending entries,
+// and returns the number of entries that were pending.
+func (g *Group) Ack(ids ...ID) int {
+	var n int
+	for _, id := range ids {
+		if item := g.pending.Get(&PendingEntry{ID: id}); item != nil {
+			g.removePending(item.(*PendingEntry))
+			n++
+		}
+	}
+	return n
+}
+
+// PendingSummary is a summary of the pending entries of a group.
+type PendingSummary struct {
+	Count     int
+	Lowest    ID
+	Highest   ID
+	Consumers map[string]int // the number of pending entries per consumer
+}
+
+// Pending returns a summary of the pending entries.
+func (g *Group) Pending() PendingSummary {
+	summary := PendingSummary{
+		Count:     g.pending.Len(),
+		Consumers: make(map[string]int),
+	}
+	if summary.Count == 0 {
+		return summary
+	}
+	summary.Lowest = g.pending.Min().(*PendingEntry).ID
+	summary.Highest = g.pending.Max().(*PendingEntry).ID
+	for _, c := range g.consumers {
+		if len(c.pending) > 0 {
+			summary.Consumers[c.Name] = len(c.pending)
+		}
+	}
+	return summary
+}
+
+// PendingRange returns the pending entries from start to end, inclusive,
+// that are idle for at least minIdle. An empty consumer returns the entries
+// of all consumers. A zero count returns all of the entries.
+func (g *Group) PendingRange(start, end ID, count int, consumer string,
+	minIdle time.Duration,
+) []PendingEntry {
+	var entries []PendingEntry
+	t := now()
+	g.pending.Ascend(&PendingEntry{ID: start}, func(item interface{}) bool {
+		pe := item.(*PendingEntry)
+		if end.Less(pe.ID) || (count > 0 && len(entries) == count) {
+			return false
+		}
+		if (consumer == "" || pe.Consumer == consumer) &&
+			t.Sub(pe.DeliveryTime) >= minIdle {
+			entries = append(entries, *pe)
+		}
+		return true
+	})
+	return entries
+}
+
+// ClaimOptions are the options for Claim.
+type ClaimOptions struct {
+	// Idle sets the idle time of the claimed entries, instead of zero.
+	Idle time.Duration
+	// RetryCount sets the delivery count when it's greater than zero,
+	// instead of incrementing it.
+	RetryCount int
+	// Force creates pending entries for the entries that exist in the
+	// stream but are not pending.
+	Force bool
+	// JustID does not increment the delivery count.
+	JustID bool
+}
+
+// Claim changes the ownership of pending entries that are idle for at least
+// minIdle to the consumer, and returns the claimed entries. Pending entries
+// that were deleted from the stream are removed.
+func (g *Group) Claim(consumer string, minIdle time.Duration, ids []ID,
+	opts ClaimOptions,
+) []Entry {
+	c := g.consumer(consumer)
+	t := now()
+	var entries []Entry
+	for _, id := range ids {
+		var pe *PendingEntry
+		if item := g.pending.Get(&PendingEntry{ID: id}); item != nil {
+			pe = item.(*PendingEntry)
+		}
+		entry, exists := g.stream.Get(id)
+		if pe == nil {
+			if !opts.Force || !exists {
+				continue
+			}
+			pe = &PendingEntry{ID: id}
+		} else {
+			if !exists {
+				g.removePending(pe)
+				continue
+			}
+			if minIdle > 0 && t.Sub(pe.DeliveryTime) < minIdle {
+				continue
+			}
+			g.removePending(pe)
+		}
+		g.claim(pe, c, t, opts)
+		if opts.JustID {
+			entry = Entry{ID: id}
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// claim gives a pending entry to a consumer.
+func (g *Group) claim(pe *PendingEntry, c *Consumer, t time.Time,
+	opts ClaimOptions,
+) {
+	pe.DeliveryTime = t.Add(-opts.Idle)
+	if opts.RetryCount > 0 {
+		pe.DeliveryCount = opts.RetryCount
+	} else if !opts.JustID {
+		pe.DeliveryCount++
+	}
+	g.addPending(pe, c)
+}
+
+// AutoClaim claims up to count pending entries, starting at start, that are
+// idle for at least minIdle, like Claim. It returns the ID to continue the
+// scan from, which is 0-0 when the scan is complete, the claimed entries,
+// and the IDs of the pending entries that were removed because they were
+// deleted from the stream. A zero count is 100.
+func (g *Group) AutoClaim(consumer string, minIdle time.Duration, start ID,
+	count int, justID bool,
+) (ID, []Entry, []ID) {
+	if count <= 0 {
+		count = 100
+	}
+	c := g.consumer(consumer)
+	t := now()
+	var next ID
+	var scanned []*PendingEntry
+	g.pending.Ascend(&PendingEntry{ID: start}, func(item interface{}) bool {
+		pe := item.(*PendingEntry)
+		if len(scanned) == count {
+			next = pe.ID
+			return false
+		}
+		scanned = append(scanned, pe)
+		return true
+	})
+	var entries []Entry
+	var deleted []ID
+	for _, pe := range scanned {
+		entry, exists := g.stream.Get(pe.ID)
+		if !exists {
+			g.removePending(pe)
+			deleted = append(deleted, pe.ID)
+			continue
+		}
+		if t.Sub(pe.DeliveryTime) < minIdle {
+			continue
+		}
+		g.removePending(pe)
+		g.claim(pe, c, t, ClaimOptions{JustID: justID})
+		if justID {
+			entry = Entry{ID: pe.ID}
+		}
+		entries = append(entries, entry)
+	}
+	return next, entries, deleted
+}
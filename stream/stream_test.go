@@ -0,0 +1,190 @@
+package stream
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testEntries(entries []Entry) string {
+	var s string
+	for i, entry := range entries {
+		if i > 0 {
+			s += " "
+		}
+		s += entry.ID.String()
+		if entry.Fields == nil {
+			s += ":nil"
+		}
+		for _, field := range entry.Fields {
+			s += ":" + string(field)
+		}
+	}
+	return s
+}
+
+func testFields(fields ...string) [][]byte {
+	var res [][]byte
+	for _, field := range fields {
+		res = append(res, []byte(field))
+	}
+	return res
+}
+
+func TestID(t *testing.T) {
+	for _, test := range []struct {
+		s   string
+		exp string
+	}{
+		{"0", "0-0"}, {"1-2", "1-2"}, {"18446744073709551615-1", "18446744073709551615-1"},
+		{"", "error"}, {"1-", "error"}, {"-1", "error"}, {"a-1", "error"},
+		{"1-2-3", "error"},
+	} {
+		res := "error"
+		if id, err := ParseID(test.s); err == nil {
+			res = id.String()
+		}
+		if res != test.exp {
+			t.Fatalf("%q: expected '%v', got '%v'", test.s, test.exp, res)
+		}
+	}
+	if id, ok := (ID{1, 0}).prev(); !ok || id != (ID{0, MaxID.Seq}) {
+		t.Fatalf("unexpected prev %v %v", id, ok)
+	}
+	if _, ok := MaxID.next(); ok {
+		t.Fatal("expected no next ID")
+	}
+}
+
+func TestStream(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Unix(0, int64(5*time.Millisecond)) }
+	s := New()
+	for _, test := range []struct {
+		id  string
+		exp string
+	}{
+		{"0-0", ErrIDZero.Error()}, {"*", "5-0"}, {"*", "5-1"}, {"5-*", "5-2"},
+		{"5-2", ErrIDTooSmall.Error()}, {"4-*", ErrIDTooSmall.Error()},
+		{"7", "7-0"}, {"8-*", "8-0"}, {"x", ErrInvalidID.Error()},
+	} {
+		var res string
+		if id, err := s.Add(test.id, testFields("f", test.id)); err != nil {
+			res = err.Error()
+		} else {
+			res = id.String()
+		}
+		if res != test.exp {
+			t.Fatalf("%q: expected '%v', got '%v'", test.id, test.exp, res)
+		}
+	}
+	if s.Len() != 5 || s.LastID() != (ID{8, 0}) || s.EntriesAdded() != 5 {
+		t.Fatalf("unexpected stream %v %v %v", s.Len(), s.LastID(),
+			s.EntriesAdded())
+	}
+	if res := testEntries(s.Range(ID{5, 1}, ID{7, 0}, 0)); res !=
+		"5-1:f:* 5-2:f:5-* 7-0:f:7" {
+		t.Fatalf("unexpected range %v", res)
+	}
+	if res := testEntries(s.RevRange(MaxID, ID{}, 2)); res !=
+		"8-0:f:8-* 7-0:f:7" {
+		t.Fatalf("unexpected range %v", res)
+	}
+	if res := testEntries(s.After(ID{5, 2}, 0)); res != "7-0:f:7 8-0:f:8-*" {
+		t.Fatalf("unexpected entries %v", res)
+	}
+	if n := s.Delete(ID{5, 1}, ID{6, 0}); n != 1 {
+		t.Fatalf("expected '%v', got '%v'", 1, n)
+	}
+	if n := s.Trim(2); n != 2 {
+		t.Fatalf("expected '%v', got '%v'", 2, n)
+	}
+	if res := testEntries(s.Range(ID{}, MaxID, 0)); res != "7-0:f:7 8-0:f:8-*" {
+		t.Fatalf("unexpected range %v", res)
+	}
+	// the last ID does not go back after deletes
+	s.Delete(ID{8, 0})
+	if _, err := s.Add("8-0", nil); err != ErrIDTooSmall {
+		t.Fatalf("expected '%v', got '%v'", ErrIDTooSmall, err)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	defer func() { now = time.Now }()
+	var ms int64 = 1
+	now = func() time.Time { return time.Unix(0, ms*int64(time.Millisecond)) }
+	s := New()
+	for i := 1; i <= 4; i++ {
+		s.Add(fmt.Sprintf("%d", i), testFields("n", fmt.Sprint(i)))
+	}
+	g, err := s.CreateGroup("g", ID{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.CreateGroup("g", ID{}); err != ErrBusyGroup {
+		t.Fatalf("expected '%v', got '%v'", ErrBusyGroup, err)
+	}
+	if res := testEntries(g.ReadNew("a", 2, false)); res != "1-0:n:1 2-0:n:2" {
+		t.Fatalf("unexpected entries %v", res)
+	}
+	if res := testEntries(g.ReadNew("b", 0, false)); res != "3-0:n:3 4-0:n:4" {
+		t.Fatalf("unexpected entries %v", res)
+	}
+	if res := testEntries(g.ReadNew("b", 0, false)); res != "" {
+		t.Fatalf("unexpected entries %v", res)
+	}
+	summary := g.Pending()
+	if summary.Count != 4 || summary.Lowest != (ID{1, 0}) ||
+		summary.Highest != (ID{4, 0}) || summary.Consumers["a"] != 2 {
+		t.Fatalf("unexpected summary %v", summary)
+	}
+	if n := g.Ack(ID{2, 0}, ID{9, 0}); n != 1 {
+		t.Fatalf("expected '%v', got '%v'", 1, n)
+	}
+	s.Delete(ID{1, 0})
+	if res := testEntries(g.ReadHistory("a", ID{}, 0)); res != "1-0:nil" {
+		t.Fatalf("unexpected entries %v", res)
+	}
+
+	ms = 100
+	pending := g.PendingRange(ID{}, MaxID, 0, "b", time.Millisecond*50)
+	if len(pending) != 2 || pending[0].DeliveryCount != 1 {
+		t.Fatalf("unexpected pending %v", pending)
+	}
+	res := testEntries(g.Claim("a", time.Millisecond*50,
+		[]ID{{3, 0}, {4, 0}}, ClaimOptions{RetryCount: 5}))
+	if res != "3-0:n:3 4-0:n:4" {
+		t.Fatalf("unexpected entries %v", res)
+	}
+	pending = g.PendingRange(ID{}, MaxID, 0, "a", 0)
+	if len(pending) != 3 || pending[1].DeliveryCount != 5 {
+		t.Fatalf("unexpected pending %v", pending)
+	}
+	// recently claimed entries are not idle
+	if res := testEntries(g.Claim("b", time.Millisecond,
+		[]ID{{3, 0}}, ClaimOptions{})); res != "" {
+		t.Fatalf("unexpected entries %v", res)
+	}
+
+	ms = 200
+	next, entries, deleted := g.AutoClaim("b", time.Millisecond, ID{}, 2,
+		false)
+	if next != (ID{4, 0}) || testEntries(entries) != "3-0:n:3" ||
+		fmt.Sprint(deleted) != "[1-0]" {
+		t.Fatalf("unexpected autoclaim %v %v %v", next, testEntries(entries),
+			deleted)
+	}
+	next, entries, _ = g.AutoClaim("b", time.Millisecond, next, 2, true)
+	if next != (ID{}) || testEntries(entries) != "4-0:nil" {
+		t.Fatalf("unexpected autoclaim %v %v", next, testEntries(entries))
+	}
+	if n := g.DeleteConsumer("b"); n != 2 {
+		t.Fatalf("expected '%v', got '%v'", 2, n)
+	}
+	if g.Pending().Count != 0 {
+		t.Fatalf("expected no pending entries")
+	}
+	if !s.DestroyGroup("g") || s.Group("g") != nil {
+		t.Fatal("expected the group to be destroyed")
+	}
+}
@@ -0,0 +1,176 @@
+package redcon
+
+// Message is a message that is received by a Subscriber.
+type Message struct {
+	Pattern string // the matching pattern, for Psubscribe
+	Shard   bool   // published with Spublish
+	Channel string
+	Message []byte // shared by all subscribers, must not be modified
+}
+
+// Subscriber is an in-process subscriber of a PubSub, which receives the
+// same messages as the subscribed network connections without a
+// connection of its own.
+//
+//	sub := ps.NewSubscriber(nil)
+//	defer sub.Close()
+//	sub.Subscribe("news")
+//	for msg := range sub.C {
+//		fmt.Printf("%s: %s\n", msg.Channel, msg.Message)
+//	}
+//
+// The messages are queued like those of network subscribers, so the queue
+// size and policy of SetSubscriberQueue apply. The OnSubscribe and
+// OnUnsubscribe hooks and the ACL are not used for Subscribers.
+type Subscriber struct {
+	// C receives the messages when the Subscriber has no function. It's
+	// closed after the Subscriber is closed.
+	C <-chan Message
+
+	ps    *PubSub
+	sconn *pubSubConn
+}
+
+// NewSubscriber returns a new Subscriber, which has no subscriptions. The
+// messages are passed to fn, one at a time, from a background goroutine.
+// When fn is nil the messages are sent to the C channel instead.
+func (ps *PubSub) NewSubscriber(fn func(msg Message)) *Subscriber {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.init()
+	size := ps.queueSize
+	if size == 0 {
+		size = DefaultSubscriberQueueSize
+	}
+	ps.nextid++
+	sconn := &pubSubConn{
+		id:      ps.nextid,
+		entries: make(map[*pubSubEntry]bool),
+		queue:   make(chan pubSubMessage, size),
+		policy:  ps.queuePolicy,
+		done:    make(chan struct{}),
+		fn:      fn,
+	}
+	sub := &Subscriber{ps: ps, sconn: sconn}
+	sconn.close = func() { sub.Close() }
+	if fn != nil {
+		go sconn.writer()
+		return sub
+	}
+	c := make(chan Message)
+	sub.C = c
+	sconn.fn = func(msg Message) {
+		select {
+		case c <- msg:
+		case <-sconn.done:
+		}
+	}
+	go func() {
+		sconn.writer()
+		close(c)
+	}()
+	return sub
+}
+
+// Subscribe subscribes to channels.
+func (sub *Subscriber) Subscribe(channels ...string) {
+	sub.subscribe(false, false, channels)
+}
+
+// Psubscribe subscribes to glob-style patterns.
+func (sub *Subscriber) Psubscribe(patterns ...string) {
+	sub.subscribe(true, false, patterns)
+}
+
+// Ssubscribe subscribes to shard channels.
+func (sub *Subscriber) Ssubscribe(channels ...string) {
+	sub.subscribe(false, true, channels)
+}
+
+// Unsubscribe unsubscribes from channels, or from all channels when there
+// are no channels.
+func (sub *Subscriber) Unsubscribe(channels ...string) {
+	sub.unsubscribe(false, false, channels)
+}
+
+// Punsubscribe unsubscribes from patterns, or from all patterns when there
+// are no patterns.
+func (sub *Subscriber) Punsubscribe(patterns ...string) {
+	sub.unsubscribe(true, false, patterns)
+}
+
+// Sunsubscribe unsubscribes from shard channels, or from all shard
+// channels when there are no channels.
+func (sub *Subscriber) Sunsubscribe(channels ...string) {
+	sub.unsubscribe(false, true, channels)
+}
+
+// Close removes all subscriptions and stops the Subscriber. Messages that
+// are still queued are not received. It may be called from the function of
+// the Subscriber, or while receiving from C, also when the queue is full
+// with the SubscriberBlock policy.
+func (sub *Subscriber) Close() error {
+	// the publishers that are blocked on the queue are released before
+	// taking the lock, which they hold while blocked
+	sub.sconn.closeDone()
+	ps := sub.ps
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for entry := range sub.sconn.entries {
+		ps.removeEntry(entry)
+	}
+	sub.sconn.entries = nil
+	return nil
+}
+
+// closed returns true when the Subscriber is closed. The caller must hold
+// the lock.
+func (sub *Subscriber) closed() bool {
+	select {
+	case <-sub.sconn.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (sub *Subscriber) subscribe(pattern, shard bool, channels []string) {
+	ps := sub.ps
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if sub.closed() {
+		return
+	}
+	for _, channel := range channels {
+		entry := &pubSubEntry{
+			pattern: pattern,
+			shard:   shard,
+			channel: channel,
+			sconn:   sub.sconn,
+		}
+		if ps.tree(entry).Get(entry) == nil {
+			ps.addEntry(entry)
+			sub.sconn.entries[entry] = true
+		}
+	}
+}
+
+func (sub *Subscriber) unsubscribe(pattern, shard bool, channels []string) {
+	ps := sub.ps
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if sub.closed() {
+		return
+	}
+	remove := make(map[string]bool, len(channels))
+	for _, channel := range channels {
+		remove[channel] = true
+	}
+	for entry := range sub.sconn.entries {
+		if entry.pattern == pattern && entry.shard == shard &&
+			(len(channels) == 0 || remove[entry.channel]) {
+			ps.removeEntry(entry)
+			delete(sub.sconn.entries, entry)
+		}
+	}
+}
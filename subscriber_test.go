@@ -0,0 +1,138 @@
+package redcon
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestSubscriber(t *testing.T) {
+	var ps PubSub
+	sub := ps.NewSubscriber(nil)
+	sub.Subscribe("a", "b")
+	sub.Psubscribe("a*")
+	sub.Ssubscribe("s")
+	recv := func() string {
+		t.Helper()
+		select {
+		case msg, ok := <-sub.C:
+			if !ok {
+				return "closed"
+			}
+			return fmt.Sprintf("%s %v %s %s", msg.Pattern, msg.Shard,
+				msg.Channel, msg.Message)
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out")
+		}
+		return ""
+	}
+	if n := ps.Publish("a", "x"); n != 2 {
+		t.Fatalf("expected '%v', got '%v'", 2, n)
+	}
+	for _, exp := range []string{" false a x", "a* false a x"} {
+		if res := recv(); res != exp {
+			t.Fatalf("expected '%v', got '%v'", exp, res)
+		}
+	}
+	ps.SpublishBytes([]byte("s"), []byte("y"))
+	if res := recv(); res != " true s y" {
+		t.Fatalf("expected '%v', got '%v'", " true s y", res)
+	}
+	if counts := fmt.Sprint(ps.NumSub("a", "b")); counts != "[1 1]" {
+		t.Fatalf("expected '%v', got '%v'", "[1 1]", counts)
+	}
+	sub.Unsubscribe("a")
+	if n := ps.Publish("a", "x"); n != 1 {
+		t.Fatalf("expected '%v', got '%v'", 1, n)
+	}
+	if res := recv(); res != "a* false a x" {
+		t.Fatalf("expected '%v', got '%v'", "a* false a x", res)
+	}
+	sub.Close()
+	if res := recv(); res != "closed" {
+		t.Fatalf("expected '%v', got '%v'", "closed", res)
+	}
+	if n := ps.Publish("b", "x"); n != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, n)
+	}
+	if n := ps.NumPat(); n != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, n)
+	}
+	sub.Subscribe("b")
+	if n := ps.Publish("b", "x"); n != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, n)
+	}
+}
+
+func TestSubscriberFunc(t *testing.T) {
+	var ps PubSub
+	msgs := make(chan Message, 8)
+	sub := ps.NewSubscriber(func(msg Message) { msgs <- msg })
+	defer sub.Close()
+	sub.Subscribe("a")
+
+	// network subscribers receive the same messages
+	c, peer := testPipeConn(t, 1)
+	defer peer.nc.Close()
+	ps.Subscribe(c, "a")
+	peer.expect("*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n")
+	if n := ps.PublishBytes([]byte("a"), []byte("hello")); n != 2 {
+		t.Fatalf("expected '%v', got '%v'", 2, n)
+	}
+	peer.expect("*3\r\n$7\r\nmessage\r\n$1\r\na\r\n$5\r\nhello\r\n")
+	select {
+	case msg := <-msgs:
+		if msg.Channel != "a" || string(msg.Message) != "hello" {
+			t.Fatalf("unexpected message %v", msg)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out")
+	}
+
+	// a subscriber that does not receive is disconnected
+	ps.SetSubscriberQueue(1, SubscriberDisconnect)
+	slow := ps.NewSubscriber(nil)
+	slow.Subscribe("b")
+	for i := 0; i < 10; i++ {
+		ps.Publish("b", "x")
+	}
+	start := time.Now()
+	for ps.NumSub("b")[0] != 0 {
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("expected the subscriber to be closed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSubscriberCloseBlocked(t *testing.T) {
+	// the subscriber closes itself while the publisher is blocked on its
+	// full queue
+	var ps PubSub
+	ps.SetSubscriberQueue(1, SubscriberBlock)
+	var sub *Subscriber
+	closed := make(chan bool)
+	sub = ps.NewSubscriber(func(msg Message) {
+		time.Sleep(time.Millisecond * 10)
+		sub.Close()
+		close(closed)
+	})
+	sub.Subscribe("a")
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 10; i++ {
+			ps.Publish("a", "x")
+		}
+		close(done)
+	}()
+	for _, c := range []chan bool{closed, done} {
+		select {
+		case <-c:
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out")
+		}
+	}
+	if n := ps.NumSub("a")[0]; n != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, n)
+	}
+}
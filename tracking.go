@@ -0,0 +1,428 @@
+package redcon
+
+import (
+	"strings"
+	"sync"
+)
+
+// Tracker is a Handler that implements server-assisted client side caching
+// with the CLIENT TRACKING, CLIENT CACHING, CLIENT GETREDIR and
+// CLIENT TRACKINGINFO commands. All other commands are passed to the
+// handler.
+//
+// Handlers call Track with the keys that a command reads, and Invalidate
+// with the keys that a command modifies. In the default mode, a client is
+// sent an invalidation message for each key that it has read, after which
+// the key is no longer tracked for the client. In BCAST mode, a client is
+// sent an invalidation message for every modified key that matches one of
+// its prefixes.
+//
+// Invalidation messages are sent as RESP3 push messages to clients that
+// switched to RESP3 with HELLO 3, such as through an AuthHandler. RESP2
+// clients use REDIRECT to receive messages on a connection that is
+// subscribed to the __redis__:invalidate channel of the PubSub.
+type Tracker struct {
+	handler  Handler
+	ps       *PubSub
+	mu       sync.Mutex
+	clients  map[uint64]*trackingClient
+	keys     map[string]map[uint64]bool
+	prefixes map[string]map[uint64]bool
+}
+
+// trackingClient is the tracking state of a connection.
+type trackingClient struct {
+	c        *conn
+	resp3    bool
+	redirect uint64
+	bcast    bool
+	optin    bool
+	optout   bool
+	noloop   bool
+	prefixes []string
+	keys     map[string]bool // the tracked keys, guarded by the Tracker
+}
+
+// NewTracker returns a new Tracker that passes commands to handler. The ps
+// is used for REDIRECT, and may be nil when REDIRECT is not supported.
+func NewTracker(handler Handler, ps *PubSub) *Tracker {
+	if handler == nil {
+		panic("redcon: nil handler")
+	}
+	return &Tracker{
+		handler:  handler,
+		ps:       ps,
+		clients:  make(map[uint64]*trackingClient),
+		keys:     make(map[string]map[uint64]bool),
+		prefixes: make(map[string]map[uint64]bool),
+	}
+}
+
+// ServeRESP handles the client tracking commands and passes all other
+// commands to the handler.
+func (t *Tracker) ServeRESP(conn Conn, cmd Command) {
+	c := baseConn(conn)
+	if c == nil || len(cmd.Args) < 2 ||
+		!strings.EqualFold(string(cmd.Args[0]), "client") {
+		t.handler.ServeRESP(conn, cmd)
+		t.endCommand(c)
+		return
+	}
+	switch strings.ToLower(string(cmd.Args[1])) {
+	case "tracking":
+		t.serveTracking(c, cmd)
+	case "caching":
+		t.serveCaching(c, cmd)
+	case "getredir":
+		t.serveGetRedir(c, cmd)
+	case "trackinginfo":
+		t.serveTrackingInfo(c, cmd)
+	default:
+		t.handler.ServeRESP(conn, cmd)
+		t.endCommand(c)
+	}
+}
+
+// endCommand clears the CLIENT CACHING state after a command.
+func (t *Tracker) endCommand(c *conn) {
+	if c != nil {
+		c.trackCaching = false
+	}
+}
+
+// serveTracking handles
+// "CLIENT TRACKING ON|OFF [REDIRECT id] [PREFIX prefix ...] [BCAST]
+// [OPTIN] [OPTOUT] [NOLOOP]"
+func (t *Tracker) serveTracking(c *conn, cmd Command) {
+	if len(cmd.Args) < 3 {
+		c.WriteError("ERR wrong number of arguments for 'client|tracking' " +
+			"command")
+		return
+	}
+	args := NewArgReader(Command{Args: cmd.Args[1:]})
+	on := args.Enum("on", "off") == 0
+	tc := &trackingClient{c: c, resp3: c.proto == 3,
+		keys: make(map[string]bool)}
+	for args.More() && args.Err() == nil {
+		switch args.Enum("redirect", "prefix", "bcast", "optin", "optout",
+			"noloop") {
+		case 0:
+			tc.redirect = args.Uint()
+		case 1:
+			tc.prefixes = append(tc.prefixes, args.String())
+		case 2:
+			tc.bcast = true
+		case 3:
+			tc.optin = true
+		case 4:
+			tc.optout = true
+		case 5:
+			tc.noloop = true
+		}
+	}
+	if err := args.Err(); err != nil {
+		c.WriteError(err.Error())
+		return
+	}
+	if !on {
+		t.disable(c.id)
+		c.WriteString("OK")
+		return
+	}
+	switch {
+	case len(tc.prefixes) > 0 && !tc.bcast:
+		c.WriteError("ERR PREFIX option requires BCAST mode to be enabled")
+		return
+	case tc.optin && tc.optout:
+		c.WriteError("ERR You can't use both OPTIN and OPTOUT")
+		return
+	case tc.bcast && (tc.optin || tc.optout):
+		c.WriteError("ERR OPTIN and OPTOUT are not compatible with BCAST")
+		return
+	case tc.redirect != 0 && (t.ps == nil || !t.ps.hasConn(tc.redirect)):
+		c.WriteError("ERR The client ID you want redirect to does not exist")
+		return
+	}
+	for i, a := range tc.prefixes {
+		for _, b := range tc.prefixes[i+1:] {
+			if strings.HasPrefix(a, b) || strings.HasPrefix(b, a) {
+				c.WriteError("ERR Prefix '" + a + "' overlaps with another " +
+					"provided prefix '" + b + "'. Prefixes for a single " +
+					"client must not overlap.")
+				return
+			}
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if prev, ok := t.clients[c.id]; ok {
+		if prev.bcast != tc.bcast {
+			c.WriteError("ERR You can't switch BCAST mode on/off before " +
+				"disabling tracking for this client, and then re-enabling " +
+				"it with a different mode.")
+			return
+		}
+		if prev.optin != tc.optin || prev.optout != tc.optout {
+			c.WriteError("ERR You can't switch OPTIN/OPTOUT mode before " +
+				"disabling tracking for this client, and then re-enabling " +
+				"it with a different mode.")
+			return
+		}
+		t.removePrefixes(prev)
+		tc.keys = prev.keys
+	}
+	if tc.bcast && len(tc.prefixes) == 0 {
+		// An empty prefix matches all keys
+		tc.prefixes = []string{""}
+	}
+	for _, prefix := range tc.prefixes {
+		ids, ok := t.prefixes[prefix]
+		if !ok {
+			ids = make(map[uint64]bool)
+			t.prefixes[prefix] = ids
+		}
+		ids[c.id] = true
+	}
+	t.clients[c.id] = tc
+	c.onClose(t, func() { t.disable(c.id) })
+	c.WriteString("OK")
+}
+
+// serveCaching handles "CLIENT CACHING YES|NO"
+func (t *Tracker) serveCaching(c *conn, cmd Command) {
+	if len(cmd.Args) != 3 {
+		c.WriteError("ERR wrong number of arguments for 'client|caching' " +
+			"command")
+		return
+	}
+	yes := strings.EqualFold(string(cmd.Args[2]), "yes")
+	if !yes && !strings.EqualFold(string(cmd.Args[2]), "no") {
+		c.WriteError(ErrSyntax.Error())
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tc, ok := t.clients[c.id]
+	switch {
+	case !ok || (!tc.optin && !tc.optout):
+		c.WriteError("ERR CLIENT CACHING can be called only when the " +
+			"client is in tracking mode with OPTIN or OPTOUT mode enabled")
+	case yes && !tc.optin:
+		c.WriteError("ERR CLIENT CACHING YES is only valid when tracking " +
+			"is enabled in OPTIN mode.")
+	case !yes && !tc.optout:
+		c.WriteError("ERR CLIENT CACHING NO is only valid when tracking " +
+			"is enabled in OPTOUT mode.")
+	default:
+		c.trackCaching = true
+		c.WriteString("OK")
+	}
+}
+
+// serveGetRedir handles "CLIENT GETREDIR"
+func (t *Tracker) serveGetRedir(c *conn, cmd Command) {
+	if len(cmd.Args) != 2 {
+		c.WriteError("ERR wrong number of arguments for 'client|getredir' " +
+			"command")
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tc, ok := t.clients[c.id]; ok {
+		c.WriteUint64(tc.redirect)
+	} else {
+		c.WriteInt(-1)
+	}
+}
+
+// serveTrackingInfo handles "CLIENT TRACKINGINFO"
+func (t *Tracker) serveTrackingInfo(c *conn, cmd Command) {
+	if len(cmd.Args) != 2 {
+		c.WriteError("ERR wrong number of arguments for " +
+			"'client|trackinginfo' command")
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tc, ok := t.clients[c.id]
+	c.writeMap(3)
+	c.WriteBulkString("flags")
+	if !ok {
+		c.WriteArray(1)
+		c.WriteBulkString("off")
+		c.WriteBulkString("redirect")
+		c.WriteInt(-1)
+		c.WriteBulkString("prefixes")
+		c.WriteArray(0)
+		return
+	}
+	flags := []string{"on"}
+	for _, flag := range []struct {
+		name string
+		set  bool
+	}{
+		{"bcast", tc.bcast}, {"optin", tc.optin}, {"optout", tc.optout},
+		{"caching-yes", tc.optin && c.trackCaching},
+		{"caching-no", tc.optout && c.trackCaching},
+		{"noloop", tc.noloop},
+	} {
+		if flag.set {
+			flags = append(flags, flag.name)
+		}
+	}
+	c.WriteAny(flags)
+	c.WriteBulkString("redirect")
+	c.WriteUint64(tc.redirect)
+	c.WriteBulkString("prefixes")
+	if tc.bcast {
+		c.WriteAny(tc.prefixes)
+	} else {
+		c.WriteArray(0)
+	}
+}
+
+// disable turns off tracking for a client.
+func (t *Tracker) disable(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if tc, ok := t.clients[id]; ok {
+		t.removePrefixes(tc)
+		t.removeKeys(tc)
+		delete(t.clients, id)
+	}
+}
+
+// removeKeys stops tracking the keys that a client has read. The caller
+// must hold the lock.
+func (t *Tracker) removeKeys(tc *trackingClient) {
+	for key := range tc.keys {
+		ids := t.keys[key]
+		delete(ids, tc.c.id)
+		if len(ids) == 0 {
+			delete(t.keys, key)
+		}
+	}
+	tc.keys = nil
+}
+
+// removePrefixes removes the BCAST prefixes of a client. The caller must
+// hold the lock.
+func (t *Tracker) removePrefixes(tc *trackingClient) {
+	for _, prefix := range tc.prefixes {
+		ids := t.prefixes[prefix]
+		delete(ids, tc.c.id)
+		if len(ids) == 0 {
+			delete(t.prefixes, prefix)
+		}
+	}
+}
+
+// Track records that the connection has read keys. The connection will be
+// sent an invalidation message when one of the keys is modified. This
+// should be called by handlers for commands that read keys.
+func (t *Tracker) Track(conn Conn, keys ...string) {
+	c := baseConn(conn)
+	if c == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tc, ok := t.clients[c.id]
+	if !ok || tc.bcast || (tc.optin && !c.trackCaching) ||
+		(tc.optout && c.trackCaching) {
+		return
+	}
+	for _, key := range keys {
+		ids, ok := t.keys[key]
+		if !ok {
+			ids = make(map[uint64]bool)
+			t.keys[key] = ids
+		}
+		ids[c.id] = true
+		tc.keys[key] = true
+	}
+}
+
+// Invalidate sends invalidation messages to the clients that are tracking
+// keys. The conn is the connection that modified the keys, which is not
+// sent messages when it uses NOLOOP. The conn may be nil. This should be
+// called by handlers for commands that modify keys.
+func (t *Tracker) Invalidate(conn Conn, keys ...string) {
+	var origin uint64
+	if c := baseConn(conn); c != nil {
+		origin = c.id
+	}
+	var order []*trackingClient
+	pending := make(map[*trackingClient][]string)
+	add := func(id uint64, key string) {
+		tc, ok := t.clients[id]
+		if !ok || (tc.noloop && id == origin) {
+			return
+		}
+		if _, ok := pending[tc]; !ok {
+			order = append(order, tc)
+		}
+		pending[tc] = append(pending[tc], key)
+	}
+	t.mu.Lock()
+	for _, key := range keys {
+		for id := range t.keys[key] {
+			if tc, ok := t.clients[id]; ok {
+				delete(tc.keys, key)
+			}
+			add(id, key)
+		}
+		delete(t.keys, key)
+		for prefix, ids := range t.prefixes {
+			if strings.HasPrefix(key, prefix) {
+				for id := range ids {
+					add(id, key)
+				}
+			}
+		}
+	}
+	t.mu.Unlock()
+	for _, tc := range order {
+		t.send(tc, pending[tc])
+	}
+}
+
+// InvalidateAll sends a message to all tracking clients that invalidates
+// all keys, such as after a FLUSHALL.
+func (t *Tracker) InvalidateAll() {
+	t.mu.Lock()
+	t.keys = make(map[string]map[uint64]bool)
+	clients := make([]*trackingClient, 0, len(t.clients))
+	for _, tc := range t.clients {
+		tc.keys = make(map[string]bool)
+		clients = append(clients, tc)
+	}
+	t.mu.Unlock()
+	for _, tc := range clients {
+		t.send(tc, nil)
+	}
+}
+
+// send writes an invalidation message to a client. Nil keys invalidate all
+// keys.
+func (t *Tracker) send(tc *trackingClient, keys []string) {
+	if tc.redirect != 0 {
+		t.ps.sendInvalidate(tc.redirect, keys)
+		return
+	}
+	if !tc.resp3 {
+		// RESP2 clients can only receive messages with REDIRECT
+		return
+	}
+	b := AppendPush(nil, 2)
+	b = AppendBulkString(b, "invalidate")
+	if keys == nil {
+		b = append(b, "_\r\n"...)
+	} else {
+		b = AppendArray(b, len(keys))
+		for _, key := range keys {
+			b = AppendBulkString(b, key)
+		}
+	}
+	tc.c.push(b)
+}
@@ -0,0 +1,212 @@
+package redcon
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTracker(t *testing.T) {
+	mux := NewServeMux()
+	var tr *Tracker
+	mux.HandleFunc("get", func(conn Conn, cmd Command) {
+		tr.Track(conn, string(cmd.Args[1]))
+		conn.WriteNull()
+	})
+	mux.HandleFunc("set", func(conn Conn, cmd Command) {
+		tr.Invalidate(conn, string(cmd.Args[1]))
+		conn.WriteString("OK")
+	})
+	mux.HandleFunc("flushall", func(conn Conn, cmd Command) {
+		tr.InvalidateAll()
+		conn.WriteString("OK")
+	})
+	tr = NewTracker(mux, nil)
+	type client struct {
+		c   *conn
+		buf bytes.Buffer
+	}
+	clients := make([]*client, 4)
+	for i := range clients {
+		clients[i] = &client{}
+		clients[i].c = &conn{wr: NewWriter(&clients[i].buf),
+			id: uint64(i + 1), proto: 3}
+	}
+	clients[0].c.proto = 0
+	tests := []struct {
+		client int
+		args   string
+		exp    string
+		pushes []string // expected pushes for each client
+	}{
+		{0, "CLIENT TRACKING", "-ERR wrong number of arguments for " +
+			"'client|tracking' command\r\n", nil},
+		{0, "CLIENT TRACKING maybe", "-ERR syntax error\r\n", nil},
+		{0, "CLIENT TRACKING on PREFIX a", "-ERR PREFIX option requires " +
+			"BCAST mode to be enabled\r\n", nil},
+		{0, "CLIENT TRACKING on OPTIN OPTOUT", "-ERR You can't use both " +
+			"OPTIN and OPTOUT\r\n", nil},
+		{0, "CLIENT TRACKING on BCAST OPTIN", "-ERR OPTIN and OPTOUT are " +
+			"not compatible with BCAST\r\n", nil},
+		{0, "CLIENT TRACKING on BCAST PREFIX a PREFIX ab", "-ERR Prefix 'a' " +
+			"overlaps with another provided prefix 'ab'. Prefixes for a " +
+			"single client must not overlap.\r\n", nil},
+		{0, "CLIENT GETREDIR", ":-1\r\n", nil},
+		{0, "CLIENT CACHING yes", "-ERR CLIENT CACHING can be called only " +
+			"when the client is in tracking mode with OPTIN or OPTOUT mode " +
+			"enabled\r\n", nil},
+		// default mode
+		{1, "CLIENT TRACKING on", "+OK\r\n", nil},
+		{1, "GET a", "$-1\r\n", nil},
+		{0, "SET a 1", "+OK\r\n", []string{"",
+			">2\r\n$10\r\ninvalidate\r\n*1\r\n$1\r\na\r\n", "", ""}},
+		{0, "SET a 2", "+OK\r\n", []string{"", "", "", ""}},
+		// bcast mode with noloop
+		{2, "CLIENT TRACKING on BCAST PREFIX user: NOLOOP", "+OK\r\n", nil},
+		{0, "SET user:1 x", "+OK\r\n", []string{"", "",
+			">2\r\n$10\r\ninvalidate\r\n*1\r\n$6\r\nuser:1\r\n", ""}},
+		{2, "SET user:2 x", "+OK\r\n", []string{"", "", "", ""}},
+		{2, "CLIENT TRACKING on", "-ERR You can't switch BCAST mode on/off " +
+			"before disabling tracking for this client, and then " +
+			"re-enabling it with a different mode.\r\n", nil},
+		{2, "CLIENT TRACKINGINFO", "%3\r\n$5\r\nflags\r\n*3\r\n$2\r\non\r\n" +
+			"$5\r\nbcast\r\n$6\r\nnoloop\r\n$8\r\nredirect\r\n:0\r\n" +
+			"$8\r\nprefixes\r\n*1\r\n$5\r\nuser:\r\n", nil},
+		// optin mode
+		{3, "CLIENT TRACKING on OPTIN", "+OK\r\n", nil},
+		{3, "CLIENT CACHING no", "-ERR CLIENT CACHING NO is only valid " +
+			"when tracking is enabled in OPTOUT mode.\r\n", nil},
+		{3, "GET b", "$-1\r\n", nil},
+		{0, "SET b 1", "+OK\r\n", []string{"", "", "", ""}},
+		{3, "CLIENT CACHING yes", "+OK\r\n", nil},
+		{3, "GET b", "$-1\r\n", nil},
+		{3, "GET c", "$-1\r\n", nil},
+		{0, "SET c 1", "+OK\r\n", []string{"", "", "", ""}},
+		{0, "SET b 1", "+OK\r\n", []string{"", "", "",
+			">2\r\n$10\r\ninvalidate\r\n*1\r\n$1\r\nb\r\n"}},
+		{0, "FLUSHALL", "+OK\r\n", []string{"",
+			">2\r\n$10\r\ninvalidate\r\n_\r\n",
+			">2\r\n$10\r\ninvalidate\r\n_\r\n",
+			">2\r\n$10\r\ninvalidate\r\n_\r\n"}},
+		{1, "GET d", "$-1\r\n", nil},
+		{1, "CLIENT TRACKING off", "+OK\r\n", nil},
+		{1, "CLIENT GETREDIR", ":-1\r\n", nil},
+		{3, "CLIENT CACHING yes", "+OK\r\n", nil},
+		{3, "GET e", "$-1\r\n", nil},
+	}
+	for i, test := range tests {
+		cl := clients[test.client]
+		res := testHandlerDo(tr, cl.c, &cl.buf,
+			strings.Split(test.args, " ")...)
+		if res != test.exp {
+			t.Fatalf("%d %s: expected '%q', got '%q'", i, test.args,
+				test.exp, res)
+		}
+		cl.buf.Reset()
+		for j, push := range test.pushes {
+			if j == test.client {
+				continue
+			}
+			if res := clients[j].buf.String(); res != push {
+				t.Fatalf("%d %s: client %d: expected '%q', got '%q'", i,
+					test.args, j, push, res)
+			}
+			clients[j].buf.Reset()
+		}
+	}
+	for _, cl := range clients {
+		for _, hook := range cl.c.closeHooks {
+			hook()
+		}
+	}
+	if len(tr.clients) != 0 || len(tr.prefixes) != 0 || len(tr.keys) != 0 {
+		t.Fatal("expected no tracking clients")
+	}
+}
+
+func TestTrackerDetached(t *testing.T) {
+	var ps PubSub
+	tr := NewTracker(NewServeMux(), &ps)
+	c, peer := testPipeConn(t, 1)
+	c.proto = 3
+	tr.ServeRESP(c, testArgCommand("CLIENT", "TRACKING", "on"))
+	c.wr.Flush()
+	peer.expect("+OK\r\n")
+	tr.Track(c, "a")
+
+	// the invalidation messages of a subscriber are written with its
+	// replies, and tracking is disabled when it disconnects
+	c.busy = true
+	ps.Subscribe(c, "ch")
+	peer.expect("*3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n")
+	tr.Invalidate(nil, "a")
+	peer.expect(">2\r\n$10\r\ninvalidate\r\n*1\r\n$1\r\na\r\n")
+	tr.Track(c, "b")
+	peer.nc.Close()
+	start := time.Now()
+	for {
+		tr.mu.Lock()
+		n := len(tr.clients) + len(tr.keys)
+		tr.mu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Since(start) > time.Second*5 {
+			t.Fatal("expected no tracking clients")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// other detached connections write the frames when they are flushed
+	c, peer = testPipeConn(t, 2)
+	defer peer.nc.Close()
+	c.busy = true
+	dconn := c.Detach()
+	c.push([]byte("+x\r\n"))
+	peer.expectNothing()
+	dconn.WriteString("OK")
+	dconn.Flush()
+	peer.expect("+OK\r\n+x\r\n")
+}
+
+func TestTrackerRedirect(t *testing.T) {
+	var ps PubSub
+	mux := NewServeMux()
+	var tr *Tracker
+	mux.HandleFunc("get", func(conn Conn, cmd Command) {
+		tr.Track(conn, string(cmd.Args[1]))
+		conn.WriteNull()
+	})
+	mux.HandleFunc("set", func(conn Conn, cmd Command) {
+		tr.Invalidate(conn, string(cmd.Args[1]))
+		conn.WriteString("OK")
+	})
+	tr = NewTracker(mux, &ps)
+
+	// The redirect client must be connected
+	var buf bytes.Buffer
+	c := &conn{wr: NewWriter(&buf), id: 1}
+	if res := testHandlerDo(tr, c, &buf, "CLIENT", "TRACKING", "on",
+		"REDIRECT", "9"); !strings.HasPrefix(res, "-ERR The client ID") {
+		t.Fatalf("expected error, got '%q'", res)
+	}
+
+	// The redirect client is subscribed to __redis__:invalidate
+	sub, peer := testPipeConn(t, 9)
+	defer peer.nc.Close()
+	ps.Subscribe(sub, "__redis__:invalidate")
+	peer.expect("*3\r\n$9\r\nsubscribe\r\n$20\r\n__redis__:invalidate\r\n" +
+		":1\r\n")
+
+	for _, args := range []string{"CLIENT TRACKING on REDIRECT 9", "GET a",
+		"SET a 1"} {
+		testHandlerDo(tr, c, &buf, strings.Split(args, " ")...)
+	}
+	peer.expect("*3\r\n$7\r\nmessage\r\n$20\r\n__redis__:invalidate\r\n" +
+		"*1\r\n$1\r\na\r\n")
+	if res := testHandlerDo(tr, c, &buf, "CLIENT", "GETREDIR"); res !=
+		":9\r\n" {
+		t.Fatalf("expected '%q', got '%q'", ":9\r\n", res)
+	}
+}
@@ -0,0 +1,236 @@
+package redcon
+
+import (
+	"strings"
+	"sync"
+)
+
+// TxHandler is a Handler that implements Redis transactions with the MULTI,
+// EXEC, DISCARD, WATCH and UNWATCH commands.
+//
+// After MULTI, commands are queued and replied to with +QUEUED. When the
+// handler is a *ServeMux, queued commands are validated against the
+// registered commands and their specs, and invalid commands cause EXEC to
+// fail with an EXECABORT error. EXEC runs the queued commands through the
+// handler while holding the locker, and their replies are written as a
+// single array.
+//
+// WATCH provides check-and-set behavior. Handlers must call Touch for each
+// key that is modified, and EXEC replies with a null array when any of the
+// watched keys were touched since WATCH.
+type TxHandler struct {
+	handler  Handler
+	locker   sync.Locker
+	mu       sync.Mutex
+	watchers map[string]map[*conn]bool
+}
+
+// NewTxHandler returns a new TxHandler that passes commands to handler. The
+// locker is held while EXEC runs the queued commands, which ensures that
+// the transaction is atomic. The locker may be nil.
+func NewTxHandler(handler Handler, locker sync.Locker) *TxHandler {
+	if handler == nil {
+		panic("redcon: nil handler")
+	}
+	return &TxHandler{
+		handler:  handler,
+		locker:   locker,
+		watchers: make(map[string]map[*conn]bool),
+	}
+}
+
+// Touch marks keys as modified, which causes the transactions of clients
+// that are watching the keys to fail.
+func (h *TxHandler) Touch(keys ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range keys {
+		for c := range h.watchers[key] {
+			c.watchDirty = true
+		}
+	}
+}
+
+// watch adds keys to the watched keys of a connection.
+func (h *TxHandler) watch(c *conn, keys [][]byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	c.onClose(h, func() { h.unwatch(c) })
+	for _, key := range keys {
+		conns, ok := h.watchers[string(key)]
+		if !ok {
+			conns = make(map[*conn]bool)
+			h.watchers[string(key)] = conns
+		}
+		if !conns[c] {
+			conns[c] = true
+			c.watched = append(c.watched, string(key))
+		}
+	}
+}
+
+// unwatch removes all watched keys of a connection, and returns true when
+// any of the keys were touched.
+func (h *TxHandler) unwatch(c *conn) (dirty bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, key := range c.watched {
+		conns := h.watchers[key]
+		delete(conns, c)
+		if len(conns) == 0 {
+			delete(h.watchers, key)
+		}
+	}
+	dirty = c.watchDirty
+	c.watched = nil
+	c.watchDirty = false
+	return dirty
+}
+
+// ServeRESP handles MULTI, EXEC, DISCARD, WATCH and UNWATCH, queues
+// commands while a transaction is active, and passes all other commands to
+// the handler.
+func (h *TxHandler) ServeRESP(conn Conn, cmd Command) {
+	c := baseConn(conn)
+	if c == nil {
+		conn.WriteError("ERR transactions are not supported on this " +
+			"connection")
+		return
+	}
+	name := strings.ToLower(string(cmd.Args[0]))
+	switch name {
+	case "multi":
+		if len(cmd.Args) != 1 {
+			h.queueError(c, "ERR wrong number of arguments for 'multi' "+
+				"command")
+			return
+		}
+		if c.multi {
+			c.WriteError("ERR MULTI calls can not be nested")
+			return
+		}
+		c.multi = true
+		c.WriteString("OK")
+	case "exec":
+		if len(cmd.Args) != 1 {
+			h.queueError(c, "ERR wrong number of arguments for 'exec' "+
+				"command")
+			return
+		}
+		if !c.multi {
+			c.WriteError("ERR EXEC without MULTI")
+			return
+		}
+		h.exec(c)
+	case "discard":
+		if len(cmd.Args) != 1 {
+			h.queueError(c, "ERR wrong number of arguments for 'discard' "+
+				"command")
+			return
+		}
+		if !c.multi {
+			c.WriteError("ERR DISCARD without MULTI")
+			return
+		}
+		c.resetMulti()
+		h.unwatch(c)
+		c.WriteString("OK")
+	case "watch":
+		if len(cmd.Args) < 2 {
+			h.queueError(c, "ERR wrong number of arguments for 'watch' "+
+				"command")
+			return
+		}
+		if c.multi {
+			c.WriteError("ERR WATCH inside MULTI is not allowed")
+			return
+		}
+		h.watch(c, cmd.Args[1:])
+		c.WriteString("OK")
+	case "unwatch":
+		if len(cmd.Args) != 1 {
+			h.queueError(c, "ERR wrong number of arguments for 'unwatch' "+
+				"command")
+			return
+		}
+		if c.multi {
+			// UNWATCH is queued, but has no effect inside of a transaction.
+			c.multiCmds = append(c.multiCmds, cmd)
+			c.WriteString("QUEUED")
+			return
+		}
+		h.unwatch(c)
+		c.WriteString("OK")
+	case "quit":
+		h.handler.ServeRESP(conn, cmd)
+	default:
+		if !c.multi {
+			h.handler.ServeRESP(conn, cmd)
+			return
+		}
+		if mux, ok := h.handler.(*ServeMux); ok {
+			if _, ok := mux.handlers[name]; !ok {
+				h.queueError(c, "ERR unknown command '"+
+					string(cmd.Args[0])+"'")
+				return
+			}
+			if spec, ok := mux.specs[name]; ok &&
+				!spec.CheckArity(len(cmd.Args)) {
+				h.queueError(c, "ERR wrong number of arguments for '"+
+					name+"' command")
+				return
+			}
+		}
+		c.multiCmds = append(c.multiCmds, cmd)
+		c.WriteString("QUEUED")
+	}
+}
+
+// queueError writes an error, and causes EXEC to fail when a transaction
+// is active.
+func (h *TxHandler) queueError(c *conn, msg string) {
+	if c.multi {
+		c.multiErr = true
+	}
+	c.WriteError(msg)
+}
+
+// exec runs the queued commands, unless a watched key was touched.
+func (h *TxHandler) exec(c *conn) {
+	cmds, failed := c.multiCmds, c.multiErr
+	c.resetMulti()
+	if failed {
+		h.unwatch(c)
+		c.WriteError("EXECABORT Transaction discarded because of previous " +
+			"errors.")
+		return
+	}
+	if h.locker != nil {
+		h.locker.Lock()
+		defer h.locker.Unlock()
+	}
+	// The watched keys are checked while holding the locker, which prevents
+	// writers that also hold the locker from touching the keys before the
+	// commands are executed.
+	if h.unwatch(c) {
+		c.WriteArray(-1)
+		return
+	}
+	c.WriteArray(len(cmds))
+	c.execing = true
+	defer func() { c.execing = false }()
+	for _, cmd := range cmds {
+		if strings.EqualFold(string(cmd.Args[0]), "unwatch") {
+			c.WriteString("OK")
+			continue
+		}
+		h.handler.ServeRESP(c, cmd)
+	}
+}
+
+// resetMulti ends the transaction of a connection.
+func (c *conn) resetMulti() {
+	c.multi = false
+	c.multiErr = false
+	c.multiCmds = nil
+}
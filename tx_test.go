@@ -0,0 +1,118 @@
+package redcon
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestTxHandler(t *testing.T) {
+	mux := NewServeMux()
+	vals := make(map[string]string)
+	mux.HandleCommand(CommandSpec{Name: "set", Arity: 3},
+		HandlerFunc(func(conn Conn, cmd Command) {
+			vals[string(cmd.Args[1])] = string(cmd.Args[2])
+			conn.WriteString("OK")
+		}))
+	mux.HandleCommand(CommandSpec{Name: "get", Arity: 2},
+		HandlerFunc(func(conn Conn, cmd Command) {
+			if val, ok := vals[string(cmd.Args[1])]; ok {
+				conn.WriteBulkString(val)
+			} else {
+				conn.WriteNull()
+			}
+		}))
+	var mu sync.Mutex
+	h := NewTxHandler(mux, &mu)
+	var buf bytes.Buffer
+	c := &conn{wr: NewWriter(&buf)}
+	tests := [][2]string{
+		{"EXEC", "-ERR EXEC without MULTI\r\n"},
+		{"DISCARD", "-ERR DISCARD without MULTI\r\n"},
+		{"MULTI", "+OK\r\n"},
+		{"MULTI", "-ERR MULTI calls can not be nested\r\n"},
+		{"SET a 1", "+QUEUED\r\n"},
+		{"GET a", "+QUEUED\r\n"},
+		{"GET b", "+QUEUED\r\n"},
+		{"EXEC", "*3\r\n+OK\r\n$1\r\n1\r\n$-1\r\n"},
+		{"MULTI", "+OK\r\n"},
+		{"SET a 2", "+QUEUED\r\n"},
+		{"DISCARD", "+OK\r\n"},
+		{"GET a", "$1\r\n1\r\n"},
+		{"MULTI", "+OK\r\n"},
+		{"SET a", "-ERR wrong number of arguments for 'set' command\r\n"},
+		{"NOPE", "-ERR unknown command 'NOPE'\r\n"},
+		{"SET a 3", "+QUEUED\r\n"},
+		{"EXEC", "-EXECABORT Transaction discarded because of previous " +
+			"errors.\r\n"},
+		{"GET a", "$1\r\n1\r\n"},
+		{"MULTI", "+OK\r\n"},
+		{"EXEC", "*0\r\n"},
+	}
+	for _, test := range tests {
+		res := testHandlerDo(h, c, &buf, strings.Split(test[0], " ")...)
+		if res != test[1] {
+			t.Fatalf("%s: expected '%q', got '%q'", test[0], test[1], res)
+		}
+	}
+}
+
+func TestTxHandlerWatch(t *testing.T) {
+	mux := NewServeMux()
+	var h *TxHandler
+	mux.HandleCommand(CommandSpec{Name: "set", Arity: 3},
+		HandlerFunc(func(conn Conn, cmd Command) {
+			h.Touch(string(cmd.Args[1]))
+			conn.WriteString("OK")
+		}))
+	h = NewTxHandler(mux, nil)
+	var buf1, buf2 bytes.Buffer
+	c1 := &conn{wr: NewWriter(&buf1)}
+	c2 := &conn{wr: NewWriter(&buf2)}
+	tests := []struct {
+		c    *conn
+		args string
+		exp  string
+	}{
+		{c1, "WATCH", "-ERR wrong number of arguments for 'watch' " +
+			"command\r\n"},
+		{c1, "WATCH a b", "+OK\r\n"},
+		{c1, "MULTI", "+OK\r\n"},
+		{c1, "WATCH c", "-ERR WATCH inside MULTI is not allowed\r\n"},
+		{c1, "SET a 1", "+QUEUED\r\n"},
+		{c1, "EXEC", "*1\r\n+OK\r\n"},
+		{c1, "WATCH a", "+OK\r\n"},
+		{c2, "SET a 2", "+OK\r\n"},
+		{c1, "MULTI", "+OK\r\n"},
+		{c1, "SET a 3", "+QUEUED\r\n"},
+		{c1, "EXEC", "*-1\r\n"},
+		{c1, "WATCH a", "+OK\r\n"},
+		{c1, "UNWATCH", "+OK\r\n"},
+		{c2, "SET a 4", "+OK\r\n"},
+		{c1, "MULTI", "+OK\r\n"},
+		{c1, "SET a 5", "+QUEUED\r\n"},
+		{c1, "EXEC", "*1\r\n+OK\r\n"},
+		{c1, "WATCH b", "+OK\r\n"},
+	}
+	for _, test := range tests {
+		buf := &buf1
+		if test.c == c2 {
+			buf = &buf2
+		}
+		res := testHandlerDo(h, test.c, buf,
+			strings.Split(test.args, " ")...)
+		if res != test.exp {
+			t.Fatalf("%s: expected '%q', got '%q'", test.args, test.exp, res)
+		}
+	}
+	if len(h.watchers) != 1 {
+		t.Fatalf("expected '%v', got '%v'", 1, len(h.watchers))
+	}
+	for _, hook := range c1.closeHooks {
+		hook()
+	}
+	if len(h.watchers) != 0 {
+		t.Fatalf("expected '%v', got '%v'", 0, len(h.watchers))
+	}
+}